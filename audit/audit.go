@@ -0,0 +1,187 @@
+// Package audit keeps a durable, tamper-evident record of who did what to
+// which job.
+//
+// The audit log is a file of JSON records, one per line, that is only ever
+// appended to.  Each record carries the hash of the line before it, computed
+// with hasher.Compute, so changing, inserting or removing a record breaks the
+// chain at that point, and Verify says where.  Nothing in the file can reveal
+// a change to the last record, or records cut off the end, so anyone who
+// needs that guarantee should keep a copy of the head hash reported by Verify
+// somewhere else.
+//
+// Records say who acted and on which job id, but never contain a password or
+// a hash.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// The actions that are audited.
+const (
+	Submitted = "submitted" // POST /hash accepted a password
+	Retrieved = "retrieved" // GET /hash/{id} returned a hash, or the reason it failed
+	Verified  = "verified"  // POST /verify/{id} checked a password against a hash
+	Expired   = "expired"   // The hash, or the reason it failed, was thrown away after the TTL
+	Deleted   = "deleted"   // The hash was thrown away for any other reason, such as chaos dropping it
+)
+
+// System is the Actor of records for things the server did by itself, rather
+// than for a client.
+const System = "system"
+
+// Record is a single entry in the audit log.
+type Record struct {
+	Seq       uint64    `json:"seq"`       // Position in the log, starting from 1
+	Time      time.Time `json:"time"`      // When the action happened
+	Action    string    `json:"action"`    // One of the actions above
+	JobID     int64     `json:"jobId"`     // The job acted on
+	Actor     string    `json:"actor"`     // Who acted: the client's address, or System
+	RequestID string    `json:"requestId"` // The request that acted, see package trace
+	Prev      string    `json:"prev"`      // hasher.Compute of the previous line, "" for the first record
+}
+
+// Log appends records to an audit log file.  A nil *Log is valid and records
+// nothing, so auditing costs nothing when it is off.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64 // Seq of the last record
+	head string // hasher.Compute of the last line
+}
+
+// Open opens the audit log at path for appending, creating it if needed.  An
+// existing log is verified first, because appending to a broken chain would
+// make it look like the break happened later than it did.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := Verify(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Log{f: f, seq: sum.Records, head: sum.Head}, nil
+}
+
+// Discarded records that the hasher threw away the result r without it
+// being retrieved, for the reason why.  It's meant for hasher.Config.OnDiscard.
+func (l *Log) Discarded(r hasher.JobResult, why hasher.Discard) error {
+	action := Deleted
+	if why == hasher.DiscardExpired {
+		action = Expired
+	}
+	return l.Append(Record{
+		Time:      time.Now(),
+		Action:    action,
+		JobID:     r.ID,
+		Actor:     System,
+		RequestID: r.RequestID,
+	})
+}
+
+// Append fills in r's Seq and Prev and writes it to the log.  The record is
+// synced to disk before Append returns, so an action that was audited stays
+// audited even if the machine goes down.
+func (l *Log) Append(r Record) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Seq, r.Prev = l.seq+1, l.head
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+
+	l.seq, l.head = r.Seq, hasher.Compute(string(line))
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Summary describes an audit log whose chain is intact.
+type Summary struct {
+	Records uint64 // Number of records
+	Head    string // hasher.Compute of the last line, "" if there are none
+}
+
+// TamperError is returned by Verify when the chain is broken.  Line is the
+// first line that doesn't follow from the ones before it.  Either it was
+// changed, or the line before it was, or lines were inserted or removed
+// between them.
+type TamperError struct {
+	Line   int
+	Reason string
+}
+
+func (e *TamperError) Error() string {
+	return fmt.Sprintf("audit log tampered with at line %d: %s", e.Line, e.Reason)
+}
+
+// ErrTruncated is returned by Verify when the last line isn't complete, which
+// is what a crash in the middle of an Append leaves behind.
+var ErrTruncated = errors.New("audit log ends with an incomplete record")
+
+// Verify reads an audit log from r and checks that every record follows from
+// the one before it.  It returns a *TamperError for the first record that
+// doesn't.
+func Verify(r io.Reader) (Summary, error) {
+	var sum Summary
+	in := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := in.ReadString('\n')
+		if err == io.EOF {
+			if text != "" {
+				return sum, ErrTruncated
+			}
+			return sum, nil
+		} else if err != nil {
+			return sum, err
+		}
+		text = text[:len(text)-1]
+
+		var rec Record
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return sum, &TamperError{line, "not a valid record"}
+		}
+		if rec.Seq != sum.Records+1 {
+			return sum, &TamperError{line, fmt.Sprintf("record %d follows record %d", rec.Seq, sum.Records)}
+		}
+		if rec.Prev != sum.Head {
+			return sum, &TamperError{line, fmt.Sprintf("record %d doesn't match the hash of the line before it", rec.Seq)}
+		}
+
+		sum.Records, sum.Head = rec.Seq, hasher.Compute(text)
+	}
+}
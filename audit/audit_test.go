@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// writeTestLog creates an audit log of n records and returns its path.
+func writeTestLog(t *testing.T, n int) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		err := l.Append(Record{Time: time.Unix(int64(i), 0), Action: Submitted, JobID: int64(i), Actor: "127.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// verifyFile verifies the audit log at path.
+func verifyFile(t *testing.T, path string) (Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return Verify(f)
+}
+
+// editLines rewrites the audit log at path.
+func editLines(t *testing.T, path string, edit func(lines []string) []string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if err := os.WriteFile(path, []byte(strings.Join(edit(lines), "")), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path := writeTestLog(t, 3)
+
+	// Reopening carries on the same chain
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(Record{Action: Retrieved, JobID: 1})
+	l.Close()
+
+	sum, err := verifyFile(t, path)
+	if err != nil || sum.Records != 4 || sum.Head == "" {
+		t.Fatalf("got %+v, %v", sum, err)
+	}
+}
+
+// TestDiscarded verifies that results the hasher throws away are recorded as
+// done by the system.
+func TestDiscarded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Discarded(hasher.JobResult{ID: 1, RequestID: "a", Hash: "secret"}, hasher.DiscardExpired)
+	l.Discarded(hasher.JobResult{ID: 2, RequestID: "b"}, hasher.DiscardDropped)
+	l.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []Record
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 || records[0].Action != Expired || records[0].Actor != System || records[0].RequestID != "a" ||
+		records[1].Action != Deleted || records[1].JobID != 2 {
+		t.Errorf("records %+v", records)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("the hash was recorded: %s", b)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(lines []string) []string
+		line int
+	}{
+		{"changed", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"jobId":2`, `"jobId":7`, 1)
+			return lines
+		}, 3},
+		{"removed", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, 2},
+		{"inserted", func(lines []string) []string {
+			return append(lines[:2], append([]string{lines[1]}, lines[2:]...)...)
+		}, 3},
+		{"garbage", func(lines []string) []string {
+			lines[2] = "oops\n"
+			return lines
+		}, 3},
+	}
+
+	for _, test := range tests {
+		path := writeTestLog(t, 4)
+		editLines(t, path, test.edit)
+
+		_, err := verifyFile(t, path)
+		var tamper *TamperError
+		if !errors.As(err, &tamper) || tamper.Line != test.line {
+			t.Errorf("%s: got %v, expected line %d", test.name, err, test.line)
+		}
+
+		// Nothing more is appended to a broken chain
+		if _, err := Open(path); err == nil {
+			t.Errorf("%s: Open succeeded", test.name)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	path := writeTestLog(t, 2)
+	editLines(t, path, func(lines []string) []string {
+		lines[1] = lines[1][:10]
+		return lines
+	})
+
+	if _, err := verifyFile(t, path); err != ErrTruncated {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	if err := l.Append(Record{}); err != nil {
+		t.Error(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
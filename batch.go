@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// batch hashes a file of passwords without starting a server, writing the
+// results in the same order as the input.
+//
+//	hash-server batch [flags] [FILE]
+//
+// The input is read from FILE, or stdin if there isn't one, and is either
+// JSONL:
+//
+//	{"id": "alice", "password": "angryMonkey"}
+//
+// or CSV with a header row naming a password column and optionally an id
+// column.  Records without an id are numbered from 1.  Each result is an id,
+// hash and algorithm, or an error if the hash failed, written in the same
+// format as the input.  The hasher's Stats are printed to stderr at the end.
+func batch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	format := fs.String("format", "auto", "input and output format: jsonl, csv, or auto to guess from the file name and contents")
+	output := fs.String("o", "-", "file to write the results to, - for stdout")
+	concurrency := fs.Int("concurrency", runtime.NumCPU(), "most hashes to compute at once")
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	fs.StringVar(&cfg.Implementation, "hasher", cfg.Implementation, "hasher implementation, one of: "+strings.Join(hasher.Implementations(), ", "))
+	fs.StringVar(&cfg.Algorithm, "algorithm", cfg.Algorithm, "hash algorithm, one of: "+strings.Join(hasher.Algorithms(), ", "))
+	fs.DurationVar(&cfg.Delay, "delay", cfg.Delay, "simulated work performed before each hash")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hash-server batch [flags] [FILE]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one input file")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1: %d", *concurrency)
+	}
+
+	in, name := io.Reader(os.Stdin), "stdin"
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in, name = f, fs.Arg(0)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// There's room in the queue for every hash in flight, so none are ever
+	// refused, even before the workers are ready for them.
+	cfg.Workers, cfg.QueueDepth = *concurrency, *concurrency
+	h, err := hasher.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	b := bufio.NewReader(in)
+	if *format == "auto" {
+		*format = guessFormat(name, b)
+	}
+	r, w, err := newBatchFormat(*format, b, out)
+	if err != nil {
+		h.Drain()
+		return err
+	}
+
+	err = runBatch(context.Background(), h, *concurrency, r, w)
+
+	// Every hash has been retrieved by now, so the stats are final, and
+	// they can't be had once the hasher is drained.
+	stats := h.Stats()
+	h.Drain()
+	summary, _ := json.MarshalIndent(stats, "", "  ")
+	fmt.Fprintln(os.Stderr, string(summary))
+	return err
+}
+
+// batchRecord is a password to hash.
+type batchRecord struct {
+	ID       string `json:"id"`
+	Password string `json:"password"`
+}
+
+// batchResult is the outcome of hashing a batchRecord.
+type batchResult struct {
+	ID        string `json:"id"`
+	Hash      string `json:"hash,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// recordReader reads batchRecords until io.EOF.
+type recordReader interface {
+	Read() (batchRecord, error)
+}
+
+// resultWriter writes batchResults.  Flush must be called at the end.
+type resultWriter interface {
+	Write(batchResult) error
+	Flush() error
+}
+
+// runBatch hashes every record from r with h, keeping at most concurrency
+// hashes in flight, and writes the results to w in input order.  It returns
+// an error if the input was invalid, the output couldn't be written, or any
+// hash failed.
+func runBatch(ctx context.Context, h hasher.AsyncHasher, concurrency int, r recordReader, w resultWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The reader submits jobs as fast as slots free up, while the results
+	// are collected in order here.  A slot is held from Compute until the
+	// hash has been retrieved.
+	type submitted struct {
+		id  string
+		job int64
+		err error
+	}
+	slots := make(chan interface{}, concurrency)
+	jobs := make(chan submitted, concurrency)
+	var readErr error
+	go func() {
+		defer close(jobs)
+		for n := 1; ; n++ {
+			rec, err := r.Read()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				readErr = err
+				return
+			}
+			if rec.ID == "" {
+				rec.ID = fmt.Sprint(n)
+			}
+
+			select {
+			case slots <- nil:
+			case <-ctx.Done():
+				return
+			}
+			job, err := h.Compute(rec.Password)
+			jobs <- submitted{rec.ID, job, err}
+		}
+	}()
+
+	algorithm := h.Stats().Algorithm
+	failed := 0
+	for s := range jobs {
+		result := batchResult{ID: s.id}
+		err := s.err
+		if err == nil {
+			if err = h.Wait(ctx, s.job); err == nil {
+				var res hasher.Result
+				if res, err = h.Retrieve(ctx, s.job); err == nil {
+					result.Hash, result.Algorithm = res.Hash, algorithm
+				}
+			}
+		}
+		<-slots
+
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		if err := w.Write(result); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d hashes failed", failed)
+	}
+	return nil
+}
+
+// guessFormat picks csv for a .csv file, jsonl for a .jsonl or .json file,
+// and otherwise jsonl if the input starts with a JSON object and csv if it
+// doesn't.
+func guessFormat(name string, b *bufio.Reader) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return "csv"
+	case ".jsonl", ".json", ".ndjson":
+		return "jsonl"
+	}
+	// Peek returns what it can along with an error for short input, which
+	// is all that's needed here.
+	peek, _ := b.Peek(512)
+	if strings.HasPrefix(strings.TrimSpace(string(peek)), "{") {
+		return "jsonl"
+	}
+	return "csv"
+}
+
+// newBatchFormat creates the reader and writer for a format.
+func newBatchFormat(format string, in io.Reader, out io.Writer) (recordReader, resultWriter, error) {
+	switch format {
+	case "jsonl":
+		return &jsonlReader{r: bufio.NewReader(in)}, &jsonlWriter{w: bufio.NewWriter(out)}, nil
+	case "csv":
+		r := csv.NewReader(in)
+		r.FieldsPerRecord = -1
+		return &csvReader{r: r, id: -1, password: -1}, &csvWriter{w: csv.NewWriter(out)}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown format %q, expected jsonl, csv or auto", format)
+	}
+}
+
+// jsonlReader reads a JSON object per line.  Blank lines are skipped.
+type jsonlReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (j *jsonlReader) Read() (batchRecord, error) {
+	for {
+		text, err := j.r.ReadString('\n')
+		if err != nil && (err != io.EOF || text == "") {
+			return batchRecord{}, err
+		}
+		j.line++
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		var rec batchRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return rec, fmt.Errorf("line %d: %w", j.line, err)
+		}
+		if rec.Password == "" {
+			return rec, fmt.Errorf("line %d: no password", j.line)
+		}
+		return rec, nil
+	}
+}
+
+type jsonlWriter struct {
+	w *bufio.Writer
+}
+
+func (j *jsonlWriter) Write(r batchResult) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.w.Flush()
+}
+
+// csvReader reads CSV records, finding the columns from the header row.
+type csvReader struct {
+	r            *csv.Reader
+	header       bool
+	id, password int // Column indexes, -1 if missing
+}
+
+func (c *csvReader) Read() (batchRecord, error) {
+	if !c.header {
+		row, err := c.r.Read()
+		if err == io.EOF {
+			return batchRecord{}, errors.New("CSV input is empty, expected a header row")
+		} else if err != nil {
+			return batchRecord{}, err
+		}
+		for i, name := range row {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "id":
+				c.id = i
+			case "password":
+				c.password = i
+			}
+		}
+		if c.password < 0 {
+			return batchRecord{}, errors.New("CSV header has no password column")
+		}
+		c.header = true
+	}
+
+	row, err := c.r.Read()
+	if err != nil {
+		return batchRecord{}, err
+	}
+	line, _ := c.r.FieldPos(0)
+	if c.password >= len(row) || row[c.password] == "" {
+		return batchRecord{}, fmt.Errorf("line %d: no password", line)
+	}
+	rec := batchRecord{Password: row[c.password]}
+	if c.id >= 0 && c.id < len(row) {
+		rec.ID = row[c.id]
+	}
+	return rec, nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvWriter) Write(r batchResult) error {
+	if !c.header {
+		if err := c.w.Write([]string{"id", "hash", "algorithm", "error"}); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	return c.w.Write([]string{r.ID, r.Hash, r.Algorithm, r.Error})
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// runBatchString hashes input in format with a hasher whose hashes take a
+// little longer the earlier they are in the input, so that they complete out
+// of order, and returns the output.
+func runBatchString(t *testing.T, format, input string, work hasher.WorkFunc) (string, error) {
+	t.Helper()
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	cfg.Workers, cfg.QueueDepth = 4, 4
+	cfg.Work = work
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Drain()
+
+	var out bytes.Buffer
+	r, w, err := newBatchFormat(format, strings.NewReader(input), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runBatch(context.Background(), h, 4, r, w)
+	return out.String(), err
+}
+
+// slowFirst hashes the way the hasher would, but takes longer for passwords
+// that sort first, so that a batch of them completes in reverse.
+func slowFirst(password string) (string, error) {
+	time.Sleep(time.Duration('z'-password[0]) * time.Millisecond)
+	return hasher.Compute(password), nil
+}
+
+func TestBatchJSONL(t *testing.T) {
+	input := `{"id": "alice", "password": "a"}
+
+{"password": "b"}
+{"id": "carol", "password": "c"}`
+
+	out, err := runBatchString(t, "jsonl", input, slowFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ""
+	for _, r := range []struct{ id, password string }{{"alice", "a"}, {"2", "b"}, {"carol", "c"}} {
+		want += fmt.Sprintf(`{"id":%q,"hash":%q,"algorithm":"sha512"}`+"\n", r.id, hasher.Compute(r.password))
+	}
+	if out != want {
+		t.Errorf("output was:\n%s\nexpected:\n%s", out, want)
+	}
+}
+
+func TestBatchCSV(t *testing.T) {
+	input := "password,id\na,alice\n\"b,\"\"quoted\"\"\",bob\n"
+
+	out, err := runBatchString(t, "csv", input, slowFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "id,hash,algorithm,error\n" +
+		"alice," + hasher.Compute("a") + ",sha512,\n" +
+		"bob," + hasher.Compute(`b,"quoted"`) + ",sha512,\n"
+	if out != want {
+		t.Errorf("output was:\n%s\nexpected:\n%s", out, want)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	fail := func(password string) (string, error) {
+		if password == "bad" {
+			return "", errors.New("boom")
+		}
+		return hasher.Compute(password), nil
+	}
+
+	// A hash that fails is reported in its place and the rest carry on
+	out, err := runBatchString(t, "csv", "password\ngood\nbad\ngood\n", fail)
+	if err == nil || strings.Count(out, hasher.Compute("good")) != 2 || !strings.Contains(out, "\n2,,,") {
+		t.Errorf("batch with a failure returned %v and output:\n%s", err, out)
+	}
+
+	// Invalid input stops the batch, after the records before it
+	for format, input := range map[string]string{
+		"jsonl": `{"password": "good"}` + "\n" + `{"password": ""}`,
+		"csv":   "id\nalice\n",
+	} {
+		if _, err := runBatchString(t, format, input, fail); err == nil {
+			t.Errorf("%s batch of %q succeeded", format, input)
+		}
+	}
+}
+
+func TestGuessFormat(t *testing.T) {
+	for _, test := range []struct {
+		name, input, want string
+	}{
+		{"in.csv", `{"password": "a"}`, "csv"},
+		{"in.jsonl", "password\na\n", "jsonl"},
+		{"stdin", "\n  {\"password\": \"a\"}", "jsonl"},
+		{"stdin", "password\na\n", "csv"},
+		{"stdin", "", "csv"},
+	} {
+		if got := guessFormat(test.name, bufio.NewReader(strings.NewReader(test.input))); got != test.want {
+			t.Errorf("guessFormat(%q, %q) = %s, expected %s", test.name, test.input, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Package chaos injects faults into an AsyncHasher so we can test how clients
+// behave when the hashing backend misbehaves.
+//
+// A chaos Hasher wraps one of the regular AsyncHasher implementations.  With
+// every fault turned off it passes straight through, so it can always be
+// installed and then switched on at runtime.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// ErrInjected is the reason given for jobs that chaos decided should fail.
+var ErrInjected = errors.New("injected failure")
+
+// Config controls which faults are injected.  The zero Config injects none.
+type Config struct {
+	FailRate   float64       // Fraction of jobs that fail with ErrInjected
+	PanicRate  float64       // Fraction of jobs whose worker goroutine panics
+	DropRate   float64       // Fraction of completed results that are lost instead of returned
+	LoopDelay  time.Duration // Stalls the hasher's internal synchronization as it answers each call
+	StatsDelay time.Duration // Added to every Stats call, on top of LoopDelay
+	Seed       int64         // Seed for deciding which jobs are affected.  0 picks a different seed every time.
+}
+
+// Enabled returns true if any fault is turned on.
+func (c Config) Enabled() bool {
+	return c.FailRate > 0 || c.PanicRate > 0 || c.DropRate > 0 || c.LoopDelay > 0 || c.StatsDelay > 0
+}
+
+// fields maps each name used in a spec to the Config field it sets.
+var fields = []struct {
+	name string
+	get  func(c *Config) string
+	set  func(c *Config, v string) error
+}{
+	{"fail", func(c *Config) string { return formatRate(c.FailRate) },
+		func(c *Config, v string) error { return parseRate(&c.FailRate, v) }},
+	{"panic", func(c *Config) string { return formatRate(c.PanicRate) },
+		func(c *Config, v string) error { return parseRate(&c.PanicRate, v) }},
+	{"drop", func(c *Config) string { return formatRate(c.DropRate) },
+		func(c *Config, v string) error { return parseRate(&c.DropRate, v) }},
+	{"loop-delay", func(c *Config) string { return c.LoopDelay.String() },
+		func(c *Config, v string) error { return parseDuration(&c.LoopDelay, v) }},
+	{"stats-delay", func(c *Config) string { return c.StatsDelay.String() },
+		func(c *Config, v string) error { return parseDuration(&c.StatsDelay, v) }},
+	{"seed", func(c *Config) string { return strconv.FormatInt(c.Seed, 10) },
+		func(c *Config, v string) (err error) { c.Seed, err = strconv.ParseInt(v, 10, 64); return }},
+}
+
+// Parse reads a Config from a comma separated list of name=value pairs, for
+// example "fail=0.1,drop=0.05,loop-delay=50ms".  Settings that aren't listed
+// are off.  An empty spec, or "off", turns everything off.
+func Parse(spec string) (Config, error) {
+	var c Config
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "off" {
+		return c, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return c, fmt.Errorf("chaos: expected name=value, got %q", pair)
+		}
+
+		found := false
+		for _, f := range fields {
+			if f.name == kv[0] {
+				if err := f.set(&c, kv[1]); err != nil {
+					return c, fmt.Errorf("chaos: %s: %v", kv[0], err)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return c, fmt.Errorf("chaos: unknown setting %q", kv[0])
+		}
+	}
+
+	return c, nil
+}
+
+// String returns the spec for c, which Parse turns back into c.
+func (c Config) String() string {
+	if !c.Enabled() {
+		return "off"
+	}
+
+	var pairs []string
+	zero := Config{}
+	for _, f := range fields {
+		if v := f.get(&c); v != f.get(&zero) {
+			pairs = append(pairs, f.name+"="+v)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func parseRate(dst *float64, v string) error {
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("%v is not between 0 and 1", rate)
+	}
+	*dst = rate
+	return nil
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'g', -1, 64)
+}
+
+func parseDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("%s is negative", d)
+	}
+	*dst = d
+	return nil
+}
+
+// Hasher is an AsyncHasher that injects the faults described by its Config
+// into another AsyncHasher.
+type Hasher struct {
+	hasher.AsyncHasher // The hasher faults are injected into
+
+	mu      sync.Mutex
+	cfg     Config
+	rng     *rand.Rand
+	sleep   func(d time.Duration)                        // Used for injected delays, replaceable by tests
+	discard func(r hasher.JobResult, why hasher.Discard) // The hasher's OnDiscard, told of each dropped result
+}
+
+// New creates the AsyncHasher described by cfg with chaos installed, and
+// injects the faults described by c.  Failures and panics happen inside the
+// hasher's own workers, which is why chaos has to create the hasher rather
+// than wrap one that already exists.
+func New(cfg hasher.Config, c Config) (*Hasher, error) {
+	work := cfg.Work
+	if work == nil {
+		algorithm, err := hasher.LookupAlgorithm(cfg.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		work = func(password string) (string, error) {
+			return algorithm(password), nil
+		}
+	}
+
+	h := &Hasher{sleep: time.Sleep, discard: cfg.OnDiscard}
+	h.SetConfig(c)
+
+	// The delay goes inside the hasher, in its event loop or under its
+	// mutex, so a slow call holds up every other one the way a busy event
+	// loop really would
+	cfg.Stall = func() {
+		h.sleep(h.Config().LoopDelay)
+	}
+
+	cfg.Work = func(password string) (string, error) {
+		if h.roll(func(c Config) float64 { return c.PanicRate }) {
+			panic("chaos: injected panic")
+		}
+		if h.roll(func(c Config) float64 { return c.FailRate }) {
+			return "", ErrInjected
+		}
+		return work(password)
+	}
+
+	inner, err := hasher.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.AsyncHasher = inner
+
+	return h, nil
+}
+
+// Config returns the faults currently being injected.
+func (h *Hasher) Config() Config {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cfg
+}
+
+// SetConfig changes the faults being injected.  It takes effect immediately,
+// including for jobs that are already in progress.
+func (h *Hasher) SetConfig(c Config) {
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg = c
+	h.rng = rand.New(rand.NewSource(seed))
+}
+
+// roll decides whether a fault happens, given a function that picks its rate
+// out of the current Config.
+func (h *Hasher) roll(rate func(c Config) float64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := rate(h.cfg)
+	return r > 0 && h.rng.Float64() < r
+}
+
+// GetAndRemoveHash retrieves the hash with the faults of Retrieve.
+func (h *Hasher) GetAndRemoveHash(id int64) (string, error) {
+	res, err := h.Retrieve(context.Background(), id)
+	return res.Hash, err
+}
+
+// Retrieve retrieves the hash.  If the hash was found but chaos decides to
+// drop it, it is thrown away and reported as hasher.ErrGone.
+func (h *Hasher) Retrieve(ctx context.Context, id int64) (hasher.Result, error) {
+	res, err := h.AsyncHasher.Retrieve(ctx, id)
+	if err == nil && h.roll(func(c Config) float64 { return c.DropRate }) {
+		if h.discard != nil {
+			h.discard(hasher.JobResult{ID: id, RequestID: res.RequestID, Hash: res.Hash}, hasher.DiscardDropped)
+		}
+		return hasher.Result{}, hasher.ErrGone
+	}
+	return res, err
+}
+
+// Lease leases a job to a remote worker, see hasher.Leaser.  Chaos doesn't
+// touch remote work beyond the failures and panics, which happen in the
+// hasher's own workers.
+func (h *Hasher) Lease(ctx context.Context, worker string) (hasher.Lease, error) {
+	l, ok := h.AsyncHasher.(hasher.Leaser)
+	if !ok {
+		return hasher.Lease{}, hasher.ErrNotRemote
+	}
+	return l.Lease(ctx, worker)
+}
+
+// Heartbeat renews a lease, see hasher.Leaser.
+func (h *Hasher) Heartbeat(lease string) (time.Time, error) {
+	l, ok := h.AsyncHasher.(hasher.Leaser)
+	if !ok {
+		return time.Time{}, hasher.ErrNotRemote
+	}
+	return l.Heartbeat(lease)
+}
+
+// Complete finishes a leased job with a worker's hash, see hasher.Leaser.
+func (h *Hasher) Complete(lease string, o hasher.Outcome) error {
+	l, ok := h.AsyncHasher.(hasher.Leaser)
+	if !ok {
+		return hasher.ErrNotRemote
+	}
+	return l.Complete(lease, o)
+}
+
+// Fail finishes a leased job a worker couldn't hash, see hasher.Leaser.
+func (h *Hasher) Fail(lease string, reason string) error {
+	l, ok := h.AsyncHasher.(hasher.Leaser)
+	if !ok {
+		return hasher.ErrNotRemote
+	}
+	return l.Fail(lease, reason)
+}
+
+// Stats delays for StatsDelay, on top of any LoopDelay in the hasher, then
+// returns the stats.
+func (h *Hasher) Stats() hasher.Stats {
+	h.sleep(h.Config().StatsDelay)
+	return h.AsyncHasher.Stats()
+}
@@ -0,0 +1,152 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// newTestHasher creates a chaos Hasher with no simulated delay, so jobs
+// complete as soon as a worker gets to them.
+func newTestHasher(t *testing.T, c Config) *Hasher {
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+
+	h, err := New(cfg, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// waitFor polls until cond is true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"off", "fail=0.1", "fail=0.5,drop=1,loop-delay=50ms,stats-delay=2s,seed=7"} {
+		c, err := Parse(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+			continue
+		}
+		if c.String() != spec {
+			t.Errorf("%q round tripped to %q", spec, c)
+		}
+	}
+
+	if c, err := Parse(""); err != nil || c.Enabled() {
+		t.Errorf("empty spec gave %v, %v", c, err)
+	}
+
+	for _, spec := range []string{"fail", "fail=2", "drop=-0.1", "loop-delay=soon", "stats-delay=-1s", "bogus=1"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+// TestFail verifies that failed jobs are reported through GetAndRemoveHash,
+// and that turning chaos off lets jobs succeed again.
+func TestFail(t *testing.T) {
+	h := newTestHasher(t, Config{FailRate: 1})
+	defer h.Drain()
+
+	id, err := h.Compute("angryMonkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jobErr *hasher.JobError
+	waitFor(t, "failure", func() bool {
+		_, err := h.GetAndRemoveHash(id)
+		return errors.As(err, &jobErr)
+	})
+	if jobErr.ID != id || jobErr.Reason != ErrInjected.Error() {
+		t.Errorf("got %v", jobErr)
+	}
+
+	h.SetConfig(Config{})
+	if id, err = h.Compute("angryMonkey"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "hash", func() bool {
+		hash, err := h.GetAndRemoveHash(id)
+		return err == nil && hash == hasher.Compute("angryMonkey")
+	})
+}
+
+// TestDrop verifies that a dropped result is gone for good, and reported as
+// discarded.
+func TestDrop(t *testing.T) {
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	var discarded []hasher.Discard
+	cfg.OnDiscard = func(r hasher.JobResult, why hasher.Discard) { discarded = append(discarded, why) }
+	h, err := New(cfg, Config{DropRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Drain()
+
+	id, err := h.Compute("angryMonkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "hash", func() bool { return h.Stats().Total == 1 })
+
+	if _, err := h.GetAndRemoveHash(id); err != hasher.ErrGone {
+		t.Errorf("GetAndRemoveHash returned %v, want ErrGone", err)
+	}
+	if len(discarded) != 1 || discarded[0] != hasher.DiscardDropped {
+		t.Errorf("discarded %v", discarded)
+	}
+	h.SetConfig(Config{})
+	if _, err := h.GetAndRemoveHash(id); err != hasher.ErrGone {
+		t.Errorf("dropped hash was still available: %v", err)
+	}
+}
+
+// TestDelays verifies that the loop delay stalls the hasher's own
+// synchronization, so a delay longer than the probe timeout makes it look
+// unresponsive, and that the stats delay is added on top.
+func TestDelays(t *testing.T) {
+	for _, implementation := range hasher.Implementations() {
+		cfg := hasher.DefaultConfig()
+		cfg.Delay = 0
+		cfg.Implementation = implementation
+		h, err := New(cfg, Config{LoopDelay: time.Second, StatsDelay: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var slept []time.Duration
+		h.sleep = func(d time.Duration) { slept = append(slept, d) }
+		h.Stats()
+		if fmt.Sprint(slept) != "[1m0s 1s]" {
+			t.Errorf("%s: Stats slept %v", implementation, slept)
+		}
+
+		h.sleep = time.Sleep
+		h.SetConfig(Config{LoopDelay: 200 * time.Millisecond})
+		if _, err := h.Probe(50 * time.Millisecond); err != hasher.ErrUnresponsive {
+			t.Errorf("%s: Probe returned %v, want ErrUnresponsive", implementation, err)
+		}
+		start := time.Now()
+		if _, err := h.Probe(5 * time.Second); err != nil {
+			t.Errorf("%s: Probe returned %v", implementation, err)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("%s: Probe took %s, want the loop delay", implementation, elapsed)
+		}
+		h.Drain()
+	}
+}
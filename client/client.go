@@ -0,0 +1,363 @@
+// Package client talks to a hash server, so that programs don't each need
+// their own wrapper around POST /hash and the polling loop.
+//
+// Requests that the server turns away because it is busy (429 or 503) are
+// retried with jittered exponential backoff, or after the server's
+// Retry-After if it sends one.  Wait uses long polling when the server
+// supports it, and falls back to polling otherwise.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// Reasons there's no hash for an id.  The server reports which in the
+// X-Hash-State header of a 404.
+var (
+	ErrPending   = errors.New("hash is not complete yet")
+	ErrRetrieved = errors.New("hash was already retrieved or has expired")
+	ErrNotFound  = errors.New("no such hash")
+)
+
+// JobError is returned when the hash for an id could not be computed.  Like a
+// hash, the failure is only reported once.
+type JobError struct {
+	ID     int64
+	Reason string
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("hash %d failed: %s", e.ID, e.Reason)
+}
+
+// StatusError is returned for any other response the server shouldn't have
+// sent, or that was still busy once the retries ran out.
+type StatusError struct {
+	Code    int
+	Message string // The body of the response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Code, e.Message)
+}
+
+// Defaults for the options.
+const (
+	defaultRetries    = 5
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+	defaultLongPoll   = 30 * time.Second
+)
+
+// Client talks to one hash server.  It is safe for concurrent use.
+type Client struct {
+	base       string
+	http       *http.Client
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	longPoll   time.Duration
+	token      string                                           // Sent as a bearer token, "" for none
+	sleep      func(ctx context.Context, d time.Duration) error // Replaceable by tests
+}
+
+// Option configures a Client.  Options are passed to New.
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for requests.  The default is
+// http.DefaultClient.  Its Timeout must be longer than the long poll.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) {
+		cl.http = c
+	}
+}
+
+// WithRetries sets how many times a request the server is too busy for is
+// retried before giving up.  The default is 5.
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// WithBackoff sets the shortest and longest delays between retries, and
+// between polls of a server that doesn't support long polling.  The default
+// is 100ms to 5s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithLongPoll sets how long Wait asks the server to hold each request open
+// while waiting for a hash.  The default is 30s.  0 turns long polling off.
+func WithLongPoll(d time.Duration) Option {
+	return func(c *Client) {
+		c.longPoll = d
+	}
+}
+
+// WithToken sends token as a bearer token with every request.  The worker
+// endpoints require the server's worker token.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New creates a Client for the server at base, e.g. "http://localhost:8080".
+func New(base string, options ...Option) *Client {
+	c := &Client{
+		base:       strings.TrimSuffix(base, "/"),
+		http:       http.DefaultClient,
+		retries:    defaultRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		longPoll:   defaultLongPoll,
+		sleep:      sleep,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Submit submits a password to be hashed, and returns the id to fetch the
+// hash with.
+func (c *Client) Submit(ctx context.Context, password string) (int64, error) {
+	resp, body, err := c.do(ctx, "POST", "/hash", "password="+password)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != 200 {
+		return 0, statusError(resp, body)
+	}
+	return strconv.ParseInt(strings.TrimSpace(body), 10, 64)
+}
+
+// Get fetches the hash for id if it is complete.  Otherwise it returns
+// ErrPending, ErrRetrieved or ErrNotFound straight away.  Once a hash has
+// been fetched, the server forgets it.
+func (c *Client) Get(ctx context.Context, id int64) (string, error) {
+	hash, _, err := c.get(ctx, id, 0)
+	return hash, err
+}
+
+// Wait fetches the hash for id, waiting for it to be complete, until ctx is
+// done.
+func (c *Client) Wait(ctx context.Context, id int64) (string, error) {
+	backoff := c.minBackoff
+	for {
+		hash, longPolled, err := c.get(ctx, id, c.longPoll)
+		if err != ErrPending {
+			return hash, err
+		}
+
+		// A server that long polled has already waited, so ask again
+		// straight away.  Otherwise we have to poll.
+		if longPolled {
+			continue
+		}
+		if err := c.sleep(ctx, jitter(backoff)); err != nil {
+			return "", err
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// get fetches the hash for id, asking the server to wait up to wait for it.
+// longPolled is true if the server supports waiting.
+func (c *Client) get(ctx context.Context, id int64, wait time.Duration) (hash string, longPolled bool, err error) {
+	path := "/hash/" + strconv.FormatInt(id, 10)
+	if wait > 0 {
+		path += "?wait=" + url.QueryEscape(wait.String())
+	}
+
+	resp, body, err := c.do(ctx, "GET", path, "")
+	if err != nil {
+		return "", false, err
+	}
+	longPolled = wait > 0 && resp.Header.Get("X-Long-Poll") != ""
+
+	switch resp.StatusCode {
+	case 200:
+		return strings.TrimSpace(body), longPolled, nil
+	case 404:
+		return "", longPolled, notFound(resp)
+	default:
+		return "", longPolled, jobError(id, resp, body)
+	}
+}
+
+// Verify checks whether password is the one that was hashed for id, without
+// fetching the hash, which can still be fetched afterwards.
+func (c *Client) Verify(ctx context.Context, id int64, password string) (bool, error) {
+	resp, body, err := c.do(ctx, "POST", "/verify/"+strconv.FormatInt(id, 10), "password="+password)
+	if err != nil {
+		return false, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		var result struct {
+			Match bool `json:"match"`
+		}
+		err := json.Unmarshal([]byte(body), &result)
+		return result.Match, err
+	case 404:
+		return false, notFound(resp)
+	default:
+		return false, jobError(id, resp, body)
+	}
+}
+
+// Stats fetches the server's stats.
+func (c *Client) Stats(ctx context.Context) (hasher.Stats, error) {
+	var stats hasher.Stats
+	resp, body, err := c.do(ctx, "GET", "/stats", "")
+	if err != nil {
+		return stats, err
+	}
+	if resp.StatusCode != 200 {
+		return stats, statusError(resp, body)
+	}
+	err = json.Unmarshal([]byte(body), &stats)
+	return stats, err
+}
+
+// Shutdown asks the server to shut down once every hash is complete.
+func (c *Client) Shutdown(ctx context.Context) error {
+	resp, body, err := c.do(ctx, "POST", "/shutdown", "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return statusError(resp, body)
+	}
+	return nil
+}
+
+// do makes a request, retrying while the server is too busy.  It returns the
+// final response, which has already been read into body.
+func (c *Client) do(ctx context.Context, method, path, body string) (*http.Response, string, error) {
+	backoff := c.minBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.base+path, strings.NewReader(body))
+		if err != nil {
+			return nil, "", err
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+
+		busy := resp.StatusCode == 429 || resp.StatusCode == 503
+		if !busy || attempt >= c.retries {
+			return resp, buf.String(), nil
+		}
+
+		delay, ok := retryAfter(resp)
+		if !ok {
+			delay = jitter(backoff)
+			if backoff *= 2; backoff > c.maxBackoff {
+				backoff = c.maxBackoff
+			}
+		}
+		if err := c.sleep(ctx, delay); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// retryAfter returns how long the Retry-After header of resp says to wait.
+// It can be a number of seconds or a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// jitter picks a delay between half of d and d, so that clients that were
+// turned away together don't all come back together.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notFound turns a 404 into the error for why there's no hash.
+func notFound(resp *http.Response) error {
+	switch resp.Header.Get("X-Hash-State") {
+	case "pending":
+		return ErrPending
+	case "gone":
+		return ErrRetrieved
+	default:
+		return ErrNotFound
+	}
+}
+
+// jobError turns a response to a request about job id into a *JobError if
+// the job failed, or a *StatusError otherwise.
+func jobError(id int64, resp *http.Response, body string) error {
+	const prefix = "Hash failed: "
+	if msg := strings.TrimSpace(body); resp.StatusCode == 500 && strings.HasPrefix(msg, prefix) {
+		return &JobError{id, strings.TrimSuffix(strings.TrimPrefix(msg, prefix), ".")}
+	}
+	return statusError(resp, body)
+}
+
+// statusError creates a *StatusError for an unexpected response.
+func statusError(resp *http.Response, body string) error {
+	return &StatusError{resp.StatusCode, strings.TrimSpace(body)}
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/server"
+)
+
+// newTestServer starts a hash server whose hasher runs on a FakeClock, and
+// whose worker token is "sesame".  The server is shut down when the test ends, advancing the clock until any
+// outstanding hashes are complete.
+func newTestServer(t *testing.T, tweak func(*hasher.Config)) (*httptest.Server, *hasher.FakeClock) {
+	clock := hasher.NewFakeClock(time.Unix(0, 0))
+	cfg := hasher.DefaultConfig()
+	cfg.Clock = clock
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(server.WithHasher(h), server.WithWorkerToken("sesame"))
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		ts.Close()
+
+		done := make(chan interface{})
+		go func() {
+			s.Shutdown()
+			close(done)
+		}()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				clock.Advance(time.Second)
+			}
+		}
+	})
+	return ts, clock
+}
+
+// sleepRecorder replaces Client.sleep, recording the delays instead of
+// waiting.
+type sleepRecorder struct {
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (r *sleepRecorder) sleep(ctx context.Context, d time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delays = append(r.delays, d)
+	return ctx.Err()
+}
+
+func TestClient(t *testing.T) {
+	ts, clock := newTestServer(t, nil)
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	id, err := c.Submit(ctx, "angryMonkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, id); err != ErrPending {
+		t.Errorf("Get before completion returned %v", err)
+	}
+	if _, err := c.Get(ctx, id+1); err != ErrNotFound {
+		t.Errorf("Get of an unknown id returned %v", err)
+	}
+
+	// Wait long polls, so it returns as soon as the hash is complete
+	done := make(chan error)
+	go func() {
+		hash, err := c.Wait(ctx, id)
+		if err == nil && hash != hasher.Compute("angryMonkey") {
+			err = errors.New("wrong hash " + hash)
+		}
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	time.Sleep(10 * time.Millisecond) // Give Wait time to start long polling
+	if ok, err := c.Verify(ctx, id, "angryMonkey"); err != ErrPending || ok {
+		t.Errorf("Verify before completion returned %v, %v", ok, err)
+	}
+	clock.Advance(5 * time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(ctx, id); err != ErrRetrieved {
+		t.Errorf("second Get returned %v", err)
+	}
+
+	stats, err := c.Stats(ctx)
+	if err != nil || stats.Total != 1 || stats.Algorithm != "sha512" {
+		t.Errorf("Stats returned %+v, %v", stats, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ts, _ := newTestServer(t, func(cfg *hasher.Config) { cfg.Delay = 0 })
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	id, _ := c.Submit(ctx, "angryMonkey")
+	for _, test := range []struct {
+		password string
+		match    bool
+	}{{"angryMonkey", true}, {"happyMonkey", false}} {
+		var ok bool
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			if ok, err = c.Verify(ctx, id, test.password); err != ErrPending || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil || ok != test.match {
+			t.Errorf("Verify(%s) returned %v, %v", test.password, ok, err)
+		}
+	}
+
+	// Verifying leaves the hash to be fetched
+	if _, err := c.Get(ctx, id); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJobError(t *testing.T) {
+	ts, _ := newTestServer(t, func(cfg *hasher.Config) {
+		cfg.Delay = 0
+		cfg.Work = func(password string) (string, error) {
+			return "", errors.New("out of entropy")
+		}
+	})
+	c := New(ts.URL)
+
+	id, err := c.Submit(context.Background(), "angryMonkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Wait(context.Background(), id)
+	var jobErr *JobError
+	if !errors.As(err, &jobErr) || jobErr.ID != id || jobErr.Reason != "out of entropy" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ts, _ := newTestServer(t, nil)
+
+	// Turn away the first few requests, the way a busy server or a rate
+	// limiter in front of it would
+	var mu sync.Mutex
+	refusals := []string{"2", "", "Mon, 02 Jan 2006 15:04:05 GMT"}
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(refusals) > 0 {
+			if refusals[0] != "" {
+				w.Header().Set("Retry-After", refusals[0])
+			}
+			refusals = refusals[1:]
+			http.Error(w, "Too many requests.", 429)
+			return
+		}
+		proxy(ts.URL, w, r)
+	}))
+	defer busy.Close()
+
+	var sleeps sleepRecorder
+	c := New(busy.URL, WithBackoff(time.Second, 10*time.Second))
+	c.sleep = sleeps.sleep
+
+	if _, err := c.Submit(context.Background(), "angryMonkey"); err != nil {
+		t.Fatal(err)
+	}
+	d := sleeps.delays
+	if len(d) != 3 || d[0] != 2*time.Second || d[1] < 500*time.Millisecond || d[1] > time.Second || d[2] != 0 {
+		t.Errorf("slept for %v", d)
+	}
+
+	// Give up eventually
+	mu.Lock()
+	refusals = []string{"", "", ""}
+	mu.Unlock()
+	c = New(busy.URL, WithRetries(2))
+	c.sleep = sleeps.sleep
+	var status *StatusError
+	if _, err := c.Submit(context.Background(), "angryMonkey"); !errors.As(err, &status) || status.Code != 429 {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestPoll verifies that Wait polls a server that doesn't long poll.
+func TestPoll(t *testing.T) {
+	var mu sync.Mutex
+	polls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if polls++; polls < 4 {
+			w.Header().Set("X-Hash-State", "pending")
+			http.Error(w, "Hash not complete yet.", 404)
+			return
+		}
+		w.Write([]byte("hash\n"))
+	}))
+	defer ts.Close()
+
+	var sleeps sleepRecorder
+	c := New(ts.URL, WithBackoff(time.Second, 3*time.Second))
+	c.sleep = sleeps.sleep
+
+	hash, err := c.Wait(context.Background(), 1)
+	if err != nil || hash != "hash" {
+		t.Fatalf("got %q, %v", hash, err)
+	}
+	if d := sleeps.delays; len(d) != 3 || d[2] < 1500*time.Millisecond || d[2] > 3*time.Second {
+		t.Errorf("slept for %v", d)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ts, _ := newTestServer(t, nil)
+	c := New(ts.URL, WithRetries(0))
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var status *StatusError
+	if _, err := c.Submit(context.Background(), "angryMonkey"); !errors.As(err, &status) || status.Code != 503 {
+		t.Errorf("Submit after Shutdown returned %v", err)
+	}
+}
+
+// proxy forwards a request to the server at base.
+func proxy(base string, w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest(r.Method, base+r.URL.RequestURI(), r.Body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func TestWorker(t *testing.T) {
+	ts, _ := newTestServer(t, func(cfg *hasher.Config) {
+		cfg.Remote, cfg.QueueDepth = true, 1
+	})
+	c := New(ts.URL, WithLongPoll(10*time.Millisecond), WithToken("sesame"))
+	ctx := context.Background()
+
+	if _, ok, err := c.Lease(ctx, "w1"); ok || err != nil {
+		t.Errorf("Lease with nothing queued returned %v, %v", ok, err)
+	}
+
+	id, _ := c.Submit(ctx, "angryMonkey")
+	l, ok, err := c.Lease(ctx, "w1")
+	if !ok || err != nil || l.JobID != id || l.Password != "angryMonkey" {
+		t.Fatalf("Lease returned %+v, %v, %v", l, ok, err)
+	}
+	if _, err := c.Heartbeat(ctx, l.ID); err != nil {
+		t.Errorf("Heartbeat returned %v", err)
+	}
+	if err := c.Complete(ctx, l.ID, hasher.Outcome{Hash: hasher.Compute("angryMonkey")}); err != nil {
+		t.Errorf("Complete returned %v", err)
+	}
+	if err := c.Fail(ctx, l.ID, "too late"); err != ErrLeaseExpired {
+		t.Errorf("Fail of a completed lease returned %v", err)
+	}
+	if hash, err := c.Wait(ctx, id); err != nil || hash != hasher.Compute("angryMonkey") {
+		t.Errorf("Wait returned %q, %v", hash, err)
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// ErrLeaseExpired is returned by Heartbeat, Complete and Fail once the server
+// has given up on a lease and put its job back on the queue.
+var ErrLeaseExpired = errors.New("lease has expired")
+
+// Lease asks the server for a job to hash on behalf of worker, which names it
+// in the server's logs.  The request is long polled like Wait, and ok is false
+// if no job was queued in that time.
+func (c *Client) Lease(ctx context.Context, worker string) (l hasher.Lease, ok bool, err error) {
+	path := "/worker/lease"
+	if c.longPoll > 0 {
+		path += "?wait=" + url.QueryEscape(c.longPoll.String())
+	}
+	body, _ := json.Marshal(struct {
+		Worker string `json:"worker"`
+	}{worker})
+
+	resp, text, err := c.do(ctx, "POST", path, string(body))
+	if err != nil {
+		return l, false, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		err = json.Unmarshal([]byte(text), &l)
+		return l, err == nil, err
+	case 204:
+		return l, false, nil
+	default:
+		return l, false, statusError(resp, text)
+	}
+}
+
+// Heartbeat renews a lease, and returns when it now expires.
+func (c *Client) Heartbeat(ctx context.Context, lease string) (time.Time, error) {
+	var result struct {
+		Expires time.Time `json:"expires"`
+	}
+	text, err := c.worker(ctx, "/worker/heartbeat", workerRequest{Lease: lease})
+	if err != nil {
+		return result.Expires, err
+	}
+	err = json.Unmarshal([]byte(text), &result)
+	return result.Expires, err
+}
+
+// Complete reports the hash computed for a leased job.
+func (c *Client) Complete(ctx context.Context, lease string, o hasher.Outcome) error {
+	_, err := c.worker(ctx, "/worker/complete", workerRequest{Lease: lease, Outcome: &o})
+	return err
+}
+
+// Fail reports that a leased job couldn't be hashed, and why.
+func (c *Client) Fail(ctx context.Context, lease string, reason string) error {
+	_, err := c.worker(ctx, "/worker/fail", workerRequest{Lease: lease, Reason: reason})
+	return err
+}
+
+// workerRequest is the body of a request about a lease.
+type workerRequest struct {
+	Lease   string          `json:"lease"`
+	Outcome *hasher.Outcome `json:"outcome,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+}
+
+// worker makes a request about a lease, and returns the body of the response.
+func (c *Client) worker(ctx context.Context, path string, req workerRequest) (string, error) {
+	body, _ := json.Marshal(req)
+	resp, text, err := c.do(ctx, "POST", path, string(body))
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return text, nil
+	case 410:
+		return "", ErrLeaseExpired
+	default:
+		return "", statusError(resp, text)
+	}
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// Aggregate adds together the stats of several nodes.  Counts, gauges and
+// rates are summed, and averages are weighted by the number of hashes behind
+// them.  The count, min, max, mean and standard deviation of each latency are
+// exact, but a percentile can't be recovered from the percentiles of the
+// parts, so each one is the highest of the nodes', which is an upper bound on
+// the real thing.
+func Aggregate(stats []hasher.Stats) hasher.Stats {
+	var total hasher.Stats
+	var avg, simulatedAvg float64
+	algorithms := make(map[string]bool)
+	windows := make(map[string][]hasher.Window)
+	var windowOrder []string
+	var queue, simulated, hash, endToEnd []hasher.Latencies
+
+	for _, s := range stats {
+		total.Total += s.Total
+		total.Failed += s.Failed
+		avg += s.Avg * float64(s.Total)
+		simulatedAvg += s.SimulatedAvg * float64(s.Total)
+
+		queue = append(queue, s.Queue)
+		simulated = append(simulated, s.Simulated)
+		hash = append(hash, s.Hash)
+		endToEnd = append(endToEnd, s.EndToEnd)
+
+		total.InFlight += s.InFlight
+		total.Queued += s.Queued
+		total.Stored += s.Stored
+
+		for _, w := range s.Windows {
+			if _, ok := windows[w.Window]; !ok {
+				windowOrder = append(windowOrder, w.Window)
+			}
+			windows[w.Window] = append(windows[w.Window], w)
+		}
+
+		if s.Algorithm != "" {
+			algorithms[s.Algorithm] = true
+		}
+		total.Counters.Submitted += s.Counters.Submitted
+		total.Counters.Rejected += s.Counters.Rejected
+		total.Counters.Completed += s.Counters.Completed
+		total.Counters.Failed += s.Counters.Failed
+		total.Counters.Retrieved += s.Counters.Retrieved
+		total.Counters.Expired += s.Counters.Expired
+	}
+
+	if total.Total > 0 {
+		total.Avg = avg / float64(total.Total)
+		total.SimulatedAvg = simulatedAvg / float64(total.Total)
+	}
+	total.Queue = mergeLatencies(queue)
+	total.Simulated = mergeLatencies(simulated)
+	total.Hash = mergeLatencies(hash)
+	total.EndToEnd = mergeLatencies(endToEnd)
+
+	for _, name := range windowOrder {
+		total.Windows = append(total.Windows, mergeWindows(name, windows[name]))
+	}
+
+	// Nodes ought to agree on the algorithm, but during a rolling change
+	// they won't, and that's worth seeing
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	total.Algorithm = strings.Join(names, ",")
+	return total
+}
+
+// mergeWindows adds together the same window from several nodes.
+func mergeWindows(name string, windows []hasher.Window) hasher.Window {
+	merged := hasher.Window{Window: name}
+	var latencies []hasher.Latencies
+	for _, w := range windows {
+		merged.Requests += w.Requests
+		merged.RequestRate += w.RequestRate
+		merged.Completed += w.Completed
+		merged.CompletionRate += w.CompletionRate
+		merged.Failed += w.Failed
+		latencies = append(latencies, w.Latency)
+	}
+	merged.Latency = mergeLatencies(latencies)
+	return merged
+}
+
+// mergeLatencies combines the summaries of several distributions, as
+// described by Aggregate.
+func mergeLatencies(ls []hasher.Latencies) hasher.Latencies {
+	var merged hasher.Latencies
+	var sum, sumSquares float64
+	for _, l := range ls {
+		if l.Count == 0 {
+			continue
+		}
+		if merged.Count == 0 || l.Min < merged.Min {
+			merged.Min = l.Min
+		}
+		merged.Max = math.Max(merged.Max, l.Max)
+		merged.P50 = math.Max(merged.P50, l.P50)
+		merged.P90 = math.Max(merged.P90, l.P90)
+		merged.P99 = math.Max(merged.P99, l.P99)
+		merged.P999 = math.Max(merged.P999, l.P999)
+
+		// Each node's mean and standard deviation give back the sum and
+		// sum of squares of its times, which do add up
+		n := float64(l.Count)
+		merged.Count += l.Count
+		sum += l.Mean * n
+		sumSquares += (l.StdDev*l.StdDev + l.Mean*l.Mean) * n
+	}
+
+	if merged.Count > 0 {
+		n := float64(merged.Count)
+		merged.Mean = sum / n
+		merged.StdDev = math.Sqrt(math.Max(sumSquares/n-merged.Mean*merged.Mean, 0))
+	}
+	return merged
+}
@@ -0,0 +1,430 @@
+// Package cluster lets several hash servers behind a load balancer act as one.
+//
+// Membership is static: every node is started with the same list of nodes,
+// and its own node id.  Each node issues ids with its node id in the top bits
+// (see hasher.NodeOf), so the node holding the hash for an id is known from
+// the id alone.  A request for an id that landed on another node is sent to
+// the owner, either by forwarding it and relaying the response, or by
+// redirecting the client.  Stats gathers the stats of every node, so that
+// one request shows how the whole cluster is doing.
+//
+// Each node's jobs can also be replicated to the nodes that follow it, so
+// that when it dies its hashes can still be retrieved from them, see
+// Submitted.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// ForwardedHeader marks a request that one node forwarded to another, with
+// the id of the node that forwarded it.  A node never forwards a request that
+// has already been forwarded, so a misconfigured cluster can't bounce a
+// request around forever.
+const ForwardedHeader = "X-Hash-Forwarded-By"
+
+// statsTimeout is how long Stats waits for each node.  A node that doesn't
+// answer in time is reported as down rather than holding up the rest.
+const statsTimeout = 2 * time.Second
+
+// dialTimeout is how long a node that redirects clients waits to see whether
+// the owner is up.
+const dialTimeout = 500 * time.Millisecond
+
+// Node is a member of the cluster.
+type Node struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"` // Where the other nodes reach it, e.g. http://10.0.0.1:8080
+}
+
+// Routing says how a request for another node's id is sent there.
+type Routing string
+
+const (
+	Forward  Routing = "forward"  // Forward the request to the owner and relay the response
+	Redirect Routing = "redirect" // Redirect the client to the owner with a 307
+)
+
+// ParseRouting parses the name of a Routing.
+func ParseRouting(name string) (Routing, error) {
+	switch r := Routing(name); r {
+	case Forward, Redirect:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown cluster routing %q, expected forward or redirect", name)
+}
+
+// ParseNodes parses a list of nodes of the form
+//
+//	1=http://10.0.0.1:8080,2=http://10.0.0.2:8080
+func ParseNodes(spec string) ([]Node, error) {
+	var nodes []Node
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		idText, rawURL, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid node %q, expected ID=URL", item)
+		}
+		id, err := strconv.Atoi(idText)
+		if err != nil || id < 0 || id > hasher.MaxNode {
+			return nil, fmt.Errorf("invalid node id %q, expected 0 to %d", idText, hasher.MaxNode)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("node %d is listed twice", id)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q for node %d", rawURL, id)
+		}
+
+		seen[id] = true
+		nodes = append(nodes, Node{id, strings.TrimSuffix(rawURL, "/")})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// Config says how a node sees the cluster.
+type Config struct {
+	Self    int    // This node's id
+	Nodes   []Node // Every node, including this one, so every node can be given the same list
+	Routing Routing
+
+	// Replicas is how many other nodes keep a copy of each node's jobs, so
+	// that none are lost with it, and Ack how many of them must have a job
+	// before its id is handed out, see Submitted.
+	Replicas int
+	Ack      Ack
+	Token    string // Shared by every node, and required by POST /cluster/replicate, so it must be set with Replicas.
+
+	// TTL and Algorithm are the hasher's, and apply to the copies of other
+	// nodes' jobs kept here.
+	TTL       time.Duration
+	Algorithm string
+
+	// Logger receives an event when a node can't be reached.  nil logs
+	// nothing.  Passwords are never logged.
+	Logger *slog.Logger
+}
+
+// Cluster is this node's view of the cluster.
+type Cluster struct {
+	cfg       Config
+	log       *slog.Logger
+	client    *http.Client // For stats and replication, which mustn't hang
+	forwarder *http.Client // For forwarded requests, which may long poll
+	store     *Store       // Copies of other nodes' jobs
+	recovered int64        // The last id this node issued before it restarted, see Recover
+
+	mu     sync.Mutex
+	peers  map[int]*peer // Replication queues, started as they're needed
+	closed bool
+	wg     sync.WaitGroup
+	stop   context.Context // Cancelled when Close gives up on flushing the queues
+	cancel context.CancelFunc
+}
+
+// New creates a node's view of the cluster.
+func New(cfg Config) (*Cluster, error) {
+	if _, err := ParseAck(string(cfg.Ack)); err != nil {
+		return nil, err
+	}
+	if cfg.Replicas < 0 || cfg.Replicas >= len(cfg.Nodes) {
+		return nil, fmt.Errorf("replicas must be between 0 and %d, one less than the number of nodes: %d",
+			len(cfg.Nodes)-1, cfg.Replicas)
+	}
+	// Replication carries passwords, so it's never taken from just anyone
+	if cfg.Replicas > 0 && cfg.Token == "" {
+		return nil, errors.New("replicas need a cluster token")
+	}
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = hasher.DefaultConfig().Algorithm
+	}
+	algorithm, err := hasher.LookupAlgorithm(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		cfg:       cfg,
+		log:       cfg.Logger,
+		client:    &http.Client{Timeout: statsTimeout},
+		forwarder: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		store:     newStore(cfg.TTL, algorithm),
+		peers:     make(map[int]*peer),
+	}
+	if c.log == nil {
+		c.log = slog.New(slog.DiscardHandler)
+	}
+	c.stop, c.cancel = context.WithCancel(context.Background())
+
+	if !c.member(cfg.Self) {
+		return nil, fmt.Errorf("node %d is not one of the cluster's nodes", cfg.Self)
+	}
+	return c, nil
+}
+
+// Self returns the id of this node.
+func (c *Cluster) Self() int {
+	return c.cfg.Self
+}
+
+// Nodes returns every node, including this one, in order of id.
+func (c *Cluster) Nodes() []Node {
+	return c.cfg.Nodes
+}
+
+// Route sends a request about id to the node that issued it.  It returns
+// false, having done nothing, if id belongs to this node, or to no node this
+// one knows of, or the request was already forwarded here, in which case the
+// caller should answer the request as though this node owned the id.
+//
+// If the owner can't be reached, the request fails over to the nodes that
+// replicate its jobs.  It returns false if this is one of them, so that the
+// caller answers from Replicated.
+func (c *Cluster) Route(w http.ResponseWriter, r *http.Request, id int64) bool {
+	owner := hasher.NodeOf(id)
+	if owner == c.cfg.Self || !c.member(owner) || r.Header.Get(ForwardedHeader) != "" {
+		return false
+	}
+
+	if c.cfg.Routing == Redirect && c.reachable(c.node(owner)) {
+		http.Redirect(w, r, c.node(owner).URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+	if c.cfg.Routing == Forward && c.relay(w, r, []int{owner}) {
+		return true
+	}
+
+	// The owner is down.  A copy here is as good as any other.
+	var replicas []int
+	for _, n := range c.replicasOf(owner) {
+		if n == c.cfg.Self {
+			return false
+		}
+		replicas = append(replicas, n)
+	}
+	if !c.relay(w, r, replicas) {
+		http.Error(w, fmt.Sprintf("Node %d is unavailable.", owner), 502)
+	}
+	return true
+}
+
+// Failover sends a request about one of this node's own ids to the nodes that
+// replicate its jobs, if the id was issued before this node restarted and so
+// is only known to them.  It returns false if the id is newer than that, or
+// none of them could be reached, in which case the caller should answer that
+// it has no such id.
+func (c *Cluster) Failover(w http.ResponseWriter, r *http.Request, id int64) bool {
+	if hasher.NodeOf(id) != c.cfg.Self || id > c.recovered || r.Header.Get(ForwardedHeader) != "" {
+		return false
+	}
+	return c.relay(w, r, c.replicasOf(c.cfg.Self))
+}
+
+// relay forwards a request to the first of nodes that can be reached, and
+// relays its response.  It returns false if none of them could be.
+func (c *Cluster) relay(w http.ResponseWriter, r *http.Request, nodes []int) bool {
+	if len(nodes) == 0 {
+		return false
+	}
+
+	// The body is kept so that it can be sent again to the next node
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Unable to read the request body.", 400)
+		return true
+	}
+
+	for _, id := range nodes {
+		resp, err := c.forward(r, c.node(id), body)
+		if err != nil {
+			c.log.Warn("node unavailable", "node", id, "error", err)
+			continue
+		}
+
+		for name, values := range resp.Header {
+			if name != "Connection" && name != "Keep-Alive" {
+				w.Header()[name] = values
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+		return true
+	}
+	return false
+}
+
+// forward sends a copy of r to node n.  The node logs the request under the
+// same request ID as we do.  A traceparent from the client is passed on as it
+// is, and the client's address is added to X-Forwarded-For.
+func (c *Cluster) forward(r *http.Request, n Node, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, n.URL+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Connection")
+	req.Header.Set(ForwardedHeader, strconv.Itoa(c.cfg.Self))
+	if id, ok := trace.FromContext(r.Context()); ok {
+		req.Header.Set(trace.RequestIDHeader, id.ID)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	return c.forwarder.Do(req)
+}
+
+// reachable reports whether node n is accepting connections, before a client
+// is redirected to it.
+func (c *Cluster) reachable(n Node) bool {
+	u, _ := url.Parse(n.URL)
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+	conn, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		c.log.Warn("node unavailable", "node", n.ID, "error", err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// member reports whether id is one of the nodes.
+func (c *Cluster) member(id int) bool {
+	for _, n := range c.cfg.Nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// node returns the node with the given id, which must be a member.
+func (c *Cluster) node(id int) Node {
+	for _, n := range c.cfg.Nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	panic("unknown node " + strconv.Itoa(id))
+}
+
+// replicasOf returns the nodes that keep copies of owner's jobs: the
+// Replicas nodes that follow it in order of id, wrapping around.
+func (c *Cluster) replicasOf(owner int) []int {
+	var replicas []int
+	for i, n := range c.cfg.Nodes {
+		if n.ID != owner {
+			continue
+		}
+		for j := 1; j <= c.cfg.Replicas; j++ {
+			replicas = append(replicas, c.cfg.Nodes[(i+j)%len(c.cfg.Nodes)].ID)
+		}
+	}
+	return replicas
+}
+
+// NodeStats is the stats of a single node, or why they couldn't be fetched.
+type NodeStats struct {
+	Node
+	Stats *hasher.Stats `json:"stats,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// Stats is the stats of the whole cluster.
+type Stats struct {
+	Nodes []NodeStats  `json:"nodes"` // Every node, in order of id
+	Down  int          `json:"down"`  // Nodes whose stats couldn't be fetched
+	Total hasher.Stats `json:"total"` // The stats of the nodes that answered, added together, see Aggregate
+}
+
+// Stats fetches the stats of every other node from GET /stats, and adds them
+// to local, the stats of this node.
+func (c *Cluster) Stats(ctx context.Context, local hasher.Stats) Stats {
+	stats := Stats{Nodes: make([]NodeStats, len(c.cfg.Nodes))}
+
+	var wg sync.WaitGroup
+	for i, n := range c.cfg.Nodes {
+		stats.Nodes[i].Node = n
+		if n.ID == c.cfg.Self {
+			stats.Nodes[i].Stats = &local
+			continue
+		}
+
+		wg.Add(1)
+		go func(ns *NodeStats) {
+			defer wg.Done()
+			s, err := c.fetchStats(ctx, ns.Node)
+			if err != nil {
+				ns.Error = err.Error()
+				return
+			}
+			ns.Stats = &s
+		}(&stats.Nodes[i])
+	}
+	wg.Wait()
+
+	var all []hasher.Stats
+	for _, ns := range stats.Nodes {
+		if ns.Stats == nil {
+			stats.Down++
+			continue
+		}
+		all = append(all, *ns.Stats)
+	}
+	stats.Total = Aggregate(all)
+	return stats
+}
+
+// fetchStats fetches the stats of node n.
+func (c *Cluster) fetchStats(ctx context.Context, n Node) (hasher.Stats, error) {
+	var s hasher.Stats
+	req, err := http.NewRequestWithContext(ctx, "GET", n.URL+"/stats", nil)
+	if err != nil {
+		return s, err
+	}
+	req.Header.Set(ForwardedHeader, strconv.Itoa(c.cfg.Self))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return s, fmt.Errorf("GET /stats returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
@@ -0,0 +1,315 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := ParseNodes(" 2=http://b:8080/, 1=https://a:8080 ,")
+	want := []Node{{1, "https://a:8080"}, {2, "http://b:8080"}}
+	if err != nil || !reflect.DeepEqual(nodes, want) {
+		t.Errorf("ParseNodes() = %+v, %v", nodes, err)
+	}
+
+	for _, spec := range []string{
+		"1",
+		"x=http://a",
+		"-1=http://a",
+		"1024=http://a",
+		"1=http://a,1=http://b",
+		"1=a:8080",
+		"1=ftp://a",
+	} {
+		if _, err := ParseNodes(spec); err == nil {
+			t.Errorf("ParseNodes(%q) succeeded", spec)
+		}
+	}
+
+	if _, err := New(Config{Self: 3, Nodes: want, Routing: Forward}); err == nil {
+		t.Error("New() accepted a node that isn't a member")
+	}
+	if _, err := ParseRouting("teleport"); err == nil {
+		t.Error("ParseRouting() accepted nonsense")
+	}
+}
+
+// TestRoute verifies that requests for another node's ids are forwarded or
+// redirected to it, and nothing else is.
+func TestRoute(t *testing.T) {
+	var forwardedBy string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy = r.Header.Get(ForwardedHeader)
+		w.Write([]byte("owner " + r.URL.RequestURI()))
+	}))
+	defer owner.Close()
+
+	nodes := []Node{{1, "http://localhost:1"}, {2, owner.URL}}
+	theirs := int64(2)<<53 | 7
+
+	for _, routing := range []Routing{Forward, Redirect} {
+		c, err := New(Config{Self: 1, Nodes: nodes, Routing: routing})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			id        int64
+			forwarded string
+			routed    bool
+		}{
+			{1, "", false},              // Ours
+			{int64(9) << 53, "", false}, // Nobody's
+			{theirs, "1", false},        // Already forwarded
+			{theirs, "", true},
+		} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/hash/123?wait=1s", nil)
+			if test.forwarded != "" {
+				r.Header.Set(ForwardedHeader, test.forwarded)
+			}
+			if routed := c.Route(w, r, test.id); routed != test.routed {
+				t.Errorf("%s: Route(%d) = %v", routing, test.id, routed)
+			}
+			if !test.routed {
+				continue
+			}
+
+			switch routing {
+			case Forward:
+				if w.Code != 200 || w.Body.String() != "owner /hash/123?wait=1s" || forwardedBy != "1" {
+					t.Errorf("forwarded request got %d: %s, forwarded by %q", w.Code, w.Body, forwardedBy)
+				}
+			case Redirect:
+				if w.Code != 307 || w.Header().Get("Location") != owner.URL+"/hash/123?wait=1s" {
+					t.Errorf("redirect was %d to %s", w.Code, w.Header().Get("Location"))
+				}
+			}
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(hasher.Stats{Total: 3, Avg: 4, Algorithm: "sha512"})
+	}))
+	defer peer.Close()
+
+	c, _ := New(Config{Self: 1, Nodes: []Node{{1, "http://localhost:1"}, {2, peer.URL}, {3, "http://127.0.0.1:1"}}})
+	stats := c.Stats(context.Background(), hasher.Stats{Total: 1, Avg: 8, Algorithm: "sha512"})
+
+	if stats.Down != 1 || stats.Nodes[2].Error == "" || stats.Nodes[1].Stats.Total != 3 {
+		t.Errorf("unexpected nodes %+v", stats.Nodes)
+	}
+	if stats.Total.Total != 4 || stats.Total.Avg != 5 || stats.Total.Algorithm != "sha512" {
+		t.Errorf("unexpected total %+v", stats.Total)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	// Two nodes, one of which timed 1 and 3, and the other 5, 5 and 5
+	a := hasher.Latencies{Count: 2, Min: 1, Max: 3, Mean: 2, StdDev: 1, P50: 1, P99: 3}
+	b := hasher.Latencies{Count: 3, Min: 5, Max: 5, Mean: 5, StdDev: 0, P50: 5, P99: 5}
+	total := Aggregate([]hasher.Stats{
+		{Total: 2, Avg: 2, Hash: a, InFlight: 1, Algorithm: "sha512",
+			Windows:  []hasher.Window{{Window: "1m", Requests: 2, RequestRate: 0.5, Latency: a}},
+			Counters: hasher.Counters{Submitted: 3}},
+		{Total: 3, Avg: 5, Hash: b, InFlight: 2, Algorithm: "sha256",
+			Windows:  []hasher.Window{{Window: "1m", Requests: 3, RequestRate: 1, Latency: b}},
+			Counters: hasher.Counters{Submitted: 4}},
+	})
+
+	// The times were 1, 3, 5, 5 and 5
+	wantStdDev := math.Sqrt((1+9+25+25+25)/5.0 - 3.8*3.8)
+	h := total.Hash
+	if h.Count != 5 || h.Min != 1 || h.Max != 5 || math.Abs(h.Mean-3.8) > 1e-9 || math.Abs(h.StdDev-wantStdDev) > 1e-9 || h.P50 != 5 {
+		t.Errorf("merged latencies %+v, expected a standard deviation of %g", h, wantStdDev)
+	}
+	if total.Total != 5 || math.Abs(total.Avg-3.8) > 1e-9 || total.InFlight != 3 || total.Counters.Submitted != 7 {
+		t.Errorf("unexpected total %+v", total)
+	}
+	if len(total.Windows) != 1 || total.Windows[0].Requests != 5 || total.Windows[0].RequestRate != 1.5 ||
+		total.Windows[0].Latency.Count != 5 {
+		t.Errorf("unexpected windows %+v", total.Windows)
+	}
+	if total.Algorithm != "sha256,sha512" {
+		t.Errorf("algorithm %q", total.Algorithm)
+	}
+}
+
+func TestReplicasOf(t *testing.T) {
+	c, err := New(Config{Self: 1, Nodes: []Node{{1, "http://a"}, {4, "http://b"}, {7, "http://c"}}, Replicas: 2, Token: "sesame"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for owner, want := range map[int][]int{1: {4, 7}, 4: {7, 1}, 7: {1, 4}} {
+		if got := c.replicasOf(owner); !reflect.DeepEqual(got, want) {
+			t.Errorf("replicasOf(%d) = %v, expected %v", owner, got, want)
+		}
+	}
+
+	if _, err := New(Config{Self: 1, Nodes: []Node{{1, "http://a"}, {2, "http://b"}}, Replicas: 2}); err == nil {
+		t.Error("New() accepted more replicas than other nodes")
+	}
+	if _, err := New(Config{Self: 1, Nodes: []Node{{1, "http://a"}}, Ack: "most"}); err == nil {
+		t.Error("New() accepted an unknown ack policy")
+	}
+	if _, err := New(Config{Self: 1, Nodes: []Node{{1, "http://a"}, {2, "http://b"}}, Replicas: 1}); err == nil {
+		t.Error("New() accepted replicas without a cluster token")
+	}
+}
+
+// TestStore verifies that ops are applied in whatever order they arrive, and
+// that a copy is answered for like the hasher would.
+func TestStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newStore(time.Minute, hasher.Compute)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	id := func(seq int64) int64 { return int64(2)<<53 | seq }
+
+	s.Apply([]Op{
+		{Kind: OpSubmitted, ID: id(1), RequestID: "r1", Password: "angryMonkey"},
+		{Kind: OpSubmitted, ID: id(2), Password: "happyMonkey"},
+		{Kind: OpCompleted, ID: id(2), Hash: "h2"},
+		{Kind: OpCompleted, ID: id(3), Error: "boom"},
+		{Kind: OpSubmitted, ID: id(3), Password: "late"}, // Out of order
+		{Kind: OpRetrieved, ID: id(4)},
+		{Kind: OpSubmitted, ID: id(4), Password: "late"},
+	})
+	if last := s.LastID(2); last != id(4) {
+		t.Errorf("LastID() = %d", last)
+	}
+
+	// Never completed, so it's computed
+	if ok, err := s.Verify(ctx, id(1), "angryMonkey"); !ok || err != nil {
+		t.Errorf("Verify() of a pending job = %v, %v", ok, err)
+	}
+	if ok, err := s.Verify(ctx, id(1), "angryMonkeys"); ok || err != nil {
+		t.Errorf("Verify() of a pending job with the wrong password = %v, %v", ok, err)
+	}
+	res, err := s.Retrieve(ctx, id(1))
+	if err != nil || res.Hash != hasher.Compute("angryMonkey") || res.RequestID != "r1" {
+		t.Errorf("Retrieve() of a pending job = %+v, %v", res, err)
+	}
+	if _, err := s.Retrieve(ctx, id(1)); err != hasher.ErrGone {
+		t.Errorf("second Retrieve() = %v", err)
+	}
+
+	if res, err := s.Retrieve(ctx, id(2)); err != nil || res.Hash != "h2" {
+		t.Errorf("Retrieve() of a completed job = %+v, %v", res, err)
+	}
+	var jobErr *hasher.JobError
+	if _, err := s.Retrieve(ctx, id(3)); !errors.As(err, &jobErr) || jobErr.Reason != "boom" {
+		t.Errorf("Retrieve() of a failed job = %v", err)
+	}
+	if _, err := s.Retrieve(ctx, id(4)); err != hasher.ErrGone {
+		t.Errorf("Retrieve() of a retrieved job = %v", err)
+	}
+	if _, err := s.Retrieve(ctx, id(5)); err != hasher.ErrNotFound {
+		t.Errorf("Retrieve() of an unknown job = %v", err)
+	}
+
+	// Completed copies expire with the TTL, like the hasher's
+	s.Apply([]Op{{Kind: OpCompleted, ID: id(6), Hash: "h6"}})
+	now = now.Add(2 * time.Minute)
+	if _, err := s.Verify(ctx, id(6), "x"); err != hasher.ErrGone {
+		t.Errorf("Verify() of an expired job = %v", err)
+	}
+}
+
+// TestSubmitted verifies that a submission waits for as many replicas as the
+// ack policy says, and no more.
+func TestSubmitted(t *testing.T) {
+	var mu sync.Mutex
+	var got []Op
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sesame" || r.Header.Get(ForwardedHeader) != "1" {
+			http.Error(w, "who are you?", 401)
+			return
+		}
+		var ops []Op
+		json.NewDecoder(r.Body).Decode(&ops)
+		mu.Lock()
+		got = append(got, ops...)
+		mu.Unlock()
+	}))
+	defer replica.Close()
+
+	// Node 3 is down
+	nodes := []Node{{1, "http://localhost:1"}, {2, replica.URL}, {3, "http://127.0.0.1:1"}}
+	for _, test := range []struct {
+		ack Ack
+		ok  bool
+	}{
+		{AckNone, true},
+		{AckOne, true},
+		{AckAll, false},
+	} {
+		c, err := New(Config{Self: 1, Nodes: nodes, Replicas: 2, Ack: test.ack, Token: "sesame"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Submitted(context.Background(), 1, "r1", "angryMonkey")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Submitted() = %v", test.ack, err)
+		}
+		c.Completed(hasher.JobResult{ID: 1, Hash: "h1"})
+		c.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 6 || got[0].Password != "angryMonkey" || got[1].Kind != OpCompleted || got[1].Password != "" {
+		t.Errorf("replica got %+v", got)
+	}
+}
+
+// TestFailover verifies that a request for the ids of a node that is down
+// goes to its replicas, or is answered here if this is one of them.
+func TestFailover(t *testing.T) {
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "replica %s %s", r.Header.Get(ForwardedHeader), body)
+	}))
+	defer replica.Close()
+
+	// Node 2 is down, and node 3 follows it
+	nodes := []Node{{1, "http://localhost:1"}, {2, "http://127.0.0.1:1"}, {3, replica.URL}}
+	theirs := int64(2)<<53 | 7
+
+	for _, routing := range []Routing{Forward, Redirect} {
+		c, _ := New(Config{Self: 1, Nodes: nodes, Routing: routing, Replicas: 1, Token: "sesame"})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/verify/123", strings.NewReader("password=angryMonkey"))
+		if !c.Route(w, r, theirs) || w.Code != 200 || w.Body.String() != "replica 1 password=angryMonkey" {
+			t.Errorf("%s: failover got %d: %s", routing, w.Code, w.Body)
+		}
+	}
+
+	// This node has a copy too
+	c, _ := New(Config{Self: 1, Nodes: nodes, Replicas: 2, Token: "sesame"})
+	if c.Route(httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/123", nil), theirs) {
+		t.Error("Route() sent a request elsewhere when this node has a copy")
+	}
+
+	// Nobody has a copy
+	c, _ = New(Config{Self: 1, Nodes: nodes})
+	w := httptest.NewRecorder()
+	if !c.Route(w, httptest.NewRequest("GET", "/hash/123", nil), theirs) || w.Code != 502 {
+		t.Errorf("Route() with no replicas got %d", w.Code)
+	}
+}
@@ -0,0 +1,340 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// Replication works like this.  When a node hands out an id, it sends the job,
+// password and all, to the Replicas nodes that follow it.  When the hash is
+// stored it sends them the result, which replaces the password, and when the
+// hash is retrieved it tells them so they can forget it.  Ops are sent to each
+// node in order, in batches, to POST /cluster/replicate.
+//
+// If the owner dies, its replicas answer for its ids: with the hash if it was
+// stored, or by computing it from the password if it wasn't, so a job that
+// was handed out isn't lost even if it was still in the queue.  The replicas
+// don't simulate any delay.
+//
+// Only the submission is waited for, according to the Ack policy.  The result
+// and the retrieval are sent in the background, since a replica that misses
+// a result can still compute it.
+
+const (
+	replicationQueue   = 10000           // Ops waiting to be sent to each node
+	replicationBatch   = 100             // Ops sent to a node in one request
+	replicationRetries = 3               // Attempts at sending a batch before it's dropped
+	replicationTimeout = 5 * time.Second // How long Submitted and Close wait for replicas
+)
+
+// Ack says how many replicas must have a job before its id is handed out.
+type Ack string
+
+const (
+	AckNone Ack = "none" // Don't wait.  A job can be lost if its owner dies right after handing out the id.
+	AckOne  Ack = "one"  // Wait for one replica
+	AckAll  Ack = "all"  // Wait for every replica, failing the request if any can't be reached
+)
+
+// ParseAck parses the name of an Ack policy.  "" is AckOne.
+func ParseAck(name string) (Ack, error) {
+	switch a := Ack(name); a {
+	case "":
+		return AckOne, nil
+	case AckNone, AckOne, AckAll:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown replication ack %q, expected none, one or all", name)
+}
+
+// The kinds of Op.
+const (
+	OpSubmitted = "submitted"
+	OpCompleted = "completed"
+	OpRetrieved = "retrieved"
+)
+
+// Op is a change to a job, sent by the node that owns it to its replicas.
+type Op struct {
+	Kind      string `json:"op"`
+	ID        int64  `json:"id"`
+	RequestID string `json:"requestId,omitempty"`
+	Password  string `json:"password,omitempty"` // Only set by OpSubmitted
+	Hash      string `json:"hash,omitempty"`     // Only set by OpCompleted
+	Error     string `json:"error,omitempty"`    // Only set by OpCompleted, if the job failed
+}
+
+// peer is the queue of ops waiting to be sent to a node.
+type peer struct {
+	node  Node
+	queue chan pendingOp
+}
+
+// pendingOp is an op waiting to be sent, and where to say whether it was, if
+// anyone is waiting.
+type pendingOp struct {
+	op    Op
+	acked chan<- error
+}
+
+// Submitted replicates a job that this node has just been asked for, and
+// waits for as many replicas as the Ack policy requires to have it.  An error
+// means the id shouldn't be handed out, since the job could be lost.
+func (c *Cluster) Submitted(ctx context.Context, id int64, requestID, password string) error {
+	replicas := c.replicasOf(c.cfg.Self)
+	need := len(replicas)
+	switch c.cfg.Ack {
+	case AckNone:
+		need = 0
+	case AckOne, "":
+		need = min(need, 1)
+	}
+
+	acked := make(chan error, len(replicas))
+	op := Op{Kind: OpSubmitted, ID: id, RequestID: requestID, Password: password}
+	for _, n := range replicas {
+		c.enqueue(n, op, acked)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replicationTimeout)
+	defer cancel()
+	var failed []string
+	for got := 0; got < need; {
+		select {
+		case err := <-acked:
+			if err == nil {
+				got++
+				continue
+			}
+			failed = append(failed, err.Error())
+			if len(replicas)-len(failed) < need {
+				return fmt.Errorf("job %d could not be replicated: %s", id, strings.Join(failed, "; "))
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("job %d could not be replicated: %w", id, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Completed replicates the result of one of this node's jobs.  It is meant to
+// be hasher.Config.OnComplete.
+func (c *Cluster) Completed(r hasher.JobResult) {
+	op := Op{Kind: OpCompleted, ID: r.ID, RequestID: r.RequestID, Hash: r.Hash, Error: r.Error}
+	for _, n := range c.replicasOf(c.cfg.Self) {
+		c.enqueue(n, op, nil)
+	}
+}
+
+// Retrieved tells the other replicas of job id that it has been retrieved,
+// from this node, so that it isn't handed out twice.
+func (c *Cluster) Retrieved(id int64) {
+	owner := hasher.NodeOf(id)
+	for _, n := range c.replicasOf(owner) {
+		if n != c.cfg.Self {
+			c.enqueue(n, Op{Kind: OpRetrieved, ID: id}, nil)
+		}
+	}
+}
+
+// Replicated returns the copies of other nodes' jobs kept by this node.
+func (c *Cluster) Replicated() *Store {
+	return c.store
+}
+
+// Authorized reports whether a replication request carries the cluster's
+// token.  Without a token, there are no replicas, and nothing is.
+func (c *Cluster) Authorized(r *http.Request) bool {
+	if c.cfg.Token == "" {
+		return false
+	}
+	want := "Bearer " + c.cfg.Token
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// Recover asks the replicas of this node for the last id it issued, in case
+// it has been restarted.  New ids must carry on after it, so they aren't
+// mistaken for the old ones, and Failover sends requests for the old ones to
+// the replicas.  A replica that can't be reached is skipped, since on a fresh
+// start the others may not be up yet.
+func (c *Cluster) Recover(ctx context.Context) int64 {
+	for _, id := range c.replicasOf(c.cfg.Self) {
+		n := c.node(id)
+		last, err := c.fetchLastID(ctx, n)
+		if err != nil {
+			c.log.Warn("node unavailable", "node", n.ID, "error", err)
+			continue
+		}
+		c.recovered = max(c.recovered, last)
+	}
+	return c.recovered
+}
+
+// fetchLastID asks node n for the last of this node's ids it has a copy of.
+func (c *Cluster) fetchLastID(ctx context.Context, n Node) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", n.URL+"/cluster/replicate?node="+strconv.Itoa(c.cfg.Self), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		LastID int64 `json:"lastId"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return body.LastID, err
+}
+
+// Close sends whatever is still waiting to be replicated, giving up on nodes
+// that can't be reached after a few seconds.  Nothing more is replicated
+// after Close.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	for _, p := range c.peers {
+		close(p.queue)
+	}
+	c.mu.Unlock()
+
+	done := make(chan interface{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(replicationTimeout):
+		c.cancel()
+		<-done
+	}
+}
+
+// enqueue queues op to be sent to node id.  If the queue is full, or the
+// cluster has been closed, the op is dropped, and acked told so.
+func (c *Cluster) enqueue(id int, op Op, acked chan<- error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := fmt.Errorf("replication to node %d has stopped", id)
+	if !c.closed {
+		p, ok := c.peers[id]
+		if !ok {
+			p = &peer{node: c.node(id), queue: make(chan pendingOp, replicationQueue)}
+			c.peers[id] = p
+			c.wg.Add(1)
+			go c.replicate(p)
+		}
+
+		select {
+		case p.queue <- pendingOp{op, acked}:
+			return
+		default:
+			err = fmt.Errorf("replication queue to node %d is full", id)
+		}
+	}
+
+	c.log.Warn("replication dropped", "node", id, "id", op.ID, "op", op.Kind, "error", err)
+	if acked != nil {
+		acked <- err
+	}
+}
+
+// replicate sends the ops queued for a node, in order, until the queue is
+// closed.
+func (c *Cluster) replicate(p *peer) {
+	defer c.wg.Done()
+
+	for first := range p.queue {
+		batch := []pendingOp{first}
+	fill:
+		for len(batch) < replicationBatch {
+			select {
+			case next, ok := <-p.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+
+		ops := make([]Op, len(batch))
+		for i, b := range batch {
+			ops[i] = b.op
+		}
+		err := c.send(p.node, ops)
+		for attempt := 1; err != nil && attempt < replicationRetries && c.stop.Err() == nil; attempt++ {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			err = c.send(p.node, ops)
+		}
+		if err != nil {
+			c.log.Warn("replication failed", "node", p.node.ID, "ops", len(ops), "error", err)
+		}
+
+		for _, b := range batch {
+			if b.acked != nil {
+				b.acked <- err
+			}
+		}
+	}
+}
+
+// send sends a batch of ops to node n.
+func (c *Cluster) send(n Node, ops []Op) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(c.stop, "POST", n.URL+"/cluster/replicate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request to another node, as this one and with the cluster's
+// token, and turns anything but a 200 into an error.
+func (c *Cluster) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set(ForwardedHeader, strconv.Itoa(c.cfg.Self))
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %d: %s", req.Method, req.URL.Path, resp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
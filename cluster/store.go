@@ -0,0 +1,196 @@
+package cluster
+
+import (
+	"context"
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// tombstoneTTL is how long a replica remembers that a job was retrieved, in
+// case the owner's ops arrive late, or out of order from different nodes.
+const tombstoneTTL = time.Hour
+
+// The states of a replicated job.
+const (
+	replicaPending   = iota // Submitted, with the password
+	replicaCompleted        // The hash or error is in, the password is gone
+	replicaRetrieved        // Retrieved or expired, only the fact is kept
+)
+
+// replica is the copy of a job kept for another node.
+type replica struct {
+	state     int
+	requestID string
+	password  string // Only while pending
+	hash      string
+	err       string
+	updated   time.Time // When the state last changed
+}
+
+// Store keeps the copies of other nodes' jobs held by this node, and answers
+// for them when their owner is down, like a hasher would.
+type Store struct {
+	mu        sync.Mutex
+	jobs      map[int64]*replica
+	last      map[int]int64 // The last id seen from each node
+	ttl       time.Duration
+	algorithm hasher.Algorithm
+	swept     time.Time
+	now       func() time.Time
+}
+
+// newStore creates an empty store.  Completed jobs are kept for ttl, like the
+// hasher keeps them, and jobs that are still pending are hashed with
+// algorithm if they're retrieved.
+func newStore(ttl time.Duration, algorithm hasher.Algorithm) *Store {
+	return &Store{
+		jobs:      make(map[int64]*replica),
+		last:      make(map[int]int64),
+		ttl:       ttl,
+		algorithm: algorithm,
+		now:       time.Now,
+	}
+}
+
+// Apply applies ops from the owner of the jobs.  Ops for the same job can
+// arrive from different nodes in any order, so a job only ever moves forward
+// from pending to completed to retrieved.
+func (s *Store) Apply(ops []Op) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	for _, op := range ops {
+		node := hasher.NodeOf(op.ID)
+		s.last[node] = max(s.last[node], op.ID)
+
+		r, ok := s.jobs[op.ID]
+		if !ok {
+			r = &replica{state: -1}
+			s.jobs[op.ID] = r
+		}
+		if op.RequestID != "" {
+			r.requestID = op.RequestID
+		}
+
+		switch {
+		case op.Kind == OpSubmitted && r.state < replicaPending:
+			r.state, r.password = replicaPending, op.Password
+		case op.Kind == OpCompleted && r.state < replicaCompleted:
+			r.state, r.password, r.hash, r.err = replicaCompleted, "", op.Hash, op.Error
+		case op.Kind == OpRetrieved && r.state < replicaRetrieved:
+			r.forget()
+		default:
+			continue
+		}
+		r.updated = now
+	}
+}
+
+// LastID returns the last id from node that this store has seen, 0 if none.
+func (s *Store) LastID(node int) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last[node]
+}
+
+// Wait returns straight away.  A job that was still pending when its owner
+// died won't be completed by anyone but Retrieve.
+func (s *Store) Wait(ctx context.Context, id int64) error {
+	return nil
+}
+
+// Retrieve removes and returns the hash for id, computing it if the owner
+// never got to.  A failed job is reported as a *hasher.JobError, and an id
+// the store has no hash for as hasher.ErrGone or hasher.ErrNotFound.
+func (s *Store) Retrieve(ctx context.Context, id int64) (hasher.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.lookup(id)
+	if err != nil {
+		return hasher.Result{}, err
+	}
+	res := hasher.Result{Hash: r.hash, RequestID: r.requestID}
+	if r.state == replicaPending {
+		res.Hash = s.algorithm(r.password)
+	}
+	failure := r.err
+	r.forget()
+	r.updated = s.now()
+
+	if failure != "" {
+		return hasher.Result{RequestID: res.RequestID}, &hasher.JobError{ID: id, Reason: failure}
+	}
+	return res, nil
+}
+
+// Verify reports whether password hashes to the hash for id, leaving it in
+// place.
+func (s *Store) Verify(ctx context.Context, id int64, password string) (bool, error) {
+	s.mu.Lock()
+	r, err := s.lookup(id)
+	var hash, failure, pending string
+	if err == nil {
+		hash, failure = r.hash, r.err
+		if r.state == replicaPending {
+			pending = r.password
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case err != nil:
+		return false, err
+	case failure != "":
+		return false, &hasher.JobError{ID: id, Reason: failure}
+	case pending != "":
+		// Comparing hashes, rather than the passwords themselves, takes
+		// the same time whatever the password
+		hash = s.algorithm(pending)
+	}
+	return subtle.ConstantTimeCompare([]byte(s.algorithm(password)), []byte(hash)) == 1, nil
+}
+
+// lookup returns the job id, if it can still be retrieved.
+func (s *Store) lookup(id int64) (*replica, error) {
+	r, ok := s.jobs[id]
+	if !ok || r.state < replicaPending {
+		return nil, hasher.ErrNotFound
+	}
+	if r.state == replicaCompleted && s.ttl > 0 && s.now().Sub(r.updated) > s.ttl {
+		r.forget()
+	}
+	if r.state == replicaRetrieved {
+		return nil, hasher.ErrGone
+	}
+	return r, nil
+}
+
+// sweep expires completed jobs older than the TTL, and forgets tombstones
+// entirely, at most once a minute.
+func (s *Store) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+
+	for id, r := range s.jobs {
+		switch {
+		case r.state == replicaRetrieved && now.Sub(r.updated) > tombstoneTTL:
+			delete(s.jobs, id)
+		case r.state == replicaCompleted && s.ttl > 0 && now.Sub(r.updated) > s.ttl:
+			r.forget()
+			r.updated = now
+		}
+	}
+}
+
+// forget drops everything about a job but the fact it existed.
+func (r *replica) forget() {
+	r.state, r.password, r.hash, r.err = replicaRetrieved, "", "", ""
+}
@@ -0,0 +1,323 @@
+// Command hashctl talks to a running hash server.
+//
+//	hashctl [-server URL] [-json] [-timeout D] COMMAND [ARGS]
+//
+// The commands are:
+//
+//	submit            Submit a password and print its id
+//	get ID            Print the hash for ID if it is complete
+//	wait ID           Wait for the hash for ID and print it
+//	verify ID         Check a password against the hash for ID
+//	stats [-watch D]  Print the server's stats, refreshing every D
+//	shutdown          Ask the server to shut down
+//
+// Passwords are read from stdin, or prompted for without echo if stdin is a
+// terminal.  They are never taken from the command line, where other users
+// could see them in ps and they would end up in shell history.
+//
+// hashctl exits with status 1 if verify finds the password doesn't match, and
+// 2 for any other error.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/client"
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// defaultServer is used when neither -server nor $HASHCTL_SERVER is set.
+const defaultServer = "http://localhost:8080"
+
+// errMismatch is returned by verify when the password doesn't match.  It has
+// already been reported, so it only sets the exit status.
+var errMismatch = errors.New("password doesn't match")
+
+// app is everything a command needs, so tests can run commands without a
+// terminal or a real stdin and stdout.
+type app struct {
+	client *client.Client
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+
+	// readPassword reads a password, from stdin or a terminal prompt
+	readPassword func() (string, error)
+}
+
+// commands maps each command name to the function that runs it.
+var commands = map[string]func(a *app, ctx context.Context, args []string) error{
+	"submit":   (*app).submit,
+	"get":      (*app).get,
+	"wait":     (*app).wait,
+	"verify":   (*app).verify,
+	"stats":    (*app).stats,
+	"shutdown": (*app).shutdown,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a := &app{stdout: os.Stdout, stderr: os.Stderr}
+	a.readPassword = func() (string, error) {
+		return readPassword(os.Stdin, os.Stderr)
+	}
+
+	switch err := a.run(ctx, os.Args[1:], os.Getenv); {
+	case err == errMismatch:
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "hashctl:", err)
+		os.Exit(2)
+	}
+}
+
+// run parses the global flags and runs the command named by args.
+func (a *app) run(ctx context.Context, args []string, getenv func(string) string) error {
+	fs := flag.NewFlagSet("hashctl", flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	server := fs.String("server", "", "URL of the hash server (default $HASHCTL_SERVER or "+defaultServer+")")
+	fs.BoolVar(&a.json, "json", false, "print JSON instead of text")
+	timeout := fs.Duration("timeout", 0, "give up after this long, 0 for never")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hashctl [flags] submit | get ID | wait ID | verify ID | stats [-watch D] | shutdown")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+
+	if *server == "" {
+		*server = getenv("HASHCTL_SERVER")
+	}
+	if *server == "" {
+		*server = defaultServer
+	}
+	a.client = client.New(*server)
+
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	return command(a, ctx, fs.Args()[1:])
+}
+
+// submit submits a password and prints its id.
+func (a *app) submit(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errors.New("submit reads the password from stdin, not the command line")
+	}
+	password, err := a.readPassword()
+	if err != nil {
+		return err
+	}
+
+	id, err := a.client.Submit(ctx, password)
+	if err != nil {
+		return err
+	}
+	return a.print(struct {
+		ID int64 `json:"id"`
+	}{id}, strconv.FormatInt(id, 10))
+}
+
+// get prints the hash for an id if it is complete.
+func (a *app) get(ctx context.Context, args []string) error {
+	id, err := parseID("get", args)
+	if err != nil {
+		return err
+	}
+	hash, err := a.client.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return a.printHash(id, hash)
+}
+
+// wait waits for the hash for an id and prints it.
+func (a *app) wait(ctx context.Context, args []string) error {
+	id, err := parseID("wait", args)
+	if err != nil {
+		return err
+	}
+	hash, err := a.client.Wait(ctx, id)
+	if err != nil {
+		return err
+	}
+	return a.printHash(id, hash)
+}
+
+// verify checks a password against the hash for an id, leaving the hash to be
+// fetched later.
+func (a *app) verify(ctx context.Context, args []string) error {
+	id, err := parseID("verify", args)
+	if err != nil {
+		return err
+	}
+	password, err := a.readPassword()
+	if err != nil {
+		return err
+	}
+
+	match, err := a.client.Verify(ctx, id, password)
+	if err != nil {
+		return err
+	}
+	text := "match"
+	if !match {
+		text = "mismatch"
+	}
+	if err := a.print(struct {
+		ID    int64 `json:"id"`
+		Match bool  `json:"match"`
+	}{id, match}, text); err != nil {
+		return err
+	}
+	if !match {
+		return errMismatch
+	}
+	return nil
+}
+
+// stats prints the server's stats once, or with -watch, clears the screen and
+// prints them again every interval like top until interrupted.
+func (a *app) stats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	watch := fs.Duration("watch", 0, "refresh every interval, 0 to print once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("stats takes no arguments")
+	}
+
+	for {
+		stats, err := a.client.Stats(ctx)
+		if *watch > 0 && ctx.Err() != nil {
+			// Stopping a refreshing display is how it's meant to end
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if *watch <= 0 {
+			return a.printStats(stats)
+		}
+
+		if !a.json {
+			// Home the cursor and clear the screen
+			fmt.Fprint(a.stdout, "\033[H\033[2J")
+			fmt.Fprintf(a.stdout, "Every %s: %s\n\n", *watch, time.Now().Format(time.TimeOnly))
+		}
+		if err := a.printStats(stats); err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(*watch):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// shutdown asks the server to shut down.
+func (a *app) shutdown(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errors.New("shutdown takes no arguments")
+	}
+	if err := a.client.Shutdown(ctx); err != nil {
+		return err
+	}
+	return a.print(struct {
+		Shutdown bool `json:"shutdown"`
+	}{true}, "shutting down")
+}
+
+// parseID parses the single id argument of a command.
+func parseID(command string, args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("usage: hashctl %s ID", command)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid id %q", args[0])
+	}
+	return id, nil
+}
+
+// print prints v as JSON with -json, and text otherwise.
+func (a *app) print(v interface{}, text string) error {
+	if a.json {
+		return json.NewEncoder(a.stdout).Encode(v)
+	}
+	_, err := fmt.Fprintln(a.stdout, text)
+	return err
+}
+
+func (a *app) printHash(id int64, hash string) error {
+	return a.print(struct {
+		ID   int64  `json:"id"`
+		Hash string `json:"hash"`
+	}{id, hash}, hash)
+}
+
+// printStats prints the stats as JSON with -json, or as a table of the parts
+// an operator is most likely to be looking for.
+func (a *app) printStats(stats hasher.Stats) error {
+	if a.json {
+		return json.NewEncoder(a.stdout).Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(a.stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "algorithm\t%s\t\n", stats.Algorithm)
+	fmt.Fprintf(w, "in flight\t%d\tqueued\t%d\tstored\t%d\t\n", stats.InFlight, stats.Queued, stats.Stored)
+	fmt.Fprintf(w, "total\t%d\tfailed\t%d\t\n", stats.Total, stats.Failed)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "ms\tcount\tmean\tp50\tp90\tp99\tmax\t")
+	for _, stage := range []struct {
+		name string
+		l    hasher.Latencies
+	}{
+		{"queue", stats.Queue},
+		{"simulated", stats.Simulated},
+		{"hash", stats.Hash},
+		{"end to end", stats.EndToEnd},
+	} {
+		l := stage.l
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n", stage.name, l.Count, l.Mean, l.P50, l.P90, l.P99, l.Max)
+	}
+
+	if len(stats.Windows) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "window\trequests/s\tcompleted/s\tfailed\tp99 ms\t")
+		for _, win := range stats.Windows {
+			fmt.Fprintf(w, "%s\t%.2f\t%.2f\t%d\t%.1f\t\n", win.Window, win.RequestRate, win.CompletionRate, win.Failed, win.Latency.P99)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/server"
+)
+
+// newTestServer starts a hash server with no simulated delay, which is shut
+// down when the test ends.
+func newTestServer(t *testing.T) *httptest.Server {
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(server.WithHasher(h))
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		s.Shutdown()
+	})
+	return ts
+}
+
+// hashctl runs a command against ts with password on stdin, returning what it
+// printed.
+func hashctl(t *testing.T, ts *httptest.Server, password string, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	a := &app{
+		stdout:       &stdout,
+		stderr:       &stderr,
+		readPassword: func() (string, error) { return readAll(strings.NewReader(password)) },
+	}
+	getenv := func(key string) string {
+		if key == "HASHCTL_SERVER" {
+			return ts.URL
+		}
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := a.run(ctx, args, getenv)
+	return strings.TrimSpace(stdout.String()), err
+}
+
+func TestHashctl(t *testing.T) {
+	ts := newTestServer(t)
+
+	id, err := hashctl(t, ts, "angryMonkey\n", "submit")
+	if err != nil || id != "1" {
+		t.Fatalf("submit printed %q, %v", id, err)
+	}
+
+	if out, err := hashctl(t, ts, "angryMonkey\n", "verify", id); err != nil || out != "match" {
+		t.Errorf("verify printed %q, %v", out, err)
+	}
+	if out, err := hashctl(t, ts, "happyMonkey\n", "verify", id); err != errMismatch || out != "mismatch" {
+		t.Errorf("verify of the wrong password printed %q, %v", out, err)
+	}
+
+	want := hasher.Compute("angryMonkey")
+	if out, err := hashctl(t, ts, "", "wait", id); err != nil || out != want {
+		t.Errorf("wait printed %q, %v", out, err)
+	}
+	if _, err := hashctl(t, ts, "", "get", id); err == nil {
+		t.Errorf("get of a retrieved hash succeeded")
+	}
+
+	out, err := hashctl(t, ts, "", "stats")
+	if err != nil || !strings.Contains(out, "end to end") {
+		t.Errorf("stats printed %q, %v", out, err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	ts := newTestServer(t)
+
+	out, err := hashctl(t, ts, "angryMonkey", "-json", "submit")
+	var submitted struct{ ID int64 }
+	if err != nil || json.Unmarshal([]byte(out), &submitted) != nil || submitted.ID != 1 {
+		t.Fatalf("submit printed %q, %v", out, err)
+	}
+
+	out, err = hashctl(t, ts, "", "-json", "wait", "1")
+	var waited struct {
+		ID   int64
+		Hash string
+	}
+	if err != nil || json.Unmarshal([]byte(out), &waited) != nil || waited.Hash != hasher.Compute("angryMonkey") {
+		t.Errorf("wait printed %q, %v", out, err)
+	}
+
+	out, err = hashctl(t, ts, "", "-json", "stats")
+	var stats hasher.Stats
+	if err != nil || json.Unmarshal([]byte(out), &stats) != nil || stats.Counters.Retrieved != 1 {
+		t.Errorf("stats printed %q, %v", out, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, args := range [][]string{
+		{},
+		{"frobnicate"},
+		{"submit", "angryMonkey"}, // Passwords never come from argv
+		{"get"},
+		{"get", "x"},
+		{"stats", "extra"},
+	} {
+		if _, err := hashctl(t, ts, "angryMonkey", args...); err == nil {
+			t.Errorf("hashctl %v succeeded", args)
+		}
+	}
+
+	if _, err := hashctl(t, ts, "\n", "submit"); err == nil {
+		t.Errorf("submit of an empty password succeeded")
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	for in, want := range map[string]string{
+		"angryMonkey":          "angryMonkey",
+		"angryMonkey\n":        "angryMonkey",
+		"angryMonkey\r\n":      "angryMonkey",
+		"angry Monkey&%\n\n":   "angry Monkey&%\n",
+		" angryMonkey ":        " angryMonkey ",
+		"password=angryMonkey": "password=angryMonkey",
+	} {
+		if got, err := readAll(strings.NewReader(in)); err != nil || got != want {
+			t.Errorf("readAll(%q) returned %q, %v", in, got, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// readPassword reads a password from in.  If in is a terminal, the password
+// is prompted for on prompt with echo turned off, and ends at the first
+// newline.  Otherwise everything up to EOF is the password, without the final
+// newline, so that `echo password | hashctl submit` does what it looks like.
+func readPassword(in *os.File, prompt io.Writer) (string, error) {
+	if !isTerminal(in) {
+		return readAll(in)
+	}
+
+	// The standard library has no way to turn off echo, and pulling in
+	// golang.org/x/term for it isn't worth it when stty is everywhere a
+	// terminal is.
+	if err := stty(in, "-echo"); err != nil {
+		return "", fmt.Errorf("can't turn off echo to prompt for the password, pipe it in instead: %w", err)
+	}
+
+	// An interrupt would only cancel a context nobody is waiting on yet,
+	// leaving us stuck at the prompt, so handle it here and put echo back.
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(interrupted)
+		close(interrupted)
+	}()
+	go func() {
+		if _, ok := <-interrupted; ok {
+			stty(in, "echo")
+			fmt.Fprintln(prompt)
+			os.Exit(2)
+		}
+	}()
+
+	fmt.Fprint(prompt, "Password: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	fmt.Fprintln(prompt)
+	stty(in, "echo")
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return checkPassword(strings.TrimRight(line, "\r\n"))
+}
+
+// readAll reads a password from a pipe or file.
+func readAll(r io.Reader) (string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimSuffix(string(b), "\n")
+	return checkPassword(strings.TrimSuffix(password, "\r"))
+}
+
+// checkPassword rejects an empty password here rather than sending it to the
+// server to be rejected.
+func checkPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("no password supplied")
+	}
+	return password, nil
+}
+
+// isTerminal returns true if f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty changes a setting of the terminal f.
+func stty(f *os.File, setting string) error {
+	cmd := exec.Command("stty", setting)
+	cmd.Stdin = f
+	return cmd.Run()
+}
@@ -0,0 +1,476 @@
+// Package config assembles the hash server's configuration from defaults, a
+// JSON config file, environment variables and command line flags.
+//
+// Every setting can be supplied in each of the three places, with later ones
+// taking precedence:
+//
+//	config file:  {"workers": 8}
+//	environment:  HASH_SERVER_WORKERS=8
+//	flag:         --workers 8
+//
+// The config file itself is named with --config or HASH_SERVER_CONFIG.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/cluster"
+	"github.com/jaredcantwell/hash-server/consensus"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+	"github.com/jaredcantwell/hash-server/raft"
+)
+
+// envPrefix is prepended to the upper-cased setting name to form the name of
+// its environment variable.
+const envPrefix = "HASH_SERVER_"
+
+// Config is the complete configuration of the hash server.
+type Config struct {
+	Port           int           // Port to listen on for REST requests
+	AdminAddr      string        // Address for the admin diagnostics listener, "" for none
+	LogLevel       slog.Level    // Least severe level that is logged
+	LogOutput      string        // Where logs go: stderr, stdout or a file path
+	Trace          string        // Where trace spans go: off, a file path or a collector URL
+	AuditLog       string        // Path of the audit log, "" for none
+	Record         string        // Path to record the shape of requests to, "" for none
+	WorkerToken    string        // Token remote workers must present, required with Remote
+	Peers          string        // Every node of the cluster, see cluster.ParseNodes, "" to stand alone
+	ClusterRouting string        // How requests for other nodes' ids are sent there: forward or redirect
+	Replicas       int           // How many other nodes keep a copy of each node's jobs
+	ReplicationAck string        // How many replicas must have a job before its id is handed out: none, one or all
+	ClusterToken   string        // Token the nodes replicate to each other with, required with Replicas or Consensus
+	Consensus      string        // Directory of the consensus log the peers share, "" for none
+	ConsensusPeers string        // Where the peers reach each other's consensus listeners, in the form of Peers
+	ConsensusAddr  string        // Address for this node's consensus listener
+	Hasher         hasher.Config // Tuning for the AsyncHasher
+	Chaos          chaos.Config  // Faults injected into the AsyncHasher, off by default
+}
+
+// Default returns the configuration used when nothing else is supplied.
+func Default() Config {
+	return Config{
+		Port:           8080,
+		LogLevel:       slog.LevelInfo,
+		LogOutput:      "stderr",
+		Trace:          "off",
+		ClusterRouting: "forward",
+		ReplicationAck: "one",
+		Hasher:         hasher.DefaultConfig(),
+	}
+}
+
+// setting describes a single configuration value and how to convert it to and
+// from the string form used by flags, environment variables and reports.
+type setting struct {
+	name  string
+	usage string
+	get   func(c *Config) string
+	set   func(c *Config, v string) error
+}
+
+// settings lists every configurable value.  Adding a setting here makes it
+// available everywhere.
+var settings = []setting{
+	{"port", "port number on which to start listening for REST requests",
+		func(c *Config) string { return strconv.Itoa(c.Port) },
+		func(c *Config, v string) error { return setInt(&c.Port, v) }},
+	{"admin-addr", "address for the admin listener serving expvar, pprof and the job dump, e.g. 127.0.0.1:6060, or empty for none",
+		func(c *Config) string { return c.AdminAddr },
+		func(c *Config, v string) error { c.AdminAddr = v; return nil }},
+	{"log-level", "least severe level to log: debug, info, warn or error.  Job events are logged at debug.",
+		func(c *Config) string { return strings.ToLower(c.LogLevel.String()) },
+		func(c *Config, v string) (err error) { c.LogLevel, err = logging.ParseLevel(v); return }},
+	{"log-output", "where to write the JSON logs: stderr, stdout or a file path",
+		func(c *Config) string { return c.LogOutput },
+		func(c *Config, v string) error { c.LogOutput = v; return nil }},
+	{"trace", "where to export trace spans as OTLP JSON: off, a file path, or a collector URL such as http://localhost:4318/v1/traces",
+		func(c *Config) string { return c.Trace },
+		func(c *Config, v string) error { c.Trace = v; return nil }},
+	{"audit-log", "path of the tamper-evident audit log of who submitted and retrieved each job, or empty for none",
+		func(c *Config) string { return c.AuditLog },
+		func(c *Config, v string) error { c.AuditLog = v; return nil }},
+	{"record", "path of a file to record the timing and shape of every request to, for hash-server replay, or empty for none.  Passwords are not recorded.",
+		func(c *Config) string { return c.Record },
+		func(c *Config, v string) error { c.Record = v; return nil }},
+	{"node-id", "this server's node id in a cluster, 0 to 1023, which goes in the top bits of every id it issues",
+		func(c *Config) string { return strconv.Itoa(c.Hasher.Node) },
+		func(c *Config, v string) error { return setInt(&c.Hasher.Node, v) }},
+	{"peers", "every node of the cluster, this one included, e.g. 1=http://10.0.0.1:8080,2=http://10.0.0.2:8080, or empty to stand alone",
+		func(c *Config) string { return c.Peers },
+		func(c *Config, v string) error { c.Peers = v; return nil }},
+	{"cluster-routing", "how a request for an id issued by another node is sent there: forward, or redirect the client",
+		func(c *Config) string { return c.ClusterRouting },
+		func(c *Config, v string) error { c.ClusterRouting = v; return nil }},
+	{"replicas", "how many other nodes of the cluster keep a copy of each node's jobs, so their hashes survive it, 0 for none",
+		func(c *Config) string { return strconv.Itoa(c.Replicas) },
+		func(c *Config, v string) error { return setInt(&c.Replicas, v) }},
+	{"replication-ack", "how many replicas must have a job before its id is handed out: none, one or all",
+		func(c *Config) string { return c.ReplicationAck },
+		func(c *Config, v string) error { c.ReplicationAck = v; return nil }},
+	{"cluster-token", "token the nodes of the cluster present to each other when replicating or writing the consensus log, required with either",
+		func(c *Config) string { return redact(c.ClusterToken) },
+		func(c *Config, v string) error { c.ClusterToken = v; return nil }},
+	{"consensus-dir", "directory to keep this node's copy of a consensus log in, which the peers elect a leader to write, so every node has every job.  Only the leader accepts hashes, the others redirect to it.  Empty for none.",
+		func(c *Config) string { return c.Consensus },
+		func(c *Config, v string) error { c.Consensus = v; return nil }},
+	{"consensus-peers", "where the peers reach each other's consensus listeners, by node id as in peers, e.g. 1=http://10.0.0.1:9090,2=http://10.0.0.2:9090.  Required with consensus-dir.",
+		func(c *Config) string { return c.ConsensusPeers },
+		func(c *Config, v string) error { c.ConsensusPeers = v; return nil }},
+	{"consensus-addr", "address for the listener the other peers write the consensus log through, e.g. :9090, kept off the public port.  Required with consensus-dir.",
+		func(c *Config) string { return c.ConsensusAddr },
+		func(c *Config, v string) error { c.ConsensusAddr = v; return nil }},
+	{"hasher", "hasher implementation, one of: " + strings.Join(hasher.Implementations(), ", "),
+		func(c *Config) string { return c.Hasher.Implementation },
+		func(c *Config, v string) error { c.Hasher.Implementation = v; return nil }},
+	{"workers", "number of hashing workers, 0 for a goroutine per hash",
+		func(c *Config) string { return strconv.Itoa(c.Hasher.Workers) },
+		func(c *Config, v string) error { return setInt(&c.Hasher.Workers, v) }},
+	{"queue-depth", "hashes that may wait for a busy worker before new ones are refused",
+		func(c *Config) string { return strconv.Itoa(c.Hasher.QueueDepth) },
+		func(c *Config, v string) error { return setInt(&c.Hasher.QueueDepth, v) }},
+	{"delay", "simulated work performed before each hash",
+		func(c *Config) string { return c.Hasher.Delay.String() },
+		func(c *Config, v string) error { return setDuration(&c.Hasher.Delay, v) }},
+	{"latency", "latency profile for the simulated work, overriding --delay, e.g. normal:5s,1s+stall:0.01,30s",
+		func(c *Config) string { return c.Hasher.Latency },
+		func(c *Config, v string) error { c.Hasher.Latency = v; return nil }},
+	{"seed", "seed for random latency profiles, 0 for a different seed every run",
+		func(c *Config) string { return strconv.FormatInt(c.Hasher.Seed, 10) },
+		func(c *Config, v string) error {
+			seed, err := strconv.ParseInt(v, 10, 64)
+			c.Hasher.Seed = seed
+			return err
+		}},
+	{"ttl", "how long completed hashes are kept waiting for retrieval, 0 to keep forever",
+		func(c *Config) string { return c.Hasher.TTL.String() },
+		func(c *Config, v string) error { return setDuration(&c.Hasher.TTL, v) }},
+	{"algorithm", "hash algorithm, one of: " + strings.Join(hasher.Algorithms(), ", "),
+		func(c *Config) string { return c.Hasher.Algorithm },
+		func(c *Config, v string) error { c.Hasher.Algorithm = v; return nil }},
+	{"remote-workers", "leave the hashing to hash-server worker processes, which lease jobs from a queue of --queue-depth.  --workers must be 0.",
+		func(c *Config) string { return strconv.FormatBool(c.Hasher.Remote) },
+		func(c *Config, v string) error { return setBool(&c.Hasher.Remote, v) }},
+	{"lease-ttl", "how long a remote worker may hold a job without a heartbeat before it is given to another",
+		func(c *Config) string { return c.Hasher.LeaseTTL.String() },
+		func(c *Config, v string) error { return setDuration(&c.Hasher.LeaseTTL, v) }},
+	{"worker-token", "token remote workers must present as a bearer token, required with remote-workers",
+		func(c *Config) string { return redact(c.WorkerToken) },
+		func(c *Config, v string) error { c.WorkerToken = v; return nil }},
+	{"chaos", "faults to inject into the hasher, e.g. fail=0.1,drop=0.05,loop-delay=50ms, or off",
+		func(c *Config) string { return c.Chaos.String() },
+		func(c *Config, v string) (err error) { c.Chaos, err = chaos.Parse(v); return }},
+}
+
+// Loader parses command line flags and remembers them, so that the
+// configuration can be loaded again later (on SIGHUP) with the same flags
+// still taking precedence over the file and environment.
+type Loader struct {
+	flags    *flag.FlagSet
+	values   map[string]*string
+	path     *string
+	getenv   func(string) string
+	explicit map[string]bool
+}
+
+// NewLoader registers a flag for every setting, plus --config, on fs.
+// getenv is normally os.Getenv.
+func NewLoader(fs *flag.FlagSet, getenv func(string) string) *Loader {
+	l := &Loader{
+		flags:  fs,
+		values: make(map[string]*string),
+		getenv: getenv,
+	}
+
+	defaults := Default()
+	for _, s := range settings {
+		l.values[s.name] = fs.String(s.name, s.get(&defaults), s.usage)
+	}
+	l.path = fs.String("config", "", "path to a JSON config file")
+
+	return l
+}
+
+// Parse parses the command line arguments.
+func (l *Loader) Parse(args []string) error {
+	if err := l.flags.Parse(args); err != nil {
+		return err
+	}
+
+	l.explicit = make(map[string]bool)
+	l.flags.Visit(func(f *flag.Flag) {
+		l.explicit[f.Name] = true
+	})
+	return nil
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the flags, in that order of increasing precedence.  It can
+// be called repeatedly to pick up changes to the file or environment.
+func (l *Loader) Load() (Config, error) {
+	c := Default()
+
+	path := l.getenv(envPrefix + "CONFIG")
+	if l.explicit["config"] {
+		path = *l.path
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return c, err
+		}
+	}
+
+	for _, s := range settings {
+		env := envName(s.name)
+		if v := l.getenv(env); v != "" {
+			if err := s.set(&c, v); err != nil {
+				return c, fmt.Errorf("%s: %v", env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if l.explicit[s.name] {
+			if err := s.set(&c, *l.values[s.name]); err != nil {
+				return c, fmt.Errorf("--%s: %v", s.name, err)
+			}
+		}
+	}
+
+	if err := c.Hasher.Validate(); err != nil {
+		return c, err
+	}
+	// Leases carry passwords, so they're never handed to just anyone
+	if c.Hasher.Remote && c.WorkerToken == "" {
+		return c, fmt.Errorf("remote workers need a worker-token, since leases carry passwords")
+	}
+	if _, err := c.Cluster(nil); err != nil {
+		return c, err
+	}
+	if _, err := c.ConsensusConfig(nil); err != nil {
+		return c, err
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return c, fmt.Errorf("invalid port %d", c.Port)
+	}
+
+	return c, nil
+}
+
+// Cluster builds this node's view of the cluster, logging to logger, or
+// returns nil if it stands alone.  It's also nil if the peers share a
+// consensus log, since then every node has every job and there's nothing to
+// route or replicate.
+func (c Config) Cluster(logger *slog.Logger) (*cluster.Cluster, error) {
+	routing, err := cluster.ParseRouting(c.ClusterRouting)
+	if err != nil {
+		return nil, err
+	}
+	ack, err := cluster.ParseAck(c.ReplicationAck)
+	if err != nil {
+		return nil, err
+	}
+	if c.Peers == "" {
+		if c.Replicas != 0 {
+			return nil, fmt.Errorf("replicas need peers to replicate to: %d", c.Replicas)
+		}
+		return nil, nil
+	}
+	if c.Consensus != "" {
+		return nil, nil
+	}
+	nodes, err := cluster.ParseNodes(c.Peers)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.New(cluster.Config{
+		Self:      c.Hasher.Node,
+		Nodes:     nodes,
+		Routing:   routing,
+		Replicas:  c.Replicas,
+		Ack:       ack,
+		Token:     c.ClusterToken,
+		TTL:       c.Hasher.TTL,
+		Algorithm: c.Hasher.Algorithm,
+		Logger:    logger,
+	})
+}
+
+// ConsensusConfig returns the configuration of this node's part in the
+// consensus log, logging to logger, or nil if there isn't one.  The consensus
+// peers are its members, the peers are where clients are sent to reach the
+// leader, and the node id says which one this is.
+func (c Config) ConsensusConfig(logger *slog.Logger) (*consensus.Config, error) {
+	if c.Consensus == "" {
+		return nil, nil
+	}
+	if c.Peers == "" {
+		return nil, fmt.Errorf("a consensus log needs peers to share it with: %s", c.Consensus)
+	}
+	if c.Replicas != 0 {
+		return nil, fmt.Errorf("every node has every job with a consensus log, so replicas must be 0: %d", c.Replicas)
+	}
+	// A peer that could write to the log could forge ids and results, or
+	// win an election, so the peers only talk to each other, with a token
+	if c.ConsensusPeers == "" || c.ConsensusAddr == "" {
+		return nil, fmt.Errorf("a consensus log needs consensus-peers and a consensus-addr to listen on: %s", c.Consensus)
+	}
+	if c.ClusterToken == "" {
+		return nil, fmt.Errorf("a consensus log needs a cluster-token: %s", c.Consensus)
+	}
+	nodes, err := cluster.ParseNodes(c.Peers)
+	if err != nil {
+		return nil, err
+	}
+	raftNodes, err := cluster.ParseNodes(c.ConsensusPeers)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make(map[int]string)
+	for _, n := range nodes {
+		urls[n.ID] = n.URL
+	}
+	if len(raftNodes) != len(nodes) {
+		return nil, fmt.Errorf("consensus-peers must have the same nodes as peers: %s", c.ConsensusPeers)
+	}
+	members := make([]raft.Member, len(raftNodes))
+	for i, n := range raftNodes {
+		if _, ok := urls[n.ID]; !ok {
+			return nil, fmt.Errorf("consensus-peers must have the same nodes as peers: %s", c.ConsensusPeers)
+		}
+		members[i] = raft.Member{ID: n.ID, URL: n.URL}
+	}
+	if _, ok := urls[c.Hasher.Node]; !ok {
+		return nil, fmt.Errorf("node %d is not one of the peers", c.Hasher.Node)
+	}
+	return &consensus.Config{
+		Node:    c.Hasher.Node,
+		Members: members,
+		URLs:    urls,
+		Dir:     c.Consensus,
+		Token:   c.ClusterToken,
+		Logger:  logger,
+	}, nil
+}
+
+// loadFile applies the settings from a JSON config file.  The file is a
+// single object whose keys are setting names.  Values may be JSON strings or
+// numbers, in the same form as the flags.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var values map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	for name, value := range values {
+		s, ok := lookup(name)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if err := s.set(c, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// Report returns every setting in its string form, keyed by name.  This is
+// what gets logged at startup and served by the admin endpoint.
+func (c Config) Report() map[string]string {
+	report := make(map[string]string)
+	for _, s := range settings {
+		report[s.name] = s.get(&c)
+	}
+	return report
+}
+
+// String returns the report as a single line of name=value pairs.
+func (c Config) String() string {
+	pairs := make([]string, len(settings))
+	for i, s := range settings {
+		pairs[i] = s.name + "=" + s.get(&c)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Diff returns the names of the settings that differ between c and other.
+func (c Config) Diff(other Config) []string {
+	var changed []string
+	for _, s := range settings {
+		if s.get(&c) != s.get(&other) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
+
+// lookup finds a setting by name.
+func lookup(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// envName returns the environment variable for a setting.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func setInt(dst *int, v string) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = i
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+func setDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*dst = d
+	return nil
+}
+
+// redact hides a secret setting from the report, which is logged and served
+// by the admin endpoint, while still showing whether it is set.  Changing the
+// secret to another one won't be picked up by Diff, but it can't be applied
+// without a restart anyway.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "redacted"
+}
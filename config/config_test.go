@@ -0,0 +1,138 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// load runs a Loader with the supplied arguments and environment.
+func load(t *testing.T, args []string, env map[string]string) (Config, error) {
+	l := NewLoader(flag.NewFlagSet("test", flag.ContinueOnError), func(name string) string {
+		return env[name]
+	})
+	if err := l.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return l.Load()
+}
+
+// TestDefaults verifies that no configuration gives the defaults.
+func TestDefaults(t *testing.T) {
+	c, err := load(t, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("got %s, want %s", c, Default())
+	}
+}
+
+// TestPrecedence verifies flags beat the environment, which beats the file.
+func TestPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"port": 9000, "workers": 4, "delay": "1s", "hasher": "mutex"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := load(t, []string{"--config", path, "--workers", "8"}, map[string]string{
+		"HASH_SERVER_DELAY":       "250ms",
+		"HASH_SERVER_WORKERS":     "6",
+		"HASH_SERVER_QUEUE_DEPTH": "100",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.Port = 9000
+	want.Hasher.Implementation = "mutex"
+	want.Hasher.Workers = 8
+	want.Hasher.QueueDepth = 100
+	want.Hasher.Delay = 250 * time.Millisecond
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %s\nwant %s", c, want)
+	}
+
+	if diff := c.Diff(Default()); len(diff) != 5 {
+		t.Errorf("Diff() = %v", diff)
+	}
+}
+
+// TestInvalid verifies that bad values are reported rather than ignored.
+func TestInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"bogus": 1}`), 0600)
+
+	for _, tc := range []struct {
+		args []string
+		env  map[string]string
+	}{
+		{[]string{"--delay", "soon"}, nil},
+		{[]string{"--hasher", "bogus"}, nil},
+		{[]string{"--port", "70000"}, nil},
+		{[]string{"--chaos", "fail=2"}, nil},
+		{[]string{"--log-level", "loud"}, nil},
+		{[]string{"--remote-workers", "maybe"}, nil},
+		{[]string{"--remote-workers", "true"}, nil},
+		{[]string{"--remote-workers", "true", "--queue-depth", "10"}, nil},
+		{[]string{"--node-id", "1024"}, nil},
+		{[]string{"--cluster-routing", "teleport"}, nil},
+		{[]string{"--node-id", "3", "--peers", "1=http://a:8080,2=http://b:8080"}, nil},
+		{[]string{"--replicas", "1"}, nil},
+		{[]string{"--node-id", "1", "--peers", "1=http://a:8080,2=http://b:8080", "--replicas", "2"}, nil},
+		{[]string{"--node-id", "1", "--peers", "1=http://a:8080,2=http://b:8080", "--replicas", "1"}, nil},
+		{[]string{"--replication-ack", "most"}, nil},
+		{[]string{"--consensus-dir", "/var/lib/hash-server"}, nil},
+		{[]string{"--node-id", "3", "--peers", "1=http://a:8080,2=http://b:8080", "--consensus-dir", "/var/lib/hash-server", "--consensus-peers", "1=http://a:9090,2=http://b:9090", "--consensus-addr", ":9090", "--cluster-token", "sesame"}, nil},
+		{[]string{"--node-id", "1", "--peers", "1=http://a:8080,2=http://b:8080", "--replicas", "1", "--consensus-dir", "/var/lib/hash-server", "--consensus-peers", "1=http://a:9090,2=http://b:9090", "--consensus-addr", ":9090", "--cluster-token", "sesame"}, nil},
+		{[]string{"--node-id", "1", "--peers", "1=http://a:8080,2=http://b:8080", "--consensus-dir", "/var/lib/hash-server", "--consensus-peers", "1=http://a:9090,2=http://b:9090", "--consensus-addr", ":9090"}, nil},
+		{[]string{"--node-id", "1", "--peers", "1=http://a:8080,2=http://b:8080", "--consensus-dir", "/var/lib/hash-server", "--cluster-token", "sesame"}, nil},
+		{[]string{"--node-id", "1", "--peers", "1=http://a:8080,2=http://b:8080", "--consensus-dir", "/var/lib/hash-server", "--consensus-peers", "1=http://a:9090,3=http://c:9090", "--consensus-addr", ":9090", "--cluster-token", "sesame"}, nil},
+		{nil, map[string]string{"HASH_SERVER_WORKERS": "many"}},
+		{nil, map[string]string{"HASH_SERVER_CONFIG": path}},
+	} {
+		if _, err := load(t, tc.args, tc.env); err == nil {
+			t.Errorf("%v %v: expected an error", tc.args, tc.env)
+		}
+	}
+}
+
+// TestConsensus verifies that the consensus peers become the members of the
+// consensus log, that clients are sent to the peers, and that there's no
+// cluster to route or replicate with besides.
+func TestConsensus(t *testing.T) {
+	c, err := load(t, []string{"--node-id", "2", "--peers", "1=http://a:8080,2=http://b:8080,3=http://c:8080",
+		"--consensus-dir", "/var/lib/hash-server", "--consensus-peers", "1=http://a:9090,2=http://b:9090,3=http://c:9090",
+		"--consensus-addr", ":9090", "--cluster-token", "sesame"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := c.ConsensusConfig(nil)
+	if err != nil || cc.Node != 2 || len(cc.Members) != 3 || cc.Members[2].URL != "http://c:9090" || cc.URLs[3] != "http://c:8080" ||
+		cc.Dir != "/var/lib/hash-server" || cc.Token != "sesame" || c.ConsensusAddr != ":9090" {
+		t.Errorf("ConsensusConfig() = %+v, %v", cc, err)
+	}
+	if cl, err := c.Cluster(nil); cl != nil || err != nil {
+		t.Errorf("Cluster() = %v, %v with a consensus log", cl, err)
+	}
+}
+
+// TestWorkerToken verifies that the worker token is kept out of the report.
+func TestWorkerToken(t *testing.T) {
+	c, err := load(t, []string{"--remote-workers", "true", "--queue-depth", "10"},
+		map[string]string{"HASH_SERVER_WORKER_TOKEN": "sesame"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Hasher.Remote || c.WorkerToken != "sesame" {
+		t.Errorf("got %+v", c)
+	}
+	if report := c.Report(); report["worker-token"] != "redacted" {
+		t.Errorf("report shows the worker token as %q", report["worker-token"])
+	}
+}
@@ -0,0 +1,653 @@
+// Package consensus keeps the hash server's jobs in a Raft log shared by
+// every node of a cluster, so that the cluster behaves like a single server
+// that survives any minority of its nodes failing.
+//
+// Replication, see package cluster, copies each node's jobs to others on a
+// best effort basis, and a node that takes over for another may be missing
+// the last few of them.  Here nothing is acknowledged until a majority has
+// it: ids, results and the stats all come from the log, which every node
+// applies in the same order.  The price is that only the leader can accept
+// hashes, retrieve them, or verify passwords, and the other nodes send
+// clients to it with hasher.NotLeaderError.
+//
+// Passwords never go in the log.  The leader that accepts a password hashes
+// it with a hasher of its own, and records only the outcome.  If that leader
+// fails before it does, the password is gone with it, so the next leader
+// records those jobs as failed.
+package consensus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/raft"
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// proposeTimeout is how long the leader waits for a result to be committed
+// before giving up on it.
+const proposeTimeout = 10 * time.Second
+
+// replacedReason is why a job fails when the leader that accepted it is
+// replaced before it finished.
+const replacedReason = "the leader that accepted it was replaced before the hash was computed"
+
+// Config configures the consensus log.
+type Config struct {
+	Node    int           // This node's id, which must be one of Members
+	Members []raft.Member // Every node of the cluster, this one included, where the others reach its raft.Handler
+	Dir     string        // Directory to keep the log in, see raft.FileStorage.  "" keeps it in memory.
+	Token   string        // Token the nodes present to each other
+
+	// URLs says where clients reach each node, by id, so that they can be
+	// sent to the leader.  A node that isn't in it is reached at its
+	// member URL, which is only right if its raft.Handler shares the port.
+	URLs map[int]string
+
+	// Transport carries messages between the nodes.  nil uses
+	// raft.HTTPTransport with Token, which is then required.  A node that
+	// took messages from anyone could be sent forged jobs and results, or
+	// voted out by a stranger.
+	Transport raft.Transport
+
+	ElectionTimeout   time.Duration // See raft.Config, 0 for the default
+	HeartbeatInterval time.Duration
+	SnapshotEntries   uint64
+
+	// Logger receives leadership changes.  nil logs nothing.
+	Logger *slog.Logger
+
+	// New creates the hasher the leader hashes passwords with.  nil uses
+	// hasher.New.
+	New func(cfg hasher.Config) (hasher.AsyncHasher, error)
+}
+
+// Hasher is an AsyncHasher whose jobs are kept in a Raft log.  On the leader,
+// it hashes with another AsyncHasher, and on every node it answers Wait,
+// Stats and Jobs from the log.
+type Hasher struct {
+	cfg       hasher.Config
+	inner     hasher.AsyncHasher // Hashes the passwords this node accepted as leader
+	node      *raft.Node
+	machine   *machine
+	storage   *raft.FileStorage // nil if the log is in memory
+	self      int
+	urls      map[int]string // Where clients reach each node, see Config.URLs
+	run       string         // Tells this process's tickets from those of earlier runs
+	clock     hasher.Clock
+	algorithm hasher.Algorithm
+	log       *slog.Logger
+
+	paused   int32  // atomic, 0 while accepting work, 1 paused, 2 drained
+	rejected uint64 // atomic count of hashes refused while paused
+
+	mu         sync.Mutex
+	computing  map[int64]int64            // Inner id to log id of the jobs being hashed here, 0 if the submission was lost
+	early      map[int64]hasher.JobResult // Inner id to results whose submission isn't applied yet
+	unsent     map[int64]hasher.JobResult // Log id to results that couldn't be committed before leadership changed
+	base       hasher.Counters            // The counters as of ResetStats
+	closed     bool                       // Set by Drain, after which no more results are committed
+	completing sync.WaitGroup             // Results being committed
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	expiry   sync.WaitGroup
+}
+
+// New creates a Hasher, and starts this node of the log.  Hashes are computed
+// as cfg describes.  cfg.TTL applies to results in the log, and
+// cfg.OnComplete isn't called, since the log does what it is for.
+func New(cfg hasher.Config, c Config) (*Hasher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Transport == nil && c.Token == "" {
+		return nil, errors.New("the nodes of a consensus log need a token")
+	}
+	algorithm, err := hasher.LookupAlgorithm(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hasher{
+		cfg:       cfg,
+		self:      c.Node,
+		urls:      c.URLs,
+		run:       newRun(),
+		clock:     cfg.Clock,
+		algorithm: algorithm,
+		log:       c.Logger,
+		computing: make(map[int64]int64),
+		early:     make(map[int64]hasher.JobResult),
+		unsent:    make(map[int64]hasher.JobResult),
+		stop:      make(chan struct{}),
+	}
+	if h.clock == nil {
+		h.clock = hasher.RealClock{}
+	}
+	if h.log == nil {
+		h.log = slog.New(slog.DiscardHandler)
+	}
+	h.machine = newMachine(h.submitted, h.expired)
+
+	// The inner hasher's results are handed over to the log as soon as
+	// they're done, so it needn't keep them.  Its ids are its own, and it
+	// discards every result once the log has it, so only the log reports
+	// discards.
+	inner := cfg
+	inner.TTL = 0
+	inner.LastID = 0
+	inner.OnComplete = h.computed
+	inner.OnDiscard = nil
+	build := c.New
+	if build == nil {
+		build = hasher.New
+	}
+	if h.inner, err = build(inner); err != nil {
+		return nil, err
+	}
+
+	storage := raft.Storage(raft.NewMemoryStorage())
+	if c.Dir != "" {
+		if h.storage, err = raft.OpenFileStorage(c.Dir); err != nil {
+			h.inner.Drain()
+			return nil, err
+		}
+		storage = h.storage
+	}
+	transport := c.Transport
+	if transport == nil {
+		transport = &raft.HTTPTransport{Token: c.Token}
+	}
+
+	h.node, err = raft.New(raft.Config{
+		ID:                c.Node,
+		Members:           c.Members,
+		StateMachine:      h.machine,
+		Storage:           storage,
+		Transport:         transport,
+		ElectionTimeout:   c.ElectionTimeout,
+		HeartbeatInterval: c.HeartbeatInterval,
+		SnapshotEntries:   c.SnapshotEntries,
+		Logger:            c.Logger,
+		OnLead:            h.lead,
+	})
+	if err != nil {
+		h.inner.Drain()
+		if h.storage != nil {
+			h.storage.Close()
+		}
+		return nil, err
+	}
+	h.node.Start()
+
+	if cfg.TTL > 0 {
+		h.expiry.Add(1)
+		go h.expire()
+	}
+	return h, nil
+}
+
+// Node returns this node of the log, to serve raft.Handler and its status.
+func (h *Hasher) Node() *raft.Node {
+	return h.node
+}
+
+// Compute accepts a password to hash, if this node is the leader.
+func (h *Hasher) Compute(password string) (int64, error) {
+	return h.ComputeContext(context.Background(), password)
+}
+
+// ComputeContext accepts a password to hash, if this node is the leader, and
+// returns its id once a majority of the nodes have it.  The password is
+// hashed here, and only the result goes in the log.
+func (h *Hasher) ComputeContext(ctx context.Context, password string) (int64, error) {
+	if atomic.LoadInt32(&h.paused) != 0 {
+		atomic.AddUint64(&h.rejected, 1)
+		return 0, hasher.ErrPaused
+	}
+	// Don't hash anything that can't be submitted
+	if err := h.leaderCheck(); err != nil {
+		return 0, err
+	}
+
+	innerID, err := h.inner.ComputeContext(ctx, password)
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := command{Op: opSubmit, Ticket: ticket{h.self, h.run, innerID}, Time: h.clock.Now()}
+	if req, ok := trace.FromContext(ctx); ok {
+		cmd.RequestID = req.ID
+	}
+	value, err := h.propose(ctx, cmd)
+	if err != nil {
+		var notLeader *hasher.NotLeaderError
+		if errors.As(err, &notLeader) {
+			// It's certain the submission never made it into the log, so
+			// the hash is of no use to anyone.  Otherwise, such as when ctx
+			// is done, it may yet, and submitted will find the hash.
+			h.abandon(innerID)
+		}
+		return 0, err
+	}
+	return value.(int64), nil
+}
+
+// GetAndRemoveHash retrieves the hash for id.
+func (h *Hasher) GetAndRemoveHash(id int64) (string, error) {
+	res, err := h.Retrieve(context.Background(), id)
+	return res.Hash, err
+}
+
+// Retrieve hands over the result for id, if this node is the leader, and
+// records in the log that it's gone.
+func (h *Hasher) Retrieve(ctx context.Context, id int64) (hasher.Result, error) {
+	if err := h.leaderCheck(); err != nil {
+		return hasher.Result{}, err
+	}
+
+	// This node might no longer be the leader without knowing it, or not
+	// have applied the latest entries yet, so what it has only counts once a
+	// barrier says it's up to date.  A result that's there is retrieved
+	// through the log, which makes the same check.
+	if _, err := h.machine.result(id); err != nil {
+		if err := h.node.Barrier(ctx); err != nil {
+			return hasher.Result{}, h.convert(err)
+		}
+		if _, err := h.machine.result(id); err != nil {
+			return hasher.Result{}, err
+		}
+	}
+
+	value, err := h.propose(ctx, command{Op: opRetrieve, ID: id, Time: h.clock.Now()})
+	if err != nil {
+		return hasher.Result{}, err
+	}
+	r := value.(retrieval)
+	return r.result, r.err
+}
+
+// Wait blocks until job id isn't pending, by this node's copy of the log.
+func (h *Hasher) Wait(ctx context.Context, id int64) error {
+	return h.machine.wait(ctx, id)
+}
+
+// Verify checks password against the hash for id, if this node is the
+// leader, without using up the result.
+func (h *Hasher) Verify(ctx context.Context, id int64, password string) (bool, error) {
+	if err := h.node.Barrier(ctx); err != nil {
+		return false, h.convert(err)
+	}
+	j, err := h.machine.result(id)
+	if err != nil {
+		return false, err
+	}
+	if j.Error != "" {
+		return false, &hasher.JobError{ID: id, Reason: j.Error}
+	}
+	return subtle.ConstantTimeCompare([]byte(h.algorithm(password)), []byte(j.Hash)) == 1, nil
+}
+
+// Stats returns the stats of the inner hasher, with the totals, counters and
+// gauges taken from the log, so every node reports the same for those.  The
+// latencies are only of the hashes computed here.
+func (h *Hasher) Stats() hasher.Stats {
+	s := h.inner.Stats()
+	counters, pending, stored := h.machine.counts()
+
+	h.mu.Lock()
+	base := h.base
+	h.mu.Unlock()
+
+	s.Total = counters.Completed - base.Completed
+	s.Failed = counters.Failed - base.Failed
+	counters.Rejected = s.Counters.Rejected + atomic.LoadUint64(&h.rejected)
+	s.Counters = counters
+	s.InFlight = max(pending-int64(s.Queued), 0)
+	s.Stored = stored
+	return s
+}
+
+// ResetStats starts the totals over on this node.
+func (h *Hasher) ResetStats() {
+	h.inner.ResetStats()
+	counters, _, _ := h.machine.counts()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.base = counters
+}
+
+// Pause stops accepting new hashes until Resume is called.
+func (h *Hasher) Pause() {
+	atomic.CompareAndSwapInt32(&h.paused, 0, 1)
+	h.inner.Pause()
+}
+
+// Resume undoes Pause, unless the hasher has been drained.
+func (h *Hasher) Resume() {
+	if atomic.CompareAndSwapInt32(&h.paused, 1, 0) {
+		h.inner.Resume()
+	}
+}
+
+// Probe checks that the inner hasher is responsive, and reports the pending
+// and stored jobs from the log.
+func (h *Hasher) Probe(timeout time.Duration) (hasher.Health, error) {
+	health, err := h.inner.Probe(timeout)
+	if err != nil {
+		return health, err
+	}
+	_, health.Pending, health.Stored = h.machine.counts()
+	return health, nil
+}
+
+// Jobs lists the jobs in the log that haven't been retrieved.  A pending job
+// is queued unless it's running here.
+func (h *Hasher) Jobs() []hasher.Job {
+	running := make(map[int64]bool)
+	for _, j := range h.inner.Jobs() {
+		running[j.ID] = j.State == hasher.JobRunning
+	}
+
+	now := h.clock.Now()
+	var jobs []hasher.Job
+	for id, j := range h.machine.jobs() {
+		state := hasher.JobQueued
+		switch {
+		case j.Done && j.Error != "":
+			state = hasher.JobFailed
+		case j.Done:
+			state = hasher.JobCompleted
+		case h.mine(j.Ticket) && running[j.Ticket.Job]:
+			state = hasher.JobRunning
+		}
+		jobs = append(jobs, hasher.Job{ID: id, State: state, RequestID: j.RequestID, Submitted: j.Submitted, Age: now.Sub(j.Submitted)})
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs
+}
+
+// Drain stops accepting hashes, waits for those being computed here to be
+// committed to the log, and stops this node of it.  There's no coming back.
+func (h *Hasher) Drain() {
+	atomic.StoreInt32(&h.paused, 2)
+	h.inner.Drain()
+
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	h.completing.Wait()
+
+	h.stopOnce.Do(func() {
+		close(h.stop)
+		h.expiry.Wait()
+		h.node.Stop()
+		if h.storage != nil {
+			if err := h.storage.Close(); err != nil {
+				h.log.Error("closing raft log failed", "error", err)
+			}
+		}
+	})
+}
+
+// Lease leases a job to a remote worker from the inner hasher, see
+// hasher.Config.Remote.
+func (h *Hasher) Lease(ctx context.Context, worker string) (hasher.Lease, error) {
+	l, ok := h.inner.(hasher.Leaser)
+	if !ok {
+		return hasher.Lease{}, hasher.ErrNotRemote
+	}
+	return l.Lease(ctx, worker)
+}
+
+// Heartbeat extends a lease from the inner hasher.
+func (h *Hasher) Heartbeat(lease string) (time.Time, error) {
+	l, ok := h.inner.(hasher.Leaser)
+	if !ok {
+		return time.Time{}, hasher.ErrNotRemote
+	}
+	return l.Heartbeat(lease)
+}
+
+// Complete reports the hash for a lease to the inner hasher, which hands it
+// on to the log.
+func (h *Hasher) Complete(lease string, o hasher.Outcome) error {
+	l, ok := h.inner.(hasher.Leaser)
+	if !ok {
+		return hasher.ErrNotRemote
+	}
+	return l.Complete(lease, o)
+}
+
+// Fail reports a lease's failure to the inner hasher.
+func (h *Hasher) Fail(lease string, reason string) error {
+	l, ok := h.inner.(hasher.Leaser)
+	if !ok {
+		return hasher.ErrNotRemote
+	}
+	return l.Fail(lease, reason)
+}
+
+// propose appends cmd to the log and waits for the result of applying it.
+func (h *Hasher) propose(ctx context.Context, cmd command) (interface{}, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	value, err := h.node.Propose(ctx, data)
+	if err != nil {
+		return nil, h.convert(err)
+	}
+	if err, ok := value.(error); ok {
+		return nil, err
+	}
+	return value, nil
+}
+
+// leaderCheck returns a *hasher.NotLeaderError unless this node is the
+// leader.
+func (h *Hasher) leaderCheck() error {
+	if h.node.Status().Role != raft.Leader {
+		return h.notLeader()
+	}
+	return nil
+}
+
+// notLeader returns a *hasher.NotLeaderError naming the leader, if known.
+func (h *Hasher) notLeader() error {
+	if leader, ok := h.node.Leader(); ok && leader.ID != h.self {
+		if u, ok := h.urls[leader.ID]; ok {
+			return &hasher.NotLeaderError{Leader: u}
+		}
+		return &hasher.NotLeaderError{Leader: leader.URL}
+	}
+	return &hasher.NotLeaderError{}
+}
+
+// convert turns the errors of a raft.Node into those of a hasher.  Either
+// way the entry never made it into the log, or at least not from here.
+func (h *Hasher) convert(err error) error {
+	var notLeader *raft.NotLeaderError
+	switch {
+	case errors.As(err, &notLeader), errors.Is(err, raft.ErrLost):
+		return h.notLeader()
+	case errors.Is(err, raft.ErrStopped):
+		return hasher.ErrDrained
+	}
+	return err
+}
+
+// mine reports whether t is for a job this process is hashing.
+func (h *Hasher) mine(t ticket) bool {
+	return t.Node == h.self && t.Run == h.run
+}
+
+// expired is called by the machine as each result expires.  Every node
+// applies the expiry, so every node reports it.
+func (h *Hasher) expired(r hasher.JobResult) {
+	if h.cfg.OnDiscard != nil {
+		h.cfg.OnDiscard(r, hasher.DiscardExpired)
+	}
+}
+
+// submitted is called by the machine as each job is submitted.  If it's one
+// this process is hashing, the result is committed as soon as it's ready.
+func (h *Hasher) submitted(id int64, t ticket) {
+	if !h.mine(t) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.computing[t.Job] = id
+	if r, ok := h.early[t.Job]; ok {
+		delete(h.early, t.Job)
+		h.commit(id, r)
+	}
+}
+
+// computed is the inner hasher's OnComplete.  It commits the result, unless
+// the job's submission isn't in the log yet, in which case submitted does.
+func (h *Hasher) computed(r hasher.JobResult) {
+	// The log has the result from here on.  The inner hasher can't have
+	// drained while one of its jobs is in OnComplete, so it's still there to
+	// ask.
+	h.inner.GetAndRemoveHash(r.ID)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, ok := h.computing[r.ID]
+	if !ok {
+		h.early[r.ID] = r
+		return
+	}
+	if id == 0 {
+		// Abandoned
+		delete(h.computing, r.ID)
+		return
+	}
+	h.commit(id, r)
+}
+
+// abandon forgets a job whose submission never made it into the log.
+func (h *Hasher) abandon(innerID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.early[innerID]; ok {
+		delete(h.early, innerID)
+		return
+	}
+	h.computing[innerID] = 0
+}
+
+// commit starts committing the result of job id to the log.  The job stays
+// in h.computing until it's done, so lead leaves it alone.  h.mu must be
+// held.
+func (h *Hasher) commit(id int64, r hasher.JobResult) {
+	if h.closed {
+		delete(h.computing, r.ID)
+		return
+	}
+	h.completing.Add(1)
+	go func() {
+		defer h.completing.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+		defer cancel()
+		cmd := command{Op: opComplete, ID: id, Hash: r.Hash, Error: r.Error, Time: r.Completed}
+		_, err := h.propose(ctx, cmd)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.computing, r.ID)
+		if err != nil {
+			// If this node leads again before anyone else has failed the
+			// job, it can still commit the result
+			h.log.Warn("result not committed", "id", id, "error", err)
+			h.unsent[id] = r
+		}
+	}()
+}
+
+// lead is called once this node is the leader and has applied everything
+// from earlier terms.  Jobs whose passwords died with an earlier leader will
+// never be hashed, so they're failed, while this node's own results that
+// weren't committed before are committed now.
+func (h *Hasher) lead(term uint64) {
+	h.log.Info("leading the consensus log", "term", term)
+
+	h.mu.Lock()
+	hashing := make(map[int64]bool)
+	for _, id := range h.computing {
+		hashing[id] = true
+	}
+	unsent := h.unsent
+	h.unsent = make(map[int64]hasher.JobResult)
+	h.mu.Unlock()
+
+	for _, j := range h.machine.pending() {
+		if h.mine(j.ticket) && hashing[j.id] {
+			continue
+		}
+		cmd := command{Op: opComplete, ID: j.id, Error: replacedReason, Time: h.clock.Now()}
+		if r, ok := unsent[j.id]; ok {
+			cmd.Hash, cmd.Error, cmd.Time = r.Hash, r.Error, r.Completed
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+		_, err := h.propose(ctx, cmd)
+		cancel()
+		if err != nil {
+			// The next leader will try again
+			h.log.Warn("taking over pending jobs failed", "id", j.id, "error", err)
+			return
+		}
+	}
+}
+
+// expire throws away results older than the TTL, while this node is the
+// leader.  Every node throws away the same results, when the entry saying so
+// is applied.
+func (h *Hasher) expire() {
+	defer h.expiry.Done()
+	ticker := h.clock.NewTicker(max(h.cfg.TTL/4, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C():
+		}
+
+		cutoff := h.clock.Now().Add(-h.cfg.TTL)
+		if h.leaderCheck() != nil || !h.machine.expirable(cutoff) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+		if _, err := h.propose(ctx, command{Op: opExpire, Time: cutoff}); err != nil {
+			h.log.Warn("expiring results failed", "error", err)
+		}
+		cancel()
+	}
+}
+
+// newRun returns a random id for this run of the process.
+func newRun() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
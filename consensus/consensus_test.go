@@ -0,0 +1,364 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/raft"
+)
+
+// testCluster is a cluster of Hashers on a raft.LocalNetwork.
+type testCluster struct {
+	t       *testing.T
+	net     *raft.LocalNetwork
+	members []raft.Member
+	urls    map[int]string
+	hashers map[int]*Hasher
+	cfg     hasher.Config
+	dirs    map[int]string
+}
+
+// newCluster starts size Hashers configured by cfg, with ids from 1.  If
+// durable is set, each keeps its log in a directory, and can be restarted.
+func newCluster(t *testing.T, size int, cfg hasher.Config, durable bool) *testCluster {
+	c := &testCluster{t: t, net: raft.NewLocalNetwork(), urls: make(map[int]string), hashers: make(map[int]*Hasher), cfg: cfg,
+		dirs: make(map[int]string)}
+	for id := 1; id <= size; id++ {
+		c.members = append(c.members, raft.Member{ID: id, URL: fmt.Sprintf("http://node%d:9090", id)})
+		c.urls[id] = fmt.Sprintf("http://node%d:8080", id)
+		if durable {
+			c.dirs[id] = t.TempDir()
+		}
+	}
+	for id := 1; id <= size; id++ {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for id := range c.hashers {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts node id.
+func (c *testCluster) start(id int) {
+	c.t.Helper()
+	h, err := New(c.cfg, Config{
+		Node:              id,
+		Members:           c.members,
+		URLs:              c.urls,
+		Dir:               c.dirs[id],
+		Transport:         c.net.Transport(id),
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotEntries:   20,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.net.Attach(h.Node())
+	c.hashers[id] = h
+}
+
+// stop drains node id and takes it off the network.
+func (c *testCluster) stop(id int) {
+	c.net.Detach(id)
+	c.hashers[id].Drain()
+	delete(c.hashers, id)
+}
+
+// leader waits for a leader to be elected and returns its id.
+func (c *testCluster) leader() int {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for id, h := range c.hashers {
+			if h.leaderCheck() == nil {
+				return id
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader was elected")
+	return 0
+}
+
+// compute submits password to the leader, trying again while leadership
+// changes.
+func (c *testCluster) compute(password string) int64 {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		id, err := c.hashers[c.leader()].Compute(password)
+		var notLeader *hasher.NotLeaderError
+		switch {
+		case err == nil:
+			return id
+		case !errors.As(err, &notLeader) || time.Now().After(deadline):
+			c.t.Fatalf("Compute() = %v", err)
+		}
+	}
+}
+
+// wait waits until every node has the result for job id.  Wait alone isn't
+// enough, since it doesn't wait for a job a node hasn't heard of yet.
+func (c *testCluster) wait(id int64) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for node, h := range c.hashers {
+		for {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			err := h.Wait(ctx, id)
+			cancel()
+			if err != nil {
+				c.t.Fatalf("node %d Wait(%d) = %v", node, id, err)
+			}
+			if _, err := h.machine.result(id); !errors.Is(err, hasher.ErrNotFound) || errors.Is(err, hasher.ErrGone) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func testConfig() hasher.Config {
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	return cfg
+}
+
+// TestToken verifies that the log isn't sent over HTTP without a token.
+func TestToken(t *testing.T) {
+	if _, err := New(testConfig(), Config{Node: 1, Members: []raft.Member{{ID: 1, URL: "http://node1:9090"}}}); err == nil {
+		t.Error("New() accepted the HTTP transport without a token")
+	}
+}
+
+// TestConsensus verifies that only the leader accepts and hands out hashes,
+// that the others send clients to it, and that every node agrees on the
+// ids and the stats.
+func TestConsensus(t *testing.T) {
+	c := newCluster(t, 3, testConfig(), false)
+	leaderID := c.leader()
+	leader := c.hashers[leaderID]
+
+	for i := int64(1); i <= 3; i++ {
+		if id := c.compute(fmt.Sprint("password", i)); id != i {
+			t.Errorf("Compute() = %d, want %d", id, i)
+		}
+	}
+	c.wait(3)
+
+	for id, h := range c.hashers {
+		if id == leaderID {
+			continue
+		}
+		var notLeader *hasher.NotLeaderError
+		if _, err := h.Compute("password"); !errors.As(err, &notLeader) || notLeader.Leader != c.urls[leaderID] {
+			t.Errorf("node %d Compute() = %v", id, err)
+		}
+		if _, err := h.Retrieve(context.Background(), 1); !errors.As(err, &notLeader) {
+			t.Errorf("node %d Retrieve() = %v", id, err)
+		}
+		if _, err := h.Verify(context.Background(), 1, "password1"); !errors.As(err, &notLeader) {
+			t.Errorf("node %d Verify() = %v", id, err)
+		}
+	}
+
+	if match, err := leader.Verify(context.Background(), 1, "password1"); !match || err != nil {
+		t.Errorf("Verify() = %v, %v", match, err)
+	}
+	if match, err := leader.Verify(context.Background(), 1, "wrong"); match || err != nil {
+		t.Errorf("Verify(wrong) = %v, %v", match, err)
+	}
+	if hash, err := leader.GetAndRemoveHash(1); hash != hasher.Compute("password1") || err != nil {
+		t.Errorf("GetAndRemoveHash(1) = %q, %v", hash, err)
+	}
+	if _, err := leader.GetAndRemoveHash(1); !errors.Is(err, hasher.ErrGone) {
+		t.Errorf("GetAndRemoveHash(1) again = %v, want ErrGone", err)
+	}
+	if _, err := leader.GetAndRemoveHash(99); !errors.Is(err, hasher.ErrNotFound) || errors.Is(err, hasher.ErrGone) {
+		t.Errorf("GetAndRemoveHash(99) = %v, want ErrNotFound", err)
+	}
+
+	// Every node applies the retrieval, so they all agree on the stats
+	want := hasher.Counters{Submitted: 3, Completed: 3, Retrieved: 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for id, h := range c.hashers {
+		for {
+			s := h.Stats()
+			if s.Counters == want && s.Total == 3 && s.Stored == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d Stats() = %+v", id, s)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if jobs := h.Jobs(); len(jobs) != 2 || jobs[0].ID != 2 || jobs[0].State != hasher.JobCompleted {
+			t.Errorf("node %d Jobs() = %+v", id, jobs)
+		}
+	}
+}
+
+// TestFailover verifies that when the leader fails, another takes over with
+// every id and result, and fails the jobs the old leader never finished.
+func TestFailover(t *testing.T) {
+	cfg := testConfig()
+	release := make(chan struct{})
+	cfg.Work = func(password string) (string, error) {
+		if password == "stuck" {
+			<-release
+		}
+		return hasher.Compute(password), nil
+	}
+	c := newCluster(t, 3, cfg, false)
+	defer close(release)
+
+	done := c.compute("done")
+	c.wait(done)
+	stuck := c.compute("stuck")
+
+	// The leader fails without draining, which would finish the stuck job
+	old := c.leader()
+	c.net.Detach(old)
+	c.hashers[old].node.Stop()
+	crashed := c.hashers[old]
+	delete(c.hashers, old)
+	defer func() {
+		release <- struct{}{}
+		crashed.Drain()
+	}()
+
+	c.wait(stuck)
+	leader := c.hashers[c.leader()]
+	var jobErr *hasher.JobError
+	if _, err := leader.GetAndRemoveHash(stuck); !errors.As(err, &jobErr) || jobErr.Reason != replacedReason {
+		t.Errorf("GetAndRemoveHash(stuck) = %v", err)
+	}
+	if hash, err := leader.GetAndRemoveHash(done); hash != hasher.Compute("done") || err != nil {
+		t.Errorf("GetAndRemoveHash(done) = %q, %v", hash, err)
+	}
+	if id := c.compute("after"); id != stuck+1 {
+		t.Errorf("Compute() after failover = %d, want %d", id, stuck+1)
+	}
+}
+
+// TestExpire verifies that results are thrown away after the TTL on every
+// node.
+func TestExpire(t *testing.T) {
+	cfg := testConfig()
+	cfg.TTL = 50 * time.Millisecond
+	var discarded atomic.Int32
+	cfg.OnDiscard = func(r hasher.JobResult, why hasher.Discard) {
+		if why == hasher.DiscardExpired {
+			discarded.Add(1)
+		}
+	}
+	c := newCluster(t, 3, cfg, false)
+
+	id := c.compute("password")
+	deadline := time.Now().Add(5 * time.Second)
+	for _, h := range c.hashers {
+		for h.Stats().Counters.Expired != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Stats() = %+v, want a result expired", h.Stats())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if _, err := c.hashers[c.leader()].GetAndRemoveHash(id); !errors.Is(err, hasher.ErrGone) {
+		t.Errorf("GetAndRemoveHash() after the TTL = %v, want ErrGone", err)
+	}
+	for discarded.Load() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d nodes reported the expiry, want 3", discarded.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestInnerDiscard verifies that results the inner hasher drops, once the
+// log has them, aren't reported as discarded, since its ids aren't the log's.
+func TestInnerDiscard(t *testing.T) {
+	cfg := testConfig()
+	var discarded atomic.Int32
+	cfg.OnDiscard = func(r hasher.JobResult, why hasher.Discard) { discarded.Add(1) }
+	h, err := New(cfg, Config{
+		Node:              1,
+		Members:           []raft.Member{{ID: 1, URL: "http://node1"}},
+		Transport:         raft.NewLocalNetwork().Transport(1),
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		New: func(cfg hasher.Config) (hasher.AsyncHasher, error) {
+			return chaos.New(cfg, chaos.Config{DropRate: 1})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Drain()
+
+	var id int64
+	deadline := time.Now().Add(5 * time.Second)
+	for id, err = h.Compute("password"); err != nil; id, err = h.Compute("password") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Compute() = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := h.Wait(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := h.GetAndRemoveHash(id); err != nil || hash != hasher.Compute("password") {
+		t.Errorf("GetAndRemoveHash() = %q, %v", hash, err)
+	}
+	if n := discarded.Load(); n != 0 {
+		t.Errorf("%d results reported as discarded", n)
+	}
+}
+
+// TestRestart verifies that a cluster restarted from its logs carries on with
+// the same ids and results, including from snapshots.
+func TestRestart(t *testing.T) {
+	c := newCluster(t, 3, testConfig(), true)
+
+	// Enough to take a snapshot
+	var last int64
+	for i := 0; i < 30; i++ {
+		last = c.compute(fmt.Sprint("password", i))
+	}
+	c.wait(last)
+	before := c.hashers[c.leader()].Stats().Counters
+
+	for id := range c.hashers {
+		c.stop(id)
+	}
+	for _, m := range c.members {
+		c.start(m.ID)
+	}
+
+	leader := c.hashers[c.leader()]
+	c.wait(last)
+	if hash, err := leader.GetAndRemoveHash(last); hash != hasher.Compute("password29") || err != nil {
+		t.Errorf("GetAndRemoveHash(%d) after restarting = %q, %v", last, hash, err)
+	}
+	if id := c.compute("again"); id != last+1 {
+		t.Errorf("Compute() after restarting = %d, want %d", id, last+1)
+	}
+	if after := leader.Stats().Counters; after.Submitted != before.Submitted+1 || after.Retrieved != 1 {
+		t.Errorf("counters after restarting = %+v, before %+v", after, before)
+	}
+	if s := leader.Node().Status(); s.SnapshotIndex == 0 {
+		t.Errorf("status %+v, want a snapshot", s)
+	}
+}
@@ -0,0 +1,304 @@
+package consensus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// The operations in the log.  Each is a command, JSON encoded.
+const (
+	opSubmit   = "submit"   // A job was accepted, and gets the next id
+	opComplete = "complete" // A job was hashed, or failed
+	opRetrieve = "retrieve" // A job's result was handed to the client, and is gone
+	opExpire   = "expire"   // Results completed by Time are thrown away
+)
+
+// command is an entry in the log.  There's never a password in one.
+type command struct {
+	Op        string    `json:"op"`
+	ID        int64     `json:"id,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Ticket    ticket    `json:"ticket"`
+	Hash      string    `json:"hash,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"` // By the leader's clock, so every node applies the same thing
+}
+
+// ticket says where a job is being hashed: the leader that accepted it, in
+// which run of its process, and its id in that leader's own hasher.  Only
+// that process can complete the job, since only it had the password.
+type ticket struct {
+	Node int    `json:"node"`
+	Run  string `json:"run"`
+	Job  int64  `json:"job"`
+}
+
+// job is what the log says about a job that hasn't been retrieved yet.
+type job struct {
+	RequestID string    `json:"requestId"`
+	Ticket    ticket    `json:"ticket"`
+	Done      bool      `json:"done"`
+	Hash      string    `json:"hash,omitempty"`
+	Error     string    `json:"error,omitempty"` // Why it failed, if it did
+	Submitted time.Time `json:"submitted"`
+	Completed time.Time `json:"completed"`
+}
+
+// state is everything the log has built up, which is also what a snapshot
+// holds.
+type state struct {
+	LastID   int64           `json:"lastId"`
+	Jobs     map[int64]*job  `json:"jobs"`
+	Counters hasher.Counters `json:"counters"` // Rejected isn't counted, since rejections aren't in the log
+}
+
+// retrieval is the result of applying an opRetrieve.
+type retrieval struct {
+	result hasher.Result
+	err    error
+}
+
+// machine is the raft.StateMachine the log drives.  Every node has the same
+// one, so any of them can take over as leader with every id, result and
+// count intact.
+type machine struct {
+	mu      sync.Mutex
+	state   state
+	changed chan struct{} // Closed, and replaced, whenever a job stops being pending, see wait
+
+	// submitted is called as each job is submitted, so the node that is
+	// hashing it learns its id even if it gave up waiting for it.
+	submitted func(id int64, t ticket)
+
+	// expired is called with each result that expires, nil to ignore them.
+	expired func(r hasher.JobResult)
+}
+
+// newMachine returns a machine with no jobs.
+func newMachine(submitted func(id int64, t ticket), expired func(r hasher.JobResult)) *machine {
+	return &machine{
+		state:     state{Jobs: make(map[int64]*job)},
+		changed:   make(chan struct{}),
+		submitted: submitted,
+		expired:   expired,
+	}
+}
+
+// Apply applies a command from the log.  An opSubmit returns the job's id,
+// and an opRetrieve a retrieval.  The callbacks are called once the state
+// has been unlocked.
+func (m *machine) Apply(index uint64, data []byte) interface{} {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return fmt.Errorf("entry %d is not a command: %w", index, err)
+	}
+
+	m.mu.Lock()
+	result := m.apply(index, cmd)
+	m.mu.Unlock()
+
+	if id, ok := result.(int64); ok && cmd.Op == opSubmit {
+		m.submitted(id, cmd.Ticket)
+	}
+	if expired, ok := result.([]hasher.JobResult); ok {
+		for _, r := range expired {
+			if m.expired != nil {
+				m.expired(r)
+			}
+		}
+		return nil
+	}
+	return result
+}
+
+// apply applies a command with m.mu held.  An opExpire returns the results
+// that expired, for Apply to pass on.
+func (m *machine) apply(index uint64, cmd command) interface{} {
+	switch cmd.Op {
+	case opSubmit:
+		m.state.LastID++
+		id := m.state.LastID
+		m.state.Jobs[id] = &job{RequestID: cmd.RequestID, Ticket: cmd.Ticket, Submitted: cmd.Time}
+		m.state.Counters.Submitted++
+		return id
+
+	case opComplete:
+		// A job can be failed by a new leader and completed by the old one,
+		// and only the first counts
+		j, ok := m.state.Jobs[cmd.ID]
+		if !ok || j.Done {
+			return nil
+		}
+		j.Done, j.Hash, j.Error, j.Completed = true, cmd.Hash, cmd.Error, cmd.Time
+		if cmd.Error != "" {
+			m.state.Counters.Failed++
+		} else {
+			m.state.Counters.Completed++
+		}
+		m.broadcast()
+		return nil
+
+	case opRetrieve:
+		j, err := m.lookup(cmd.ID)
+		if err != nil {
+			return retrieval{err: err}
+		}
+		delete(m.state.Jobs, cmd.ID)
+		m.state.Counters.Retrieved++
+		m.broadcast()
+		r := retrieval{result: hasher.Result{Hash: j.Hash, RequestID: j.RequestID}}
+		if j.Error != "" {
+			r.result.Hash = ""
+			r.err = &hasher.JobError{ID: cmd.ID, Reason: j.Error}
+		}
+		return r
+
+	case opExpire:
+		var expired []hasher.JobResult
+		for id, j := range m.state.Jobs {
+			if j.Done && !j.Completed.After(cmd.Time) {
+				delete(m.state.Jobs, id)
+				m.state.Counters.Expired++
+				expired = append(expired, hasher.JobResult{ID: id, RequestID: j.RequestID, Hash: j.Hash,
+					Error: j.Error, Submitted: j.Submitted, Completed: j.Completed})
+			}
+		}
+		m.broadcast()
+		return expired
+	}
+	return fmt.Errorf("entry %d has unknown op %q", index, cmd.Op)
+}
+
+// Snapshot returns the state as JSON.
+func (m *machine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.state)
+}
+
+// Restore replaces the state with a snapshot.
+func (m *machine) Restore(data []byte) error {
+	s := state{Jobs: make(map[int64]*job)}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = s
+	m.broadcast()
+	return nil
+}
+
+// broadcast wakes everyone in wait.  m.mu must be held.
+func (m *machine) broadcast() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// lookup returns a copy of job id, if it's done, or why not: ErrPending,
+// ErrGone or ErrNotFound.  m.mu must be held.
+func (m *machine) lookup(id int64) (job, error) {
+	j, ok := m.state.Jobs[id]
+	switch {
+	case ok && j.Done:
+		return *j, nil
+	case ok:
+		return job{}, hasher.ErrPending
+	case id > 0 && id <= m.state.LastID:
+		return job{}, hasher.ErrGone
+	default:
+		return job{}, hasher.ErrNotFound
+	}
+}
+
+// result returns a copy of job id, if it's done, or why not.
+func (m *machine) result(id int64) (job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lookup(id)
+}
+
+// wait blocks until job id isn't pending, or ctx is done.
+func (m *machine) wait(ctx context.Context, id int64) error {
+	for {
+		m.mu.Lock()
+		j, ok := m.state.Jobs[id]
+		pending := ok && !j.Done
+		changed := m.changed
+		m.mu.Unlock()
+		if !pending {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pendingJob is a job that hasn't been hashed yet, see pending.
+type pendingJob struct {
+	id     int64
+	ticket ticket
+}
+
+// pending returns the jobs that haven't been hashed yet, oldest first.
+func (m *machine) pending() []pendingJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var jobs []pendingJob
+	for id, j := range m.state.Jobs {
+		if !j.Done {
+			jobs = append(jobs, pendingJob{id, j.Ticket})
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].id < jobs[k].id })
+	return jobs
+}
+
+// expirable reports whether any result was completed by cutoff.
+func (m *machine) expirable(cutoff time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.state.Jobs {
+		if j.Done && !j.Completed.After(cutoff) {
+			return true
+		}
+	}
+	return false
+}
+
+// counts returns the counters, and how many jobs are pending and stored.
+func (m *machine) counts() (counters hasher.Counters, pending int64, stored int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.state.Jobs {
+		if j.Done {
+			stored++
+		} else {
+			pending++
+		}
+	}
+	return m.state.Counters, pending, stored
+}
+
+// jobs lists the jobs that haven't been retrieved, with their tickets.
+func (m *machine) jobs() map[int64]job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make(map[int64]job, len(m.state.Jobs))
+	for id, j := range m.state.Jobs {
+		jobs[id] = *j
+	}
+	return jobs
+}
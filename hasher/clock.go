@@ -0,0 +1,181 @@
+package hasher
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the hasher's source of time.  Everything the hasher does with time,
+// from the simulated delay to timing the hash to expiring old results, goes
+// through a Clock so that tests can control it with a FakeClock instead of
+// actually waiting.  The exception is Probe, whose timeout detects a wedged
+// hasher and so has to be measured in real time.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, like a time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock used when none is configured.  It simply calls the
+// functions of the same name in package time.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Sleep calls time.Sleep.
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// NewTicker wraps time.NewTicker.
+func (RealClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// FakeClock is a Clock that only moves when Advance is called.  Sleepers and
+// tickers fire as the clock passes their deadlines, which lets tests walk the
+// hasher through its lifecycle deterministically and in microseconds.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan interface{} // Closed and replaced whenever waiters changes
+}
+
+// fakeWaiter is a sleeper or ticker waiting for the FakeClock to reach its
+// deadline.  Sleepers have a period of 0 and are removed once they fire.
+type fakeWaiter struct {
+	deadline time.Time
+	period   time.Duration
+	c        chan time.Time
+}
+
+// NewFakeClock creates a FakeClock set to the supplied time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, changed: make(chan interface{})}
+}
+
+// Now returns the fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock has been advanced by at least d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-c.add(d, 0).c
+}
+
+// NewTicker returns a Ticker that fires each time the clock passes another
+// multiple of d.  Like time.Ticker, ticks are dropped if nobody is reading.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	return &fakeTicker{c, c.add(d, d)}
+}
+
+// Advance moves the clock forward by d, firing every sleeper and ticker whose
+// deadline has been reached along the way.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		// Fire waiters in deadline order so tickers see every period
+		sort.Slice(c.waiters, func(i, j int) bool {
+			return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].deadline.After(end) {
+			break
+		}
+
+		w := c.waiters[0]
+		c.now = w.deadline
+		select {
+		case w.c <- c.now:
+		default:
+		}
+
+		if w.period > 0 {
+			w.deadline = w.deadline.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+			c.notify()
+		}
+	}
+	c.now = end
+}
+
+// Waiters returns the number of sleepers and tickers waiting on the clock.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil waits until at least n sleepers and tickers are waiting on the
+// clock.  Tests use this to know that background goroutines have reached
+// their Sleep before calling Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		count, changed := len(c.waiters), c.changed
+		c.mu.Unlock()
+
+		if count >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// add registers a new waiter.
+func (c *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{c.now.Add(d), period, make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	c.notify()
+	return w
+}
+
+// remove unregisters a waiter.
+func (c *FakeClock) remove(w *fakeWaiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.waiters {
+		if c.waiters[i] == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.notify()
+			return
+		}
+	}
+}
+
+// notify wakes up BlockUntil.  c.mu must be held.
+func (c *FakeClock) notify() {
+	close(c.changed)
+	c.changed = make(chan interface{})
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	w     *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t *fakeTicker) Stop()               { t.clock.remove(t.w) }
@@ -0,0 +1,45 @@
+package hasher
+
+import (
+	"testing"
+	"time"
+)
+
+// TestFakeClock verifies that sleepers and tickers fire only when the clock
+// is advanced past their deadlines.
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(100, 0)
+	clock := NewFakeClock(start)
+
+	woke := make(chan time.Time)
+	go func() {
+		clock.Sleep(time.Second)
+		woke <- clock.Now()
+	}()
+
+	ticker := clock.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
+
+	clock.BlockUntil(2)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-woke:
+		t.Fatal("sleeper woke early")
+	default:
+	}
+
+	// The ticker fired three times, but like time.Ticker, only the first
+	// tick is kept when nobody is reading
+	if tick := <-ticker.C(); !tick.Equal(start.Add(300 * time.Millisecond)) {
+		t.Errorf("tick at %v", tick)
+	}
+
+	clock.Advance(time.Millisecond)
+	if now := <-woke; !now.Equal(start.Add(time.Second)) {
+		t.Errorf("sleeper woke at %v", now)
+	}
+
+	if clock.Waiters() != 1 {
+		t.Errorf("%d waiters, want just the ticker", clock.Waiters())
+	}
+}
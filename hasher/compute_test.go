@@ -8,3 +8,28 @@ func TestCompute(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// TestAlgorithms verifies each registered algorithm produces a distinct,
+// stable result, and that sha512 is the original Compute.
+func TestAlgorithms(t *testing.T) {
+	seen := make(map[string]string)
+	for _, name := range Algorithms() {
+		algorithm, err := LookupAlgorithm(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash := algorithm("angryMonkey")
+		if hash != algorithm("angryMonkey") {
+			t.Errorf("%s is not stable", name)
+		}
+		if other, ok := seen[hash]; ok {
+			t.Errorf("%s and %s produce the same hash", name, other)
+		}
+		seen[hash] = name
+	}
+
+	if seen[Compute("angryMonkey")] != "sha512" {
+		t.Error("sha512 is not Compute")
+	}
+}
@@ -0,0 +1,245 @@
+package hasher
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// Config holds the tuning knobs shared by every AsyncHasher implementation.
+type Config struct {
+	Implementation string        // Name of a registered implementation, see Implementations
+	Workers        int           // Number of background workers.  0 starts a goroutine per hash.
+	QueueDepth     int           // Hashes that may wait for a busy worker before Compute fails.  Ignored if Workers is 0.
+	Delay          time.Duration // Simulated work performed before each hash, unless Latency is set
+	Latency        string        // Latency profile for the simulated work, see ParseLatency.  Overrides Delay.
+	Seed           int64         // Seed for random latency profiles.  0 picks a different seed every run.
+	TTL            time.Duration // How long a completed hash is kept waiting for retrieval.  0 keeps it forever.
+	Algorithm      string        // Name of a registered algorithm, see Algorithms
+	Node           int           // Identifies this server in a cluster, in the top bits of every id.  0 to MaxNode.
+	LastID         int64         // The last id this node issued before it restarted.  New ids carry on after it.
+
+	// Remote leaves the hashing to remote workers, which lease jobs from a
+	// queue of QueueDepth, see Lease.  Workers must be 0.
+	Remote   bool
+	LeaseTTL time.Duration // How long a remote worker may hold a job without a heartbeat
+
+	// Logger receives an event as each job is submitted, completed, retrieved
+	// or expires.  Failures are logged as warnings and everything else at
+	// debug level.  nil logs nothing.  Passwords are never logged.
+	Logger *slog.Logger
+
+	// Tracer receives a span for each phase of every job: queued, simulated
+	// work, hash, stored and retrieved, under a span for the whole job.  nil
+	// records nothing.
+	Tracer *trace.Tracer
+
+	// OnComplete is called with the outcome of every job once it has been
+	// stored, which is how a cluster replicates results.  It must not block.
+	OnComplete func(r JobResult)
+
+	// OnDiscard is called with each result that is thrown away without
+	// being retrieved, and why, which is how the audit log records it.  It's
+	// called from the event loop, or with the mutex held, so it must be
+	// quick.
+	OnDiscard func(r JobResult, why Discard)
+
+	// Hooks for tests, which can't be set from a config file
+	Clock Clock    // Source of time.  nil uses RealClock.
+	Work  WorkFunc // Computes each hash in place of Algorithm.  nil uses Algorithm.
+
+	// Stall is called as the hasher's internal synchronization answers each
+	// call that needs it: from the event loop, or with the mutex held.
+	// Sleeping in it holds up every other such call, as a busy event loop
+	// would, which is how chaos injects its loop delay.  nil for none.
+	Stall func()
+}
+
+// JobResult is the outcome of a job, as passed to Config.OnComplete.  It
+// doesn't include the password.
+type JobResult struct {
+	ID        int64
+	RequestID string    // The request that submitted the job
+	Hash      string    // The hash, "" if the job failed
+	Error     string    // Why the job failed, "" if it didn't
+	Submitted time.Time // When Compute was called
+	Completed time.Time // When the hash was stored
+}
+
+// Discard says why a result was thrown away without being retrieved, see
+// Config.OnDiscard.
+type Discard string
+
+// The reasons a result can be thrown away.
+const (
+	DiscardExpired Discard = "expired" // It wasn't retrieved within the TTL
+	DiscardDropped Discard = "dropped" // Fault injection lost it, see package chaos
+)
+
+// WorkFunc performs the real work of a hash job once the simulated delay has
+// passed.  Replacing it lets tests control exactly how long a hash takes and
+// when it completes.  If it returns an error, the job is recorded as failed
+// and GetAndRemoveHash reports the error instead of a hash.
+type WorkFunc func(password string) (string, error)
+
+// DefaultConfig returns the configuration that matches the original behavior
+// of the hasher: one goroutine per hash, a 5 second delay, sha512, and hashes
+// kept until they are retrieved.
+func DefaultConfig() Config {
+	return Config{
+		Implementation: "channel",
+		Workers:        0,
+		QueueDepth:     0,
+		Delay:          5 * time.Second,
+		TTL:            0,
+		Algorithm:      "sha512",
+		LeaseTTL:       30 * time.Second,
+	}
+}
+
+// Validate returns an error describing the first problem with the config.
+func (c Config) Validate() error {
+	if _, ok := implementations[c.Implementation]; !ok {
+		return fmt.Errorf("unknown hasher implementation %q", c.Implementation)
+	}
+	if _, ok := algorithms[c.Algorithm]; !ok {
+		return fmt.Errorf("unknown hash algorithm %q", c.Algorithm)
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers must not be negative: %d", c.Workers)
+	}
+	if c.QueueDepth < 0 {
+		return fmt.Errorf("queue depth must not be negative: %d", c.QueueDepth)
+	}
+	if c.Delay < 0 {
+		return fmt.Errorf("delay must not be negative: %s", c.Delay)
+	}
+	if c.Latency != "" {
+		if _, err := ParseLatency(c.Latency, c.Seed); err != nil {
+			return err
+		}
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative: %s", c.TTL)
+	}
+	if c.Node < 0 || c.Node > MaxNode {
+		return fmt.Errorf("node must be between 0 and %d: %d", MaxNode, c.Node)
+	}
+	if c.LastID < 0 || (c.LastID != 0 && NodeOf(c.LastID) != c.Node) {
+		return fmt.Errorf("last id %d was not issued by node %d", c.LastID, c.Node)
+	}
+	if c.Remote {
+		if c.Workers != 0 {
+			return fmt.Errorf("workers must be 0 with remote workers: %d", c.Workers)
+		}
+		if c.QueueDepth <= 0 {
+			return fmt.Errorf("queue depth must be positive with remote workers: %d", c.QueueDepth)
+		}
+		if c.LeaseTTL <= 0 {
+			return fmt.Errorf("lease ttl must be positive with remote workers: %s", c.LeaseTTL)
+		}
+	}
+	return nil
+}
+
+// latency builds the Latency described by the config.  The config must be
+// valid.
+func (c Config) latency() Latency {
+	if c.Latency == "" {
+		return fixedLatency(c.Delay)
+	}
+
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	l, _ := ParseLatency(c.Latency, seed)
+	return l
+}
+
+// Factory creates an AsyncHasher from an already validated Config.
+type Factory func(cfg Config) AsyncHasher
+
+// implementations holds the registered AsyncHasher implementations by name.
+var implementations = map[string]Factory{
+	"channel": func(cfg Config) AsyncHasher { return newHasherChannel(cfg) },
+	"mutex":   func(cfg Config) AsyncHasher { return newHasherMutex(cfg) },
+}
+
+// Register makes an AsyncHasher implementation available to New under the
+// supplied name.  It is not safe to call concurrently with New, so it should
+// be done from an init function.
+func Register(name string, factory Factory) {
+	implementations[name] = factory
+}
+
+// Implementations returns the names of the registered implementations, sorted.
+func Implementations() []string {
+	var names []string
+	for name := range implementations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New validates cfg and creates the AsyncHasher implementation it names.
+func New(cfg Config) (AsyncHasher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return implementations[cfg.Implementation](cfg), nil
+}
+
+// Algorithm hashes its input and returns an encoded form of the result.
+// Compute is the original, and default, Algorithm.
+type Algorithm func(in string) string
+
+// algorithms holds the registered hash algorithms by name.
+var algorithms = map[string]Algorithm{
+	"sha512": Compute,
+	"sha384": base64Hash(sha512.New384),
+	"sha256": base64Hash(sha256.New),
+}
+
+// RegisterAlgorithm makes a hash algorithm available under the supplied name.
+// Like Register, it should be called from an init function.
+func RegisterAlgorithm(name string, algorithm Algorithm) {
+	algorithms[name] = algorithm
+}
+
+// Algorithms returns the names of the registered algorithms, sorted.
+func Algorithms() []string {
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupAlgorithm returns the algorithm registered under name.
+func LookupAlgorithm(name string) (Algorithm, error) {
+	algorithm, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", name)
+	}
+	return algorithm, nil
+}
+
+// base64Hash builds an Algorithm that encodes the result of a standard
+// library hash the same way Compute does.
+func base64Hash(newHash func() hash.Hash) Algorithm {
+	return func(in string) string {
+		h := newHash()
+		h.Write([]byte(in))
+		return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+}
@@ -10,11 +10,11 @@
 package hasher
 
 import (
+	"context"
 	"crypto/sha512"
 	"encoding/base64"
 	"errors"
-	"sync"
-	"sync/atomic"
+	"fmt"
 	"time"
 )
 
@@ -22,70 +22,189 @@ import (
 // provides an interface for the user to retrieve computed hashes at a later
 // time asynchronously.
 type AsyncHasher interface {
-	Compute(password string) int64
+	Compute(password string) (int64, error)
+	ComputeContext(ctx context.Context, password string) (int64, error)
 	GetAndRemoveHash(id int64) (string, error)
+	Retrieve(ctx context.Context, id int64) (Result, error)
+	Wait(ctx context.Context, id int64) error
+	Verify(ctx context.Context, id int64, password string) (bool, error)
 	Stats() Stats
+	ResetStats()
+	Pause()
+	Resume()
+	Probe(timeout time.Duration) (Health, error)
+	Jobs() []Job
 	Drain()
 }
 
+// Leaser is implemented by an AsyncHasher that can leave the hashing to
+// remote workers, see Config.Remote.  Both implementations here do, and fail
+// with ErrNotRemote unless they were configured for it.  It's kept out of
+// AsyncHasher so that hashers which never lease, and the wrappers around
+// them, needn't carry it.
+type Leaser interface {
+	Lease(ctx context.Context, worker string) (Lease, error)
+	Heartbeat(lease string) (time.Time, error)
+	Complete(lease string, o Outcome) error
+	Fail(lease string, reason string) error
+}
+
+// Result is a hash returned by Retrieve.
+type Result struct {
+	Hash      string // The hash, "" if the job failed
+	RequestID string // The ID of the request that submitted the job
+}
+
+// Job describes a hash that hasn't been retrieved yet, for diagnostics.  It
+// deliberately doesn't include the password.
+type Job struct {
+	ID        int64         `json:"id"`
+	State     string        `json:"state"`     // One of JobQueued, JobRunning, JobCompleted or JobFailed
+	RequestID string        `json:"requestId"` // The ID of the request that submitted the job
+	Submitted time.Time     `json:"submitted"` // When Compute was called, by the hasher's clock
+	Age       time.Duration `json:"age"`       // How long ago Compute was called
+}
+
+// The states of a Job.
+const (
+	JobQueued    = "queued"    // Waiting for a worker
+	JobRunning   = "running"   // Being hashed
+	JobCompleted = "completed" // Hashed, waiting to be retrieved
+	JobFailed    = "failed"    // Failed, waiting for the failure to be retrieved
+)
+
+// Health is a snapshot of the hasher's internal state returned by a
+// successful Probe.
+type Health struct {
+	Pending  int64 `json:"pending"`  // Hashes accepted by Compute but not yet complete
+	Queued   int   `json:"queued"`   // Pending hashes waiting for a worker
+	Capacity int   `json:"capacity"` // Maximum hashes that can be queued, 0 if there's no queue
+	Stored   int   `json:"stored"`   // Completed hashes waiting to be retrieved
+}
+
+// ErrPaused is returned by Compute when the hasher is not accepting new work,
+// either because Pause was called or because it has been drained.
+var ErrPaused = errors.New("hasher is not accepting new work")
+
+// ErrNotFound is returned by GetAndRemoveHash when there is no hash for the
+// id because the id was never handed out.
+var ErrNotFound = errors.New("id not found")
+
+// ErrPending and ErrGone are returned in place of ErrNotFound when the id was
+// handed out, but the hash isn't complete yet, or was already retrieved or
+// expired.  Both match ErrNotFound with errors.Is, so callers that don't care
+// why there's no hash needn't check for them.
+var (
+	ErrPending = fmt.Errorf("%w: hash is not complete yet", ErrNotFound)
+	ErrGone    = fmt.Errorf("%w: hash was already retrieved or has expired", ErrNotFound)
+)
+
+// JobError is returned by GetAndRemoveHash when the hash for the id could not
+// be computed.  Like a hash, a failure is only reported once.
+type JobError struct {
+	ID     int64  // The id of the failed job
+	Reason string // Why it failed
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("hash %d failed: %s", e.ID, e.Reason)
+}
+
+// NotLeaderError is returned by a hasher that shares its jobs with other
+// servers through a consensus log, see package consensus, when only the
+// leader can do what was asked.  The client should ask the leader instead.
+type NotLeaderError struct {
+	Leader string // The leader's URL, "" if there isn't one right now
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not the leader, and no leader is known"
+	}
+	return "not the leader, " + e.Leader + " is"
+}
+
+// ErrQueueFull is returned by Compute when every worker is busy and the queue
+// of waiting hashes is full.
+var ErrQueueFull = errors.New("hasher queue is full")
+
+// ErrUnresponsive is returned by Probe when the hasher did not respond within
+// the timeout, which means its internal synchronization is wedged.
+var ErrUnresponsive = errors.New("hasher is unresponsive")
+
+// ErrDrained is returned by Probe once Drain has been called.
+var ErrDrained = errors.New("hasher has been drained")
+
 // AsyncHasherChannel is an implementation of the AsyncHasher interface
 // that uses channels as the primary means of synchronization.  No mutexes
 // are used in an attempt to "idomatic" Go.  See AsyncHasherMutex for an
 // implementation using mutexes.
 type AsyncHasherChannel struct {
-	asyncId         int64              // atomic counter of ids to return to ensure uniqueness
-	hashPutChan     chan hashPair      // Communicate that a new hash should be cached
-	hashRequestChan chan hashRequest   // Communicate a request to retrieve a hash
-	statUpdateChan  chan time.Duration // Communicate that an op has completed
-	statsChan       chan Stats         // Used to request the latest stats
-	shutdown        chan interface{}   // Used to signal shutdown to the event loop
-	wg              sync.WaitGroup     // Used to wait for all long-running operations to complete on shutdown
+	pool            *pool            // Runs the hashes in the background
+	clock           Clock            // Same as pool.clock
+	ttl             time.Duration    // How long completed hashes are kept
+	hashPutChan     chan completion  // Communicate that a hash has completed and should be cached
+	hashRequestChan chan hashRequest // Communicate a request to retrieve a hash
+	statsChan       chan chan Stats  // Used to request the latest stats
+	resetChan       chan interface{} // Used to reset the cumulative stats
+	jobsChan        chan chan []Job  // Used to list the jobs
+	probeChan       chan chan Health // Used to verify the event loop is responsive
+	shutdown        chan interface{} // Used to signal shutdown to the event loop
+	done            chan interface{} // Closed when the event loop exits
 }
 
-// NewHasherChannel creates and initializes a new AsyncHasher.
-func NewHasherChannel() AsyncHasher {
+// newHasherChannel creates and initializes a new AsyncHasherChannel.  Use New
+// to create one from a Config that hasn't been validated.
+func newHasherChannel(cfg Config) *AsyncHasherChannel {
 	var hasher AsyncHasherChannel
-	hasher.hashPutChan = make(chan hashPair, 100)
+	hasher.ttl = cfg.TTL
+	hasher.hashPutChan = make(chan completion, 100)
 	hasher.hashRequestChan = make(chan hashRequest, 100)
-	hasher.statUpdateChan = make(chan time.Duration, 100)
-	hasher.statsChan = make(chan Stats)
+	hasher.statsChan = make(chan chan Stats)
+	hasher.resetChan = make(chan interface{})
+	hasher.jobsChan = make(chan chan []Job)
+	hasher.probeChan = make(chan chan Health)
 	hasher.shutdown = make(chan interface{})
+	hasher.done = make(chan interface{})
+	hasher.pool = newPool(cfg, func(c completion) {
+		hasher.hashPutChan <- c
+	})
+
+	hasher.clock = hasher.pool.clock
 
 	go hasher.eventLoop()
 
 	return &hasher
 }
 
+// NewHasherChannel creates and initializes a new AsyncHasherChannel with the
+// default Config.  It's kept for callers from before New; use New to tune it.
+func NewHasherChannel() AsyncHasher {
+	return newDefault("channel")
+}
+
+// newDefault creates the named implementation with the default Config, which
+// is always valid.
+func newDefault(implementation string) AsyncHasher {
+	cfg := DefaultConfig()
+	cfg.Implementation = implementation
+	h, _ := New(cfg)
+	return h
+}
+
 // Compute schedules the supplied password to be hashed asynchronously and
 // returns an id that can be supplied to GetAndRemoveHash at a later time to
 // retrieve the hash.  For details on the hash, see hasher.Compute.
-func (h *AsyncHasherChannel) Compute(password string) int64 {
-	// Atomically incrementing is the easiest way to have non-conflicting ids.
-	// If security was a concern, we'd want to consider returning a random integer,
-	// or even better a long alphanumeric key.
-	id := atomic.AddInt64(&h.asyncId, 1)
-
-	h.wg.Add(1)
-	go func() {
-		// The purpose of this sleep is to simulate a longer running
-		// task, so we just sleep.  I considered using time.After along
-		// with a channel to cancel the task mid-operation, but instead
-		// opted to assume this was a "long" running task that is NOT
-		// cancelable.  This means we just have to wait for it to complete
-		// when shutting down.
-		time.Sleep(5 * time.Second)
-
-		// For stats, we're only interested in the real work, which is the hash.
-		// Maybe if the sleep were real work, we would include that too.
-		start := time.Now()
-		hash := Compute(password)
-		h.statUpdateChan <- time.Since(start)
-
-		h.hashPutChan <- hashPair{id, hash}
-		h.wg.Done()
-	}()
-
-	return id
+// If the hasher is paused, ErrPaused is returned and no work is scheduled.
+func (h *AsyncHasherChannel) Compute(password string) (int64, error) {
+	return h.pool.submit(context.Background(), password)
+}
+
+// ComputeContext is Compute for a job submitted by the trace.Request carried
+// by ctx.  The request ID is stored with the job, and its spans are recorded
+// in the request's trace.
+func (h *AsyncHasherChannel) ComputeContext(ctx context.Context, password string) (int64, error) {
+	return h.pool.submit(ctx, password)
 }
 
 // GetAndRemoveHash returns the hash that was computed in the background for
@@ -94,22 +213,139 @@ func (h *AsyncHasherChannel) Compute(password string) int64 {
 // This id must have been returned from a previous Compute call.
 // If the hash is not completed yet, an error will be returned.
 func (h *AsyncHasherChannel) GetAndRemoveHash(id int64) (string, error) {
+	res, err := h.Retrieve(context.Background(), id)
+	return res.Hash, err
+}
+
+// Retrieve is GetAndRemoveHash for the request carried by ctx, which is
+// recorded in the job's trace.  It also returns the ID of the request that
+// submitted the job, including when the job failed.
+func (h *AsyncHasherChannel) Retrieve(ctx context.Context, id int64) (Result, error) {
+	start := h.clock.Now()
+
+	val, err := h.lookup(id, true)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Logging and tracing can wait until the event loop is free
+	h.pool.retrieved(ctx, id, val, start)
+	return val.get(id)
+}
+
+// Wait blocks until the hash for id is complete, or ctx is done.  It returns
+// straight away if there's no such job, so GetAndRemoveHash may still fail
+// afterwards.
+func (h *AsyncHasherChannel) Wait(ctx context.Context, id int64) error {
+	return h.pool.wait(ctx, id)
+}
+
+// Verify checks whether password hashes to the hash for id, without removing
+// it.  It fails the same way GetAndRemoveHash would.
+func (h *AsyncHasherChannel) Verify(ctx context.Context, id int64, password string) (bool, error) {
+	val, err := h.lookup(id, false)
+	if err != nil {
+		return false, err
+	}
+	return h.pool.verify(id, val, password)
+}
+
+// Lease waits for a queued job and leases it to a remote worker, until ctx
+// is done.  It fails with ErrNotRemote unless the hasher was configured for
+// remote workers.
+func (h *AsyncHasherChannel) Lease(ctx context.Context, worker string) (Lease, error) {
+	return h.pool.lease(ctx, worker)
+}
+
+// Heartbeat renews a lease, and returns when it now expires.
+func (h *AsyncHasherChannel) Heartbeat(lease string) (time.Time, error) {
+	return h.pool.heartbeat(lease)
+}
+
+// Complete finishes a leased job with the hash the worker computed.
+func (h *AsyncHasherChannel) Complete(lease string, o Outcome) error {
+	return h.pool.complete(lease, o)
+}
+
+// Fail finishes a leased job that the worker couldn't hash.
+func (h *AsyncHasherChannel) Fail(lease string, reason string) error {
+	return h.pool.fail(lease, reason)
+}
+
+// lookup asks the event loop for the result for id, removing it if remove is
+// true.
+func (h *AsyncHasherChannel) lookup(id int64, remove bool) (result, error) {
 	// Now post a request for the hash for the specified id
 	respChan := make(chan hashResponse)
-	h.hashRequestChan <- hashRequest{id, respChan}
+	h.hashRequestChan <- hashRequest{id, remove, respChan}
 
 	// Wait for the response to come back on the channel
 	resp := <-respChan
-
-	return resp.hash, resp.err
+	return resp.val, resp.err
 }
 
 // Stats returns the current statistics about performance of the hash
 // computations being performed, including the total number of Compute
-// requests and the average time (in milliseconds) to perform the hash
-// computation.
+// requests, the average time (in milliseconds) to perform the hash
+// computation, and the distribution of time spent in each stage of a hash.
 func (h *AsyncHasherChannel) Stats() Stats {
-	return <-h.statsChan
+	resp := make(chan Stats)
+	h.statsChan <- resp
+	return <-resp
+}
+
+// ResetStats starts the cumulative stats over from zero.  The gauges and
+// windows aren't affected.
+func (h *AsyncHasherChannel) ResetStats() {
+	h.resetChan <- nil
+}
+
+// Jobs lists every job that hasn't been retrieved yet, oldest first.
+func (h *AsyncHasherChannel) Jobs() []Job {
+	resp := make(chan []Job)
+	h.jobsChan <- resp
+	return <-resp
+}
+
+// Pause stops the hasher from accepting new work.  Hashes that are already in
+// progress continue in the background and can still be retrieved, and Stats
+// keeps working.  Call Resume to start accepting work again.
+func (h *AsyncHasherChannel) Pause() {
+	h.pool.pause()
+}
+
+// Resume undoes a previous call to Pause.  Resuming a hasher that has been
+// drained has no effect.
+func (h *AsyncHasherChannel) Resume() {
+	h.pool.resume()
+}
+
+// Probe verifies the hasher is healthy by making a round trip through the
+// event loop.  If the event loop doesn't answer within timeout, it is assumed
+// to be wedged and ErrUnresponsive is returned.
+func (h *AsyncHasherChannel) Probe(timeout time.Duration) (Health, error) {
+	if h.pool.drained() {
+		return Health{}, ErrDrained
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// The response channel is buffered so that a late answer from the event
+	// loop doesn't block it after we've given up waiting.
+	resp := make(chan Health, 1)
+	select {
+	case h.probeChan <- resp:
+	case <-timer.C:
+		return Health{}, ErrUnresponsive
+	}
+
+	select {
+	case health := <-resp:
+		return health, nil
+	case <-timer.C:
+		return Health{}, ErrUnresponsive
+	}
 }
 
 // Drain cleans up the AsyncHasher and waits for all outstanding asynchronous
@@ -117,8 +353,12 @@ func (h *AsyncHasherChannel) Stats() Stats {
 // because we're simulating these being an expensive operation).  When Drain
 // returns, all resources for the AsyncHasher are in a clean shutdown state.
 func (h *AsyncHasherChannel) Drain() {
-	h.shutdown <- nil
-	h.wg.Wait()
+	// The outstanding hashes report back through the event loop, so it has to
+	// keep running until they are all complete.
+	if h.pool.drain() {
+		h.shutdown <- nil
+	}
+	<-h.done
 }
 
 // Compute performs a sha512 has on the supplied string and returns the
@@ -140,23 +380,45 @@ func Compute(in string) string {
 // such that this is the only thread touching the map of hashes or the central
 // stats value (they are local to this function).
 func (h *AsyncHasherChannel) eventLoop() {
-	h.wg.Add(1)
+	defer close(h.done)
 
-	var hashes = make(map[int64]string)
-	var stats Stats
+	var hashes = make(map[int64]result)
+	var stats recorder
+
+	// Only bother waking up to look for expired hashes if they can expire
+	var sweep <-chan time.Time
+	if h.ttl > 0 {
+		ticker := h.clock.NewTicker(sweepInterval(h.ttl))
+		defer ticker.Stop()
+		sweep = ticker.C()
+	}
 
 loop:
 	for {
 		select {
 		// A hash computation has completed and is adding into the map
-		case pair := <-h.hashPutChan:
-			hashes[pair.id] = pair.hash
+		case c := <-h.hashPutChan:
+			hashes[c.id] = newResult(c, h.clock.Now())
+			h.pool.untrack(c.id)
+			stats.record(c)
 			// A user is requesting the hash for an id
 		case req := <-h.hashRequestChan:
+			h.pool.stall()
 			// get entry in the map and put it back on the channel
 			val, exists := hashes[req.id]
+			if exists && val.expired(h.ttl, h.clock.Now()) {
+				delete(hashes, req.id)
+				stats.expired(1)
+				h.pool.expired(req.id, val)
+				req.resp <- hashResponse{result{}, ErrGone}
+				break
+			}
 			if !exists {
-				req.resp <- hashResponse{"", errors.New("id not found")}
+				req.resp <- hashResponse{result{}, h.pool.missing(req.id)}
+				break
+			}
+			if !req.remove {
+				req.resp <- hashResponse{val, nil}
 				break
 			}
 
@@ -164,35 +426,52 @@ loop:
 			// behavior for asynchronous operations in order to avoid our map growing
 			// boundlessly
 			delete(hashes, req.id)
+			stats.retrieved(h.clock.Now().Sub(val.submitted), val.err == nil)
 			req.resp <- hashResponse{val, nil}
-			// A user is requesting the latest stats
-		case h.statsChan <- stats:
-			// The hash computation has completed and is reporting how long it took
-		case elapsed := <-h.statUpdateChan:
-			stats.update(elapsed)
+			// A user is requesting the latest stats.  Computing them takes
+			// a moment, so it's only done when asked.
+		case resp := <-h.statsChan:
+			h.pool.stall()
+			resp <- h.pool.stats(stats.snapshot(), len(hashes))
+			// A user is starting the stats over
+		case <-h.resetChan:
+			stats.reset()
+			// A user is listing the jobs
+		case resp := <-h.jobsChan:
+			h.pool.stall()
+			resp <- h.pool.listJobs(hashes)
+			// A health probe is checking that we're still responsive
+		case resp := <-h.probeChan:
+			h.pool.stall()
+			health := h.pool.health()
+			health.Stored = len(hashes)
+			resp <- health
+			// Time to throw away hashes nobody came back for
+		case <-sweep:
+			now := h.clock.Now()
+			for id, val := range hashes {
+				if val.expired(h.ttl, now) {
+					delete(hashes, id)
+					stats.expired(1)
+					h.pool.expired(id, val)
+				}
+			}
 			// Drain has been called and its time to exit this loop
 		case <-h.shutdown:
 			break loop
 		}
 	}
-
-	h.wg.Done()
-}
-
-// hashPair represents a new entry to be added into the map of hashes
-type hashPair struct {
-	id   int64
-	hash string
 }
 
 // hashRequest represents a user request to retrieve a hash for id
 type hashRequest struct {
-	id   int64             // The id for the hash to be retrieved
-	resp chan hashResponse // A channel to send the response back to the caller
+	id     int64             // The id for the hash to be retrieved
+	remove bool              // Whether to remove the hash, false to only look at it
+	resp   chan hashResponse // A channel to send the response back to the caller
 }
 
 // hashResponse is sent back from the event loop to the requesting function
 type hashResponse struct {
-	hash string // If no error, the requested hash
-	err  error  // Error indicating hash retreival failed
+	val result // If no error, the completed job for the id
+	err error  // Error indicating hash retreival failed
 }
@@ -1,9 +1,8 @@
 package hasher
 
 import (
-	"errors"
+	"context"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -12,59 +11,67 @@ import (
 // a simple application using channels for synchronization seems like
 // overkill.  See AsyncHasherChannel for an implementation using channels.
 type AsyncHasherMutex struct {
+	pool  *pool         // Runs the hashes in the background
+	clock Clock         // Same as pool.clock
+	ttl   time.Duration // How long completed hashes are kept
+
 	hashMutex sync.Mutex
-	asyncId   int64 // counter of ids to return to ensure uniqueness
-	hashes    map[int64]string
+	hashes    map[int64]result
 
 	statsMutex sync.Mutex
-	stats      Stats
+	stats      recorder
 
-	wg sync.WaitGroup // Used to wait for all long-running operations to complete on shutdown
+	quit chan interface{} // Closed on Drain to stop the expiration sweeper
 }
 
-// NewHasherMutex creates and initializes a new AsyncHasher.
+// NewHasherMutex creates and initializes a new AsyncHasherMutex with the
+// default Config.  It's kept for callers from before New; use New to tune it.
 func NewHasherMutex() AsyncHasher {
+	return newDefault("mutex")
+}
+
+// newHasherMutex creates and initializes a new AsyncHasherMutex.  Use New to
+// create one from a Config that hasn't been validated.
+func newHasherMutex(cfg Config) *AsyncHasherMutex {
 	var hasher AsyncHasherMutex
-	hasher.hashes = make(map[int64]string)
+	hasher.ttl = cfg.TTL
+	hasher.hashes = make(map[int64]result)
+	hasher.quit = make(chan interface{})
+	hasher.pool = newPool(cfg, hasher.store)
+	hasher.clock = hasher.pool.clock
+
+	if cfg.TTL > 0 {
+		go hasher.sweep()
+	}
+
 	return &hasher
 }
 
 // Compute schedules the supplied password to be hashed asynchronously and
 // returns an id that can be supplied to GetAndRemoveHash at a later time to
 // retrieve the hash.  For details on the hash, see hasher.Compute.
-func (h *AsyncHasherMutex) Compute(password string) int64 {
-	// Atomically incrementing is the easiest way to have non-conflicting ids.
-	// If security was a concern, we'd want to consider returning a random integer,
-	// or even better a long alphanumeric key.
-	id := atomic.AddInt64(&h.asyncId, 1)
-
-	h.wg.Add(1)
-	go func() {
-		// The purpose of this sleep is to simulate a longer running
-		// task, so we just sleep.  I considered using time.After along
-		// with a channel to cancel the task mid-operation, but instead
-		// opted to assume this was a "long" running task that is NOT
-		// cancelable.  This means we just have to wait for it to complete
-		// when shutting down.
-		time.Sleep(5 * time.Second)
-
-		// For stats, we're only interested in the real work, which is the hash.
-		// Maybe if the sleep were real work, we would include that too.
-		start := time.Now()
-		hash := Compute(password)
-
-		h.statsMutex.Lock()
-		h.stats.update(time.Since(start))
-		h.statsMutex.Unlock()
+// If the hasher is paused, ErrPaused is returned and no work is scheduled.
+func (h *AsyncHasherMutex) Compute(password string) (int64, error) {
+	return h.pool.submit(context.Background(), password)
+}
 
-		h.hashMutex.Lock()
-		h.hashes[id] = hash
-		h.hashMutex.Unlock()
+// ComputeContext is Compute for a job submitted by the trace.Request carried
+// by ctx.  The request ID is stored with the job, and its spans are recorded
+// in the request's trace.
+func (h *AsyncHasherMutex) ComputeContext(ctx context.Context, password string) (int64, error) {
+	return h.pool.submit(ctx, password)
+}
 
-		h.wg.Done()
-	}()
+// store records the outcome of a completed hash.  It is called by the pool.
+func (h *AsyncHasherMutex) store(c completion) {
+	h.statsMutex.Lock()
+	h.stats.record(c)
+	h.statsMutex.Unlock()
 
-	return id
+	h.hashMutex.Lock()
+	h.hashes[c.id] = newResult(c, h.clock.Now())
+	h.pool.untrack(c.id)
+	h.hashMutex.Unlock()
 }
 
 // GetAndRemoveHash returns the hash that was computed in the background for
@@ -73,30 +80,174 @@ func (h *AsyncHasherMutex) Compute(password string) int64 {
 // This id must have been returned from a previous Compute call.
 // If the hash is not completed yet, an error will be returned.
 func (h *AsyncHasherMutex) GetAndRemoveHash(id int64) (string, error) {
+	res, err := h.Retrieve(context.Background(), id)
+	return res.Hash, err
+}
+
+// Retrieve is GetAndRemoveHash for the request carried by ctx, which is
+// recorded in the job's trace.  It also returns the ID of the request that
+// submitted the job, including when the job failed.
+func (h *AsyncHasherMutex) Retrieve(ctx context.Context, id int64) (Result, error) {
+	start := h.clock.Now()
+	val, err := h.lookup(id, true)
+	if err != nil {
+		return Result{}, err
+	}
+
+	h.pool.retrieved(ctx, id, val, start)
+	return val.get(id)
+}
+
+// Wait blocks until the hash for id is complete, or ctx is done.  It returns
+// straight away if there's no such job, so GetAndRemoveHash may still fail
+// afterwards.
+func (h *AsyncHasherMutex) Wait(ctx context.Context, id int64) error {
+	return h.pool.wait(ctx, id)
+}
+
+// Verify checks whether password hashes to the hash for id, without removing
+// it.  It fails the same way GetAndRemoveHash would.
+func (h *AsyncHasherMutex) Verify(ctx context.Context, id int64, password string) (bool, error) {
+	val, err := h.lookup(id, false)
+	if err != nil {
+		return false, err
+	}
+	return h.pool.verify(id, val, password)
+}
+
+// Lease waits for a queued job and leases it to a remote worker, until ctx
+// is done.  It fails with ErrNotRemote unless the hasher was configured for
+// remote workers.
+func (h *AsyncHasherMutex) Lease(ctx context.Context, worker string) (Lease, error) {
+	return h.pool.lease(ctx, worker)
+}
+
+// Heartbeat renews a lease, and returns when it now expires.
+func (h *AsyncHasherMutex) Heartbeat(lease string) (time.Time, error) {
+	return h.pool.heartbeat(lease)
+}
+
+// Complete finishes a leased job with the hash the worker computed.
+func (h *AsyncHasherMutex) Complete(lease string, o Outcome) error {
+	return h.pool.complete(lease, o)
+}
+
+// Fail finishes a leased job that the worker couldn't hash.
+func (h *AsyncHasherMutex) Fail(lease string, reason string) error {
+	return h.pool.fail(lease, reason)
+}
+
+// lookup returns the completed job for id, removing it if remove is true.
+func (h *AsyncHasherMutex) lookup(id int64, remove bool) (result, error) {
 	h.hashMutex.Lock()
 	defer h.hashMutex.Unlock()
+	h.pool.stall()
 
 	val, exists := h.hashes[id]
+	if exists && val.expired(h.ttl, h.clock.Now()) {
+		delete(h.hashes, id)
+		h.statsMutex.Lock()
+		h.stats.expired(1)
+		h.statsMutex.Unlock()
+		h.pool.expired(id, val)
+		return result{}, ErrGone
+	}
 	if !exists {
-		return "", errors.New("id not found")
+		// Holding hashMutex keeps the job from being stored while we look
+		return result{}, h.pool.missing(id)
+	}
+	if !remove {
+		return val, nil
 	}
 
 	// After the value is retrieved, remove it from the map.  This is typical
 	// behavior for asynchronous operations in order to avoid our map growing
 	// boundlessly
 	delete(h.hashes, id)
+	h.statsMutex.Lock()
+	h.stats.retrieved(h.clock.Now().Sub(val.submitted), val.err == nil)
+	h.statsMutex.Unlock()
 	return val, nil
 }
 
 // Stats returns the current statistics about performance of the hash
 // computations being performed, including the total number of Compute
-// requests and the average time (in milliseconds) to perform the hash
-// computation.
+// requests, the average time (in milliseconds) to perform the hash
+// computation, and the distribution of time spent in each stage of a hash.
 func (h *AsyncHasherMutex) Stats() Stats {
+	h.hashMutex.Lock()
+	h.pool.stall()
+	stored := len(h.hashes)
+	h.hashMutex.Unlock()
+
+	h.statsMutex.Lock()
+	defer h.statsMutex.Unlock()
+
+	return h.pool.stats(h.stats.snapshot(), stored)
+}
+
+// ResetStats starts the cumulative stats over from zero.  The gauges and
+// windows aren't affected.
+func (h *AsyncHasherMutex) ResetStats() {
 	h.statsMutex.Lock()
 	defer h.statsMutex.Unlock()
 
-	return h.stats
+	h.stats.reset()
+}
+
+// Jobs lists every job that hasn't been retrieved yet, oldest first.
+func (h *AsyncHasherMutex) Jobs() []Job {
+	h.hashMutex.Lock()
+	defer h.hashMutex.Unlock()
+	h.pool.stall()
+
+	return h.pool.listJobs(h.hashes)
+}
+
+// Pause stops the hasher from accepting new work.  Hashes that are already in
+// progress continue in the background and can still be retrieved, and Stats
+// keeps working.  Call Resume to start accepting work again.
+func (h *AsyncHasherMutex) Pause() {
+	h.pool.pause()
+}
+
+// Resume undoes a previous call to Pause.  Resuming a hasher that has been
+// drained has no effect.
+func (h *AsyncHasherMutex) Resume() {
+	h.pool.resume()
+}
+
+// Probe verifies the hasher is healthy by acquiring each of its locks.  If
+// that can't be done within timeout, a lock is assumed to be held forever and
+// ErrUnresponsive is returned.
+func (h *AsyncHasherMutex) Probe(timeout time.Duration) (Health, error) {
+	if h.pool.drained() {
+		return Health{}, ErrDrained
+	}
+
+	// A wedged lock would wedge us too, so take the locks in the background
+	// and only wait as long as we were asked to.  The channel is buffered so
+	// the goroutine can always finish once the locks are free.
+	resp := make(chan Health, 1)
+	go func() {
+		h.statsMutex.Lock()
+		h.statsMutex.Unlock()
+
+		h.hashMutex.Lock()
+		defer h.hashMutex.Unlock()
+		h.pool.stall()
+
+		health := h.pool.health()
+		health.Stored = len(h.hashes)
+		resp <- health
+	}()
+
+	select {
+	case health := <-resp:
+		return health, nil
+	case <-time.After(timeout):
+		return Health{}, ErrUnresponsive
+	}
 }
 
 // Drain cleans up the AsyncHasher and waits for all outstanding asynchronous
@@ -104,5 +255,36 @@ func (h *AsyncHasherMutex) Stats() Stats {
 // because we're simulating these being an expensive operation).  When Drain
 // returns, all resources for the AsyncHasher are in a clean shutdown state.
 func (h *AsyncHasherMutex) Drain() {
-	h.wg.Wait()
+	if h.pool.drain() {
+		close(h.quit)
+	}
+}
+
+// sweep periodically throws away hashes nobody came back for.
+func (h *AsyncHasherMutex) sweep() {
+	ticker := h.clock.NewTicker(sweepInterval(h.ttl))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			now := h.clock.Now()
+			expired := 0
+			h.hashMutex.Lock()
+			for id, val := range h.hashes {
+				if val.expired(h.ttl, now) {
+					delete(h.hashes, id)
+					expired++
+					h.pool.expired(id, val)
+				}
+			}
+			h.hashMutex.Unlock()
+
+			h.statsMutex.Lock()
+			h.stats.expired(expired)
+			h.statsMutex.Unlock()
+		case <-h.quit:
+			return
+		}
+	}
 }
@@ -1,43 +1,659 @@
 package hasher
 
 import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/jaredcantwell/hash-server/trace"
 )
 
 // Missing Tests
 // -------------
 // These tests should be added in order to have complete test coverage:
 // - Many outstanding Compute calls at once
-// - GetAndRemoveHash should return an error if hash isn't computed yet
-// - GetAndRemoveHash should return an error if an invalid hash is provided
-// - GetAndRemoveHash should return an error if a hash was already retrieved
-// - Verify that Stats properly updates totals and averages
 // - Verify many concurrent calls to Stats
 // - Stress test many calls to Stats at once (or in quick succession)
 
+// testDelay is the simulated delay used by tests.  It only passes when the
+// test advances the FakeClock, so the actual value doesn't matter.
+const testDelay = 5 * time.Second
+
+// newTestHashers creates a hasher of every registered implementation with the
+// supplied config tweaks, so each test covers all of them.  Each hasher gets
+// its own FakeClock.
+func newTestHashers(t *testing.T, tweak func(*Config)) map[string]AsyncHasher {
+	hashers := make(map[string]AsyncHasher)
+	for _, name := range Implementations() {
+		cfg := DefaultConfig()
+		cfg.Implementation = name
+		cfg.Delay = testDelay
+		cfg.Clock = NewFakeClock(time.Unix(0, 0))
+		if tweak != nil {
+			tweak(&cfg)
+		}
+
+		h, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashers[name] = h
+	}
+	return hashers
+}
+
+// clockOf returns the FakeClock a test hasher was created with.
+func clockOf(h AsyncHasher) *FakeClock {
+	switch h := h.(type) {
+	case *AsyncHasherChannel:
+		return h.clock.(*FakeClock)
+	case *AsyncHasherMutex:
+		return h.clock.(*FakeClock)
+	}
+	panic("unknown hasher")
+}
+
+// waitFor polls cond until it is true.  Advancing a FakeClock wakes up the
+// background goroutines, but they still need a moment to record the result.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// waitForHash polls until the hash for id is available.
+func waitForHash(t *testing.T, h AsyncHasher, id int64) string {
+	var hash string
+	waitFor(t, "hash", func() bool {
+		var err error
+		hash, err = h.GetAndRemoveHash(id)
+		return err == nil
+	})
+	return hash
+}
+
 func TestHasher(t *testing.T) {
-	h := New()
+	for name, h := range newTestHashers(t, nil) {
+		clock := clockOf(h)
+
+		id, err := h.Compute("angryMonkey")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The hash can't be done until the delay has passed
+		clock.BlockUntil(1)
+		clock.Advance(testDelay - time.Millisecond)
+		if _, err = h.GetAndRemoveHash(id); err == nil {
+			t.Errorf("%s: hash available before the delay", name)
+		}
 
-	id := h.Compute("angryMonkey")
-	_, err := h.GetAndRemoveHash(id)
-	if err == nil {
-		t.Fail()
+		clock.Advance(time.Millisecond)
+		if hash := waitForHash(t, h, id); hash != Compute("angryMonkey") {
+			t.Errorf("%s: wrong hash %s", name, hash)
+		}
+
+		// A hash can only be retrieved once
+		if _, err = h.GetAndRemoveHash(id); err == nil {
+			t.Errorf("%s: hash retrieved twice", name)
+		}
+
+		// Ids that were never handed out don't exist
+		if _, err = h.GetAndRemoveHash(id + 1); err == nil {
+			t.Errorf("%s: retrieved a hash for an invalid id", name)
+		}
+
+		h.Drain()
 	}
+}
+
+// TestStats verifies that Stats counts each hash and averages the time spent
+// in the work function separately from the simulated work.
+func TestStats(t *testing.T) {
+	var clock *FakeClock
+	elapsed := []time.Duration{2 * time.Millisecond, 4 * time.Millisecond, 9 * time.Millisecond}
+	calls := 0
+
+	for _, name := range Implementations() {
+		clock = NewFakeClock(time.Unix(0, 0))
+		calls = 0
 
-	for {
-		time.Sleep(time.Second)
-		hash, err := h.GetAndRemoveHash(id)
+		h, err := New(Config{
+			Implementation: name,
+			Algorithm:      "sha512",
+			Workers:        1,
+			QueueDepth:     10,
+			Delay:          testDelay,
+			Clock:          clock,
+			Work: func(password string) (string, error) {
+				// With one worker, calls are never concurrent
+				clock.Advance(elapsed[calls])
+				calls++
+				return Compute(password), nil
+			},
+		})
 		if err != nil {
-			continue
+			t.Fatal(err)
+		}
+
+		var ids []int64
+		for range elapsed {
+			id, _ := h.Compute("angryMonkey")
+			ids = append(ids, id)
+		}
+		for i := range elapsed {
+			clock.BlockUntil(1)
+			clock.Advance(testDelay)
+			waitFor(t, "stats", func() bool { return h.Stats().Total == uint64(i+1) })
 		}
 
-		if hash != Compute("angryMonkey") {
-			t.Fail()
+		if stats := h.Stats(); stats.Total != 3 || stats.Avg != 5 || stats.SimulatedAvg != 5000 {
+			t.Errorf("%s: got %+v, want 3 hashes averaging 5ms after 5s of simulated work", name, stats)
 		}
 
-		break
+		if stats := h.Stats(); stats.Stored != 3 || stats.Queued != 0 || stats.InFlight != 0 {
+			t.Errorf("%s: gauges %+v", name, stats)
+		}
+
+		// Each hash waited in the queue for the ones before it, and all
+		// were submitted at time 0 and retrieved at the end.
+		for _, id := range ids {
+			h.GetAndRemoveHash(id)
+		}
+		stats := h.Stats()
+		if stats.Hash.Min != 2 || stats.Hash.Max != 9 || math.Abs(stats.Hash.P50-4) > 0.06 {
+			t.Errorf("%s: hash latencies %+v", name, stats.Hash)
+		}
+		if stats.Queue.Min != 0 || stats.Queue.Max != 10006 {
+			t.Errorf("%s: queue latencies %+v", name, stats.Queue)
+		}
+		if stats.EndToEnd.Count != 3 || stats.EndToEnd.Min != 15015 || stats.EndToEnd.StdDev != 0 {
+			t.Errorf("%s: end-to-end latencies %+v", name, stats.EndToEnd)
+		}
+
+		// Resetting only starts the cumulative stats over
+		h.ResetStats()
+		stats = h.Stats()
+		if stats.Total != 0 || stats.Hash.Count != 0 || stats.Windows[2].Completed != 3 {
+			t.Errorf("%s: after reset %+v", name, stats)
+		}
+
+		h.Drain()
 	}
+}
+
+// TestJobFailure verifies that a job whose work fails is reported once with
+// the reason, and doesn't count towards the stats.
+func TestJobFailure(t *testing.T) {
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Work = func(password string) (string, error) {
+			return "", errors.New("out of entropy")
+		}
+	})
+
+	for name, h := range hashers {
+		clock := clockOf(h)
+
+		id, _ := h.Compute("angryMonkey")
+		clock.BlockUntil(1)
+		clock.Advance(testDelay)
+
+		var err error
+		waitFor(t, "failure", func() bool {
+			_, err = h.GetAndRemoveHash(id)
+			return err != ErrPending
+		})
+
+		jobErr, ok := err.(*JobError)
+		if !ok || jobErr.ID != id || jobErr.Reason != "out of entropy" {
+			t.Errorf("%s: got %v, want a JobError", name, err)
+		}
+		if _, err = h.GetAndRemoveHash(id); err != ErrGone {
+			t.Errorf("%s: failure reported twice: %v", name, err)
+		}
+		if stats := h.Stats(); stats.Total != 0 || stats.Failed != 1 {
+			t.Errorf("%s: failed job counted wrong in stats: %+v", name, stats)
+		}
+
+		h.Drain()
+	}
+}
+
+// TestPanic verifies that a panicking hash fails its job without killing the
+// worker or leaving Drain waiting for it.
+func TestPanic(t *testing.T) {
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Workers = 1
+		cfg.QueueDepth = 1
+		cfg.Work = func(password string) (string, error) {
+			if password == "boom" {
+				panic("kaboom")
+			}
+			return Compute(password), nil
+		}
+	})
+
+	for name, h := range hashers {
+		clock := clockOf(h)
+
+		bad, _ := h.Compute("boom")
+		clock.BlockUntil(1)
+		good, err := h.Compute("angryMonkey")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(testDelay)
+		clock.BlockUntil(1)
+		clock.Advance(testDelay)
+
+		// The only worker survived the panic to compute the next hash
+		if hash := waitForHash(t, h, good); hash != Compute("angryMonkey") {
+			t.Errorf("%s: got %s", name, hash)
+		}
+
+		_, err = h.GetAndRemoveHash(bad)
+		if jobErr, ok := err.(*JobError); !ok || jobErr.Reason != "panic: kaboom" {
+			t.Errorf("%s: got %v, want a JobError", name, err)
+		}
+		if stats := h.Stats(); stats.Total != 1 || stats.Failed != 1 {
+			t.Errorf("%s: got %+v", name, stats)
+		}
+
+		h.Drain()
+	}
+}
+
+// TestPause verifies that a paused hasher refuses work until resumed, and
+// that Drain is final.
+func TestPause(t *testing.T) {
+	for name, h := range newTestHashers(t, nil) {
+		clock := clockOf(h)
+
+		h.Pause()
+		if _, err := h.Compute("angryMonkey"); err != ErrPaused {
+			t.Errorf("%s: Compute while paused returned %v", name, err)
+		}
+
+		h.Resume()
+		if _, err := h.Compute("angryMonkey"); err != nil {
+			t.Errorf("%s: Compute after resume returned %v", name, err)
+		}
+
+		// Drain has to wait for the outstanding hash
+		drained := make(chan interface{})
+		go func() {
+			h.Drain()
+			close(drained)
+		}()
+
+		clock.BlockUntil(1)
+		select {
+		case <-drained:
+			t.Fatalf("%s: Drain returned with a hash outstanding", name)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		clock.Advance(testDelay)
+		<-drained
+
+		h.Resume()
+		if _, err := h.Compute("angryMonkey"); err != ErrPaused {
+			t.Errorf("%s: Compute after drain returned %v", name, err)
+		}
+		if _, err := h.Probe(time.Second); err != ErrDrained {
+			t.Errorf("%s: Probe after drain returned %v", name, err)
+		}
+
+		// Drain is safe to call more than once
+		h.Drain()
+	}
+}
+
+// TestQueueFull verifies that a hasher with a bounded queue fails fast once
+// every worker is busy and the queue is full.
+func TestQueueFull(t *testing.T) {
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Workers = 1
+		cfg.QueueDepth = 1
+	})
+
+	for name, h := range hashers {
+		clock := clockOf(h)
+
+		// One for the worker, which has to pick it up before the next
+		// one can sit in the queue
+		h.Compute("angryMonkey")
+		clock.BlockUntil(1)
+		h.Compute("angryMonkey")
+
+		if _, err := h.Compute("angryMonkey"); err != ErrQueueFull {
+			t.Errorf("%s: got %v, want ErrQueueFull", name, err)
+		}
 
-	h.Drain()
+		health, err := h.Probe(time.Second)
+		if err != nil || health != (Health{Pending: 2, Queued: 1, Capacity: 1}) {
+			t.Errorf("%s: Probe() = %+v, %v", name, health, err)
+		}
+
+		go h.Drain()
+		clock.Advance(testDelay)
+		clock.BlockUntil(1)
+		clock.Advance(testDelay)
+	}
+}
+
+// TestTTL verifies that hashes which aren't retrieved in time expire.
+func TestTTL(t *testing.T) {
+	const ttl = time.Minute
+	var mu sync.Mutex
+	var discarded []Discard
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.TTL = ttl
+		cfg.OnDiscard = func(r JobResult, why Discard) {
+			mu.Lock()
+			defer mu.Unlock()
+			discarded = append(discarded, why)
+		}
+	})
+
+	for name, h := range hashers {
+		clock := clockOf(h)
+		mu.Lock()
+		discarded = nil
+		mu.Unlock()
+
+		first, _ := h.Compute("angryMonkey")
+		second, _ := h.Compute("angryMonkey")
+
+		// Two sleepers plus the expiration ticker
+		clock.BlockUntil(3)
+		clock.Advance(testDelay)
+		waitFor(t, "hashes", func() bool {
+			health, _ := h.Probe(time.Second)
+			return health.Stored == 2
+		})
+
+		// The first hash is retrieved just in time, the second isn't
+		clock.Advance(ttl - time.Second)
+		if _, err := h.GetAndRemoveHash(first); err != nil {
+			t.Errorf("%s: hash expired early: %v", name, err)
+		}
+
+		clock.Advance(time.Second)
+		if _, err := h.GetAndRemoveHash(second); err == nil {
+			t.Errorf("%s: hash did not expire", name)
+		}
+
+		// Expired hashes that nobody asks for are cleaned up in the background
+		h.Compute("angryMonkey")
+		clock.BlockUntil(2)
+		clock.Advance(testDelay)
+		waitFor(t, "hash", func() bool {
+			health, _ := h.Probe(time.Second)
+			return health.Stored == 1
+		})
+		clock.Advance(ttl + sweepInterval(ttl))
+		waitFor(t, "sweep", func() bool {
+			health, _ := h.Probe(time.Second)
+			return health.Stored == 0
+		})
+
+		// Both ways of expiring are reported
+		mu.Lock()
+		if len(discarded) != 2 || discarded[0] != DiscardExpired || discarded[1] != DiscardExpired {
+			t.Errorf("%s: discarded %v", name, discarded)
+		}
+		mu.Unlock()
+
+		h.Drain()
+	}
+}
+
+// TestNewInvalid verifies that New rejects bad configuration.
+func TestNewInvalid(t *testing.T) {
+	for _, tweak := range []func(*Config){
+		func(cfg *Config) { cfg.Implementation = "bogus" },
+		func(cfg *Config) { cfg.Algorithm = "md4" },
+		func(cfg *Config) { cfg.Workers = -1 },
+		func(cfg *Config) { cfg.Delay = -time.Second },
+		func(cfg *Config) { cfg.Node = MaxNode + 1 },
+		func(cfg *Config) { cfg.Node = 3; cfg.LastID = makeID(2, 5) },
+		func(cfg *Config) { cfg.Remote = true },
+		func(cfg *Config) { cfg.Remote, cfg.QueueDepth, cfg.Workers = true, 1, 1 },
+	} {
+		cfg := DefaultConfig()
+		tweak(&cfg)
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
+
+// TestConstructors verifies that the constructors from before New still
+// build the implementation they're named for.
+func TestConstructors(t *testing.T) {
+	channel, mutex := NewHasherChannel(), NewHasherMutex()
+	defer channel.Drain()
+	defer mutex.Drain()
+	if _, ok := channel.(*AsyncHasherChannel); !ok {
+		t.Errorf("NewHasherChannel() = %T", channel)
+	}
+	if _, ok := mutex.(*AsyncHasherMutex); !ok {
+		t.Errorf("NewHasherMutex() = %T", mutex)
+	}
+}
+
+// TestJobs verifies that Jobs follows each job from the queue through to
+// retrieval.
+func TestJobs(t *testing.T) {
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Workers = 1
+		cfg.QueueDepth = 5
+	})
+
+	states := func(h AsyncHasher) []string {
+		var s []string
+		for _, job := range h.Jobs() {
+			s = append(s, job.State)
+		}
+		return s
+	}
+
+	for name, h := range hashers {
+		clock := clockOf(h)
+
+		first, _ := h.Compute("angryMonkey")
+		clock.BlockUntil(1)
+		h.Compute("angryMonkey")
+		clock.Advance(time.Second)
+
+		jobs := h.Jobs()
+		if got := states(h); !reflect.DeepEqual(got, []string{JobRunning, JobQueued}) {
+			t.Errorf("%s: got %v", name, got)
+		}
+		if jobs[0].ID != first || jobs[0].Age != time.Second {
+			t.Errorf("%s: got %+v", name, jobs[0])
+		}
+
+		// The second job starts once the first is done
+		clock.Advance(testDelay)
+		waitFor(t, "first hash", func() bool {
+			return reflect.DeepEqual(states(h), []string{JobCompleted, JobRunning})
+		})
+
+		h.GetAndRemoveHash(first)
+		if got := states(h); !reflect.DeepEqual(got, []string{JobRunning}) {
+			t.Errorf("%s: got %v", name, got)
+		}
+
+		clock.BlockUntil(1)
+		clock.Advance(testDelay)
+		h.Drain()
+	}
+}
+
+// spanRecorder is a trace.Exporter that keeps the spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []trace.Span
+}
+
+func (r *spanRecorder) Export(spans []trace.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	for _, name := range Implementations() {
+		var exported spanRecorder
+		tracer := trace.New(&exported)
+
+		cfg := DefaultConfig()
+		cfg.Implementation = name
+		cfg.Delay = testDelay
+		clock := NewFakeClock(time.Unix(0, 0))
+		cfg.Clock = clock
+		cfg.Tracer = tracer
+		h, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := trace.Request{ID: "req-1", Trace: trace.NewTraceID(), Parent: trace.NewSpanID()}
+		id, err := h.ComputeContext(trace.NewContext(context.Background(), req), "angryMonkey")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs := h.Jobs(); len(jobs) != 1 || jobs[0].RequestID != "req-1" {
+			t.Errorf("%s: got jobs %+v", name, jobs)
+		}
+
+		clock.BlockUntil(1)
+		clock.Advance(testDelay)
+		var res Result
+		waitFor(t, "hash", func() bool {
+			res, err = h.Retrieve(context.Background(), id)
+			return err == nil
+		})
+		if res.RequestID != "req-1" || res.Hash != Compute("angryMonkey") {
+			t.Errorf("%s: got %+v", name, res)
+		}
+		h.Drain()
+		tracer.Close()
+
+		spans := make(map[string]trace.Span)
+		for _, s := range exported.spans {
+			spans[s.Name] = s
+		}
+		root := spans["hash job"]
+		if root.Trace != req.Trace || root.Parent != req.Parent || root.Attributes["hash.request_id"] != "req-1" {
+			t.Errorf("%s: got root span %+v", name, root)
+		}
+		for _, phase := range []string{"queued", "simulated work", "hash", "stored", "retrieved"} {
+			s, ok := spans[phase]
+			if !ok || s.Trace != req.Trace || s.Parent != root.ID {
+				t.Errorf("%s: got %s span %+v", name, phase, s)
+			}
+		}
+		if d := spans["simulated work"].End.Sub(spans["simulated work"].Start); d != testDelay {
+			t.Errorf("%s: simulated work took %s", name, d)
+		}
+	}
+}
+
+// TestWaitAndVerify verifies that Wait returns once a hash is complete, that
+// Verify doesn't use the hash up, and that missing hashes say why.
+func TestWaitAndVerify(t *testing.T) {
+	for name, h := range newTestHashers(t, nil) {
+		clock := clockOf(h)
+		ctx := context.Background()
+
+		id, _ := h.Compute("angryMonkey")
+		if _, err := h.Verify(ctx, id, "angryMonkey"); err != ErrPending {
+			t.Errorf("%s: Verify before completion returned %v", name, err)
+		}
+
+		waited := make(chan error)
+		go func() { waited <- h.Wait(ctx, id) }()
+		clock.BlockUntil(1)
+		select {
+		case <-waited:
+			t.Fatalf("%s: Wait returned before the hash was complete", name)
+		case <-time.After(10 * time.Millisecond):
+		}
+		clock.Advance(testDelay)
+		if err := <-waited; err != nil {
+			t.Fatalf("%s: Wait returned %v", name, err)
+		}
+
+		// Wait guarantees the hash is there to be found
+		for password, want := range map[string]bool{"angryMonkey": true, "happyMonkey": false} {
+			if match, err := h.Verify(ctx, id, password); err != nil || match != want {
+				t.Errorf("%s: Verify(%s) returned %v, %v", name, password, match, err)
+			}
+		}
+		if hash, err := h.GetAndRemoveHash(id); err != nil || hash != Compute("angryMonkey") {
+			t.Errorf("%s: GetAndRemoveHash returned %q, %v", name, hash, err)
+		}
+
+		if _, err := h.Verify(ctx, id, "angryMonkey"); err != ErrGone {
+			t.Errorf("%s: Verify after retrieval returned %v", name, err)
+		}
+		if _, err := h.GetAndRemoveHash(id + 1); err != ErrNotFound {
+			t.Errorf("%s: GetAndRemoveHash of an unknown id returned %v", name, err)
+		}
+		if !errors.Is(ErrPending, ErrNotFound) || !errors.Is(ErrGone, ErrNotFound) {
+			t.Errorf("ErrPending and ErrGone should match ErrNotFound")
+		}
+
+		h.Drain()
+	}
+}
+
+// TestNode verifies that ids carry the node that issued them, and that an id
+// from another node is unknown here.
+func TestNode(t *testing.T) {
+	for name, h := range newTestHashers(t, func(cfg *Config) { cfg.Node = 3 }) {
+		clock := clockOf(h)
+
+		id, _ := h.Compute("angryMonkey")
+		if NodeOf(id) != 3 || sequenceOf(id) != 1 {
+			t.Errorf("%s: id %d is node %d sequence %d", name, id, NodeOf(id), sequenceOf(id))
+		}
+		if _, err := h.GetAndRemoveHash(makeID(4, 1)); err != ErrNotFound {
+			t.Errorf("%s: GetAndRemoveHash of another node's id returned %v", name, err)
+		}
+
+		clock.BlockUntil(1)
+		clock.Advance(testDelay)
+		waitForHash(t, h, id)
+		if _, err := h.GetAndRemoveHash(id); err != ErrGone {
+			t.Errorf("%s: second GetAndRemoveHash returned %v", name, err)
+		}
+		h.Drain()
+	}
+
+	// After a restart, ids carry on from the last one issued before it, and
+	// the earlier ones are reported as gone
+	for name, h := range newTestHashers(t, func(cfg *Config) {
+		cfg.Node, cfg.LastID, cfg.Delay = 3, makeID(3, 10), 0
+	}) {
+		if id, _ := h.Compute("angryMonkey"); id != makeID(3, 11) {
+			t.Errorf("%s: restarted node issued sequence %d", name, sequenceOf(id))
+		}
+		if _, err := h.GetAndRemoveHash(makeID(3, 4)); err != ErrGone {
+			t.Errorf("%s: GetAndRemoveHash of an id from before the restart returned %v", name, err)
+		}
+		h.Drain()
+	}
 }
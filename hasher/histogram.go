@@ -0,0 +1,165 @@
+package hasher
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// The histogram is laid out like an HDR histogram.  Values below
+// subBucketCount get a bucket each.  Above that, every power of two is split
+// into subBucketHalf linear buckets, so each bucket is within 1/subBucketHalf
+// (about 1.5%) of the values it holds no matter how large they get.  That
+// covers every possible time.Duration in at most bucketCount buckets, and
+// since only the buckets that are used are stored, latencies that cluster
+// take far fewer.
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+	bucketCount    = subBucketCount + (64-subBucketBits)*subBucketHalf
+)
+
+// histogram records durations, in nanoseconds, with bounded memory and
+// bounded relative error.  The count, min, max, mean and standard deviation
+// are exact.  Only the percentiles are approximated by the buckets.
+type histogram struct {
+	counts  map[int]uint64 // Bucket index to count, nil until something is recorded
+	count   uint64
+	min     int64
+	max     int64
+	sum     float64
+	squares float64 // Sum of the squares, for the standard deviation
+}
+
+// bucketIndex returns the bucket that v belongs in.
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	return subBucketCount + (shift-1)*subBucketHalf + int(v>>uint(shift)) - subBucketHalf
+}
+
+// bucketValue returns the middle of the range of values in bucket i.
+func bucketValue(i int) int64 {
+	if i < subBucketCount {
+		return int64(i)
+	}
+	shift := uint((i-subBucketCount)/subBucketHalf + 1)
+	top := int64((i-subBucketCount)%subBucketHalf + subBucketHalf)
+	return top<<shift + (int64(1)<<shift)/2
+}
+
+// record adds a duration to the histogram.  Negative durations, which a clock
+// stepping backwards could produce, are recorded as 0.
+func (h *histogram) record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+
+	if h.counts == nil {
+		h.counts = make(map[int]uint64)
+	}
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.counts[bucketIndex(v)]++
+	h.sum += float64(v)
+	h.squares += float64(v) * float64(v)
+}
+
+// percentile returns the smallest recorded value that q of the values are
+// less than or equal to, for q between 0 and 1.
+func (h *histogram) percentile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	buckets := make([]int, 0, len(h.counts))
+	for i := range h.counts {
+		buckets = append(buckets, i)
+	}
+	sort.Ints(buckets)
+
+	var seen uint64
+	for _, i := range buckets {
+		seen += h.counts[i]
+		if seen >= rank {
+			// The exact extremes are known, so don't report past them
+			v := bucketValue(i)
+			if v < h.min {
+				v = h.min
+			}
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// merge adds everything recorded in o to h.
+func (h *histogram) merge(o *histogram) {
+	if o.count == 0 {
+		return
+	}
+	if h.counts == nil {
+		h.counts = make(map[int]uint64)
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.count += o.count
+	h.sum += o.sum
+	h.squares += o.squares
+}
+
+// summary reports the histogram in milliseconds, like the rest of Stats.
+func (h *histogram) summary() Latencies {
+	if h.count == 0 {
+		return Latencies{}
+	}
+
+	mean := h.sum / float64(h.count)
+	variance := h.squares/float64(h.count) - mean*mean
+	if variance < 0 {
+		// Rounding error when every value is the same
+		variance = 0
+	}
+
+	return Latencies{
+		Count:  h.count,
+		Min:    ms(h.min),
+		Max:    ms(h.max),
+		Mean:   mean / 1e6,
+		StdDev: math.Sqrt(variance) / 1e6,
+		P50:    ms(h.percentile(0.5)),
+		P90:    ms(h.percentile(0.9)),
+		P99:    ms(h.percentile(0.99)),
+		P999:   ms(h.percentile(0.999)),
+	}
+}
+
+// ms converts nanoseconds to milliseconds.
+func ms(ns int64) float64 {
+	return float64(ns) / 1e6
+}
@@ -0,0 +1,78 @@
+package hasher
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestHistogram verifies the percentiles stay within the promised error
+// across many orders of magnitude, and that the exact values are exact.
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 100000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+
+	s := h.summary()
+	if s.Count != 100000 || s.Min != 0.001 || s.Max != 100 || math.Abs(s.Mean-50.0005) > 1e-9 {
+		t.Errorf("got %+v", s)
+	}
+	for _, tc := range []struct{ got, want float64 }{
+		{s.P50, 50}, {s.P90, 90}, {s.P99, 99}, {s.P999, 99.9}, {s.StdDev, 28.8675},
+	} {
+		if math.Abs(tc.got-tc.want)/tc.want > 0.015 {
+			t.Errorf("got %v, want %v", tc.got, tc.want)
+		}
+	}
+}
+
+// TestBuckets verifies every bucket holds the values it claims to.
+func TestBuckets(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 129, 255, 256, 1000, 1 << 40, math.MaxInt64} {
+		i := bucketIndex(v)
+		if i < 0 || i >= bucketCount {
+			t.Fatalf("%d: bucket %d out of range", v, i)
+		}
+		if got := bucketValue(i); math.Abs(float64(got-v)) > float64(v)/subBucketHalf {
+			t.Errorf("%d: bucket %d has value %d", v, i, got)
+		}
+	}
+
+	var h histogram
+	if h.percentile(0.5) != 0 || h.summary() != (Latencies{}) {
+		t.Error("empty histogram isn't empty")
+	}
+	h.record(-time.Second)
+	if h.min != 0 || h.max != 0 {
+		t.Errorf("negative duration recorded as %d", h.min)
+	}
+}
+
+// TestMerge verifies that merging histograms is the same as recording
+// everything in one.
+func TestMerge(t *testing.T) {
+	var all, a, b, merged histogram
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i*i) * time.Microsecond
+		all.record(d)
+		if i%3 == 0 {
+			a.record(d)
+		} else {
+			b.record(d)
+		}
+	}
+
+	merged.merge(&a)
+	merged.merge(&b)
+	merged.merge(&histogram{})
+	// The sums are floating point, so adding in a different order can round
+	// differently
+	got, want := merged.summary(), all.summary()
+	if math.Abs(got.StdDev-want.StdDev) < 1e-6 && math.Abs(got.Mean-want.Mean) < 1e-6 {
+		got.StdDev, got.Mean = want.StdDev, want.Mean
+	}
+	if got != want {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
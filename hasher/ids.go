@@ -0,0 +1,30 @@
+package hasher
+
+// Every id carries the node that issued it, the way Snowflake ids do, so that
+// a cluster of servers can hand out ids without coordinating and any of them
+// can tell which node holds the hash for an id without a lookup.  The top bits
+// of an id hold the node and the rest a sequence counting up from 1.  Node 0
+// issues the same ids, 1, 2, 3 and so on, as a hasher that isn't part of a
+// cluster.
+const (
+	nodeBits     = 10
+	sequenceBits = 63 - nodeBits
+
+	// MaxNode is the largest Config.Node.
+	MaxNode = 1<<nodeBits - 1
+)
+
+// NodeOf returns the node that issued id.
+func NodeOf(id int64) int {
+	return int(id >> sequenceBits)
+}
+
+// makeID builds the id of the seq'th job submitted to node.
+func makeID(node int, seq int64) int64 {
+	return int64(node)<<sequenceBits | seq
+}
+
+// sequenceOf returns the sequence part of id.
+func sequenceOf(id int64) int64 {
+	return id & (1<<sequenceBits - 1)
+}
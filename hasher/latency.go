@@ -0,0 +1,278 @@
+package hasher
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency decides how long each hash spends in simulated work before the
+// real hash is computed.  This stands in for whatever expensive operation a
+// production hasher would be doing, so load tests can model its behavior.
+type Latency interface {
+	Next() time.Duration
+}
+
+// ParseLatency builds a Latency from a profile spec.  The spec names a
+// distribution followed by its parameters:
+//
+//	fixed:5s             always 5s
+//	uniform:1s,5s        uniformly distributed between 1s and 5s
+//	normal:5s,1s         normally distributed with a mean of 5s and standard deviation of 1s
+//	lognormal:5s,0.5     log-normally distributed with a median of 5s and sigma of 0.5
+//	trace:delays.txt     replays the delays in a file, one per line, in order
+//
+// Any of these can be followed by "+stall:P,D" to add an extra D to a
+// fraction P of the delays, modeling occasional long-tail stalls.  For
+// example "normal:5s,1s+stall:0.01,30s".  Negative delays are treated as 0.
+//
+// Random profiles draw from a source seeded with seed, so the same spec and
+// seed always produce the same sequence of delays.
+func ParseLatency(spec string, seed int64) (Latency, error) {
+	rng := &lockedRand{r: rand.New(rand.NewSource(seed))}
+
+	// Trace file names can contain a "+", so only a trailing "+stall:" counts
+	base, stall := spec, ""
+	if i := strings.LastIndex(spec, "+stall:"); i >= 0 {
+		base, stall = spec[:i], spec[i+1:]
+	}
+
+	l, err := parseProfile(base, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	if stall != "" {
+		name, args := splitSpec(stall)
+		if name != "stall" || len(args) != 2 {
+			return nil, fmt.Errorf("latency %q: expected +stall:probability,duration", spec)
+		}
+		p, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("latency %q: invalid stall probability %q", spec, args[0])
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("latency %q: %v", spec, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("latency %q: negative stall duration %s", spec, d)
+		}
+		l = &stallLatency{l, rng, p, d}
+	}
+
+	return l, nil
+}
+
+// parseProfile parses a single distribution, without any stall suffix.
+func parseProfile(spec string, rng *lockedRand) (Latency, error) {
+	name, args := splitSpec(spec)
+	bad := func() (Latency, error) {
+		return nil, fmt.Errorf("invalid latency profile %q", spec)
+	}
+
+	switch name {
+	case "fixed":
+		d, err := parseDurations(args, 1)
+		if err != nil {
+			return bad()
+		}
+		return fixedLatency(d[0]), nil
+	case "uniform":
+		d, err := parseDurations(args, 2)
+		if err != nil || d[1] < d[0] {
+			return bad()
+		}
+		return &uniformLatency{rng, d[0], d[1]}, nil
+	case "normal":
+		d, err := parseDurations(args, 2)
+		if err != nil {
+			return bad()
+		}
+		return &normalLatency{rng, d[0], d[1]}, nil
+	case "lognormal":
+		if len(args) != 2 {
+			return bad()
+		}
+		median, err := time.ParseDuration(args[0])
+		if err != nil || median <= 0 {
+			return bad()
+		}
+		sigma, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || sigma < 0 {
+			return bad()
+		}
+		return &lognormalLatency{rng, median, sigma}, nil
+	case "trace":
+		if len(args) != 1 {
+			return bad()
+		}
+		return loadTrace(args[0])
+	default:
+		return bad()
+	}
+}
+
+// splitSpec splits "name:a,b" into "name" and ["a", "b"].  A trace file name
+// may contain commas, so it is never split.
+func splitSpec(spec string) (string, []string) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return spec, nil
+	}
+	name := spec[:i]
+	if name == "trace" {
+		return name, []string{spec[i+1:]}
+	}
+	return name, strings.Split(spec[i+1:], ",")
+}
+
+// parseDurations parses exactly n durations.
+func parseDurations(args []string, n int) ([]time.Duration, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %d durations", n)
+	}
+	d := make([]time.Duration, n)
+	for i, arg := range args {
+		var err error
+		if d[i], err = time.ParseDuration(arg); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// nonNegative clamps a sampled delay at 0, since the tails of the normal
+// distribution extend below it.
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// lockedRand serializes access to a rand.Rand, which isn't safe for use by
+// several workers at once.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) NormFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.NormFloat64()
+}
+
+type fixedLatency time.Duration
+
+func (l fixedLatency) Next() time.Duration { return nonNegative(time.Duration(l)) }
+
+type uniformLatency struct {
+	rng      *lockedRand
+	min, max time.Duration
+}
+
+func (l *uniformLatency) Next() time.Duration {
+	return nonNegative(l.min + time.Duration(l.rng.Float64()*float64(l.max-l.min)))
+}
+
+type normalLatency struct {
+	rng          *lockedRand
+	mean, stddev time.Duration
+}
+
+func (l *normalLatency) Next() time.Duration {
+	return nonNegative(l.mean + time.Duration(l.rng.NormFloat64()*float64(l.stddev)))
+}
+
+type lognormalLatency struct {
+	rng    *lockedRand
+	median time.Duration
+	sigma  float64
+}
+
+func (l *lognormalLatency) Next() time.Duration {
+	return time.Duration(float64(l.median) * math.Exp(l.sigma*l.rng.NormFloat64()))
+}
+
+type stallLatency struct {
+	Latency
+	rng         *lockedRand
+	probability float64
+	stall       time.Duration
+}
+
+func (l *stallLatency) Next() time.Duration {
+	d := l.Latency.Next()
+	if l.rng.Float64() < l.probability {
+		d += l.stall
+	}
+	return d
+}
+
+// traceLatency replays recorded delays in order, starting over at the end.
+type traceLatency struct {
+	mu     sync.Mutex
+	delays []time.Duration
+	next   int
+}
+
+// loadTrace reads a trace file.  Each line is a Go duration ("12.5ms") or a
+// bare number of milliseconds.  Blank lines and lines starting with # are
+// ignored.
+func loadTrace(path string) (Latency, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &traceLatency{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			ms, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid delay %q", path, line, text)
+			}
+			d = time.Duration(ms * float64(time.Millisecond))
+		}
+		l.delays = append(l.delays, nonNegative(d))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.delays) == 0 {
+		return nil, fmt.Errorf("%s: trace has no delays", path)
+	}
+
+	return l, nil
+}
+
+func (l *traceLatency) Next() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := l.delays[l.next]
+	l.next = (l.next + 1) % len(l.delays)
+	return d
+}
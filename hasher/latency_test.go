@@ -0,0 +1,125 @@
+package hasher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sample draws n delays from a profile.
+func sample(t *testing.T, spec string, seed int64, n int) []time.Duration {
+	l, err := ParseLatency(spec, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		delays[i] = l.Next()
+	}
+	return delays
+}
+
+// mean returns the average of delays.
+func mean(delays []time.Duration) time.Duration {
+	var total time.Duration
+	for _, d := range delays {
+		total += d
+	}
+	return total / time.Duration(len(delays))
+}
+
+// TestLatencyProfiles checks each distribution stays in range and lands
+// roughly where it should.
+func TestLatencyProfiles(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		min, max time.Duration // Bounds on every sample
+		avg      time.Duration // Expected mean, within 10%
+	}{
+		{"fixed:5s", 5 * time.Second, 5 * time.Second, 5 * time.Second},
+		{"uniform:1s,3s", time.Second, 3 * time.Second, 2 * time.Second},
+		{"normal:5s,1s", 0, time.Minute, 5 * time.Second},
+		{"normal:1s,5s", 0, time.Minute, 0}, // Mostly clamped, so no useful mean
+		{"lognormal:1s,0.5", 0, time.Minute, 1133 * time.Millisecond},
+		{"fixed:1s+stall:0.1,10s", time.Second, 11 * time.Second, 2 * time.Second},
+	} {
+		delays := sample(t, tc.spec, 1, 10000)
+		for _, d := range delays {
+			if d < tc.min || d > tc.max {
+				t.Errorf("%s: sample %s out of range", tc.spec, d)
+				break
+			}
+		}
+
+		if tc.avg > 0 {
+			if avg := mean(delays); avg < tc.avg*9/10 || avg > tc.avg*11/10 {
+				t.Errorf("%s: mean %s, want about %s", tc.spec, avg, tc.avg)
+			}
+		}
+	}
+}
+
+// TestLatencySeed verifies that random profiles are reproducible.
+func TestLatencySeed(t *testing.T) {
+	a := sample(t, "normal:5s,1s+stall:0.5,1s", 42, 100)
+	b := sample(t, "normal:5s,1s+stall:0.5,1s", 42, 100)
+	c := sample(t, "normal:5s,1s+stall:0.5,1s", 43, 100)
+
+	same := true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("sample %d differs with the same seed: %s vs %s", i, a[i], b[i])
+		}
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Error("different seeds produced the same samples")
+	}
+}
+
+// TestLatencyTrace verifies that a recorded trace is replayed in order.
+func TestLatencyTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.txt")
+	os.WriteFile(path, []byte("# recorded delays\n10ms\n\n2.5\n1s\n"), 0600)
+
+	want := []time.Duration{10 * time.Millisecond, 2500 * time.Microsecond, time.Second, 10 * time.Millisecond}
+	for i, d := range sample(t, "trace:"+path, 0, len(want)) {
+		if d != want[i] {
+			t.Errorf("delay %d = %s, want %s", i, d, want[i])
+		}
+	}
+
+	// A "+" in the file name isn't mistaken for a stall
+	path = filepath.Join(t.TempDir(), "p99+tail.txt")
+	os.WriteFile(path, []byte("10ms\n"), 0600)
+	for spec, want := range map[string]time.Duration{
+		"trace:" + path:                 10 * time.Millisecond,
+		"trace:" + path + "+stall:1,1s": time.Second + 10*time.Millisecond,
+	} {
+		if d := sample(t, spec, 0, 1)[0]; d != want {
+			t.Errorf("%q: delay = %s, want %s", spec, d, want)
+		}
+	}
+}
+
+// TestLatencyInvalid verifies bad specs are rejected.
+func TestLatencyInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"fixed",
+		"fixed:soon",
+		"uniform:5s,1s",
+		"normal:5s",
+		"lognormal:0s,1",
+		"bogus:1s",
+		"fixed:1s+stall:2,1s",
+		"fixed:1s+stall:0.1,-1s",
+		"fixed:1s+pause:0.1,1s",
+		"trace:/does/not/exist",
+	} {
+		if _, err := ParseLatency(spec, 0); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
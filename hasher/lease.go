@@ -0,0 +1,249 @@
+package hasher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// With Config.Remote set, the pool runs no hashes itself.  Jobs wait in the
+// queue until a remote worker leases one, and the worker reports the hash
+// back with Complete, or the reason it couldn't with Fail.  A lease lasts
+// LeaseTTL, and the worker renews it with Heartbeat while it works.  If it
+// stops, because the worker died or lost touch with us, the lease expires and
+// the job goes back on the queue for another worker.  A worker that reports
+// on an expired lease is told so, and its report is ignored, which means a
+// job is only ever completed once.
+//
+// Nothing here can make a remote worker show up, so Drain doesn't wait for
+// them forever.  Once it has waited LeaseTTL, it fails every job that is still
+// queued or leased, and the workers' later reports on them are ignored as if
+// their leases had expired.
+
+// Lease is a job handed to a remote worker.
+type Lease struct {
+	ID        string        `json:"lease"`     // Identifies the lease to Heartbeat, Complete and Fail
+	JobID     int64         `json:"jobId"`     // The job being worked on
+	Password  string        `json:"password"`  // The password to hash
+	Algorithm string        `json:"algorithm"` // The algorithm to hash it with, see LookupAlgorithm
+	Delay     time.Duration `json:"delay"`     // Simulated work to perform before hashing, from the latency profile
+	Expires   time.Time     `json:"expires"`   // When the job goes back on the queue unless the lease is renewed
+	TTL       time.Duration `json:"ttl"`       // How long each renewal lasts, which doesn't depend on the worker's clock
+}
+
+// Outcome is what a remote worker reports for a job it hashed.
+type Outcome struct {
+	Hash      string        `json:"hash"`
+	Simulated time.Duration `json:"simulated"` // Time spent in simulated work
+	Elapsed   time.Duration `json:"elapsed"`   // Time spent computing the hash
+}
+
+// ErrNotRemote is returned by the lease methods of a hasher that runs its
+// hashes itself.
+var ErrNotRemote = errors.New("hasher is not configured for remote workers")
+
+// ErrLeaseExpired is returned by Heartbeat, Complete and Fail for a lease that
+// has expired, or was never granted.  The job has gone back on the queue, so
+// the worker should give up on it.
+var ErrLeaseExpired = errors.New("lease has expired")
+
+// lease is what the pool remembers about a leased job.
+type lease struct {
+	Lease
+	job    job
+	worker string
+	leased time.Time
+}
+
+// lease waits for a job to be queued and leases it to worker, until ctx is
+// done.
+func (p *pool) lease(ctx context.Context, worker string) (Lease, error) {
+	if !p.cfg.Remote {
+		return Lease{}, ErrNotRemote
+	}
+
+	// A job that's already queued is leased even if ctx is already done.
+	// Go picks at random between ready cases, so that takes a select of its
+	// own.
+	var j job
+	select {
+	case j = <-p.queue:
+	default:
+		select {
+		case j = <-p.queue:
+		case <-p.quit:
+			return Lease{}, ErrDrained
+		case <-ctx.Done():
+			return Lease{}, ctx.Err()
+		}
+	}
+
+	now := p.clock.Now()
+	l := &lease{job: j, worker: worker, leased: now}
+	l.Lease = Lease{
+		ID:        newLeaseID(),
+		JobID:     j.id,
+		Password:  j.password,
+		Algorithm: p.cfg.Algorithm,
+		Delay:     p.latency.Next(),
+		Expires:   now.Add(p.cfg.LeaseTTL),
+		TTL:       p.cfg.LeaseTTL,
+	}
+
+	p.mu.Lock()
+	p.active[j.id].running = true
+	p.leases[l.ID] = l
+	p.mu.Unlock()
+
+	p.log.Debug("job leased", "id", j.id, "request_id", j.trace.req.ID, "worker", worker)
+	return l.Lease, nil
+}
+
+// heartbeat renews a lease for another LeaseTTL, and returns when it now
+// expires.
+func (p *pool) heartbeat(id string) (time.Time, error) {
+	if !p.cfg.Remote {
+		return time.Time{}, ErrNotRemote
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.leases[id]
+	if !ok {
+		return time.Time{}, ErrLeaseExpired
+	}
+	l.Expires = p.clock.Now().Add(p.cfg.LeaseTTL)
+	return l.Expires, nil
+}
+
+// complete finishes a leased job with the hash the worker computed.
+func (p *pool) complete(id string, o Outcome) error {
+	if o.Hash == "" {
+		return errors.New("no hash supplied")
+	}
+	return p.release(id, func(c *completion) {
+		c.hash, c.waited, c.elapsed = o.Hash, o.Simulated, o.Elapsed
+	})
+}
+
+// fail finishes a leased job that the worker couldn't hash.  The job isn't
+// retried, just as it wouldn't be if it had failed here.
+func (p *pool) fail(id string, reason string) error {
+	return p.release(id, func(c *completion) {
+		c.err = errors.New(reason)
+	})
+}
+
+// release ends a lease and finishes its job with the outcome filled in by
+// fill.
+func (p *pool) release(id string, fill func(c *completion)) error {
+	if !p.cfg.Remote {
+		return ErrNotRemote
+	}
+
+	p.mu.Lock()
+	l, ok := p.leases[id]
+	delete(p.leases, id)
+	p.mu.Unlock()
+	if !ok {
+		return ErrLeaseExpired
+	}
+
+	j := l.job
+	c := completion{id: j.id, trace: j.trace, submitted: j.submitted, queued: l.leased.Sub(j.submitted)}
+	fill(&c)
+	p.finish(c)
+	return nil
+}
+
+// expireLeases puts the jobs of expired leases back on the queue until the
+// pool is drained.
+func (p *pool) expireLeases() {
+	defer p.workers.Done()
+	ticker := p.clock.NewTicker(sweepInterval(p.cfg.LeaseTTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+		case <-p.quit:
+			return
+		}
+
+		now := p.clock.Now()
+		var expired []*lease
+		p.mu.Lock()
+		for id, l := range p.leases {
+			if !now.Before(l.Expires) {
+				expired = append(expired, l)
+				delete(p.leases, id)
+				p.active[l.JobID].running = false
+			}
+		}
+		p.mu.Unlock()
+
+		for _, l := range expired {
+			p.log.Warn("lease expired, requeueing job", "id", l.JobID, "request_id", l.job.trace.req.ID, "worker", l.worker)
+
+			// The job was already accepted, so it has to go back even if
+			// the queue has filled up since.  It waits its turn rather
+			// than holding up the other expirations.
+			go func(j job) {
+				p.queue <- j
+			}(l.job)
+		}
+	}
+}
+
+// errAbandoned is the reason given for a job that no remote worker finished
+// before the pool was drained.
+var errAbandoned = errors.New("no remote worker finished the job before the hasher was drained")
+
+// abandon waits up to grace for the remote workers to finish the accepted
+// jobs, then fails the rest so that drain doesn't wait on workers that may
+// never come.  Jobs leased after that, or requeued when their leases expire,
+// are left to finish or are failed in turn.
+func (p *pool) abandon(grace time.Duration) {
+	done := make(chan interface{})
+	go func() {
+		p.jobs.Wait()
+		close(done)
+	}()
+
+	ticker := p.clock.NewTicker(grace)
+	defer ticker.Stop()
+	select {
+	case <-done:
+		return
+	case <-ticker.C():
+	}
+
+	p.mu.Lock()
+	leases := p.leases
+	p.leases = make(map[string]*lease)
+	p.mu.Unlock()
+	for _, l := range leases {
+		p.finish(completion{id: l.JobID, trace: l.job.trace, submitted: l.job.submitted,
+			queued: l.leased.Sub(l.job.submitted), err: errAbandoned})
+	}
+
+	for {
+		select {
+		case j := <-p.queue:
+			p.finish(completion{id: j.id, trace: j.trace, submitted: j.submitted,
+				queued: p.clock.Now().Sub(j.submitted), err: errAbandoned})
+		case <-done:
+			return
+		}
+	}
+}
+
+// newLeaseID generates a lease ID that can't be guessed, so that only the
+// worker holding a lease can report on it.
+func newLeaseID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,206 @@
+package hasher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLease walks jobs through remote workers: leased, completed, failed, and
+// requeued when a lease expires.
+func TestLease(t *testing.T) {
+	const ttl = time.Minute
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Remote = true
+		cfg.QueueDepth = 2
+		cfg.LeaseTTL = ttl
+	})
+
+	for name, h := range hashers {
+		leaser := h.(Leaser)
+		clock := clockOf(h)
+		ctx := context.Background()
+
+		first, _ := h.Compute("angryMonkey")
+		second, _ := h.Compute("happyMonkey")
+		if _, err := h.Compute("sadMonkey"); err != ErrQueueFull {
+			t.Errorf("%s: got %v, want ErrQueueFull", name, err)
+		}
+
+		// Nothing runs here, so the workers get the simulated work too
+		l, err := leaser.Lease(ctx, "w1")
+		if err != nil || l.JobID != first || l.Password != "angryMonkey" || l.Algorithm != "sha512" ||
+			l.Delay != testDelay || !l.Expires.Equal(clock.Now().Add(ttl)) {
+			t.Fatalf("%s: Lease() = %+v, %v", name, l, err)
+		}
+		if jobs := h.Jobs(); jobs[0].State != JobRunning || jobs[1].State != JobQueued {
+			t.Errorf("%s: jobs after lease: %+v", name, jobs)
+		}
+
+		if err := leaser.Complete(l.ID, Outcome{Hash: Compute("angryMonkey")}); err != nil {
+			t.Errorf("%s: Complete() = %v", name, err)
+		}
+		if hash := waitForHash(t, h, first); hash != Compute("angryMonkey") {
+			t.Errorf("%s: got hash %q", name, hash)
+		}
+		if err := leaser.Complete(l.ID, Outcome{Hash: "again"}); err != ErrLeaseExpired {
+			t.Errorf("%s: completing twice returned %v", name, err)
+		}
+
+		// A heartbeat keeps the lease alive past its original expiry
+		l, _ = leaser.Lease(ctx, "w1")
+		clock.BlockUntil(1)
+		clock.Advance(ttl / 2)
+		if expires, err := leaser.Heartbeat(l.ID); err != nil || !expires.Equal(clock.Now().Add(ttl)) {
+			t.Errorf("%s: Heartbeat() = %s, %v", name, expires, err)
+		}
+		clock.Advance(ttl / 2)
+		if _, err := leaser.Heartbeat(l.ID); err != nil {
+			t.Errorf("%s: lease expired despite the heartbeat: %v", name, err)
+		}
+
+		// Without one, the job goes back on the queue for another worker
+		clock.Advance(ttl + sweepInterval(ttl))
+		waitFor(t, "requeue", func() bool {
+			health, _ := h.Probe(time.Second)
+			return health.Queued == 1
+		})
+		if err := leaser.Complete(l.ID, Outcome{Hash: "late"}); err != ErrLeaseExpired {
+			t.Errorf("%s: completing an expired lease returned %v", name, err)
+		}
+
+		l, _ = leaser.Lease(ctx, "w2")
+		if l.JobID != second {
+			t.Errorf("%s: leased job %d, expected %d again", name, l.JobID, second)
+		}
+		if err := leaser.Fail(l.ID, "boom"); err != nil {
+			t.Errorf("%s: Fail() = %v", name, err)
+		}
+		var jobErr *JobError
+		waitFor(t, "failure", func() bool {
+			_, err := h.GetAndRemoveHash(second)
+			return errors.As(err, &jobErr)
+		})
+
+		// With nothing queued, Lease waits
+		short, cancel := context.WithTimeout(ctx, time.Millisecond)
+		if _, err := leaser.Lease(short, "w1"); err != context.DeadlineExceeded {
+			t.Errorf("%s: Lease() with nothing queued returned %v", name, err)
+		}
+		cancel()
+
+		h.Drain()
+		if _, err := leaser.Lease(ctx, "w1"); err != ErrDrained {
+			t.Errorf("%s: Lease() after Drain returned %v", name, err)
+		}
+	}
+
+	for name, h := range newTestHashers(t, nil) {
+		leaser := h.(Leaser)
+		if _, err := leaser.Lease(context.Background(), "w1"); err != ErrNotRemote {
+			t.Errorf("%s: Lease() without remote workers returned %v", name, err)
+		}
+		h.Drain()
+	}
+}
+
+// TestLeaseNoWait verifies that a queued job is always leased, even when the
+// worker isn't prepared to wait at all.
+func TestLeaseNoWait(t *testing.T) {
+	const jobs = 20
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Remote = true
+		cfg.QueueDepth = jobs
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, h := range hashers {
+		leaser := h.(Leaser)
+		for i := 0; i < jobs; i++ {
+			h.Compute("angryMonkey")
+		}
+		var leases []string
+		for i := 0; i < jobs; i++ {
+			l, err := leaser.Lease(ctx, "w1")
+			if err != nil {
+				t.Fatalf("%s: Lease() of job %d with no wait = %v", name, i+1, err)
+			}
+			leases = append(leases, l.ID)
+		}
+		if _, err := leaser.Lease(ctx, "w1"); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: Lease() of an empty queue = %v", name, err)
+		}
+
+		for _, l := range leases {
+			leaser.Fail(l, "done")
+		}
+		h.Drain()
+	}
+}
+
+// TestDrainWithoutWorkers verifies that draining a remote pool that no worker
+// ever finishes gives up after LeaseTTL, failing the queued and leased jobs
+// rather than waiting forever.
+func TestDrainWithoutWorkers(t *testing.T) {
+	const ttl = time.Minute
+	var mu sync.Mutex
+	failed := make(map[int64]string)
+	hashers := newTestHashers(t, func(cfg *Config) {
+		cfg.Remote = true
+		cfg.QueueDepth = 2
+		cfg.LeaseTTL = ttl
+		cfg.OnComplete = func(r JobResult) {
+			mu.Lock()
+			failed[r.ID] = r.Error
+			mu.Unlock()
+		}
+	})
+
+	for name, h := range hashers {
+		leaser := h.(Leaser)
+		clock := clockOf(h)
+
+		leased, _ := h.Compute("angryMonkey")
+		queued, _ := h.Compute("happyMonkey")
+		l, err := leaser.Lease(context.Background(), "w1")
+		if err != nil || l.JobID != leased {
+			t.Fatalf("%s: Lease() = %+v, %v", name, l, err)
+		}
+
+		drained := make(chan interface{})
+		go func() {
+			h.Drain()
+			close(drained)
+		}()
+
+		// The lease expiry and the grace period
+		clock.BlockUntil(2)
+		select {
+		case <-drained:
+			t.Fatalf("%s: Drain returned before LeaseTTL", name)
+		default:
+		}
+		clock.Advance(ttl)
+		select {
+		case <-drained:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: Drain is still waiting for remote workers", name)
+		}
+
+		mu.Lock()
+		for _, id := range []int64{leased, queued} {
+			if failed[id] != errAbandoned.Error() {
+				t.Errorf("%s: job %d completed with error %q", name, id, failed[id])
+			}
+		}
+		failed = make(map[int64]string)
+		mu.Unlock()
+
+		if err := leaser.Complete(l.ID, Outcome{Hash: "late"}); err != ErrLeaseExpired {
+			t.Errorf("%s: completing an abandoned lease returned %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package hasher
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// pool schedules hashes to run in the background.  It is shared by both
+// AsyncHasher implementations, which differ only in how they synchronize
+// access to the completed hashes and the stats.  Each implementation supplies
+// a store function that is called with the outcome of every hash.
+//
+// With Workers set to 0, every hash gets its own goroutine, which is how the
+// hasher originally worked.  Otherwise a fixed number of workers pull hashes
+// off a queue of QueueDepth, and Compute fails fast with ErrQueueFull when the
+// queue is full rather than letting work pile up without bound.  With Remote
+// set, there are no workers, and the queue is emptied by remote workers
+// leasing jobs, see lease.go.
+type pool struct {
+	cfg     Config
+	clock   Clock
+	latency Latency
+	work    WorkFunc
+	hash    func(password string) string // The configured algorithm, used by verify
+	store   func(c completion)
+	log     *slog.Logger
+	tracer  *trace.Tracer
+
+	asyncId int64 // atomic counter of ids to return to ensure uniqueness, see makeID
+	paused  int32 // atomic, one of the pause* values
+	pending int64 // atomic count of hashes that haven't completed yet
+
+	submittedCount uint64 // atomic count of hashes accepted by submit
+	rejectedCount  uint64 // atomic count of hashes refused by submit
+
+	mu      sync.Mutex // Protects windows and active, which are updated by Compute and every worker
+	windows *windows
+	active  map[int64]*activeJob // Jobs that haven't been handed to the store yet
+	leases  map[string]*lease    // Jobs held by remote workers, by lease id
+
+	queue   chan job         // Hashes waiting for a worker, nil if Workers is 0 and Remote isn't set
+	quit    chan interface{} // Closed to stop the workers once the queue is empty
+	jobs    sync.WaitGroup   // Used to wait for all long-running operations to complete on shutdown
+	workers sync.WaitGroup   // Used to wait for the workers, and the lease expiry, to exit
+}
+
+// Values of pool.paused
+const (
+	pauseNone    = 0 // Accepting work
+	pausePaused  = 1 // Pause was called, Resume will undo it
+	pauseDrained = 2 // Drain was called, there's no coming back
+)
+
+// completion is the outcome of a job, handed to the store.
+type completion struct {
+	id        int64
+	trace     jobTrace
+	hash      string        // The hash, if err is nil
+	err       error         // Why the job failed
+	submitted time.Time     // When Compute was called
+	queued    time.Duration // Time spent waiting for a worker
+	waited    time.Duration // Time spent in simulated work
+	elapsed   time.Duration // Time spent computing the hash
+}
+
+// activeJob is what the pool remembers about a job it is working on.  The
+// password is deliberately left out so it can't leak into diagnostics.
+type activeJob struct {
+	submitted time.Time
+	requestID string
+	running   bool
+	done      chan interface{} // Closed once the job is stored, see wait
+}
+
+// job is a single password waiting to be hashed.
+type job struct {
+	id        int64
+	password  string
+	submitted time.Time
+	trace     jobTrace
+}
+
+// jobTrace is what a job remembers of the request that submitted it, so that
+// its spans can be recorded as it goes.
+type jobTrace struct {
+	req  trace.Request
+	span trace.SpanID // The span covering the whole job, parent of the span for each phase
+}
+
+// newPool creates a pool and starts its workers.  cfg must be valid.
+func newPool(cfg Config, store func(c completion)) *pool {
+	p := &pool{
+		cfg:     cfg,
+		clock:   cfg.Clock,
+		latency: cfg.latency(),
+		work:    cfg.Work,
+		store:   store,
+		log:     cfg.Logger,
+		tracer:  cfg.Tracer,
+		quit:    make(chan interface{}),
+	}
+	if p.log == nil {
+		p.log = slog.New(slog.DiscardHandler)
+	}
+	if p.clock == nil {
+		p.clock = RealClock{}
+	}
+	p.windows = newWindows(p.clock.Now())
+	p.asyncId = sequenceOf(cfg.LastID)
+	p.active = make(map[int64]*activeJob)
+	p.leases = make(map[string]*lease)
+	p.hash = algorithms[cfg.Algorithm]
+	if p.work == nil {
+		algorithm := p.hash
+		p.work = func(password string) (string, error) {
+			return algorithm(password), nil
+		}
+	}
+
+	if cfg.Workers > 0 {
+		p.queue = make(chan job, cfg.QueueDepth)
+		p.workers.Add(cfg.Workers)
+		for i := 0; i < cfg.Workers; i++ {
+			go p.worker()
+		}
+	} else if cfg.Remote {
+		p.queue = make(chan job, cfg.QueueDepth)
+		p.workers.Add(1)
+		go p.expireLeases()
+	}
+
+	return p
+}
+
+// stall calls Config.Stall, if there is one.
+func (p *pool) stall() {
+	if p.cfg.Stall != nil {
+		p.cfg.Stall()
+	}
+}
+
+// submit assigns an id to the password and schedules it to be hashed.  The
+// job belongs to the trace.Request carried by ctx, or a new one if there
+// isn't one.
+func (p *pool) submit(ctx context.Context, password string) (int64, error) {
+	// Count the job before checking whether we're paused.  drain sets the
+	// flag before waiting, so either we see the flag and back out, or drain's
+	// Wait is guaranteed to see this job.
+	p.jobs.Add(1)
+	if atomic.LoadInt32(&p.paused) != pauseNone {
+		p.jobs.Done()
+		atomic.AddUint64(&p.rejectedCount, 1)
+		return 0, ErrPaused
+	}
+
+	// Atomically incrementing is the easiest way to have non-conflicting ids.
+	// If security was a concern, we'd want to consider returning a random integer,
+	// or even better a long alphanumeric key.  The node goes on top, so ids
+	// are unique across a cluster too.
+	j := job{makeID(p.cfg.Node, atomic.AddInt64(&p.asyncId, 1)), password, p.clock.Now(), jobTrace{span: trace.NewSpanID()}}
+	if req, ok := trace.FromContext(ctx); ok {
+		j.trace.req = req
+	} else {
+		j.trace.req = trace.NewRequest()
+	}
+
+	atomic.AddInt64(&p.pending, 1)
+	p.track(j)
+	if p.queue == nil {
+		go p.run(j)
+		p.submitted(j)
+		return j.id, nil
+	}
+
+	select {
+	case p.queue <- j:
+		p.submitted(j)
+		return j.id, nil
+	default:
+		p.untrack(j.id)
+		atomic.AddInt64(&p.pending, -1)
+		p.jobs.Done()
+		atomic.AddUint64(&p.rejectedCount, 1)
+		return 0, ErrQueueFull
+	}
+}
+
+// submitted counts an accepted job.
+func (p *pool) submitted(j job) {
+	atomic.AddUint64(&p.submittedCount, 1)
+	p.log.Debug("job submitted", "id", j.id, "request_id", j.trace.req.ID)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.windows.submitted(j.submitted)
+}
+
+// track adds a job to the active jobs.  This has to happen before the job can
+// possibly run, so that run always finds it.
+func (p *pool) track(j job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active[j.id] = &activeJob{submitted: j.submitted, requestID: j.trace.req.ID, done: make(chan interface{})}
+}
+
+// untrack removes a job from the active jobs, waking anyone waiting for it.
+// The implementation calls this once it has stored the job's result, so that
+// the job is always either active or stored until it is retrieved.
+func (p *pool) untrack(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if a, ok := p.active[id]; ok {
+		close(a.done)
+		delete(p.active, id)
+	}
+}
+
+// wait blocks until job id is no longer active, or ctx is done.
+func (p *pool) wait(ctx context.Context, id int64) error {
+	p.mu.Lock()
+	a, ok := p.active[id]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// missing explains why the implementation has no result for id: ErrPending,
+// ErrGone or ErrNotFound.  The implementation must hold off storing results
+// while it looks, so that the job can't be stored in between.
+func (p *pool) missing(id int64) error {
+	p.mu.Lock()
+	_, ok := p.active[id]
+	p.mu.Unlock()
+
+	switch {
+	case ok:
+		return ErrPending
+	case id > 0 && NodeOf(id) == p.cfg.Node && sequenceOf(id) > 0 && sequenceOf(id) <= atomic.LoadInt64(&p.asyncId):
+		return ErrGone
+	default:
+		return ErrNotFound
+	}
+}
+
+// verify checks password against the result for id, without using up the
+// result.
+func (p *pool) verify(id int64, r result, password string) (bool, error) {
+	if r.err != nil {
+		_, err := r.get(id)
+		return false, err
+	}
+
+	match := subtle.ConstantTimeCompare([]byte(p.hash(password)), []byte(r.hash)) == 1
+	p.log.Debug("job verified", "id", id, "request_id", r.trace.req.ID, "match", match)
+	return match, nil
+}
+
+// worker runs queued hashes until the pool is drained.
+func (p *pool) worker() {
+	defer p.workers.Done()
+	for {
+		select {
+		case j := <-p.queue:
+			p.run(j)
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// run performs a single hash and hands the result to the store.  The job is
+// always accounted for, even if the hash panics, so Drain can't hang waiting
+// for it.
+func (p *pool) run(j job) {
+	p.mu.Lock()
+	p.active[j.id].running = true
+	p.mu.Unlock()
+
+	p.finish(p.compute(j))
+}
+
+// finish records the outcome of a job, whether it ran here or on a remote
+// worker, and hands it to the store.
+func (p *pool) finish(c completion) {
+	defer p.jobs.Done()
+	defer atomic.AddInt64(&p.pending, -1)
+
+	if c.err != nil {
+		p.log.Warn("job failed", "id", c.id, "request_id", c.trace.req.ID, "error", c.err)
+	} else {
+		p.log.Debug("job completed", "id", c.id, "request_id", c.trace.req.ID,
+			"queued", c.queued, "simulated", c.waited, "hash", c.elapsed)
+	}
+	p.traceWork(c)
+
+	p.mu.Lock()
+	p.windows.record(c, p.clock.Now())
+	p.mu.Unlock()
+
+	// The store untracks the job once it has it, so it doesn't briefly
+	// disappear from listJobs, or look like it has already been retrieved
+	p.store(c)
+
+	if p.cfg.OnComplete != nil {
+		r := JobResult{ID: c.id, RequestID: c.trace.req.ID, Hash: c.hash, Submitted: c.submitted, Completed: p.clock.Now()}
+		if c.err != nil {
+			r.Error = c.err.Error()
+		}
+		p.cfg.OnComplete(r)
+	}
+}
+
+// compute performs the simulated work and the hash.  A panic is recovered and
+// reported as the job failing, rather than taking the whole process down
+// along with every other client's hashes.
+func (p *pool) compute(j job) (c completion) {
+	c.id, c.submitted, c.trace = j.id, j.submitted, j.trace
+	c.queued = p.clock.Now().Sub(j.submitted)
+	defer func() {
+		if r := recover(); r != nil {
+			c.hash, c.err = "", fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	// The purpose of this sleep is to simulate a longer running
+	// task, so we just sleep.  I considered using time.After along
+	// with a channel to cancel the task mid-operation, but instead
+	// opted to assume this was a "long" running task that is NOT
+	// cancelable.  This means we just have to wait for it to complete
+	// when shutting down.
+	// How long we sleep is up to the latency profile.
+	start := p.clock.Now()
+	p.clock.Sleep(p.latency.Next())
+	c.waited = p.clock.Now().Sub(start)
+
+	// The stats keep the simulated wait separate from the real work, which is
+	// the hash, so that the cost of hashing isn't lost in the noise.
+	start = p.clock.Now()
+	c.hash, c.err = p.work(j.password)
+	c.elapsed = p.clock.Now().Sub(start)
+	return c
+}
+
+// pause stops the pool from accepting new work.
+func (p *pool) pause() {
+	atomic.CompareAndSwapInt32(&p.paused, pauseNone, pausePaused)
+}
+
+// resume undoes a previous pause, unless the pool has been drained.
+func (p *pool) resume() {
+	atomic.CompareAndSwapInt32(&p.paused, pausePaused, pauseNone)
+}
+
+// drained returns true once drain has been called.
+func (p *pool) drained() bool {
+	return atomic.LoadInt32(&p.paused) == pauseDrained
+}
+
+// drain stops accepting work, waits for every accepted hash to complete, and
+// then stops the workers.  It returns true for the first caller only, so the
+// implementation knows to release its own resources exactly once.  With
+// remote workers, jobs they haven't finished within LeaseTTL are failed, see
+// abandon.
+func (p *pool) drain() bool {
+	first := atomic.SwapInt32(&p.paused, pauseDrained) != pauseDrained
+	if p.cfg.Remote {
+		p.abandon(p.cfg.LeaseTTL)
+	}
+	p.jobs.Wait()
+	if first {
+		close(p.quit)
+	}
+	p.workers.Wait()
+	return first
+}
+
+// sweepInterval is how often completed hashes are checked for expiration.
+// Checking a few times per TTL keeps hashes from outliving it by much.
+func sweepInterval(ttl time.Duration) time.Duration {
+	if d := ttl / 4; d > time.Millisecond {
+		return d
+	}
+	return time.Millisecond
+}
+
+// result is a completed hash waiting to be retrieved.
+type result struct {
+	hash      string
+	err       error // Non-nil if the job failed
+	submitted time.Time
+	completed time.Time
+	trace     jobTrace
+}
+
+// newResult creates the result of a job that completed at now.
+func newResult(c completion, now time.Time) result {
+	return result{c.hash, c.err, c.submitted, now, c.trace}
+}
+
+// get returns the hash, or a *JobError if the job failed.  Either way, the
+// Result says which request submitted the job.
+func (r result) get(id int64) (Result, error) {
+	res := Result{RequestID: r.trace.req.ID}
+	if r.err != nil {
+		return res, &JobError{id, r.err.Error()}
+	}
+	res.Hash = r.hash
+	return res, nil
+}
+
+// expired returns true if the result has outlived ttl.  A ttl of 0 means
+// results never expire.
+func (r result) expired(ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(r.completed) >= ttl
+}
+
+// stats adds the pool's gauges and windows to s.  stored is the number of
+// completed hashes waiting to be retrieved, which only the implementation
+// knows.
+func (p *pool) stats(s Stats, stored int) Stats {
+	health := p.health()
+	s.InFlight = health.Pending - int64(health.Queued)
+	s.Queued = health.Queued
+	s.Stored = stored
+	s.Algorithm = p.cfg.Algorithm
+	s.Counters.Submitted = atomic.LoadUint64(&p.submittedCount)
+	s.Counters.Rejected = atomic.LoadUint64(&p.rejectedCount)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.Windows = p.windows.summaries(p.clock.Now())
+	return s
+}
+
+// listJobs lists every job that hasn't been retrieved yet, oldest first.  The
+// implementation supplies its completed results, which it must not change
+// until listJobs returns.
+func (p *pool) listJobs(stored map[int64]result) []Job {
+	now := p.clock.Now()
+
+	var jobs []Job
+	for id, r := range stored {
+		if r.expired(p.cfg.TTL, now) {
+			continue
+		}
+		state := JobCompleted
+		if r.err != nil {
+			state = JobFailed
+		}
+		jobs = append(jobs, Job{id, state, r.trace.req.ID, r.submitted, now.Sub(r.submitted)})
+	}
+
+	p.mu.Lock()
+	for id, a := range p.active {
+		if _, ok := stored[id]; ok {
+			continue
+		}
+		state := JobQueued
+		if a.running {
+			state = JobRunning
+		}
+		jobs = append(jobs, Job{id, state, a.requestID, a.submitted, now.Sub(a.submitted)})
+	}
+	p.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// health returns the pool's portion of a Health report.
+func (p *pool) health() Health {
+	return Health{
+		Pending:  atomic.LoadInt64(&p.pending),
+		Queued:   len(p.queue),
+		Capacity: cap(p.queue),
+	}
+}
+
+// retrieved reports that the result for id was retrieved by the request
+// carried by ctx.  start is when the retrieval began.
+func (p *pool) retrieved(ctx context.Context, id int64, r result, start time.Time) {
+	p.log.Debug("job retrieved", "id", id, "request_id", r.trace.req.ID, "failed", r.err != nil)
+	if p.tracer == nil {
+		return
+	}
+
+	now := p.clock.Now()
+	span := p.span(id, r.trace, "retrieved", start, now)
+	if req, ok := trace.FromContext(ctx); ok {
+		span.Attributes["hash.retrieved_by"] = req.ID
+	}
+	p.tracer.Record(span)
+	p.traceEnd(id, r, "retrieved", now)
+}
+
+// expired reports that the result for id was thrown away after the TTL.
+func (p *pool) expired(id int64, r result) {
+	p.log.Debug("job expired", "id", id, "request_id", r.trace.req.ID)
+	p.traceEnd(id, r, "expired", p.clock.Now())
+
+	if p.cfg.OnDiscard != nil {
+		jr := JobResult{ID: id, RequestID: r.trace.req.ID, Hash: r.hash, Submitted: r.submitted, Completed: r.completed}
+		if r.err != nil {
+			jr.Error = r.err.Error()
+		}
+		p.cfg.OnDiscard(jr, DiscardExpired)
+	}
+}
+
+// traceWork records the spans for the phases of a job up to the hash being
+// computed.  They're recorded once the job is complete, because that's when
+// the pool knows how long each one took.
+func (p *pool) traceWork(c completion) {
+	if p.tracer == nil {
+		return
+	}
+
+	queued := c.submitted.Add(c.queued)
+	simulated := queued.Add(c.waited)
+	hashed := simulated.Add(c.elapsed)
+
+	p.tracer.Record(p.span(c.id, c.trace, "queued", c.submitted, queued))
+	p.tracer.Record(p.span(c.id, c.trace, "simulated work", queued, simulated))
+	hash := p.span(c.id, c.trace, "hash", simulated, hashed)
+	if c.err != nil {
+		hash.Error = c.err.Error()
+	}
+	p.tracer.Record(hash)
+}
+
+// traceEnd records the span for the time a job's result was stored, and the
+// span for the whole job, once the result is gone at end.  outcome says why
+// it is gone: "retrieved" or "expired".
+func (p *pool) traceEnd(id int64, r result, outcome string, end time.Time) {
+	if p.tracer == nil {
+		return
+	}
+
+	p.tracer.Record(p.span(id, r.trace, "stored", r.completed, end))
+
+	root := p.span(id, r.trace, "hash job", r.submitted, end)
+	root.ID, root.Parent = r.trace.span, r.trace.req.Parent
+	root.Attributes["hash.request_id"] = r.trace.req.ID
+	root.Attributes["hash.algorithm"] = p.cfg.Algorithm
+	root.Attributes["hash.outcome"] = outcome
+	if r.err != nil {
+		root.Error = r.err.Error()
+	}
+	p.tracer.Record(root)
+}
+
+// span creates the span for one phase of job id.
+func (p *pool) span(id int64, t jobTrace, name string, start, end time.Time) trace.Span {
+	return trace.Span{
+		Trace:      t.req.Trace,
+		ID:         trace.NewSpanID(),
+		Parent:     t.span,
+		Name:       name,
+		Start:      start,
+		End:        end,
+		Attributes: map[string]string{"hash.job_id": strconv.FormatInt(id, 10)},
+	}
+}
@@ -1,18 +1,147 @@
 package hasher
 
-import "time"
+import (
+	"time"
+
+	"github.com/jaredcantwell/hash-server/metrics"
+)
 
 // Stats is a simple tracker for basic performance information around
-// the hashing computations.
+// the hashing computations.  Everything up to the gauges is cumulative since
+// the hasher was created or ResetStats was last called.
 type Stats struct {
-	Total     uint64        `json:"total"`   // Total number of hash computations performed
-	Avg       float64       `json:"average"` // The average time (in milliseconds) of each operation
-	totalTime time.Duration // The total time for all operations.. needed for average
+	Total        uint64  `json:"total"`            // Total number of hash computations performed
+	Failed       uint64  `json:"failed"`           // Total number of hashes that failed, which aren't included in Total
+	Avg          float64 `json:"average"`          // The average time (in milliseconds) of each operation
+	SimulatedAvg float64 `json:"simulatedAverage"` // The average time (in milliseconds) of the simulated work before each operation
+
+	// The distribution of time spent in each stage of a hash.  These only
+	// include hashes that were computed.
+	Queue     Latencies `json:"queue"`     // Waiting for a worker after Compute
+	Simulated Latencies `json:"simulated"` // The simulated work
+	Hash      Latencies `json:"hash"`      // Computing the hash itself
+	EndToEnd  Latencies `json:"endToEnd"`  // From Compute until the hash was retrieved with GetAndRemoveHash
+
+	// Gauges of where hashes are right now.  ResetStats leaves these alone.
+	InFlight int64 `json:"inFlight"` // Hashes being computed
+	Queued   int   `json:"queued"`   // Hashes waiting for a worker
+	Stored   int   `json:"stored"`   // Completed hashes waiting to be retrieved
+
+	// Recent activity, one entry per duration in Windows.  ResetStats leaves
+	// these alone too, since they forget the past on their own.
+	Windows []Window `json:"windows"`
+
+	// Totals since the hasher was created, which ResetStats also leaves
+	// alone so they can be exported as Prometheus counters and histograms.
+	Algorithm    string            `json:"algorithm"` // The algorithm the hashes are computed with
+	Counters     Counters          `json:"counters"`
+	HashSeconds  metrics.Histogram `json:"-"` // Time computing each hash
+	QueueSeconds metrics.Histogram `json:"-"` // Time each hash waited for a worker
+}
+
+// Counters count what has happened to every job since the hasher was created.
+type Counters struct {
+	Submitted uint64 `json:"submitted"` // Accepted by Compute
+	Rejected  uint64 `json:"rejected"`  // Refused by Compute because the hasher was paused or full
+	Completed uint64 `json:"completed"` // Hashed successfully
+	Failed    uint64 `json:"failed"`    // Failed to hash
+	Retrieved uint64 `json:"retrieved"` // Returned by GetAndRemoveHash, whether hashed or failed
+	Expired   uint64 `json:"expired"`   // Thrown away after the TTL without being retrieved
 }
 
-// update increments the totals and recalculates the average.
-func (s *Stats) update(elapsed time.Duration) {
-	s.Total++
-	s.totalTime += elapsed
-	s.Avg = float64(s.totalTime.Nanoseconds()) / float64(s.Total) / 1000000
+// Latencies summarizes a distribution of times.  Every time is in
+// milliseconds.  The min, max, mean and standard deviation are exact, while
+// the percentiles are accurate to within about 1.5%.
+type Latencies struct {
+	Count  uint64  `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P99    float64 `json:"p99"`
+	P999   float64 `json:"p999"`
+}
+
+// recorder accumulates the Stats.  It isn't safe for concurrent use, so each
+// AsyncHasher synchronizes access to it in its own way.
+type recorder struct {
+	total     uint64
+	failed    uint64
+	queue     histogram
+	simulated histogram
+	hash      histogram
+	endToEnd  histogram
+
+	lifetime lifetime
+}
+
+// lifetime is the part of the recorder that reset leaves alone.
+type lifetime struct {
+	counters     Counters
+	hashSeconds  metrics.Histogram
+	queueSeconds metrics.Histogram
+}
+
+// record updates the stats with the outcome of a job.  Failed jobs are only
+// counted, since how long they took says nothing about how long a hash takes.
+func (r *recorder) record(c completion) {
+	if c.err != nil {
+		r.failed++
+		r.lifetime.counters.Failed++
+		return
+	}
+
+	if r.lifetime.counters.Completed == 0 {
+		r.lifetime.hashSeconds = metrics.NewHistogram(metrics.DefaultBuckets)
+		r.lifetime.queueSeconds = metrics.NewHistogram(metrics.DefaultBuckets)
+	}
+	r.lifetime.counters.Completed++
+	r.lifetime.hashSeconds.ObserveDuration(c.elapsed)
+	r.lifetime.queueSeconds.ObserveDuration(c.queued)
+
+	r.total++
+	r.queue.record(c.queued)
+	r.simulated.record(c.waited)
+	r.hash.record(c.elapsed)
+}
+
+// reset clears the cumulative counters.
+func (r *recorder) reset() {
+	*r = recorder{lifetime: r.lifetime}
+}
+
+// retrieved records a job being handed back to the client.  ok is false if
+// the job failed, in which case there is no hash to time.
+func (r *recorder) retrieved(d time.Duration, ok bool) {
+	r.lifetime.counters.Retrieved++
+	if ok {
+		r.endToEnd.record(d)
+	}
+}
+
+// expired records results thrown away after the TTL.
+func (r *recorder) expired(n int) {
+	r.lifetime.counters.Expired += uint64(n)
+}
+
+// snapshot computes the Stats.  The percentiles mean walking the histograms,
+// so this is done on request rather than after every hash.
+func (r *recorder) snapshot() Stats {
+	s := Stats{
+		Total:     r.total,
+		Failed:    r.failed,
+		Queue:     r.queue.summary(),
+		Simulated: r.simulated.summary(),
+		Hash:      r.hash.summary(),
+		EndToEnd:  r.endToEnd.summary(),
+	}
+	s.Avg = s.Hash.Mean
+	s.SimulatedAvg = s.Simulated.Mean
+
+	s.Counters = r.lifetime.counters
+	s.HashSeconds = r.lifetime.hashSeconds.Snapshot()
+	s.QueueSeconds = r.lifetime.queueSeconds.Snapshot()
+	return s
 }
@@ -0,0 +1,130 @@
+package hasher
+
+import (
+	"strings"
+	"time"
+)
+
+// Windows are the spans of recent history reported in Stats.Windows, shortest
+// first.  A lifetime average hides a regression behind everything that came
+// before it, so these only look back this far.
+var Windows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// slotWidth is the granularity of the windows.  Each window covers its
+// duration rounded up to a whole number of slots, so a 1m window is between
+// 50s and 1m old at its oldest.
+const slotWidth = 10 * time.Second
+
+// Window reports the activity during a recent span of time.
+type Window struct {
+	Window         string    `json:"window"`         // How far back the window looks, e.g. "5m"
+	Requests       uint64    `json:"requests"`       // Hashes submitted
+	RequestRate    float64   `json:"requestRate"`    // Hashes submitted per second
+	Completed      uint64    `json:"completed"`      // Hashes computed
+	CompletionRate float64   `json:"completionRate"` // Hashes computed per second
+	Failed         uint64    `json:"failed"`         // Hashes that failed, which aren't included in Completed
+	Latency        Latencies `json:"latency"`        // From Compute until each hash was computed
+}
+
+// WindowName returns the name used for the window of duration d, such as
+// "5m" or "90s".
+func WindowName(d time.Duration) string {
+	name := d.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// slot is the activity during one slotWidth of time.
+type slot struct {
+	start     time.Time
+	requests  uint64
+	completed uint64
+	failed    uint64
+	latency   histogram
+}
+
+// windows keeps enough slots to cover the longest window, reusing them in a
+// ring as time moves on.  It isn't safe for concurrent use.
+type windows struct {
+	started time.Time // Windows don't reach back before this
+	slots   []slot
+}
+
+// newWindows creates a windows starting at now.
+func newWindows(now time.Time) *windows {
+	longest := Windows[len(Windows)-1]
+	return &windows{
+		started: now,
+		slots:   make([]slot, int((longest+slotWidth-1)/slotWidth)),
+	}
+}
+
+// current returns the slot for now, clearing it first if it was last used a
+// trip around the ring ago.
+func (w *windows) current(now time.Time) *slot {
+	start := now.Truncate(slotWidth)
+	s := &w.slots[int(start.UnixNano()/int64(slotWidth))%len(w.slots)]
+	if !s.start.Equal(start) {
+		*s = slot{start: start}
+	}
+	return s
+}
+
+// submitted records a hash being submitted at now.
+func (w *windows) submitted(now time.Time) {
+	w.current(now).requests++
+}
+
+// record records the outcome of a job that completed at now.
+func (w *windows) record(c completion, now time.Time) {
+	s := w.current(now)
+	if c.err != nil {
+		s.failed++
+		return
+	}
+	s.completed++
+	s.latency.record(now.Sub(c.submitted))
+}
+
+// summary reports the window of duration d ending at now.
+func (w *windows) summary(d time.Duration, now time.Time) Window {
+	// The current slot is only partly over, so the window reaches back a
+	// whole number of slots before it.
+	from := now.Truncate(slotWidth).Add(slotWidth - d)
+	if from.Before(w.started) {
+		from = w.started
+	}
+
+	sum := Window{Window: WindowName(d)}
+	var latency histogram
+	for i := range w.slots {
+		s := &w.slots[i]
+		if s.start.Add(slotWidth).After(from) && !s.start.After(now) {
+			sum.Requests += s.requests
+			sum.Completed += s.completed
+			sum.Failed += s.failed
+			latency.merge(&s.latency)
+		}
+	}
+	sum.Latency = latency.summary()
+
+	if elapsed := now.Sub(from).Seconds(); elapsed > 0 {
+		sum.RequestRate = float64(sum.Requests) / elapsed
+		sum.CompletionRate = float64(sum.Completed) / elapsed
+	}
+	return sum
+}
+
+// summaries reports every window ending at now.
+func (w *windows) summaries(now time.Time) []Window {
+	all := make([]Window, len(Windows))
+	for i, d := range Windows {
+		all[i] = w.summary(d, now)
+	}
+	return all
+}
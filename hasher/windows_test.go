@@ -0,0 +1,64 @@
+package hasher
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestWindows verifies that each window only counts recent activity, and
+// that slots are reused as time goes around the ring.
+func TestWindows(t *testing.T) {
+	start := time.Unix(0, 0)
+	w := newWindows(start)
+
+	// One hash a second for 20 minutes, each taking 2s to compute, with every
+	// tenth failing
+	for i := 0; i < 20*60; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		w.submitted(now)
+
+		var c completion
+		c.submitted = now.Add(-2 * time.Second)
+		if i%10 == 0 {
+			c.err = errors.New("failed")
+		}
+		w.record(c, now)
+	}
+
+	now := start.Add(20*time.Minute - time.Second)
+	for i, got := range w.summaries(now) {
+		d := Windows[i]
+		if got.Window != WindowName(d) {
+			t.Errorf("window %d is named %q", i, got.Window)
+		}
+		if secs := uint64(d / time.Second); got.Requests != secs || got.Completed+got.Failed != secs {
+			t.Errorf("%s: got %+v", got.Window, got)
+		}
+		if got.RequestRate < 0.98 || got.RequestRate > 1.02 {
+			t.Errorf("%s: request rate %v", got.Window, got.RequestRate)
+		}
+		if got.Latency.Min != 2000 || got.Latency.Max != 2000 {
+			t.Errorf("%s: latency %+v", got.Window, got.Latency)
+		}
+	}
+
+	// Nothing has happened for the last 10 minutes
+	later := w.summaries(now.Add(10 * time.Minute))
+	if later[0].Requests != 0 || later[1].Requests != 0 || later[2].Requests != 5*60 {
+		t.Errorf("got %+v", later)
+	}
+}
+
+func TestWindowName(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Minute:      "1m",
+		15 * time.Minute: "15m",
+		90 * time.Second: "1m30s",
+		time.Hour:        "1h",
+	} {
+		if got := WindowName(d); got != want {
+			t.Errorf("%s: got %q, want %q", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/client"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/server"
+)
+
+// loadgen drives a hash server with traffic, following each job until its
+// hash is retrieved, and reports how the server coped.
+//
+//	hash-server loadgen [flags]
+//
+// In closed-loop mode, each of -concurrency clients submits a password, waits
+// for its hash, and starts over, so the load backs off as the server slows
+// down.  In open-loop mode, passwords are submitted at -rate per second no
+// matter how far behind the server falls, with up to -concurrency jobs
+// outstanding.  Arrivals beyond that are counted as skipped rather than
+// piling up goroutines and sockets without limit.
+//
+// Without -target, a server is started in this process with the hasher
+// settings given, so that implementations can be compared on equal terms
+// without ulimit getting in the way of a test.
+func loadgen(args []string) error {
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	target := fs.String("target", "", "URL of the server to load, or empty to start one in this process")
+	mode := fs.String("mode", "closed", "closed for clients that wait for each hash before submitting the next, open for a fixed arrival rate")
+	rate := fs.Float64("rate", 100, "submissions per second in open-loop mode")
+	concurrency := fs.Int("concurrency", 50, "clients in closed-loop mode, and the most jobs outstanding in open-loop mode")
+	duration := fs.Duration("duration", 30*time.Second, "how long to submit for.  Outstanding jobs are followed to the end afterwards.")
+	poll := fs.Duration("poll", 0, "interval to poll for each hash at, or 0 to long poll")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	cfg := hasher.DefaultConfig()
+	fs.StringVar(&cfg.Implementation, "hasher", cfg.Implementation, "hasher implementation for the in-process server, one of: "+strings.Join(hasher.Implementations(), ", "))
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "hashing workers for the in-process server, 0 for a goroutine per hash")
+	fs.IntVar(&cfg.QueueDepth, "queue-depth", cfg.QueueDepth, "queue depth for the in-process server")
+	fs.DurationVar(&cfg.Delay, "delay", cfg.Delay, "simulated work for the in-process server")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hash-server loadgen [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("loadgen takes no arguments")
+	}
+
+	l := &loadTest{
+		mode:        *mode,
+		rate:        *rate,
+		concurrency: *concurrency,
+		duration:    *duration,
+	}
+	if err := l.validate(); err != nil {
+		return err
+	}
+
+	if *target == "" {
+		s, err := startLocalServer(cfg)
+		if err != nil {
+			return err
+		}
+		defer s.Shutdown()
+		*target = "http://" + s.Addr()
+		l.hasher = cfg.Implementation
+	}
+	l.target = *target
+
+	// Keep a connection per client, rather than the default 2 per host,
+	// so that a long test doesn't run out of ephemeral ports.  Busy
+	// responses are what's being measured, so they aren't retried.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	options := []client.Option{
+		client.WithHTTPClient(&http.Client{Transport: transport}),
+		client.WithRetries(0),
+	}
+	if *poll > 0 {
+		options = append(options, client.WithLongPoll(0), client.WithBackoff(*poll, *poll))
+	}
+	l.client = client.New(*target, options...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report := l.run(ctx)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.writeText(os.Stdout)
+}
+
+// startLocalServer starts a server on a free localhost port with a hasher
+// built from cfg, and any further options.  Its access log would only get in
+// the way, so it logs nothing.
+func startLocalServer(cfg hasher.Config, options ...server.Option) (*server.Server, error) {
+	h, err := hasher.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := server.New(append([]server.Option{
+		server.WithHasher(h),
+		server.WithAddr("127.0.0.1:0"),
+		server.WithLogger(slog.New(slog.NewJSONHandler(io.Discard, nil))),
+	}, options...)...)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- s.Run()
+	}()
+
+	select {
+	case <-s.Ready():
+		return s, nil
+	case err := <-failed:
+		return nil, err
+	}
+}
+
+// loadTest is a single run of the load generator.
+type loadTest struct {
+	target      string
+	hasher      string // Implementation of the in-process server, "" for a remote one
+	client      *client.Client
+	mode        string
+	rate        float64
+	concurrency int
+	duration    time.Duration
+
+	// Counters of what happened to each submission
+	submitted uint64 // Accepted by POST /hash
+	rejected  uint64 // Turned away with 429 or 503
+	completed uint64 // Hash retrieved
+	failed    uint64 // Hash failed, or couldn't be retrieved
+	errors    uint64 // Requests that got no answer, or one that made no sense
+	skipped   uint64 // Open-loop arrivals that found -concurrency jobs outstanding
+
+	mu       sync.Mutex
+	submits  []time.Duration // Latency of each accepted POST /hash
+	endToEnd []time.Duration // From submitting each job until its hash was retrieved
+}
+
+func (l *loadTest) validate() error {
+	switch {
+	case l.mode != "closed" && l.mode != "open":
+		return fmt.Errorf("unknown mode %q, expected closed or open", l.mode)
+	case l.concurrency < 1:
+		return fmt.Errorf("concurrency must be at least 1: %d", l.concurrency)
+	case l.mode == "open" && (l.rate <= 0 || math.IsInf(l.rate, 0)):
+		return fmt.Errorf("rate must be positive: %g", l.rate)
+	case l.duration <= 0:
+		return fmt.Errorf("duration must be positive: %s", l.duration)
+	}
+	return nil
+}
+
+// run generates load for the duration, or until ctx is done, then waits for
+// the outstanding jobs and reports on all of them.
+func (l *loadTest) run(ctx context.Context) loadReport {
+	start := time.Now()
+	submitting, stop := context.WithTimeout(ctx, l.duration)
+	defer stop()
+
+	var wg sync.WaitGroup
+	if l.mode == "closed" {
+		for i := 0; i < l.concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for submitting.Err() == nil {
+					l.job(ctx)
+				}
+			}()
+		}
+	} else {
+		// Arrivals are scheduled from the start time rather than from
+		// each other, so a slow tick doesn't lower the rate.
+		outstanding := make(chan interface{}, l.concurrency)
+		interval := time.Duration(float64(time.Second) / l.rate)
+		for next := start; submitting.Err() == nil; next = next.Add(interval) {
+			select {
+			case <-time.After(time.Until(next)):
+			case <-submitting.Done():
+				continue
+			}
+
+			select {
+			case outstanding <- nil:
+			default:
+				atomic.AddUint64(&l.skipped, 1)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.job(ctx)
+				<-outstanding
+			}()
+		}
+	}
+
+	wg.Wait()
+	return l.report(time.Since(start))
+}
+
+// job submits a password and follows it until its hash is retrieved.
+func (l *loadTest) job(ctx context.Context) {
+	start := time.Now()
+	id, err := l.client.Submit(ctx, "angryMonkey")
+	var status *client.StatusError
+	switch {
+	case errors.As(err, &status) && (status.Code == 429 || status.Code == 503):
+		atomic.AddUint64(&l.rejected, 1)
+		return
+	case err != nil:
+		atomic.AddUint64(&l.errors, 1)
+		return
+	}
+	submitted := time.Since(start)
+	atomic.AddUint64(&l.submitted, 1)
+
+	if _, err := l.client.Wait(ctx, id); err != nil {
+		atomic.AddUint64(&l.failed, 1)
+		return
+	}
+	atomic.AddUint64(&l.completed, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.submits = append(l.submits, submitted)
+	l.endToEnd = append(l.endToEnd, time.Since(start))
+}
+
+// loadReport is the outcome of a loadTest.  Latencies are in milliseconds,
+// as they are in hasher.Stats.
+type loadReport struct {
+	Target      string  `json:"target"`
+	Hasher      string  `json:"hasher,omitempty"` // Implementation of the in-process server
+	Mode        string  `json:"mode"`
+	Rate        float64 `json:"rate,omitempty"` // Target submissions per second in open-loop mode
+	Concurrency int     `json:"concurrency"`
+	Seconds     float64 `json:"seconds"` // How long the test took, including waiting for the last jobs
+
+	Attempts  uint64 `json:"attempts"` // POST /hash requests made
+	Submitted uint64 `json:"submitted"`
+	Rejected  uint64 `json:"rejected"`
+	Completed uint64 `json:"completed"`
+	Failed    uint64 `json:"failed"`
+	Errors    uint64 `json:"errors"`
+	Skipped   uint64 `json:"skipped"`
+
+	Throughput    float64 `json:"throughput"`    // Hashes completed per second
+	RejectionRate float64 `json:"rejectionRate"` // Fraction of attempts that were rejected
+
+	Submit   hasher.Latencies `json:"submit"`   // POST /hash
+	EndToEnd hasher.Latencies `json:"endToEnd"` // From POST /hash until the hash was retrieved
+}
+
+func (l *loadTest) report(elapsed time.Duration) loadReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := loadReport{
+		Target:      l.target,
+		Hasher:      l.hasher,
+		Mode:        l.mode,
+		Concurrency: l.concurrency,
+		Seconds:     elapsed.Seconds(),
+		Submitted:   atomic.LoadUint64(&l.submitted),
+		Rejected:    atomic.LoadUint64(&l.rejected),
+		Completed:   atomic.LoadUint64(&l.completed),
+		Failed:      atomic.LoadUint64(&l.failed),
+		Errors:      atomic.LoadUint64(&l.errors),
+		Skipped:     atomic.LoadUint64(&l.skipped),
+		Submit:      summarize(l.submits),
+		EndToEnd:    summarize(l.endToEnd),
+	}
+	if l.mode == "open" {
+		r.Rate = l.rate
+	}
+	r.Attempts = r.Submitted + r.Rejected + r.Errors
+	if r.Seconds > 0 {
+		r.Throughput = float64(r.Completed) / r.Seconds
+	}
+	if r.Attempts > 0 {
+		r.RejectionRate = float64(r.Rejected) / float64(r.Attempts)
+	}
+	return r
+}
+
+// summarize computes the exact distribution of a set of times.  It sorts
+// them in place.
+func summarize(times []time.Duration) hasher.Latencies {
+	var l hasher.Latencies
+	if len(times) == 0 {
+		return l
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	percentile := func(p float64) float64 {
+		return ms(times[int(math.Ceil(p*float64(len(times))))-1])
+	}
+
+	var sum, sumSquares float64
+	for _, t := range times {
+		sum += ms(t)
+		sumSquares += ms(t) * ms(t)
+	}
+	n := float64(len(times))
+	l.Count = uint64(len(times))
+	l.Min, l.Max = ms(times[0]), ms(times[len(times)-1])
+	l.Mean = sum / n
+	l.StdDev = math.Sqrt(math.Max(0, sumSquares/n-l.Mean*l.Mean))
+	l.P50, l.P90, l.P99, l.P999 = percentile(0.5), percentile(0.9), percentile(0.99), percentile(0.999)
+	return l
+}
+
+// writeText writes the report as a table.
+func (r loadReport) writeText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "target\t%s\n", r.Target)
+	if r.Hasher != "" {
+		fmt.Fprintf(w, "hasher\t%s\n", r.Hasher)
+	}
+	if r.Mode == "open" {
+		fmt.Fprintf(w, "mode\topen, %g/s, up to %d outstanding\n", r.Rate, r.Concurrency)
+	} else {
+		fmt.Fprintf(w, "mode\tclosed, %d clients\n", r.Concurrency)
+	}
+	fmt.Fprintf(w, "elapsed\t%.1fs\n", r.Seconds)
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "attempts\t%d\n", r.Attempts)
+	fmt.Fprintf(w, "submitted\t%d\n", r.Submitted)
+	fmt.Fprintf(w, "rejected\t%d\t(%.2f%%)\n", r.Rejected, 100*r.RejectionRate)
+	fmt.Fprintf(w, "completed\t%d\t(%.2f/s)\n", r.Completed, r.Throughput)
+	fmt.Fprintf(w, "failed\t%d\n", r.Failed)
+	fmt.Fprintf(w, "errors\t%d\n", r.Errors)
+	if r.Mode == "open" {
+		fmt.Fprintf(w, "skipped\t%d\n", r.Skipped)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "ms\tmin\tmean\tp50\tp90\tp99\tp99.9\tmax")
+	for _, row := range []struct {
+		name string
+		l    hasher.Latencies
+	}{
+		{"submit", r.Submit},
+		{"end to end", r.EndToEnd},
+	} {
+		l := row.l
+		fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n", row.name, l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/client"
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// newLoadTest creates a loadTest against an in-process server with the given
+// hasher implementation and 10ms of simulated work.
+func newLoadTest(t *testing.T, implementation, mode string) *loadTest {
+	cfg := hasher.DefaultConfig()
+	cfg.Implementation = implementation
+	cfg.Delay = 10 * time.Millisecond
+	s, err := startLocalServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	l := &loadTest{
+		target:      "http://" + s.Addr(),
+		hasher:      implementation,
+		client:      client.New("http://"+s.Addr(), client.WithRetries(0)),
+		mode:        mode,
+		rate:        200,
+		concurrency: 4,
+		duration:    200 * time.Millisecond,
+	}
+	if err := l.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLoadgen(t *testing.T) {
+	for _, implementation := range hasher.Implementations() {
+		for _, mode := range []string{"closed", "open"} {
+			r := newLoadTest(t, implementation, mode).run(context.Background())
+
+			if r.Completed == 0 || r.Completed != r.Submitted || r.Failed+r.Errors+r.Rejected != 0 {
+				t.Errorf("%s %s: unexpected counts %+v", implementation, mode, r)
+			}
+			if r.EndToEnd.Count != r.Completed || r.EndToEnd.Min < 10 || r.EndToEnd.P50 < r.Submit.P50 {
+				t.Errorf("%s %s: unexpected latencies %+v", implementation, mode, r.EndToEnd)
+			}
+			if r.Throughput <= 0 {
+				t.Errorf("%s %s: throughput %g", implementation, mode, r.Throughput)
+			}
+		}
+	}
+}
+
+func TestLoadgenRejections(t *testing.T) {
+	cfg := hasher.DefaultConfig()
+	cfg.Workers, cfg.QueueDepth = 1, 1
+	cfg.Delay = time.Second
+	s, err := startLocalServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	// Four clients against a server that only has room for two hashes,
+	// which take longer than the test, so the rest are turned away.
+	l := &loadTest{
+		client:      client.New("http://"+s.Addr(), client.WithRetries(0)),
+		mode:        "closed",
+		concurrency: 4,
+		duration:    100 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	r := l.run(ctx)
+
+	if r.Rejected == 0 || r.RejectionRate <= 0 || r.RejectionRate > 1 || r.Submitted != 2 {
+		t.Errorf("unexpected counts %+v", r)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	var times []time.Duration
+	for i := 1000; i > 0; i-- {
+		times = append(times, time.Duration(i)*time.Millisecond)
+	}
+
+	l := summarize(times)
+	want := hasher.Latencies{Count: 1000, Min: 1, Max: 1000, Mean: 500.5, P50: 500, P90: 900, P99: 990, P999: 999}
+	l.StdDev = 0
+	if l != want {
+		t.Errorf("summarize returned %+v, expected %+v", l, want)
+	}
+	if summarize(nil) != (hasher.Latencies{}) {
+		t.Errorf("summarize of nothing returned %+v", summarize(nil))
+	}
+}
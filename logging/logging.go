@@ -0,0 +1,141 @@
+// Package logging sets up the hash server's structured logs.
+//
+// Everything is logged as JSON with log/slog.  Every logger built here goes
+// through Redact, which scrubs passwords and other secrets from each record
+// before it is written, so a careless log call can't leak one.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces any secret that would otherwise have been logged.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are always redacted, compared
+// case-insensitively.
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"passwd":        true,
+	"secret":        true,
+	"token":         true,
+	"authorization": true,
+	"body":          true,
+}
+
+// sensitiveValue matches a secret embedded in a string, such as a
+// "password=..." request body quoted in an error.  The server accepts
+// passwords containing any character, including spaces and &, so there's no
+// telling where one ends.  Everything to the end of the string goes.
+var sensitiveValue = regexp.MustCompile(`(?is)\b(password|passwd|secret|token)=.*`)
+
+// New creates a logger that writes redacted JSON to w, discarding anything
+// below level.  Pass a *slog.LevelVar to be able to change the level later.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(Redact(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// ParseLevel parses a level name: debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// Open opens a log destination: "stderr", "stdout", or the path of a file to
+// append to.  The returned function closes it, if it needs closing.
+func Open(dest string) (io.Writer, func() error, error) {
+	switch dest {
+	case "", "stderr":
+		return os.Stderr, func() error { return nil }, nil
+	case "stdout":
+		return os.Stdout, func() error { return nil }, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// Redact wraps a handler so that secrets are scrubbed from every record
+// before it reaches h.  Attributes with sensitive keys are replaced entirely,
+// and secrets embedded in the message or any string value are cut out.
+// Wrapping a handler that is already redacting does nothing.
+func Redact(h slog.Handler) slog.Handler {
+	if _, ok := h.(*redactHandler); ok {
+		return h
+	}
+	return &redactHandler{h}
+}
+
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	clean := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		clean.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, clean)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = redactAttr(a)
+	}
+	return &redactHandler{h.next.WithAttrs(clean)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{h.next.WithGroup(name)}
+}
+
+// redactAttr scrubs a single attribute, descending into groups.
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		group := v.Group()
+		clean := make([]interface{}, len(group))
+		for i, g := range group {
+			clean[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, clean...)
+	case slog.KindString:
+		return slog.String(a.Key, redactString(v.String()))
+	case slog.KindAny:
+		// Errors and anything else would be formatted into the log anyway,
+		// so format them here where they can be checked.
+		return slog.String(a.Key, redactString(fmt.Sprint(v.Any())))
+	default:
+		return slog.Attr{Key: a.Key, Value: v}
+	}
+}
+
+// redactString cuts secrets out of a string.
+func redactString(s string) string {
+	return sensitiveValue.ReplaceAllStringFunc(s, func(m string) string {
+		return m[:strings.IndexByte(m, '=')+1] + Redacted
+	})
+}
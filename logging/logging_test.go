@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// secret is a password that mustn't appear in any log.  It contains the
+// characters a naive redactor would stop at.
+const secret = "hunter2 & more=stuff"
+
+func TestRedact(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, slog.LevelDebug)
+
+	log.Info("bad form: password=" + secret)
+	log.Info("event", "password", secret)
+	log.Info("event", "Body", "anything at all "+secret)
+	log.Info("event", "error", errors.New("parsing password="+secret))
+	log.Info("event", "request", slog.GroupValue(slog.String("form", "id=1&password="+secret)))
+	log.With("token", secret).Info("event")
+	log.WithGroup("g").Info("event", "detail", "secret="+secret)
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("secret was logged:\n%s", out)
+	}
+	if n := strings.Count(out, Redacted); n != 7 {
+		t.Errorf("%d secrets redacted, expected 7:\n%s", n, out)
+	}
+	if !strings.Contains(out, `"msg":"bad form: password=`+Redacted+`"`) {
+		t.Errorf("message not redacted in place:\n%s", out)
+	}
+}
+
+func TestRedactLeavesOthers(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, slog.LevelInfo).Info("request", "path", "/hash/1", "status", 200)
+
+	out := buf.String()
+	if !strings.Contains(out, `"path":"/hash/1"`) || !strings.Contains(out, `"status":200`) {
+		t.Errorf("unexpected log: %s", out)
+	}
+	if strings.Contains(out, Redacted) {
+		t.Errorf("nothing to redact: %s", out)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	level.Set(slog.LevelWarn)
+	log := New(&buf, &level)
+
+	log.Info("quiet")
+	level.Set(slog.LevelInfo)
+	log.Info("loud")
+
+	if out := buf.String(); strings.Contains(out, "quiet") || !strings.Contains(out, "loud") {
+		t.Errorf("unexpected log: %s", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		if level, err := ParseLevel(name); err != nil || level != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("ParseLevel(loud) succeeded")
+	}
+}
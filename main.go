@@ -1,18 +1,314 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/jaredcantwell/hash-server/audit"
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/config"
+	"github.com/jaredcantwell/hash-server/consensus"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+	"github.com/jaredcantwell/hash-server/recording"
 	"github.com/jaredcantwell/hash-server/server"
+	"github.com/jaredcantwell/hash-server/systemd"
+	"github.com/jaredcantwell/hash-server/trace"
 )
 
-var flagPort int
+var loader = config.NewLoader(flag.CommandLine, os.Getenv)
 
-func init() {
-	flag.IntVar(&flagPort, "port", 8080, "port number on which to start listening for REST requests")
+// level is the log level, which can change on SIGHUP.
+var level slog.LevelVar
+
+// current is the effective configuration, which can change on SIGHUP.
+var current struct {
+	sync.Mutex
+	config.Config
+}
+
+// commands are the other things this binary can do besides serve, named by
+// its first argument.
+var commands = map[string]func(args []string) error{
+	"audit-verify": auditVerify,
+	"batch":        batch,
+	"loadgen":      loadgen,
+	"replay":       replay,
+	"worker":       worker,
 }
 
 func main() {
-	flag.Parse()
-	server.New(flagPort).Run()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// Until the configuration says otherwise, log to stderr
+	slog.SetDefault(logging.New(os.Stderr, &level))
+
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		fatal(err)
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		fatal(err)
+	}
+	current.Config = cfg
+
+	out, closeLog, err := logging.Open(cfg.LogOutput)
+	if err != nil {
+		fatal(err)
+	}
+	defer closeLog()
+	level.Set(cfg.LogLevel)
+	slog.SetDefault(logging.New(out, &level))
+	slog.Info("effective configuration", "config", cfg.String())
+
+	tracer, err := trace.Open(cfg.Trace)
+	if err != nil {
+		fatal(err)
+	}
+	cfg.Hasher.Tracer = tracer
+
+	var auditLog *audit.Log
+	if cfg.AuditLog != "" {
+		if auditLog, err = audit.Open(cfg.AuditLog); err != nil {
+			fatal(err)
+		}
+	}
+
+	var recorder *recording.Recorder
+	if cfg.Record != "" {
+		if recorder, err = recording.Open(cfg.Record); err != nil {
+			fatal(err)
+		}
+	}
+
+	s, h, err := newServer(cfg, auditLog, recorder)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Catch signals before starting up so a SIGTERM that arrives during
+	// startup still results in a clean shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go handleSignals(s, h, signals)
+
+	go func() {
+		<-s.Ready()
+		notify(systemd.Ready)
+	}()
+
+	if err := s.Run(); err != nil {
+		fatal(err)
+	}
+
+	// Every job is complete once Run returns, so this gets all of their spans
+	if err := tracer.Close(); err != nil {
+		slog.Warn("exporting spans failed", "error", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		slog.Error("closing audit log failed", "error", err)
+	}
+	if err := recorder.Close(); err != nil {
+		slog.Warn("writing recording failed", "error", err)
+	}
+}
+
+// fatal logs an error that prevents the server from running, and exits.
+func fatal(err error) {
+	slog.Error("fatal", "error", err)
+	os.Exit(1)
+}
+
+// newServer creates the Server, using the socket handed to us by systemd if
+// we were socket activated and opening the configured port ourselves otherwise.
+// The hasher always has chaos installed, even when it is off, so that faults
+// can be turned on later without a restart.
+func newServer(cfg config.Config, auditLog *audit.Log, recorder *recording.Recorder) (*server.Server, *chaos.Hasher, error) {
+	cfg.Hasher.Logger = slog.Default()
+	if auditLog != nil {
+		cfg.Hasher.OnDiscard = func(r hasher.JobResult, why hasher.Discard) {
+			if err := auditLog.Discarded(r, why); err != nil {
+				slog.Error("audit failed", "action", why, "id", r.ID, "error", err)
+			}
+		}
+	}
+
+	c, err := cfg.Cluster(slog.Default())
+	if err != nil {
+		return nil, nil, err
+	}
+	if c != nil {
+		// If this node is being restarted, its new ids mustn't collide with
+		// the ones its replicas still have
+		if last := c.Recover(context.Background()); last != 0 {
+			slog.Info("continuing after replicated ids", "last_id", last)
+			cfg.Hasher.LastID = last
+		}
+		cfg.Hasher.OnComplete = c.Completed
+	}
+
+	cc, err := cfg.ConsensusConfig(slog.Default())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// With a consensus log, chaos goes inside it, around the hasher that
+	// does the work, so the faults it injects are recorded in the log like
+	// any other result
+	var h *chaos.Hasher
+	var served hasher.AsyncHasher
+	var ch *consensus.Hasher
+	if cc != nil {
+		cc.New = func(hc hasher.Config) (hasher.AsyncHasher, error) {
+			h, err = chaos.New(hc, cfg.Chaos)
+			return h, err
+		}
+		if ch, err = consensus.New(cfg.Hasher, *cc); err != nil {
+			return nil, nil, err
+		}
+		served = ch
+	} else {
+		if h, err = chaos.New(cfg.Hasher, cfg.Chaos); err != nil {
+			return nil, nil, err
+		}
+		served = h
+	}
+
+	options := []server.Option{
+		server.WithHasher(served),
+		server.WithChaos(h),
+		server.WithLogger(slog.Default()),
+		server.WithAudit(auditLog),
+		server.WithRecorder(recorder),
+		server.WithWorkerToken(cfg.WorkerToken),
+		server.WithConfigReport(func() interface{} {
+			current.Lock()
+			defer current.Unlock()
+
+			// Chaos can also be changed through the admin endpoint, so
+			// report what the hasher is actually doing.
+			report := current.Report()
+			report["chaos"] = h.Config().String()
+			return report
+		}),
+	}
+
+	if cfg.AdminAddr != "" {
+		options = append(options, server.WithAdminAddr(cfg.AdminAddr))
+	}
+
+	if c != nil {
+		options = append(options, server.WithCluster(c))
+	}
+	if ch != nil {
+		options = append(options, server.WithConsensus(ch.Node(), cfg.ClusterToken), server.WithConsensusAddr(cfg.ConsensusAddr))
+	}
+
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch len(listeners) {
+	case 0:
+		options = append(options, server.WithAddr(fmt.Sprintf(":%d", cfg.Port)))
+	case 1:
+		slog.Info("using socket-activated listener", "addr", listeners[0].Addr().String())
+		options = append(options, server.WithListener(listeners[0]))
+	default:
+		// We only know how to serve one port.  Rather than guess which
+		// socket was meant for us, refuse to start.
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, nil, fmt.Errorf("expected 1 socket-activated listener, got %d", len(listeners))
+	}
+
+	return server.New(options...), h, nil
+}
+
+// handleSignals translates OS signals into server actions.  SIGINT and SIGTERM
+// take the same graceful path as POST /shutdown, so in-flight hashes are
+// allowed to complete.  A second SIGINT/SIGTERM while that is happening
+// exits immediately for operators who really mean it.  SIGHUP reloads
+// configuration.
+func handleSignals(s *server.Server, h *chaos.Hasher, signals <-chan os.Signal) {
+	stopping := false
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			notify(systemd.Reloading)
+			reload(h)
+			notify(systemd.Ready)
+		default:
+			if stopping {
+				slog.Warn("signal received during shutdown, exiting immediately", "signal", sig.String())
+				os.Exit(1)
+			}
+
+			slog.Info("signal received, shutting down", "signal", sig.String())
+			stopping = true
+			notify(systemd.Stopping)
+
+			// Shutdown blocks until Run has finished cleaning up, so do it in
+			// the background and keep watching for signals.
+			go s.Shutdown()
+		}
+	}
+}
+
+// reload re-reads the config file and environment in response to SIGHUP.
+// Chaos and the log level are applied immediately.  The listener and hasher
+// are built once at startup, so changes to their settings are reported but
+// only take effect on the next restart.
+func reload(h *chaos.Hasher) {
+	cfg, err := loader.Load()
+	if err != nil {
+		slog.Error("reload failed, keeping current configuration", "error", err)
+		return
+	}
+
+	current.Lock()
+	defer current.Unlock()
+
+	if cfg.Chaos != current.Chaos {
+		slog.Info("chaos set", "chaos", cfg.Chaos.String())
+		h.SetConfig(cfg.Chaos)
+		current.Chaos = cfg.Chaos
+	}
+	if cfg.LogLevel != current.LogLevel {
+		slog.Info("log level set", "level", cfg.LogLevel.String())
+		level.Set(cfg.LogLevel)
+		current.LogLevel = cfg.LogLevel
+	}
+
+	if changed := cfg.Diff(current.Config); len(changed) > 0 {
+		slog.Info("reloaded configuration, restart to apply changes", "changed", strings.Join(changed, ", "))
+	} else {
+		slog.Info("reloaded configuration, no changes")
+	}
+}
+
+// notify sends a state change to systemd, logging rather than failing if that
+// isn't possible.  Losing a notification shouldn't take the server down.
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		slog.Warn("systemd notify failed", "state", state, "error", err)
+	}
 }
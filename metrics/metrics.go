@@ -0,0 +1,151 @@
+// Package metrics writes metrics in the Prometheus text exposition format.
+//
+// It only implements what the hash server needs: counters, gauges and
+// histograms with fixed buckets.  Keeping it to the standard library means
+// the server doesn't pull in the Prometheus client and its dependencies.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the Content-Type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram bucket bounds, in seconds, used for
+// latencies.  They cover everything from a fast hash to a long stall.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram counts observations into buckets with fixed upper bounds.  It
+// isn't safe for concurrent use, so whoever owns it has to synchronize
+// access, and hand out copies made with Snapshot.
+type Histogram struct {
+	Bounds []float64 // Upper bound of each bucket, in increasing order
+	Counts []uint64  // Observations in each bucket, not including those in earlier buckets
+	Count  uint64    // Total observations, including those above the last bound
+	Sum    float64   // Sum of all observations
+}
+
+// NewHistogram creates an empty Histogram with the supplied bucket bounds.
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds))}
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.Bounds, v); i < len(h.Bounds) {
+		h.Counts[i]++
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// ObserveDuration records a duration in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Snapshot returns a copy of h that doesn't share its counts.
+func (h *Histogram) Snapshot() Histogram {
+	s := *h
+	s.Counts = append([]uint64(nil), h.Counts...)
+	return s
+}
+
+// Labels are the label names and values of a single sample.
+type Labels map[string]string
+
+// String formats the labels the way they appear in the exposition format,
+// sorted by name so the output is stable.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(l[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// with returns a copy of l with one more label.
+func (l Labels) with(name, value string) Labels {
+	c := Labels{name: value}
+	for k, v := range l {
+		c[k] = v
+	}
+	return c
+}
+
+// Writer writes metric families to an io.Writer.  Each family is introduced
+// with Family, followed by its samples.  The first write error is kept and
+// returned by Err, so callers can write everything and check once.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter creates a Writer.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Family writes the HELP and TYPE lines that start a metric family.  typ is
+// "counter", "gauge" or "histogram".
+func (w *Writer) Family(name, typ, help string) {
+	w.printf("# HELP %s %s\n", name, help)
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes a single counter or gauge sample.
+func (w *Writer) Sample(name string, labels Labels, value float64) {
+	w.printf("%s%s %s\n", name, labels, formatValue(value))
+}
+
+// Histogram writes the buckets, sum and count of a histogram sample.
+func (w *Writer) Histogram(name string, labels Labels, h Histogram) {
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		w.Sample(name+"_bucket", labels.with("le", formatValue(bound)), float64(cumulative))
+	}
+	w.Sample(name+"_bucket", labels.with("le", "+Inf"), float64(h.Count))
+	w.Sample(name+"_sum", labels, h.Sum)
+	w.Sample(name+"_count", labels, float64(h.Count))
+}
+
+// Err returns the first error encountered while writing.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+// formatValue formats a sample value, spelling infinities the way Prometheus
+// expects.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.ObserveDuration(50 * time.Millisecond)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Family("jobs_total", "counter", "Jobs.")
+	w.Sample("jobs_total", Labels{"tenant": "b", "algorithm": "a\"x"}, 3)
+	w.Family("latency_seconds", "histogram", "Latency.")
+	w.Histogram("latency_seconds", nil, h)
+	if w.Err() != nil {
+		t.Fatal(w.Err())
+	}
+
+	want := `# HELP jobs_total Jobs.
+# TYPE jobs_total counter
+jobs_total{algorithm="a\"x",tenant="b"} 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// TestSnapshot verifies a snapshot isn't changed by later observations.
+func TestSnapshot(t *testing.T) {
+	h := NewHistogram(DefaultBuckets)
+	h.Observe(1)
+	s := h.Snapshot()
+	h.Observe(1)
+	if s.Count != 1 || s.Counts[8] != 1 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("closed") }
+
+// TestWriterError verifies the first error is kept.
+func TestWriterError(t *testing.T) {
+	w := NewWriter(failingWriter{})
+	w.Family("a", "counter", "A.")
+	w.Sample("a", nil, 1)
+	if w.Err() == nil || w.Err().Error() != "closed" {
+		t.Errorf("got %v", w.Err())
+	}
+}
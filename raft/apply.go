@@ -0,0 +1,117 @@
+package raft
+
+// wakeApplier tells the applier there's something new to apply.
+func (n *Node) wakeApplier() {
+	select {
+	case n.applyReady <- struct{}{}:
+	default:
+	}
+}
+
+// apply applies committed entries to the state machine, in order, and
+// installs snapshots from the leader.  It is the only goroutine that touches
+// the state machine, and takes a snapshot itself when enough entries have
+// been applied since the last one.
+func (n *Node) apply() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-n.applyReady:
+		}
+
+		n.mu.Lock()
+		install := n.install
+		n.install = nil
+		n.mu.Unlock()
+		if install != nil {
+			n.restore(install)
+		}
+
+		for {
+			n.mu.Lock()
+			if n.install != nil || n.applied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			entries := n.entriesFrom(n.applied+1, int(n.commitIndex-n.applied))
+			n.mu.Unlock()
+
+			for _, e := range entries {
+				var value interface{}
+				if e.Type == EntryCommand {
+					value = n.cfg.StateMachine.Apply(e.Index, e.Data)
+				}
+
+				n.mu.Lock()
+				n.applied = e.Index
+				if w, ok := n.waiters[e.Index]; ok {
+					delete(n.waiters, e.Index)
+					if w.term == e.Term {
+						w.result <- proposal{value: value}
+					} else {
+						w.result <- proposal{err: ErrLost}
+					}
+				}
+				n.mu.Unlock()
+			}
+			n.maybeSnapshot()
+		}
+	}
+}
+
+// restore replaces the state machine with a snapshot from the leader.
+func (n *Node) restore(s *Snapshot) {
+	if err := n.cfg.StateMachine.Restore(s.Data); err != nil {
+		n.log.Error("raft restoring snapshot failed", "index", s.Index, "error", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.applied = s.Index
+	for index, w := range n.waiters {
+		if index <= s.Index {
+			w.result <- proposal{err: ErrLost}
+			delete(n.waiters, index)
+		}
+	}
+}
+
+// maybeSnapshot takes a snapshot if enough entries have been applied since
+// the last one, and discards the entries it covers.
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	if n.install != nil || n.applied < n.snapshot.Index+n.cfg.SnapshotEntries {
+		n.mu.Unlock()
+		return
+	}
+	index := n.applied
+	term, _ := n.termAt(index)
+	members := n.membersAt(index)
+	n.mu.Unlock()
+
+	// Nothing else applies entries, so the state machine is as of index
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		n.log.Error("raft snapshot failed", "index", index, "error", err)
+		return
+	}
+	s := Snapshot{Index: index, Term: term, Members: members, Data: data}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.snapshot.Index {
+		// The leader's snapshot got here first
+		return
+	}
+	if err := n.storage.SaveSnapshot(s); err != nil {
+		n.log.Error("raft saving snapshot failed", "index", index, "error", err)
+		return
+	}
+	n.entries = compact(n.entries, s)
+	s.Data = nil
+	n.snapshot = s
+	n.log.Info("raft snapshot taken", "index", index, "bytes", len(data))
+}
@@ -0,0 +1,251 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage keeps a node's state in a directory:
+//
+//	state.json     the HardState
+//	snapshot.json  the latest Snapshot
+//	log.jsonl      the entries after it, one JSON object per line
+//
+// state.json and snapshot.json are replaced whole, by writing a new file and
+// renaming it over the old one, so a crash leaves either the old one or the
+// new one.  New entries are appended to log.jsonl, which is only rewritten
+// when entries are replaced or a snapshot discards them.  Everything is
+// synced to disk before the method that wrote it returns.
+type FileStorage struct {
+	dir string
+
+	mu       sync.Mutex
+	log      *os.File
+	snapshot Snapshot // Without its data
+	entries  []Entry  // What log.jsonl has, so it can be rewritten
+}
+
+// The files in a FileStorage directory.
+const (
+	stateFile    = "state.json"
+	snapshotFile = "snapshot.json"
+	logFile      = "log.jsonl"
+)
+
+// OpenFileStorage opens the storage in dir, creating dir if needed.
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	f := &FileStorage{dir: dir}
+
+	if err := readJSON(filepath.Join(dir, snapshotFile), &f.snapshot); err != nil {
+		return nil, err
+	}
+	f.snapshot.Data = nil
+
+	entries, err := readLog(filepath.Join(dir, logFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		// A crash between saving a snapshot and rewriting the log leaves
+		// entries the snapshot covers
+		if e.Index > f.snapshot.Index {
+			f.entries = appendEntries(f.entries, f.snapshot.Index, []Entry{e})
+		}
+	}
+
+	// Rewriting drops anything that was skipped above, and an incomplete
+	// line a crash may have left at the end
+	if err := f.rewrite(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes the log file.
+func (f *FileStorage) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.Close()
+}
+
+// Load returns everything saved.
+func (f *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hard := HardState{Vote: -1}
+	if err := readJSON(filepath.Join(f.dir, stateFile), &hard); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	var snapshot Snapshot
+	if err := readJSON(filepath.Join(f.dir, snapshotFile), &snapshot); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	return hard, snapshot, append([]Entry(nil), f.entries...), nil
+}
+
+// SetHardState saves the term and vote.
+func (f *FileStorage) SetHardState(hs HardState) error {
+	return writeJSON(filepath.Join(f.dir, stateFile), hs)
+}
+
+// Append adds entries to the log.
+func (f *FileStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last := f.snapshot.Index + uint64(len(f.entries))
+	f.entries = appendEntries(f.entries, f.snapshot.Index, entries)
+	if entries[0].Index <= last {
+		// Entries are being replaced, which an append can't do
+		return f.rewrite()
+	}
+
+	w := bufio.NewWriter(f.log)
+	if err := writeEntries(w, entries); err != nil {
+		return err
+	}
+	return f.log.Sync()
+}
+
+// SaveSnapshot saves a snapshot, discarding the entries it covers.
+func (f *FileStorage) SaveSnapshot(s Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := writeJSON(filepath.Join(f.dir, snapshotFile), s); err != nil {
+		return err
+	}
+	f.entries = compact(f.entries, s)
+	s.Data = nil
+	f.snapshot = s
+	return f.rewrite()
+}
+
+// rewrite replaces log.jsonl with f.entries, and reopens it for appending.
+func (f *FileStorage) rewrite() error {
+	path := filepath.Join(f.dir, logFile)
+	err := writeFile(path, func(w *bufio.Writer) error {
+		return writeEntries(w, f.entries)
+	})
+	if err != nil {
+		return err
+	}
+
+	if f.log != nil {
+		f.log.Close()
+	}
+	f.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+	return err
+}
+
+// writeEntries writes entries to w, one per line, and flushes it.
+func writeEntries(w *bufio.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// readLog reads the entries in path.  A missing file has none, and an
+// incomplete last line, from a crash in the middle of an append, is ignored.
+func readLog(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	in := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := in.ReadBytes('\n')
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// readJSON decodes the file at path into v, leaving v alone if there's no
+// such file.
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSON replaces the file at path with v as JSON.
+func writeJSON(path string, v interface{}) error {
+	return writeFile(path, func(w *bufio.Writer) error {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+// writeFile replaces the file at path with what write writes, by writing a
+// temporary file, syncing it and renaming it over path.
+func writeFile(path string, write func(w *bufio.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(bufio.NewWriter(tmp)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// The rename isn't durable until the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
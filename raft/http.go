@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The paths a Handler serves, under which HTTPTransport sends each request.
+const (
+	VotePath     = "/raft/vote"
+	AppendPath   = "/raft/append"
+	SnapshotPath = "/raft/snapshot"
+)
+
+// HTTPTransport sends requests to the other nodes as JSON over HTTP, to the
+// paths their Handler serves.
+type HTTPTransport struct {
+	Client *http.Client // nil uses http.DefaultClient
+	Token  string       // Sent as a bearer token, "" for none
+}
+
+// RequestVote sends a VoteRequest.
+func (t *HTTPTransport) RequestVote(ctx context.Context, to Member, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	err := t.post(ctx, to.URL+VotePath, req, &resp)
+	return resp, err
+}
+
+// AppendEntries sends an AppendRequest.
+func (t *HTTPTransport) AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	err := t.post(ctx, to.URL+AppendPath, req, &resp)
+	return resp, err
+}
+
+// InstallSnapshot sends a SnapshotRequest.
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, to Member, req SnapshotRequest) (SnapshotResponse, error) {
+	var resp SnapshotResponse
+	err := t.post(ctx, to.URL+SnapshotPath, req, &resp)
+	return resp, err
+}
+
+// post sends req to url as JSON, and decodes the response into resp.
+func (t *HTTPTransport) post(ctx context.Context, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if t.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("POST %s returned %d: %s", url, res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Handler serves the requests HTTPTransport sends to n.  Requests must carry
+// token as a bearer token.  If token is "", every request is refused, rather
+// than letting anyone vote or append entries.
+func Handler(n *Node, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(VotePath, func(w http.ResponseWriter, r *http.Request) {
+		var req VoteRequest
+		if decodeRPC(w, r, token, &req) {
+			writeRPC(w, n.HandleRequestVote(req))
+		}
+	})
+	mux.HandleFunc(AppendPath, func(w http.ResponseWriter, r *http.Request) {
+		var req AppendRequest
+		if decodeRPC(w, r, token, &req) {
+			writeRPC(w, n.HandleAppendEntries(req))
+		}
+	})
+	mux.HandleFunc(SnapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		var req SnapshotRequest
+		if decodeRPC(w, r, token, &req) {
+			writeRPC(w, n.HandleInstallSnapshot(req))
+		}
+	})
+	return mux
+}
+
+// decodeRPC checks the method and token of a request and decodes its body
+// into req.  It writes the error and returns false if any of that fails.
+func decodeRPC(w http.ResponseWriter, r *http.Request, token string, req interface{}) bool {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return false
+	}
+	want := "Bearer " + token
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid cluster token.", 401)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), 400)
+		return false
+	}
+	return true
+}
+
+// writeRPC writes the response to a request as JSON.
+func writeRPC(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,55 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+)
+
+// Membership changes one node at a time, as described in section 4.1 of the
+// dissertation, which keeps every majority of the old members overlapping
+// every majority of the new ones without joint consensus.  A change takes
+// effect on each node as soon as it's in that node's log, and another can't
+// be proposed until it is committed.
+//
+// A node being added is started with no Members, so that it waits to hear
+// from the leader rather than starting elections of its own.  It is sent
+// the log, or a snapshot, before it counts towards a majority.
+
+// AddMember adds m to the cluster, and waits until the change is committed.
+// Only the leader can add a member.
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	n.mu.Lock()
+	if n.member(m.ID) != nil {
+		n.mu.Unlock()
+		return fmt.Errorf("node %d is already a member", m.ID)
+	}
+	members := append(append([]Member(nil), n.members...), m)
+	n.mu.Unlock()
+
+	_, err := n.propose(ctx, Entry{Type: EntryMembers, Members: members})
+	return err
+}
+
+// RemoveMember removes node id from the cluster, and waits until the change
+// is committed.  Only the leader can remove a member.  The leader can remove
+// itself, and steps down once the change is committed.
+func (n *Node) RemoveMember(ctx context.Context, id int) error {
+	n.mu.Lock()
+	if n.member(id) == nil {
+		n.mu.Unlock()
+		return fmt.Errorf("node %d is not a member", id)
+	}
+	var members []Member
+	for _, m := range n.members {
+		if m.ID != id {
+			members = append(members, m)
+		}
+	}
+	n.mu.Unlock()
+
+	if len(members) == 0 {
+		return fmt.Errorf("can't remove the last member")
+	}
+	_, err := n.propose(ctx, Entry{Type: EntryMembers, Members: members})
+	return err
+}
@@ -0,0 +1,195 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned by a LocalNetwork transport when the message was
+// lost, or there's no node to deliver it to.
+var ErrUnreachable = errors.New("raft node is unreachable")
+
+// LocalNetwork connects nodes in the same process, for tests.  Messages can
+// be lost at random, delayed, or cut off between groups of nodes to
+// simulate a partition.  Every message is copied through JSON, as it would
+// be over the wire, so nodes never share memory.
+type LocalNetwork struct {
+	mu      sync.Mutex
+	nodes   map[int]*Node
+	group   map[int]int // Partition each node is in, nodes not listed are in 0
+	loss    float64
+	delay   time.Duration
+	rand    *rand.Rand
+	counter map[string]int
+}
+
+// NewLocalNetwork returns a network with no nodes, where nothing is lost.
+func NewLocalNetwork() *LocalNetwork {
+	return &LocalNetwork{
+		nodes:   make(map[int]*Node),
+		group:   make(map[int]int),
+		rand:    rand.New(rand.NewSource(1)),
+		counter: make(map[string]int),
+	}
+}
+
+// Transport returns the transport for node id to send messages with.
+func (l *LocalNetwork) Transport(id int) Transport {
+	return localTransport{l, id}
+}
+
+// Attach delivers messages for n.  A node that is restarted is attached
+// again in place of the old one.
+func (l *LocalNetwork) Attach(n *Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nodes[n.cfg.ID] = n
+}
+
+// Detach stops delivering messages to node id, as though it had crashed.
+func (l *LocalNetwork) Detach(id int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.nodes, id)
+}
+
+// Partition splits the network so that only nodes in the same group can
+// reach each other.  Nodes that aren't in any group are in a group of their
+// own with each other.
+func (l *LocalNetwork) Partition(groups ...[]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.group = make(map[int]int)
+	for i, g := range groups {
+		for _, id := range g {
+			l.group[id] = i + 1
+		}
+	}
+}
+
+// Heal undoes Partition.
+func (l *LocalNetwork) Heal() {
+	l.Partition()
+}
+
+// SetLoss makes a fraction of messages, and separately of responses, get
+// lost, from 0 to 1.
+func (l *LocalNetwork) SetLoss(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loss = rate
+}
+
+// SetDelay delays every message by up to d, at random, so that they arrive
+// out of order.
+func (l *LocalNetwork) SetDelay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delay = d
+}
+
+// Sent returns how many messages of a kind were delivered: "vote",
+// "append" or "snapshot".
+func (l *LocalNetwork) Sent(kind string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counter[kind]
+}
+
+// route returns the node to deliver a message from one node to another, if
+// it gets there.
+func (l *LocalNetwork) route(ctx context.Context, from, to int, kind string) (*Node, error) {
+	l.mu.Lock()
+	node, ok := l.nodes[to]
+	lost := !ok || l.group[from] != l.group[to] || l.rand.Float64() < l.loss
+	var delay time.Duration
+	if l.delay > 0 {
+		delay = time.Duration(l.rand.Int63n(int64(l.delay)))
+	}
+	if !lost {
+		l.counter[kind]++
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if lost {
+		return nil, ErrUnreachable
+	}
+	return node, nil
+}
+
+// lost reports whether a response is lost on the way back.
+func (l *LocalNetwork) lost(from, to int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.nodes[from]
+	return !ok || l.group[from] != l.group[to] || l.rand.Float64() < l.loss
+}
+
+// localTransport is node from's view of a LocalNetwork.
+type localTransport struct {
+	net  *LocalNetwork
+	from int
+}
+
+func (t localTransport) RequestVote(ctx context.Context, to Member, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	err := t.call(ctx, to.ID, "vote", req, &resp, func(n *Node, req interface{}) interface{} {
+		return n.HandleRequestVote(*req.(*VoteRequest))
+	}, new(VoteRequest))
+	return resp, err
+}
+
+func (t localTransport) AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	err := t.call(ctx, to.ID, "append", req, &resp, func(n *Node, req interface{}) interface{} {
+		return n.HandleAppendEntries(*req.(*AppendRequest))
+	}, new(AppendRequest))
+	return resp, err
+}
+
+func (t localTransport) InstallSnapshot(ctx context.Context, to Member, req SnapshotRequest) (SnapshotResponse, error) {
+	var resp SnapshotResponse
+	err := t.call(ctx, to.ID, "snapshot", req, &resp, func(n *Node, req interface{}) interface{} {
+		return n.HandleInstallSnapshot(*req.(*SnapshotRequest))
+	}, new(SnapshotRequest))
+	return resp, err
+}
+
+// call delivers req to node to, decoded into a fresh decoded, and hands it to
+// handle, then delivers the response back into resp.
+func (t localTransport) call(ctx context.Context, to int, kind string, req, resp interface{},
+	handle func(n *Node, req interface{}) interface{}, decoded interface{}) error {
+
+	node, err := t.net.route(ctx, t.from, to, kind)
+	if err != nil {
+		return err
+	}
+	if err := copyJSON(req, decoded); err != nil {
+		return err
+	}
+	answer := handle(node, decoded)
+	if t.net.lost(t.from, to) {
+		return ErrUnreachable
+	}
+	return copyJSON(answer, resp)
+}
+
+// copyJSON copies from into to through JSON.
+func copyJSON(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
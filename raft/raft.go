@@ -0,0 +1,616 @@
+// Package raft implements the Raft consensus algorithm, for a log of commands
+// that every node of a cluster applies to its state machine in the same
+// order.
+//
+// It has the parts of Raft described in the paper and Diego Ongaro's
+// dissertation that the hash server needs: leader election, log replication,
+// snapshots to keep the log short, and membership changes one node at a time.
+// A Node talks to the others through a Transport.  HTTPTransport and Handler
+// carry the messages between processes, and LocalNetwork between nodes in one
+// process, with partitions and lost messages for tests.
+//
+// The leader appends a no-op entry when it is elected, so that entries from
+// earlier terms are committed as soon as possible, and a Barrier is the same
+// thing on demand.  Reads that must be linearizable wait for a Barrier.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Member is a node of the cluster.
+type Member struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"` // Where the other nodes, and clients redirected to it, reach it
+}
+
+// EntryType says what an Entry is for.
+type EntryType int
+
+const (
+	EntryCommand EntryType = iota // A command for the StateMachine
+	EntryNoop                     // Appended by a new leader, and by Barrier
+	EntryMembers                  // A change of membership
+)
+
+// Entry is an entry in the log.
+type Entry struct {
+	Index   uint64    `json:"index"`
+	Term    uint64    `json:"term"`
+	Type    EntryType `json:"type"`
+	Data    []byte    `json:"data,omitempty"`    // The command, for EntryCommand
+	Members []Member  `json:"members,omitempty"` // Every member from now on, for EntryMembers
+}
+
+// StateMachine is what the log drives.  Apply is called with each committed
+// command, in order, exactly once per node, unless a snapshot replaces them.
+// None of its methods are called concurrently.
+type StateMachine interface {
+	// Apply applies a command.  Its result is returned by Propose on the
+	// node that proposed the command.
+	Apply(index uint64, command []byte) interface{}
+
+	// Snapshot returns the state machine's state, to be passed to Restore.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state machine's state with a snapshot.
+	Restore(data []byte) error
+}
+
+// Config configures a Node.
+type Config struct {
+	ID      int      // This node's id
+	Members []Member // Every node of the cluster, for a new cluster.  Empty for a node that is waiting to be added.
+
+	StateMachine StateMachine
+	Storage      Storage   // nil keeps everything in memory
+	Transport    Transport // How to reach the other nodes
+
+	ElectionTimeout   time.Duration // A follower that hears nothing from a leader for between this and twice this starts an election.  Default 1s.
+	HeartbeatInterval time.Duration // How often the leader reminds followers it's there.  Default 100ms.
+	SnapshotEntries   uint64        // Entries applied since the last snapshot that cause another.  Default 10000.
+
+	// Logger receives an event whenever the node's role changes and when a
+	// snapshot is taken or installed.  nil logs nothing.
+	Logger *slog.Logger
+
+	// OnLead is called, on its own goroutine, when this node has become the
+	// leader and the entries of earlier terms are committed and applied.
+	OnLead func(term uint64)
+}
+
+// Role is the part a node plays in its current term.
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+// ErrStopped is returned by Propose once the node has been stopped.
+var ErrStopped = errors.New("raft node is stopped")
+
+// ErrLost is returned by Propose when leadership changed before the command
+// was committed, and another entry took its place.  It may or may not have
+// been applied under another proposal, but not this one.
+var ErrLost = errors.New("raft leadership changed before the entry was committed")
+
+// ErrMembershipChange is returned by AddMember and RemoveMember while an
+// earlier change is still being committed, or a new leader has yet to commit
+// an entry from its own term.
+var ErrMembershipChange = errors.New("a membership change is already in progress")
+
+// NotLeaderError is returned by Propose on a node that isn't the leader.
+type NotLeaderError struct {
+	Leader *Member // The leader, if this node knows it
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == nil {
+		return "not the raft leader, and no leader is known"
+	}
+	return fmt.Sprintf("not the raft leader, node %d is", e.Leader.ID)
+}
+
+// Status describes a node, for diagnostics.
+type Status struct {
+	ID            int      `json:"id"`
+	Role          Role     `json:"role"`
+	Term          uint64   `json:"term"`
+	Leader        int      `json:"leader"` // -1 if not known
+	Members       []Member `json:"members"`
+	LastIndex     uint64   `json:"lastIndex"`
+	CommitIndex   uint64   `json:"commitIndex"`
+	AppliedIndex  uint64   `json:"appliedIndex"`
+	SnapshotIndex uint64   `json:"snapshotIndex"`
+}
+
+// Node is one member of a Raft cluster.
+type Node struct {
+	cfg     Config
+	log     *slog.Logger
+	storage Storage
+	rand    *rand.Rand
+
+	mu          sync.Mutex
+	role        Role
+	term        uint64
+	vote        int
+	leader      int
+	members     []Member // As of the last EntryMembers in the log, whether committed or not
+	entries     []Entry  // The log after the snapshot
+	snapshot    Snapshot // Without its data, which is only loaded to send it
+	commitIndex uint64
+	applied     uint64
+	deadline    time.Time // When a follower or candidate starts an election
+	heard       time.Time // When a follower last heard from a leader
+	votes       map[int]bool
+	next        map[int]uint64 // For each follower, the next entry to send it
+	match       map[int]uint64 // For each follower, the last entry it's known to have
+	sending     map[int]bool   // Followers with a request in flight
+	waiters     map[uint64]waiter
+	install     *Snapshot     // A snapshot from the leader, waiting for the applier
+	applyReady  chan struct{} // Wakes the applier
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	wg          sync.WaitGroup
+}
+
+// waiter is a proposal waiting for its entry to be applied.
+type waiter struct {
+	term   uint64
+	result chan<- proposal
+}
+
+// proposal is the outcome of a Propose.
+type proposal struct {
+	value interface{}
+	err   error
+}
+
+// New creates a node, restoring whatever its Storage has.  Start starts it.
+func New(cfg Config) (*Node, error) {
+	if cfg.StateMachine == nil || cfg.Transport == nil {
+		return nil, errors.New("raft needs a state machine and a transport")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = time.Second
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval >= cfg.ElectionTimeout {
+		return nil, fmt.Errorf("heartbeat interval %v must be less than the election timeout %v",
+			cfg.HeartbeatInterval, cfg.ElectionTimeout)
+	}
+	if cfg.SnapshotEntries == 0 {
+		cfg.SnapshotEntries = 10000
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+
+	n := &Node{
+		cfg:        cfg,
+		log:        cfg.Logger,
+		storage:    cfg.Storage,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano() + int64(cfg.ID))),
+		role:       Follower,
+		leader:     -1,
+		waiters:    make(map[uint64]waiter),
+		applyReady: make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+	if n.log == nil {
+		n.log = slog.New(slog.DiscardHandler)
+	}
+	n.log = n.log.With("raft_node", cfg.ID)
+
+	hard, snapshot, entries, err := n.storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n.term, n.vote = hard.Term, hard.Vote
+	n.entries = entries
+	n.members = cfg.Members
+	if snapshot.Index > 0 {
+		// The state machine starts from the snapshot, and the entries
+		// after it are applied again once they're known to be committed
+		if err := cfg.StateMachine.Restore(snapshot.Data); err != nil {
+			return nil, fmt.Errorf("restoring snapshot %d: %w", snapshot.Index, err)
+		}
+		n.members = snapshot.Members
+		snapshot.Data = nil
+		n.snapshot = snapshot
+		n.commitIndex, n.applied = snapshot.Index, snapshot.Index
+	}
+	n.updateMembers()
+	return n, nil
+}
+
+// Start starts the node's timers and applier.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.tick()
+	go n.apply()
+}
+
+// Stop stops the node.  Proposals waiting for their entries are failed with
+// ErrStopped.  The node can't be started again, but a new one can be created
+// on the same Storage.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stopped)
+	})
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for index, w := range n.waiters {
+		w.result <- proposal{err: ErrStopped}
+		delete(n.waiters, index)
+	}
+}
+
+// Status returns the state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader,
+		Members:       append([]Member(nil), n.members...),
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.applied,
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+// Leader returns the leader, if this node knows who it is.
+func (n *Node) Leader() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	m := n.member(n.leader)
+	if m == nil {
+		return Member{}, false
+	}
+	return *m, true
+}
+
+// Propose appends a command to the log, and waits until it has been applied
+// here, returning the result of StateMachine.Apply.  Only the leader can
+// propose.  If ctx is done first, the command may still be applied later.
+func (n *Node) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	return n.propose(ctx, Entry{Type: EntryCommand, Data: command})
+}
+
+// Barrier waits until this node has applied every entry committed before it
+// was called, and has confirmed that it is still the leader.  Whatever the
+// state machine says after that is at least as new as any write that
+// completed before Barrier was called.
+func (n *Node) Barrier(ctx context.Context) error {
+	_, err := n.propose(ctx, Entry{Type: EntryNoop})
+	return err
+}
+
+// propose appends e to the log as the leader and waits for it to be applied.
+func (n *Node) propose(ctx context.Context, e Entry) (interface{}, error) {
+	result := make(chan proposal, 1)
+
+	n.mu.Lock()
+	if err := n.leaderCheck(); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	if e.Type == EntryMembers && n.changing() {
+		n.mu.Unlock()
+		return nil, ErrMembershipChange
+	}
+	e.Index, e.Term = n.lastIndex()+1, n.term
+	if err := n.appendEntries([]Entry{e}); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.waiters[e.Index] = waiter{n.term, result}
+	n.replicateAll()
+	n.mu.Unlock()
+
+	select {
+	case p := <-result:
+		return p.value, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.stopped:
+		return nil, ErrStopped
+	}
+}
+
+// leaderCheck returns an error unless this node is the leader.
+func (n *Node) leaderCheck() error {
+	select {
+	case <-n.stopped:
+		return ErrStopped
+	default:
+	}
+	if n.role != Leader {
+		return &NotLeaderError{Leader: n.member(n.leader)}
+	}
+	return nil
+}
+
+// tick runs the timers: elections for followers and candidates, and
+// heartbeats for the leader.
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	lastHeartbeat := time.Time{}
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			switch {
+			case n.role == Leader && now.Sub(lastHeartbeat) >= n.cfg.HeartbeatInterval:
+				lastHeartbeat = now
+				n.heartbeat()
+			case n.role != Leader && now.After(n.deadline):
+				n.campaign()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// resetDeadline picks a new, random time to start an election, so that
+// candidates rarely split the vote.
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(n.rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// campaign starts an election, if this node is a member.  A node that is
+// waiting to be added, or has been removed, just waits.
+func (n *Node) campaign() {
+	n.resetDeadline()
+	if n.member(n.cfg.ID) == nil {
+		return
+	}
+
+	n.setRole(Candidate, n.term+1)
+	n.vote = n.cfg.ID
+	if err := n.saveHardState(); err != nil {
+		n.log.Error("raft saving vote failed", "error", err)
+		return
+	}
+	n.votes = map[int]bool{n.cfg.ID: true}
+	if n.quorum(func(id int) bool { return n.votes[id] }) {
+		n.becomeLeader()
+		return
+	}
+
+	req := VoteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	for _, m := range n.peers() {
+		go n.requestVote(m, req)
+	}
+}
+
+// requestVote asks m for its vote, and counts it.
+func (n *Node) requestVote(m Member, req VoteRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	resp, err := n.cfg.Transport.RequestVote(ctx, m, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.role != Candidate || n.term != req.Term || !resp.Granted {
+		return
+	}
+	n.votes[m.ID] = true
+	if n.quorum(func(id int) bool { return n.votes[id] }) {
+		n.becomeLeader()
+	}
+}
+
+// becomeLeader takes over as leader, and appends a no-op entry so that the
+// entries of earlier terms are committed.
+func (n *Node) becomeLeader() {
+	n.setRole(Leader, n.term)
+	n.leader = n.cfg.ID
+	n.next = make(map[int]uint64)
+	n.match = make(map[int]uint64)
+	n.sending = make(map[int]bool)
+	for _, m := range n.members {
+		n.next[m.ID] = n.lastIndex() + 1
+	}
+
+	index := n.lastIndex() + 1
+	if err := n.appendEntries([]Entry{{Index: index, Term: n.term, Type: EntryNoop}}); err != nil {
+		n.log.Error("raft appending failed", "error", err)
+		return
+	}
+	if n.cfg.OnLead != nil {
+		// The no-op is the first entry of this term, so once it's applied so
+		// is everything before it
+		result := make(chan proposal, 1)
+		n.waiters[index] = waiter{n.term, result}
+		term := n.term
+		go func() {
+			select {
+			case p := <-result:
+				if p.err == nil {
+					n.cfg.OnLead(term)
+				}
+			case <-n.stopped:
+			}
+		}()
+	}
+	n.replicateAll()
+}
+
+// stepDown becomes a follower in term, which is newer than the current one.
+func (n *Node) stepDown(term uint64) {
+	n.setRole(Follower, term)
+	n.vote = -1
+	n.leader = -1
+	if err := n.saveHardState(); err != nil {
+		n.log.Error("raft saving term failed", "error", err)
+	}
+	n.resetDeadline()
+}
+
+// setRole changes the role and term, logging the change.
+func (n *Node) setRole(role Role, term uint64) {
+	if role != n.role || term != n.term {
+		n.log.Info("raft role changed", "role", role, "term", term)
+	}
+	n.role, n.term = role, term
+}
+
+// quorum reports whether a majority of the members satisfy ok.
+func (n *Node) quorum(ok func(id int) bool) bool {
+	count := 0
+	for _, m := range n.members {
+		if ok(m.ID) {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+// peers returns every member but this one.
+func (n *Node) peers() []Member {
+	var peers []Member
+	for _, m := range n.members {
+		if m.ID != n.cfg.ID {
+			peers = append(peers, m)
+		}
+	}
+	return peers
+}
+
+// member returns the member with the given id, or nil.
+func (n *Node) member(id int) *Member {
+	for _, m := range n.members {
+		if m.ID == id {
+			return &m
+		}
+	}
+	return nil
+}
+
+// lastIndex returns the index of the last entry in the log.
+func (n *Node) lastIndex() uint64 {
+	if len(n.entries) == 0 {
+		return n.snapshot.Index
+	}
+	return n.entries[len(n.entries)-1].Index
+}
+
+// lastTerm returns the term of the last entry in the log.
+func (n *Node) lastTerm() uint64 {
+	if len(n.entries) == 0 {
+		return n.snapshot.Term
+	}
+	return n.entries[len(n.entries)-1].Term
+}
+
+// termAt returns the term of the entry at index, if it is still known.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.snapshot.Index:
+		return n.snapshot.Term, true
+	case index < n.snapshot.Index || index > n.lastIndex():
+		return 0, false
+	}
+	return n.entries[index-n.snapshot.Index-1].Term, true
+}
+
+// entriesFrom returns the entries from index on, at most max of them.
+func (n *Node) entriesFrom(index uint64, max int) []Entry {
+	if index > n.lastIndex() {
+		return nil
+	}
+	entries := n.entries[index-n.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// appendEntries adds entries to the log, durably, replacing any that are
+// there at the same indexes.
+func (n *Node) appendEntries(entries []Entry) error {
+	if err := n.storage.Append(entries); err != nil {
+		return err
+	}
+	n.entries = appendEntries(n.entries, n.snapshot.Index, entries)
+	n.updateMembers()
+	return nil
+}
+
+// updateMembers makes the last membership in the log the current one.  A
+// change takes effect as soon as it's in the log, committed or not.
+func (n *Node) updateMembers() {
+	n.members = n.membersAt(n.lastIndex())
+	sort.Slice(n.members, func(i, j int) bool { return n.members[i].ID < n.members[j].ID })
+}
+
+// membersAt returns the membership as of index.
+func (n *Node) membersAt(index uint64) []Member {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if e := n.entries[i]; e.Index <= index && e.Type == EntryMembers {
+			return e.Members
+		}
+	}
+	if n.snapshot.Index > 0 {
+		return n.snapshot.Members
+	}
+	return n.cfg.Members
+}
+
+// changing reports whether a membership change is in the log but not yet
+// committed.  Only one change may be in progress at a time.  A new leader
+// can't tell whether an uncommitted change left over from an earlier term
+// will be kept until it has committed an entry of its own, so until then it
+// counts as changing too.
+func (n *Node) changing() bool {
+	if term, _ := n.termAt(n.commitIndex); term != n.term {
+		return true
+	}
+	for i := len(n.entries) - 1; i >= 0 && n.entries[i].Index > n.commitIndex; i-- {
+		if n.entries[i].Type == EntryMembers {
+			return true
+		}
+	}
+	return false
+}
+
+// saveHardState saves the term and vote.
+func (n *Node) saveHardState() error {
+	return n.storage.SetHardState(HardState{Term: n.term, Vote: n.vote})
+}
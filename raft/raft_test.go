@@ -0,0 +1,650 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// machine is a StateMachine that remembers every command it applied.
+type machine struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (m *machine) Apply(index uint64, command []byte) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, string(command))
+	return len(m.commands)
+}
+
+func (m *machine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.commands)
+}
+
+func (m *machine) Restore(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = nil
+	return json.Unmarshal(data, &m.commands)
+}
+
+func (m *machine) applied() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands...)
+}
+
+// testCluster is a cluster of nodes on a LocalNetwork.
+type testCluster struct {
+	t        *testing.T
+	net      *LocalNetwork
+	members  []Member
+	nodes    map[int]*Node
+	machines map[int]*machine
+	storage  map[int]Storage
+	snapshot uint64
+	stalled  atomic.Bool // Every AppendEntries is lost, see stallingTransport
+}
+
+// stallingTransport loses every AppendEntries while stalled is set, so that
+// elections still work but nothing can be committed.
+type stallingTransport struct {
+	Transport
+	stalled *atomic.Bool
+}
+
+func (t stallingTransport) AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error) {
+	if t.stalled.Load() {
+		return AppendResponse{}, ErrUnreachable
+	}
+	return t.Transport.AppendEntries(ctx, to, req)
+}
+
+// newCluster starts a cluster of size nodes, with ids from 1.
+func newCluster(t *testing.T, size int, snapshotEntries uint64) *testCluster {
+	c := &testCluster{
+		t:        t,
+		net:      NewLocalNetwork(),
+		nodes:    make(map[int]*Node),
+		machines: make(map[int]*machine),
+		storage:  make(map[int]Storage),
+		snapshot: snapshotEntries,
+	}
+	for id := 1; id <= size; id++ {
+		c.members = append(c.members, Member{ID: id, URL: fmt.Sprintf("http://node%d", id)})
+	}
+	for id := 1; id <= size; id++ {
+		c.start(id, c.members)
+	}
+	t.Cleanup(c.stopAll)
+	return c
+}
+
+// start starts node id, or restarts it on the storage it had.
+func (c *testCluster) start(id int, members []Member) *Node {
+	c.t.Helper()
+	if c.storage[id] == nil {
+		c.storage[id] = NewMemoryStorage()
+	}
+	c.machines[id] = &machine{}
+	n, err := New(Config{
+		ID:                id,
+		Members:           members,
+		StateMachine:      c.machines[id],
+		Storage:           c.storage[id],
+		Transport:         stallingTransport{c.net.Transport(id), &c.stalled},
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotEntries:   c.snapshot,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+	c.net.Attach(n)
+	n.Start()
+	return n
+}
+
+// stop stops node id, as though it crashed.
+func (c *testCluster) stop(id int) {
+	c.net.Detach(id)
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) stopAll() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+}
+
+// leader waits for exactly one of the running nodes in ids, or any of them
+// if there are none, to be the leader of the newest term, and returns it.
+func (c *testCluster) leader(ids ...int) *Node {
+	c.t.Helper()
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		var newest uint64
+		for _, id := range ids {
+			if n, ok := c.nodes[id]; ok {
+				s := n.Status()
+				if s.Role == Leader {
+					leaders = append(leaders, n)
+				}
+				newest = max(newest, s.Term)
+			}
+		}
+		if len(leaders) == 1 && leaders[0].Status().Term == newest {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("no leader was elected among %v", ids)
+	return nil
+}
+
+// propose proposes commands through whichever node is the leader, trying
+// again when leadership changes.  Only errors that mean the command wasn't
+// applied are tried again, or it could be applied twice.
+func (c *testCluster) propose(ids []int, commands ...string) {
+	c.t.Helper()
+	for _, command := range commands {
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_, err := c.leader(ids...).Propose(ctx, []byte(command))
+			cancel()
+			if err == nil {
+				break
+			}
+			var notLeader *NotLeaderError
+			if attempt == 20 || !(errors.Is(err, ErrLost) || errors.As(err, &notLeader)) {
+				c.t.Fatalf("proposing %q: %v", command, err)
+			}
+		}
+	}
+}
+
+// converge waits until every running node has applied want.
+func (c *testCluster) converge(want []string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		done := true
+		for id := range c.nodes {
+			if got := c.machines[id].applied(); !reflect.DeepEqual(got, want) {
+				if time.Now().After(deadline) {
+					c.t.Fatalf("node %d applied %v, want %v", id, got, want)
+				}
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func commands(from, to int) []string {
+	var commands []string
+	for i := from; i <= to; i++ {
+		commands = append(commands, fmt.Sprint("command ", i))
+	}
+	return commands
+}
+
+// TestElection verifies that a leader is elected, that only it accepts
+// proposals, and that another is elected when it fails.
+func TestElection(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	term := leader.Status().Term
+
+	for id, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		_, err := n.Propose(context.Background(), []byte("x"))
+		var notLeader *NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader == nil || notLeader.Leader.ID != leader.Status().ID {
+			t.Errorf("Propose() on follower %d = %v", id, err)
+		}
+	}
+
+	c.stop(leader.Status().ID)
+	next := c.leader()
+	if next == leader || next.Status().Term <= term {
+		t.Errorf("after the leader failed, leader %d in term %d", next.Status().ID, next.Status().Term)
+	}
+
+	// Stopped nodes say so
+	if _, err := leader.Propose(context.Background(), []byte("x")); !errors.Is(err, ErrStopped) {
+		t.Errorf("Propose() on a stopped node = %v", err)
+	}
+}
+
+// TestReplication verifies that every node applies the same commands in
+// the same order, even when messages are lost and reordered.
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 5, 0)
+	c.net.SetLoss(0.1)
+	c.net.SetDelay(5 * time.Millisecond)
+
+	c.propose(nil, commands(1, 50)...)
+	c.net.SetLoss(0)
+	c.converge(commands(1, 50))
+
+	leader := c.leader()
+	if err := leader.Barrier(context.Background()); err != nil {
+		t.Errorf("Barrier() = %v", err)
+	}
+	if s := leader.Status(); s.CommitIndex != s.LastIndex || s.AppliedIndex != s.CommitIndex {
+		t.Errorf("after Barrier(), status %+v", s)
+	}
+}
+
+// TestPartition verifies that a leader cut off from the majority can't
+// commit anything, that the majority carries on without it, and that its
+// uncommitted entries are replaced when the partition heals.
+func TestPartition(t *testing.T) {
+	c := newCluster(t, 5, 0)
+	c.propose(nil, "before")
+
+	old := c.leader()
+	oldID := old.Status().ID
+	minority := []int{oldID}
+	var majority []int
+	for id := 1; id <= 5; id++ {
+		if id == oldID {
+			continue
+		}
+		if len(majority) < 3 {
+			majority = append(majority, id)
+		} else {
+			minority = append(minority, id)
+		}
+	}
+	c.net.Partition(minority, majority)
+
+	lost := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := old.Propose(ctx, []byte("lost"))
+		lost <- err
+	}()
+
+	c.propose(majority, "during")
+	select {
+	case err := <-lost:
+		t.Fatalf("Propose() in the minority returned %v", err)
+	default:
+	}
+
+	c.net.Heal()
+	if err := <-lost; !errors.Is(err, ErrLost) {
+		t.Errorf("Propose() in the minority = %v, want ErrLost", err)
+	}
+	c.propose(nil, "after")
+	c.converge([]string{"before", "during", "after"})
+}
+
+// TestSnapshot verifies that the log is compacted, and that a node that
+// falls too far behind is sent a snapshot.
+func TestSnapshot(t *testing.T) {
+	c := newCluster(t, 3, 10)
+	c.propose(nil, commands(1, 5)...)
+	c.converge(commands(1, 5))
+
+	var behind int
+	for id := range c.nodes {
+		if c.nodes[id] != c.leader() {
+			behind = id
+		}
+	}
+	c.stop(behind)
+	c.propose(nil, commands(6, 50)...)
+	c.converge(commands(1, 50))
+
+	if s := c.leader().Status(); s.SnapshotIndex == 0 || s.LastIndex-s.SnapshotIndex > 20 {
+		t.Errorf("leader status %+v, want the log compacted", s)
+	}
+
+	c.start(behind, c.members)
+	c.converge(commands(1, 50))
+	if c.net.Sent("snapshot") == 0 {
+		t.Error("the node that was behind wasn't sent a snapshot")
+	}
+
+	// Restarting from its own snapshot and log gives the same state
+	c.stop(behind)
+	c.start(behind, c.members)
+	c.propose(nil, "more")
+	c.converge(append(commands(1, 50), "more"))
+}
+
+// TestMembership verifies that nodes can be added and removed, including the
+// leader, and that the new membership is used for majorities.
+func TestMembership(t *testing.T) {
+	c := newCluster(t, 3, 10)
+	c.propose(nil, commands(1, 20)...)
+
+	// The new node waits to hear from the leader
+	joining := Member{ID: 4, URL: "http://node4"}
+	c.start(4, nil)
+	if err := c.leader(1, 2, 3).AddMember(context.Background(), joining); err != nil {
+		t.Fatal(err)
+	}
+	c.members = append(c.members, joining)
+	c.propose(nil, "added")
+	c.converge(append(commands(1, 20), "added"))
+	if got := c.nodes[4].Status().Members; !reflect.DeepEqual(got, c.members) {
+		t.Errorf("node 4 members = %v, want %v", got, c.members)
+	}
+
+	leader := c.leader()
+	if err := leader.AddMember(context.Background(), joining); err == nil {
+		t.Error("AddMember() accepted an existing member")
+	}
+
+	// The leader removes itself, and the rest carry on
+	id := leader.Status().ID
+	if err := leader.RemoveMember(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	var rest []int
+	for _, m := range c.members {
+		if m.ID != id {
+			rest = append(rest, m.ID)
+		}
+	}
+	next := c.leader(rest...)
+	if got := len(next.Status().Members); got != 3 {
+		t.Errorf("%d members after removing one", got)
+	}
+	c.stop(id)
+
+	// Three members need two of them, so the cluster survives one more
+	c.stop(next.Status().ID)
+	rest = rest[:0]
+	for id := range c.nodes {
+		rest = append(rest, id)
+	}
+	c.propose(rest, "removed")
+	c.converge(append(commands(1, 20), "added", "removed"))
+}
+
+// TestMembershipLeaderChange verifies that a new leader refuses membership
+// changes until it has committed an entry of its own term, since until then
+// it can't know whether a change it never saw was committed before it took
+// over.
+func TestMembershipLeaderChange(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	c.propose(nil, "before")
+	old := c.leader().Status().ID
+	var rest []int
+	for _, m := range c.members {
+		if m.ID != old {
+			rest = append(rest, m.ID)
+		}
+	}
+
+	// With the old leader gone and nothing getting through, a new one is
+	// elected but can never commit its no-op.  Leaders may come and go,
+	// but none of them accepts the change.
+	joining := Member{ID: 4, URL: "http://node4"}
+	c.start(4, nil)
+	c.stalled.Store(true)
+	c.stop(old)
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := c.leader(rest...).AddMember(ctx, joining)
+		cancel()
+		if errors.Is(err, ErrMembershipChange) {
+			break
+		}
+		var notLeader *NotLeaderError
+		if attempt == 20 || !errors.As(err, &notLeader) {
+			t.Fatalf("AddMember() before the no-op was committed = %v, want ErrMembershipChange", err)
+		}
+	}
+
+	// Once the no-op is committed, the change goes ahead
+	c.stalled.Store(false)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := c.leader(rest...).AddMember(ctx, joining)
+		cancel()
+		if err == nil {
+			break
+		}
+		var notLeader *NotLeaderError
+		if time.Since(start) > 5*time.Second || !(errors.Is(err, ErrMembershipChange) || errors.As(err, &notLeader)) {
+			t.Fatalf("AddMember() after the no-op was committed = %v", err)
+		}
+	}
+	c.propose(rest, "after")
+	if got := len(c.nodes[4].Status().Members); got != 4 {
+		t.Errorf("node 4 has %d members, want 4", got)
+	}
+}
+
+// TestFileStorage verifies that FileStorage saves everything it's given, and
+// survives the kinds of damage a crash leaves.
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	f, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(index, term uint64) Entry {
+		return Entry{Index: index, Term: term, Data: []byte(fmt.Sprint(index, "@", term))}
+	}
+
+	hard := HardState{Term: 3, Vote: 2}
+	must(t, f.SetHardState(hard))
+	must(t, f.Append([]Entry{entry(1, 1), entry(2, 1), entry(3, 1)}))
+	must(t, f.Append([]Entry{entry(4, 2)}))
+	must(t, f.Append([]Entry{entry(3, 3)})) // Replaces 3 and 4
+	must(t, f.Append([]Entry{entry(4, 3), entry(5, 3)}))
+	snapshot := Snapshot{Index: 2, Term: 1, Members: []Member{{1, "http://a"}}, Data: []byte("state")}
+	must(t, f.SaveSnapshot(snapshot))
+	must(t, f.Close())
+
+	check := func(f *FileStorage) {
+		t.Helper()
+		gotHard, gotSnapshot, entries, err := f.Load()
+		want := []Entry{entry(3, 3), entry(4, 3), entry(5, 3)}
+		if err != nil || gotHard != hard || !reflect.DeepEqual(gotSnapshot, snapshot) || !reflect.DeepEqual(entries, want) {
+			t.Errorf("Load() = %+v, %+v, %+v, %v", gotHard, gotSnapshot, entries, err)
+		}
+	}
+	f, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f)
+	f.Close()
+
+	// An append cut off by a crash is dropped
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.WriteString(`{"index":6,"te`)
+	log.Close()
+	f, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f)
+	must(t, f.Append([]Entry{entry(6, 3)}))
+	f.Close()
+	f, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, entries, _ := f.Load(); len(entries) != 4 || entries[3].Index != 6 {
+		t.Errorf("after appending to a repaired log, Load() = %+v", entries)
+	}
+	f.Close()
+
+	// A new store votes for nobody
+	f, err = OpenFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hard, _, _, _ := f.Load(); hard.Vote != -1 {
+		t.Errorf("new store HardState = %+v", hard)
+	}
+	f.Close()
+}
+
+// TestRestart verifies that a whole cluster restarted from FileStorage
+// picks up where it left off.
+func TestRestart(t *testing.T) {
+	c := newCluster(t, 0, 10)
+	c.members = []Member{{1, "http://node1"}, {2, "http://node2"}, {3, "http://node3"}}
+	dirs := map[int]string{}
+	for _, m := range c.members {
+		dirs[m.ID] = t.TempDir()
+	}
+	open := func() {
+		for _, m := range c.members {
+			f, err := OpenFileStorage(dirs[m.ID])
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.storage[m.ID] = f
+			c.start(m.ID, c.members)
+		}
+	}
+	closeAll := func() {
+		c.stopAll()
+		for _, s := range c.storage {
+			s.(*FileStorage).Close()
+		}
+	}
+
+	open()
+	c.propose(nil, commands(1, 25)...)
+	c.converge(commands(1, 25))
+	term := c.leader().Status().Term
+	closeAll()
+
+	open()
+	defer closeAll()
+	c.propose(nil, "again")
+	c.converge(append(commands(1, 25), "again"))
+	if got := c.leader().Status().Term; got <= term {
+		t.Errorf("term %d after restarting, was %d", got, term)
+	}
+}
+
+// TestHTTP verifies that nodes in different servers reach each other
+// through HTTPTransport and Handler, with the token checked.
+func TestHTTP(t *testing.T) {
+	var members []Member
+	handlers := make([]http.Handler, 3)
+	var mu sync.Mutex
+	for i := range handlers {
+		i := i
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			h := handlers[i]
+			mu.Unlock()
+			h.ServeHTTP(w, r)
+		}))
+		defer s.Close()
+		members = append(members, Member{ID: i + 1, URL: s.URL})
+	}
+
+	var nodes []*Node
+	machines := make([]*machine, 3)
+	for i := range handlers {
+		machines[i] = &machine{}
+		n, err := New(Config{
+			ID:                i + 1,
+			Members:           members,
+			StateMachine:      machines[i],
+			Transport:         &HTTPTransport{Token: "secret"},
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		handlers[i] = Handler(n, "secret")
+		mu.Unlock()
+		nodes = append(nodes, n)
+		n.Start()
+		defer n.Stop()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		for _, n := range nodes {
+			if _, err = n.Propose(context.Background(), []byte("over http")); err == nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Propose() = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, m := range machines {
+		for len(m.applied()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("a node never applied the command")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	wrong := &HTTPTransport{Token: "wrong"}
+	if _, err := wrong.RequestVote(context.Background(), members[0], VoteRequest{}); err == nil {
+		t.Error("RequestVote() with the wrong token succeeded")
+	}
+
+	// Without a token, nobody gets in
+	open := httptest.NewServer(Handler(nodes[0], ""))
+	defer open.Close()
+	if _, err := (&HTTPTransport{}).RequestVote(context.Background(), Member{ID: 1, URL: open.URL}, VoteRequest{}); err == nil {
+		t.Error("RequestVote() to a handler without a token succeeded")
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,169 @@
+package raft
+
+import (
+	"context"
+	"sort"
+)
+
+// maxAppend is the most entries sent to a follower in one request.
+const maxAppend = 500
+
+// heartbeat sends every follower whatever it is missing, or an empty
+// request to remind it there's a leader.
+func (n *Node) heartbeat() {
+	for _, m := range n.peers() {
+		n.sending[m.ID] = false
+		n.replicate(m)
+	}
+}
+
+// replicateAll sends new entries to every follower that isn't already busy
+// with a request.
+func (n *Node) replicateAll() {
+	for _, m := range n.peers() {
+		n.replicate(m)
+	}
+	n.advanceCommit()
+}
+
+// replicate sends m the entries it's missing, or the snapshot if the leader
+// no longer has them, unless a request to it is already in flight.  A lost
+// request is given up on at the next heartbeat.
+func (n *Node) replicate(m Member) {
+	if n.role != Leader || n.sending[m.ID] {
+		return
+	}
+	next, ok := n.next[m.ID]
+	if !ok {
+		// Just added
+		next = n.lastIndex() + 1
+		n.next[m.ID] = next
+	}
+	n.sending[m.ID] = true
+
+	if next <= n.snapshot.Index {
+		go n.sendSnapshot(m, n.term)
+		return
+	}
+
+	prevTerm, _ := n.termAt(next - 1)
+	req := AppendRequest{
+		Term:        n.term,
+		Leader:      n.cfg.ID,
+		PrevIndex:   next - 1,
+		PrevTerm:    prevTerm,
+		Entries:     n.entriesFrom(next, maxAppend),
+		CommitIndex: n.commitIndex,
+	}
+	go n.sendAppend(m, req)
+}
+
+// sendAppend sends an AppendRequest to m and handles the response.
+func (n *Node) sendAppend(m Member, req AppendRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	resp, err := n.cfg.Transport.AppendEntries(ctx, m, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != Leader || n.term != req.Term {
+		return
+	}
+	n.sending[m.ID] = false
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+
+	if resp.Success {
+		match := req.PrevIndex + uint64(len(req.Entries))
+		if match > n.match[m.ID] {
+			n.match[m.ID] = match
+		}
+		n.next[m.ID] = n.match[m.ID] + 1
+		n.advanceCommit()
+	} else {
+		n.next[m.ID] = max(1, min(resp.ConflictIndex, req.PrevIndex))
+	}
+
+	// Keep going while it's behind
+	if n.next[m.ID] <= n.lastIndex() {
+		n.replicate(m)
+	}
+}
+
+// sendSnapshot sends the latest snapshot to m, which is too far behind for
+// the entries the leader has.
+func (n *Node) sendSnapshot(m Member, term uint64) {
+	_, snapshot, _, err := n.storage.Load()
+	if err != nil {
+		n.log.Error("raft loading snapshot failed", "error", err)
+		n.mu.Lock()
+		n.sending[m.ID] = false
+		n.mu.Unlock()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	req := SnapshotRequest{Term: term, Leader: n.cfg.ID, Snapshot: snapshot}
+	resp, err := n.cfg.Transport.InstallSnapshot(ctx, m, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != Leader || n.term != term {
+		return
+	}
+	n.sending[m.ID] = false
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+
+	n.log.Info("raft snapshot sent", "to", m.ID, "index", snapshot.Index)
+	n.match[m.ID] = max(n.match[m.ID], snapshot.Index)
+	n.next[m.ID] = n.match[m.ID] + 1
+	n.replicate(m)
+}
+
+// advanceCommit commits the entries a majority of the members have.  Only an
+// entry from the current term is committed by counting, and the entries
+// before it along with it.
+func (n *Node) advanceCommit() {
+	if n.role != Leader {
+		return
+	}
+
+	var matches []uint64
+	for _, m := range n.members {
+		if m.ID == n.cfg.ID {
+			matches = append(matches, n.lastIndex())
+		} else {
+			matches = append(matches, n.match[m.ID])
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	majority := matches[len(matches)/2]
+
+	if term, _ := n.termAt(majority); majority > n.commitIndex && term == n.term {
+		n.commitIndex = majority
+		n.wakeApplier()
+
+		// A leader that has removed itself steps down once the change is
+		// committed, leaving the rest to elect a new one
+		if n.member(n.cfg.ID) == nil {
+			n.log.Info("raft leader removed from the cluster")
+			n.setRole(Follower, n.term)
+			n.leader = -1
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// Transport carries requests from a node to the other members.  An error
+// means the request or its response was lost, and the node will try again.
+type Transport interface {
+	RequestVote(ctx context.Context, to Member, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, to Member, req SnapshotRequest) (SnapshotResponse, error)
+}
+
+// VoteRequest asks for a node's vote in an election.
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate int    `json:"candidate"`
+	LastIndex uint64 `json:"lastIndex"` // The candidate's last entry, which must be at least as new as the voter's
+	LastTerm  uint64 `json:"lastTerm"`
+}
+
+// VoteResponse is the answer to a VoteRequest.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest sends entries from the leader, or none as a heartbeat.
+type AppendRequest struct {
+	Term        uint64  `json:"term"`
+	Leader      int     `json:"leader"`
+	PrevIndex   uint64  `json:"prevIndex"` // The entry before Entries, which the follower must already have
+	PrevTerm    uint64  `json:"prevTerm"`
+	Entries     []Entry `json:"entries"`
+	CommitIndex uint64  `json:"commitIndex"`
+}
+
+// AppendResponse is the answer to an AppendRequest.
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+
+	// If not, the leader should go back to this index, which skips a whole
+	// term of conflicting entries at a time rather than one entry.
+	ConflictIndex uint64 `json:"conflictIndex"`
+}
+
+// SnapshotRequest sends a follower that is too far behind the leader's
+// snapshot in place of the entries it no longer has.
+type SnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	Leader   int      `json:"leader"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// SnapshotResponse is the answer to a SnapshotRequest.
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// HandleRequestVote answers a candidate's request for this node's vote.
+func (n *Node) HandleRequestVote(req VoteRequest) VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// A node that has heard from a leader recently ignores candidates, so
+	// that one that was cut off, or removed, can't depose a working leader
+	if n.role != Leader && n.leader != -1 && time.Since(n.heard) < n.cfg.ElectionTimeout {
+		return VoteResponse{Term: n.term}
+	}
+
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	if req.Term < n.term || (n.vote != -1 && n.vote != req.Candidate) {
+		return VoteResponse{Term: n.term}
+	}
+
+	// Only vote for a candidate whose log has everything this one's does
+	upToDate := req.LastTerm > n.lastTerm() || (req.LastTerm == n.lastTerm() && req.LastIndex >= n.lastIndex())
+	if !upToDate {
+		return VoteResponse{Term: n.term}
+	}
+
+	n.vote = req.Candidate
+	if err := n.saveHardState(); err != nil {
+		n.log.Error("raft saving vote failed", "error", err)
+		return VoteResponse{Term: n.term}
+	}
+	n.resetDeadline()
+	return VoteResponse{Term: n.term, Granted: true}
+}
+
+// HandleAppendEntries appends the leader's entries to this node's log.
+func (n *Node) HandleAppendEntries(req AppendRequest) AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}
+	}
+	n.follow(req.Term, req.Leader)
+
+	// Entries this node has in its snapshot are committed, and so must match
+	if req.PrevIndex < n.snapshot.Index {
+		skip := n.snapshot.Index - req.PrevIndex
+		if uint64(len(req.Entries)) <= skip {
+			return AppendResponse{Term: n.term, Success: true}
+		}
+		req.Entries = req.Entries[skip:]
+		req.PrevIndex, req.PrevTerm = n.snapshot.Index, n.snapshot.Term
+	}
+
+	if req.PrevIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if term, _ := n.termAt(req.PrevIndex); term != req.PrevTerm {
+		// Skip back past every entry of the conflicting term
+		conflict := req.PrevIndex
+		for conflict > n.snapshot.Index+1 {
+			if t, _ := n.termAt(conflict - 1); t != term {
+				break
+			}
+			conflict--
+		}
+		return AppendResponse{Term: n.term, ConflictIndex: conflict}
+	}
+
+	// Append whatever isn't already here.  Entries that match are left
+	// alone, since a late, duplicate request mustn't truncate entries that
+	// a later one added.
+	for i, e := range req.Entries {
+		term, ok := n.termAt(e.Index)
+		if ok && term == e.Term {
+			continue
+		}
+		if err := n.appendEntries(req.Entries[i:]); err != nil {
+			n.log.Error("raft appending failed", "error", err)
+			return AppendResponse{Term: n.term}
+		}
+		break
+	}
+
+	last := req.PrevIndex + uint64(len(req.Entries))
+	if commit := min(req.CommitIndex, last); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.wakeApplier()
+	}
+	return AppendResponse{Term: n.term, Success: true}
+}
+
+// HandleInstallSnapshot replaces this node's state with the leader's
+// snapshot.
+func (n *Node) HandleInstallSnapshot(req SnapshotRequest) SnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return SnapshotResponse{Term: n.term}
+	}
+	n.follow(req.Term, req.Leader)
+
+	s := req.Snapshot
+	if s.Index <= n.commitIndex {
+		return SnapshotResponse{Term: n.term}
+	}
+	if err := n.storage.SaveSnapshot(s); err != nil {
+		n.log.Error("raft saving snapshot failed", "error", err)
+		return SnapshotResponse{Term: n.term}
+	}
+
+	n.entries = compact(n.entries, s)
+	install := s
+	n.install = &install
+	s.Data = nil
+	n.snapshot = s
+	n.commitIndex = s.Index
+	n.updateMembers()
+	n.log.Info("raft snapshot received", "index", s.Index, "bytes", len(install.Data))
+	n.wakeApplier()
+	return SnapshotResponse{Term: n.term}
+}
+
+// follow acknowledges the leader of term, which is at least the current one.
+func (n *Node) follow(term uint64, leader int) {
+	if term > n.term || n.role != Follower {
+		if term > n.term {
+			n.stepDown(term)
+		} else {
+			n.setRole(Follower, term)
+		}
+	}
+	n.leader = leader
+	n.heard = time.Now()
+	n.resetDeadline()
+}
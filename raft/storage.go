@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"sync"
+)
+
+// HardState is what a node must remember across restarts besides its log,
+// so that it never votes twice in the same term.
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote int    `json:"vote"` // The node voted for in Term, -1 for none
+}
+
+// Snapshot is the state machine as of a log index, which replaces every entry
+// up to and including it.
+type Snapshot struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []Member `json:"members"` // The membership as of Index
+	Data    []byte   `json:"data"`    // From StateMachine.Snapshot
+}
+
+// Storage keeps a node's state durable.  Every method must have made its
+// change durable before it returns, since the node acts on it straight away,
+// by voting or acknowledging entries to the leader.
+type Storage interface {
+	// Load returns everything saved, for a node that is starting.  The
+	// entries are those after the snapshot.  A new store returns a zero
+	// HardState with a Vote of -1.
+	Load() (HardState, Snapshot, []Entry, error)
+
+	SetHardState(hs HardState) error
+
+	// Append adds entries to the log.  If the first of them is at an index
+	// that is already in the log, every entry from there on is replaced.
+	Append(entries []Entry) error
+
+	// SaveSnapshot saves a snapshot, discarding the entries it covers.  If
+	// the log disagrees with the snapshot about the term of its last entry,
+	// the entries after it are discarded too.
+	SaveSnapshot(s Snapshot) error
+}
+
+// MemoryStorage keeps a node's state in memory.  It outlives the node, so a
+// test can stop a node and start a new one on the same storage as though the
+// process had restarted.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	hard     HardState
+	snapshot Snapshot
+	entries  []Entry
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{hard: HardState{Vote: -1}}
+}
+
+// Load returns everything saved.
+func (m *MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hard, m.snapshot, append([]Entry(nil), m.entries...), nil
+}
+
+// SetHardState saves the term and vote.
+func (m *MemoryStorage) SetHardState(hs HardState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hard = hs
+	return nil
+}
+
+// Append adds entries to the log.
+func (m *MemoryStorage) Append(entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = appendEntries(m.entries, m.snapshot.Index, entries)
+	return nil
+}
+
+// SaveSnapshot saves a snapshot, discarding the entries it covers.
+func (m *MemoryStorage) SaveSnapshot(s Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = compact(m.entries, s)
+	m.snapshot = s
+	return nil
+}
+
+// appendEntries adds entries to log, whose first entry follows the snapshot
+// at index base, replacing any it already has at the same indexes.
+func appendEntries(log []Entry, base uint64, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return log
+	}
+	keep := int(entries[0].Index - base - 1)
+	if keep < len(log) {
+		log = log[:keep:keep]
+	}
+	return append(log, entries...)
+}
+
+// compact returns what is left of log once s replaces the entries it covers.
+// The entries after s are kept only if the log agrees with s about its last
+// entry, since otherwise they're from a leader that has since been replaced.
+func compact(log []Entry, s Snapshot) []Entry {
+	for i, e := range log {
+		if e.Index == s.Index && e.Term == s.Term {
+			return append([]Entry(nil), log[i+1:]...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package recording captures the timing and shape of the requests a server
+// receives, so that the same load can be played back against another build.
+//
+// A recording is a file of JSON entries, one per line, in the order the
+// requests finished.  An entry says when a request arrived, what it was for
+// and how it was answered, and for requests carrying a password, how long
+// the password was.  The password itself is never recorded, so a recording
+// can be taken from production and passed around safely.  Job ids are
+// recorded, so that a replay can tell which request fetched which hash.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry describes a single request.
+type Entry struct {
+	Time           time.Time `json:"time"`                     // When the request arrived
+	Method         string    `json:"method"`                   // GET or POST
+	Route          string    `json:"route"`                    // The pattern the request matched, e.g. /hash/
+	Path           string    `json:"path"`                     // The path of the request
+	Wait           string    `json:"wait,omitempty"`           // The ?wait= of a long poll
+	BodySize       int       `json:"bodySize"`                 // Bytes in the request body
+	PasswordLength int       `json:"passwordLength,omitempty"` // Bytes in the password, for requests that carry one
+	JobID          int64     `json:"jobId,omitempty"`          // The job submitted, fetched or verified
+	Status         int       `json:"status"`                   // The status code of the response
+	Duration       float64   `json:"duration"`                 // How long the request took, in milliseconds
+}
+
+// Recorder appends entries to a recording.  A nil *Recorder is valid and
+// records nothing, so recording costs nothing when it is off.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// Open opens the recording at path for appending, creating it if needed.
+func Open(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Record appends an entry.  Entries are buffered, so they reach the file in
+// batches, and all of them by the time Close returns.  A recording is a
+// diagnostic, so a failure to write is reported by Close rather than holding
+// up the request being recorded.
+func (r *Recorder) Record(e Entry) {
+	if r == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(append(line, '\n'))
+}
+
+// Close writes out any buffered entries and closes the file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Reader reads the entries of a recording.
+type Reader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// NewReader creates a Reader for the recording in r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next entry, or io.EOF at the end of the recording.  A
+// final line cut short, as a crash leaves behind, is treated as the end.
+func (r *Reader) Read() (Entry, error) {
+	var e Entry
+	for {
+		text, err := r.r.ReadString('\n')
+		if err == io.EOF {
+			return e, io.EOF
+		} else if err != nil {
+			return e, err
+		}
+		r.line++
+		if len(text) <= 1 {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(text), &e); err != nil {
+			return e, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return e, nil
+	}
+}
@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	entries := []Entry{
+		{Time: time.Unix(1, 0).UTC(), Method: "POST", Route: "/hash", Path: "/hash", BodySize: 20, PasswordLength: 11, JobID: 1, Status: 200, Duration: 0.5},
+		{Time: time.Unix(6, 0).UTC(), Method: "GET", Route: "/hash/", Path: "/hash/1", Wait: "30s", JobID: 1, Status: 200, Duration: 1},
+	}
+
+	// Opening again appends
+	for _, e := range entries {
+		r, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Record(e)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := NewReader(f)
+	for i, want := range entries {
+		if got, err := r.Read(); err != nil || got != want {
+			t.Errorf("entry %d was %+v, %v, expected %+v", i, got, err, want)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("Read at the end returned %v", err)
+	}
+
+	// A nil Recorder records nothing
+	var nilRecorder *Recorder
+	nilRecorder.Record(entries[0])
+	if err := nilRecorder.Close(); err != nil {
+		t.Errorf("Close of a nil Recorder returned %v", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, test := range []struct {
+		input   string
+		entries int
+		ok      bool
+	}{
+		{`{"method":"GET"}` + "\n\n" + `{"method":"POST"}` + "\n", 2, true},
+		{`{"method":"GET"}` + "\n" + `{"meth`, 1, true}, // Cut short by a crash
+		{`{"method":"GET"}` + "\n" + `nonsense` + "\n", 1, false},
+	} {
+		r := NewReader(strings.NewReader(test.input))
+		n := 0
+		var err error
+		for ; ; n++ {
+			if _, err = r.Read(); err != nil {
+				break
+			}
+		}
+		if n != test.entries || (err == io.EOF) != test.ok {
+			t.Errorf("read %d entries from %q, then %v", n, test.input, err)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/recording"
+)
+
+// defaultReplayRoutes are the routes replayed unless -routes says otherwise.
+// The rest change the state of the server, which isn't what a replay is for.
+const defaultReplayRoutes = "/hash,/hash/,/verify/,/stats"
+
+// replay plays a recording made with --record back against a server, with
+// the same gaps between requests, or scaled by -speed.
+//
+//	hash-server replay [flags] FILE
+//
+// Passwords weren't recorded, so each job is submitted with a random password
+// of the recorded length.  Fetches and verifies of a job are sent for the id
+// the server gives it this time, once it has been submitted.  Requests for
+// jobs submitted before the recording started can't be mapped, and are
+// skipped.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "URL of the server to replay against")
+	speed := fs.Float64("speed", 1, "how much faster than the recording to play, e.g. 2 for twice as fast")
+	routes := fs.String("routes", defaultReplayRoutes, "comma separated routes to replay")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hash-server replay [flags] FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected the path of a recording")
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("speed must be positive: %g", *speed)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	entries, err := readRecording(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	p := &player{
+		target: strings.TrimSuffix(*target, "/"),
+		speed:  *speed,
+		routes: make(map[string]bool),
+		client: &http.Client{},
+	}
+	for _, route := range strings.Split(*routes, ",") {
+		p.routes[strings.TrimSpace(route)] = true
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report := p.play(ctx, entries)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.writeText(os.Stdout)
+}
+
+// readRecording reads every entry of a recording, in the order the requests
+// arrived.  They are written as the requests finish, so a long poll that
+// started early can come after requests that started later.
+func readRecording(r io.Reader) ([]recording.Entry, error) {
+	var entries []recording.Entry
+	rr := recording.NewReader(r)
+	for {
+		e, err := rr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// player replays a recording.
+type player struct {
+	target string
+	speed  float64
+	routes map[string]bool // Routes to replay
+	client *http.Client
+
+	mu     sync.Mutex
+	report replayReport
+	times  map[string][]time.Duration // Latencies of each route, for the report
+}
+
+// replayJob is a job submitted during the replay.  The requests for a job are
+// sent in the order they were recorded, each once the one before it has been
+// answered, so that a fetch can't overtake the submission or a verify it
+// followed.  id is set by the submission, and is 0 if it failed.
+type replayJob struct {
+	last     chan interface{} // Closed once the latest request scheduled for the job is answered
+	id       int64
+	password string
+}
+
+// play sends every entry at its time, scaled by the speed, waits for the
+// responses and reports on them.
+func (p *player) play(ctx context.Context, entries []recording.Entry) replayReport {
+	p.report = replayReport{Target: p.target, Speed: p.speed, Routes: make(map[string]*routeReport)}
+	p.times = make(map[string][]time.Duration)
+	if len(entries) == 0 {
+		return p.report
+	}
+
+	// Jobs are keyed by their id in the recording.  Only this goroutine
+	// touches the map, so each job is known before anything refers to it.
+	jobs := make(map[int64]*replayJob)
+	origin, start := entries[0].Time, time.Now()
+	p.report.RecordedSeconds = entries[len(entries)-1].Time.Sub(origin).Seconds()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		if !p.routes[e.Route] {
+			p.skip()
+			continue
+		}
+
+		var job *replayJob
+		var after, done chan interface{}
+		switch {
+		case e.Route == "/hash" && e.Method == "POST":
+			job = &replayJob{password: randomPassword(e.PasswordLength)}
+			if e.JobID != 0 {
+				jobs[e.JobID] = job
+			}
+		case e.JobID != 0:
+			if job = jobs[e.JobID]; job == nil {
+				p.skip()
+				continue
+			}
+		}
+		if job != nil {
+			after, done = job.last, make(chan interface{})
+			job.last = done
+		}
+
+		at := start.Add(time.Duration(float64(e.Time.Sub(origin)) / p.speed))
+		select {
+		case <-time.After(time.Until(at)):
+		case <-ctx.Done():
+			wg.Wait()
+			return p.finish(start)
+		}
+
+		wg.Add(1)
+		go func(e recording.Entry) {
+			defer wg.Done()
+			if done != nil {
+				defer close(done)
+			}
+			if after != nil {
+				select {
+				case <-after:
+				case <-ctx.Done():
+					return
+				}
+			}
+			p.send(ctx, e, job)
+		}(e)
+	}
+
+	wg.Wait()
+	return p.finish(start)
+}
+
+// send replays a single entry.  job is the job it submits, fetches or
+// verifies, if any, and the requests before it for the job have already been
+// answered.
+func (p *player) send(ctx context.Context, e recording.Entry, job *replayJob) {
+	path, body := e.Path, ""
+	switch {
+	case e.Route == "/hash" && e.Method == "POST":
+		body = passwordBody(e, job.password)
+	case job != nil:
+		if job.id == 0 {
+			p.skip()
+			return
+		}
+		path = e.Route + strconv.FormatInt(job.id, 10)
+		if e.PasswordLength == len(job.password) {
+			body = passwordBody(e, job.password)
+		} else {
+			body = passwordBody(e, randomPassword(e.PasswordLength))
+		}
+	case e.Method == "POST":
+		body = strings.Repeat("x", e.BodySize)
+	}
+	if e.Wait != "" {
+		path += "?wait=" + url.QueryEscape(e.Wait)
+	}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, e.Method, p.target+path, strings.NewReader(body))
+	if err != nil {
+		p.result(e, 0, 0)
+		return
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.result(e, 0, 0)
+		return
+	}
+	response, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if job != nil && e.Route == "/hash" && resp.StatusCode == 200 {
+		job.id, _ = strconv.ParseInt(strings.TrimSpace(string(response)), 10, 64)
+	}
+	p.result(e, resp.StatusCode, time.Since(start))
+}
+
+// passwordBody returns the body to send for e, with password in place of the
+// one that was recorded.  A request that had no password is sent with a body
+// of the same size.
+func passwordBody(e recording.Entry, password string) string {
+	if e.PasswordLength == 0 {
+		return strings.Repeat("x", e.BodySize)
+	}
+	return "password=" + password
+}
+
+// randomPassword generates a password of n printable characters.
+func randomPassword(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// skip counts an entry that wasn't replayed.
+func (p *player) skip() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Skipped++
+}
+
+// result records the response to a replayed entry.  status is 0 if there was
+// no response.
+func (p *player) result(e recording.Entry, status int, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := e.Method + " " + e.Route
+	r := p.report.Routes[key]
+	if r == nil {
+		r = &routeReport{}
+		p.report.Routes[key] = r
+	}
+
+	p.report.Requests++
+	r.Requests++
+	switch {
+	case status == 0:
+		p.report.Errors++
+		r.Errors++
+	case status != e.Status:
+		p.report.Mismatched++
+		r.Mismatched++
+	}
+	if status != 0 {
+		p.times[key] = append(p.times[key], d)
+	}
+}
+
+func (p *player) finish(start time.Time) replayReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.report.Seconds = time.Since(start).Seconds()
+	for key, r := range p.report.Routes {
+		r.Latency = summarize(p.times[key])
+	}
+	return p.report
+}
+
+// replayReport is the outcome of a replay.  Latencies are in milliseconds.
+type replayReport struct {
+	Target          string  `json:"target"`
+	Speed           float64 `json:"speed"`
+	RecordedSeconds float64 `json:"recordedSeconds"` // How long the recording covers
+	Seconds         float64 `json:"seconds"`         // How long the replay took
+
+	Requests   uint64 `json:"requests"`   // Requests sent
+	Errors     uint64 `json:"errors"`     // Requests that got no response
+	Mismatched uint64 `json:"mismatched"` // Responses whose status differed from the recording
+	Skipped    uint64 `json:"skipped"`    // Entries not replayed
+
+	Routes map[string]*routeReport `json:"routes"` // Keyed by method and route, e.g. "GET /hash/"
+}
+
+type routeReport struct {
+	Requests   uint64           `json:"requests"`
+	Errors     uint64           `json:"errors"`
+	Mismatched uint64           `json:"mismatched"`
+	Latency    hasher.Latencies `json:"latency"`
+}
+
+// writeText writes the report as a table.
+func (r replayReport) writeText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "target\t%s\n", r.Target)
+	fmt.Fprintf(w, "replayed\t%.1fs of recording in %.1fs at %gx\n", r.RecordedSeconds, r.Seconds, r.Speed)
+	fmt.Fprintf(w, "requests\t%d\n", r.Requests)
+	fmt.Fprintf(w, "errors\t%d\n", r.Errors)
+	fmt.Fprintf(w, "mismatched\t%d\n", r.Mismatched)
+	fmt.Fprintf(w, "skipped\t%d\n", r.Skipped)
+	fmt.Fprintln(w)
+
+	keys := make([]string, 0, len(r.Routes))
+	for key := range r.Routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "route\trequests\terrors\tmismatched\tp50 ms\tp99 ms\tmax ms")
+	for _, key := range keys {
+		route := r.Routes[key]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t%.1f\t%.1f\n", key, route.Requests, route.Errors, route.Mismatched,
+			route.Latency.P50, route.Latency.P99, route.Latency.Max)
+	}
+	return w.Flush()
+}
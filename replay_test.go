@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/client"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/recording"
+	"github.com/jaredcantwell/hash-server/server"
+)
+
+// newReplayServer starts a server with no simulated work, recording to rec
+// if it isn't nil.
+func newReplayServer(t *testing.T, rec *recording.Recorder) *httptest.Server {
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	s := server.New(server.WithHasher(h), server.WithRecorder(rec), server.WithLogger(logger))
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		s.Shutdown()
+	})
+	return ts
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := recording.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record some jobs being submitted, verified and fetched
+	recorded := newReplayServer(t, rec)
+	c := client.New(recorded.URL)
+	ctx := context.Background()
+	for _, password := range []string{"angryMonkey", "happyMonkey", "x"} {
+		id, err := c.Submit(ctx, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match, err := c.Verify(ctx, id, password); err != nil || !match {
+			t.Fatalf("Verify returned %v, %v", match, err)
+		}
+		if _, err := c.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Get(ctx, 1) // Already retrieved
+	c.Shutdown(ctx)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := readRecording(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay them against a server that has already handed out some ids,
+	// so that the ids have to be mapped.
+	target := newReplayServer(t, nil)
+	for i := 0; i < 5; i++ {
+		client.New(target.URL).Submit(ctx, "filler")
+	}
+	p := &player{
+		target: target.URL,
+		speed:  10,
+		routes: map[string]bool{"/hash": true, "/hash/": true, "/verify/": true},
+		client: target.Client(),
+	}
+	r := p.play(context.Background(), entries)
+
+	// Everything is answered the way it was, apart from shutdown
+	if r.Requests != 10 || r.Errors != 0 || r.Mismatched != 0 || r.Skipped != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if got := r.Routes["GET /hash/"]; got == nil || got.Requests != 4 || got.Latency.Count != 4 {
+		t.Errorf("unexpected report for GET /hash/: %+v", got)
+	}
+
+	// The gaps between requests are kept, scaled by the speed
+	recordedSpan := entries[len(entries)-1].Time.Sub(entries[0].Time)
+	if replayed := time.Duration(r.Seconds * float64(time.Second)); replayed < recordedSpan/10 {
+		t.Errorf("replay took %s of a %s recording at 10x", replayed, recordedSpan)
+	}
+
+	var text strings.Builder
+	if err := r.writeText(&text); err != nil || !strings.Contains(text.String(), "POST /verify/") {
+		t.Errorf("text report was %q, %v", text.String(), err)
+	}
+}
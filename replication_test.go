@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// childEnv marks a copy of the test binary that was started to be a server,
+// see startNode.
+const childEnv = "HASH_SERVER_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// lockedBuffer collects a child's output, which is written while the test
+// may be reading it.
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+// startNode runs a server in a process of its own, so that it can be killed
+// outright.
+func startNode(t *testing.T, args ...string) *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(lockedBuffer)
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("%s:\n%s", strings.Join(args, " "), out)
+		}
+	})
+	return cmd
+}
+
+// freePorts finds n ports that nothing is listening on, so that every node
+// can be told where the others are before any of them starts.
+func freePorts(t *testing.T, n int) []int {
+	var ports []int
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+// waitHealthy waits for a node to answer GET /healthz.
+func waitHealthy(t *testing.T, base string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get(base + "/healthz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s never became healthy", base)
+}
+
+// TestReplication runs a cluster of three processes, kills the one that
+// issued a run of jobs partway through hashing them, and checks that every
+// hash can still be retrieved from the other two.
+func TestReplication(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several servers")
+	}
+	t.Parallel()
+
+	ports := freePorts(t, 3)
+	var urls, peers []string
+	for i, port := range ports {
+		urls = append(urls, fmt.Sprintf("http://127.0.0.1:%d", port))
+		peers = append(peers, fmt.Sprintf("%d=%s", i+1, urls[i]))
+	}
+
+	start := func(node int) *exec.Cmd {
+		cmd := startNode(t,
+			"--port", strconv.Itoa(ports[node-1]),
+			"--node-id", strconv.Itoa(node),
+			"--peers", strings.Join(peers, ","),
+			"--replicas", "1",
+			"--replication-ack", "all",
+			"--cluster-token", "sesame",
+			"--workers", "2",
+			"--queue-depth", "20",
+			"--delay", "300ms")
+		waitHealthy(t, urls[node-1])
+		return cmd
+	}
+	primary := start(1)
+	start(2)
+	start(3)
+
+	submit := func(base, password string) int64 {
+		resp, err := http.PostForm(base+"/hash", url.Values{"password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		id, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		if err != nil {
+			t.Fatalf("POST %s/hash returned %d: %s", base, resp.StatusCode, body)
+		}
+		return id
+	}
+	get := func(base string, id int64, password string) {
+		resp, err := http.Get(fmt.Sprintf("%s/hash/%d", base, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != hasher.Compute(password) {
+			t.Errorf("GET %s/hash/%d returned %d: %s", base, id, resp.StatusCode, body)
+		}
+	}
+
+	// Two workers take 300ms per pair, so some of these are done when the
+	// primary is killed and the rest are still queued
+	var ids []int64
+	for i := 0; i < 10; i++ {
+		ids = append(ids, submit(urls[0], fmt.Sprintf("monkey%d", i)))
+	}
+	time.Sleep(700 * time.Millisecond)
+	primary.Process.Kill()
+	primary.Wait()
+
+	// Node 2 has the copies, and node 3 fails over to it.  The last one is
+	// left for later.
+	for i, id := range ids[:len(ids)-1] {
+		get(urls[1+i%2], id, fmt.Sprintf("monkey%d", i))
+	}
+
+	// Once it's back, the primary carries on after the ids it issued
+	// before, and sends requests for those to node 2
+	start(1)
+	if id := submit(urls[0], "angryMonkey"); id <= ids[len(ids)-1] {
+		t.Errorf("restarted node issued %d, after %d", id, ids[len(ids)-1])
+	}
+	get(urls[0], ids[len(ids)-1], "monkey9")
+
+	// A replication request without the token is refused
+	resp, err := http.Post(urls[1]+"/cluster/replicate", "application/json",
+		strings.NewReader(`[{"op":"completed","id":9007199254740993,"hash":"forged"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("unauthenticated replication returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// Headers in the response to GET /hash/{id}.  longPollHeader says how long
+// the server will wait for a hash with ?wait=, so clients know they needn't
+// poll.  hashStateHeader says why a 404 has no hash: pending, gone (already
+// retrieved or expired) or unknown.
+const (
+	longPollHeader  = "X-Long-Poll"
+	hashStateHeader = "X-Hash-State"
+)
+
+// maxLongPoll is the longest GET /hash/{id}?wait= will hold a request open.
+const maxLongPoll = time.Minute
+
+// jobRequestIDHeader names the request that submitted a job in the response
+// to GET /hash/{id}.  X-Request-ID in the same response names the GET itself.
+const jobRequestIDHeader = "X-Job-Request-ID"
+
+// withRequest wraps a handler to give every request a trace.Request, taken
+// from its X-Request-ID and traceparent headers or generated.  The request ID
+// is returned in the X-Request-ID response header, and the trace.Request is
+// carried by the request's context, which is how POST /hash hands it to the
+// hasher.
+func withRequest(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := trace.FromHTTP(r)
+		w.Header().Set(trace.RequestIDHeader, req.ID)
+		h(w, r.WithContext(trace.NewContext(r.Context(), req)))
+	}
+}
+
+// accessLog wraps a handler to log every request to route once it has been
+// served.  Only the method, path and outcome are logged.  The body, which
+// holds the password for POST /hash, is never looked at here, and the query
+// string is left out in case a client put one there.
+func (s *Server) accessLog(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: 200}
+		h(sw, r)
+		req, _ := trace.FromContext(r.Context())
+		s.log.Info("request",
+			"request_id", req.ID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", sw.code,
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr)
+	}
+}
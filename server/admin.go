@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// The admin listener serves diagnostics for debugging a live instance, and
+// the controls for its configuration.  It is kept off the public port because
+// pprof and the job dump say far more about the process than clients should
+// see, profiling can be expensive, and chaos can fail every job.  It is only
+// started if an address is given with WithAdminAddr.
+
+// AdminHandler returns the http.Handler that serves the admin diagnostics:
+//
+//	/debug/vars     expvar, with the hasher's stats and the goroutine count
+//	/debug/pprof/   net/http/pprof
+//	/debug/jobs     every job that hasn't been retrieved, with its state and age
+//	/admin/config   the effective configuration
+//	/admin/chaos    the faults being injected, which can be replaced with a POST
+func (s *Server) AdminHandler() http.Handler {
+	return s.adminMux
+}
+
+// AdminAddr returns the address the admin listener is listening on, or "" if
+// there isn't one.  Like Addr, this is the actual address once the server is
+// Ready.
+func (s *Server) AdminAddr() string {
+	if s.adminSrv == nil {
+		return ""
+	}
+
+	select {
+	case <-s.ready:
+		return s.adminListener.Addr().String()
+	default:
+		return s.adminSrv.Addr
+	}
+}
+
+// newAdminMux creates the admin routes.
+func (s *Server) newAdminMux() *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/vars", s.varsHandler)
+	m.HandleFunc("/debug/jobs", s.jobsHandler)
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.HandleFunc("/admin/config", mux(s.configHandler, nil))
+	m.HandleFunc("/admin/chaos", mux(s.chaosGETHandler, s.chaosPOSTHandler))
+	return m
+}
+
+// startAdmin opens the admin listener, if there is one, and serves it in the
+// background.
+func (s *Server) startAdmin() error {
+	if s.adminSrv == nil {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", s.adminSrv.Addr)
+	if err != nil {
+		return err
+	}
+	s.adminListener = l
+
+	go func() {
+		if err := s.adminSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.log.Error("admin serve failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// stopAdmin closes the admin listener.  Diagnostics aren't worth waiting for,
+// so unlike the public server it doesn't wait for requests to finish.
+func (s *Server) stopAdmin() {
+	if s.adminListener != nil {
+		s.adminSrv.Close()
+	}
+}
+
+// varsHandler serves /debug/vars.  It includes everything published with
+// expvar, as expvar.Handler would, plus this server's own variables.  Those
+// aren't published with expvar because it is global, and there may be more
+// than one Server in the process.
+func (s *Server) varsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := []struct {
+		name string
+		v    expvar.Var
+	}{
+		{"hasher", expvar.Func(func() interface{} { return s.hasher.Stats() })},
+		{"queueDepth", expvar.Func(func() interface{} { return s.hasher.Stats().Queued })},
+		{"goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() })},
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	for i, v := range vars {
+		if i > 0 {
+			fmt.Fprintf(w, ",\n")
+		}
+		fmt.Fprintf(w, "%q: %s", v.name, v.v)
+	}
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// jobsHandler serves /debug/jobs.  The hasher never hands out passwords, so
+// there is nothing here to scrub.
+func (s *Server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	type job struct {
+		ID        int64     `json:"id"`
+		State     string    `json:"state"`
+		RequestID string    `json:"requestId"`
+		Submitted time.Time `json:"submitted"`
+		Age       string    `json:"age"`
+	}
+
+	jobs := []job{}
+	for _, j := range s.hasher.Jobs() {
+		jobs = append(jobs, job{j.ID, j.State, j.RequestID, j.Submitted, j.Age.String()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/audit"
+	"github.com/jaredcantwell/hash-server/cluster"
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// recordAudit appends a record of r taking action on job id to the audit log,
+// if there is one.  It returns false if the record couldn't be written, in
+// which case the client must not be told the action happened.
+func (s *Server) recordAudit(r *http.Request, action string, id int64) bool {
+	req, _ := trace.FromContext(r.Context())
+	err := s.audit.Append(audit.Record{
+		Time:      time.Now(),
+		Action:    action,
+		JobID:     id,
+		Actor:     actor(r),
+		RequestID: req.ID,
+	})
+	if err != nil {
+		s.log.Error("audit failed", "action", action, "id", id, "error", err)
+		return false
+	}
+	return true
+}
+
+// actor identifies who made a request: the client's IP address.  For a
+// request forwarded by another node of the cluster, that's the node, so the
+// client it was forwarded for is named too.  Anyone could claim to be
+// forwarding, which is why the node is always named.
+func actor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if r.Header.Get(cluster.ForwardedHeader) == "" {
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	return strings.TrimSpace(forwarded[len(forwarded)-1]) + " via " + host
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/jaredcantwell/hash-server/cluster"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/trace"
+)
+
+// results is what GET /hash/{id} and POST /verify/{id} are answered from.
+// Both the hasher and the copies of other nodes' jobs are.
+type results interface {
+	Wait(ctx context.Context, id int64) error
+	Retrieve(ctx context.Context, id int64) (hasher.Result, error)
+	Verify(ctx context.Context, id int64, password string) (bool, error)
+}
+
+// results returns where the hash for id is.  A request for another node's id
+// that wasn't routed there is only here because that node is down, and this
+// one has a copy of its jobs.
+func (s *Server) results(id int64) results {
+	if s.cluster != nil && hasher.NodeOf(id) != s.cluster.Self() {
+		return s.cluster.Replicated()
+	}
+	return s.hasher
+}
+
+// route sends a request about job id to the node that issued it, if that
+// isn't this one.  It returns true if the request has been answered.
+func (s *Server) route(w http.ResponseWriter, r *http.Request, id int64) bool {
+	return s.cluster != nil && s.cluster.Route(w, r, id)
+}
+
+// failover sends a request about one of this node's ids that it doesn't
+// know of to its replicas, in case the id is from before it restarted.  It
+// returns true if the request has been answered.
+func (s *Server) failover(w http.ResponseWriter, r *http.Request, id int64) bool {
+	return s.cluster != nil && s.cluster.Failover(w, r, id)
+}
+
+// replicate sends a newly submitted job to this node's replicas, if it has
+// any.  It returns false if too few of them have it, having logged why.
+func (s *Server) replicate(r *http.Request, id int64, password string) bool {
+	if s.cluster == nil {
+		return true
+	}
+
+	var requestID string
+	if req, ok := trace.FromContext(r.Context()); ok {
+		requestID = req.ID
+	}
+	if err := s.cluster.Submitted(r.Context(), id, requestID, password); err != nil {
+		s.log.Error("replication failed", "id", id, "error", err)
+		return false
+	}
+	return true
+}
+
+// retrieved tells the replicas of job id that it has been retrieved.
+func (s *Server) retrieved(id int64) {
+	if s.cluster != nil {
+		s.cluster.Retrieved(id)
+	}
+}
+
+// closeCluster sends whatever is waiting to be replicated, once the hasher
+// has drained.
+func (s *Server) closeCluster() {
+	if s.cluster != nil {
+		s.cluster.Close()
+	}
+}
+
+// clusterAuthorized checks that a replication request comes from another
+// node, and reports the error to the client if it doesn't.  The requests
+// carry passwords and results, so they must not be taken from anyone else.
+func (s *Server) clusterAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.cluster == nil {
+		http.Error(w, "Not part of a cluster.", 404)
+		return false
+	}
+	if !s.cluster.Authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid cluster token.", 401)
+		return false
+	}
+	return true
+}
+
+// replicateHandler applies a batch of ops from another node to the copies
+// of its jobs kept here, see cluster.Op.
+func (s *Server) replicateHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.clusterAuthorized(w, r) {
+		return
+	}
+
+	var ops []cluster.Op
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), 400)
+		return
+	}
+	s.cluster.Replicated().Apply(ops)
+}
+
+// replicaLastIDHandler serves the last id of ?node= that this node has a
+// copy of, so that node can carry on after it when it restarts.
+func (s *Server) replicaLastIDHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.clusterAuthorized(w, r) {
+		return
+	}
+
+	node, err := strconv.Atoi(r.URL.Query().Get("node"))
+	if err != nil {
+		http.Error(w, "Invalid node.", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		LastID int64 `json:"lastId"`
+	}{s.cluster.Replicated().LastID(node)})
+}
+
+// clusterHandler lists the nodes of the cluster, and which one this is.
+func (s *Server) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		http.Error(w, "Not part of a cluster.", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Self  int            `json:"self"`
+		Nodes []cluster.Node `json:"nodes"`
+	}{s.cluster.Self(), s.cluster.Nodes()})
+}
+
+// clusterStatsHandler serves the stats of every node, and of the cluster as a
+// whole.  A node that can't be reached is reported as such, along with the
+// stats of the rest.
+func (s *Server) clusterStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		http.Error(w, "Not part of a cluster.", 404)
+		return
+	}
+
+	stats := s.cluster.Stats(r.Context(), s.hasher.Stats())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jaredcantwell/hash-server/cluster"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+)
+
+// startCluster runs a cluster of n nodes on localhost, with ids 1 to n, and
+// returns their URLs.
+func startCluster(t *testing.T, n int) []string {
+	var listeners []net.Listener
+	var urls, spec []string
+	for i := 1; i <= n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		urls = append(urls, "http://"+l.Addr().String())
+		spec = append(spec, fmt.Sprintf("%d=%s", i, urls[i-1]))
+	}
+	nodes, err := cluster.ParseNodes(strings.Join(spec, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, l := range listeners {
+		cfg := hasher.DefaultConfig()
+		cfg.Delay = 0
+		cfg.Node = i + 1
+		h, err := hasher.New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := cluster.New(cluster.Config{Self: cfg.Node, Nodes: nodes, Routing: cluster.Forward})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(WithHasher(h), WithListener(l), WithCluster(c),
+			WithLogger(slog.New(logging.Redact(slog.DiscardHandler))))
+		go s.Run()
+		<-s.Ready()
+		t.Cleanup(s.Shutdown)
+	}
+	return urls
+}
+
+func TestCluster(t *testing.T) {
+	t.Parallel()
+	urls := startCluster(t, 3)
+
+	submit := func(node int, password string) int64 {
+		resp, err := http.PostForm(urls[node-1]+"/hash", url.Values{"password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		id, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		if err != nil || hasher.NodeOf(id) != node {
+			t.Fatalf("node %d issued id %q", node, body)
+		}
+		return id
+	}
+	first, second := submit(1, "angryMonkey"), submit(2, "happyMonkey")
+
+	// Any node answers for any other's ids
+	resp, err := http.Post(fmt.Sprintf("%s/verify/%d", urls[2], second), "", strings.NewReader("password=happyMonkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(body), `"match":true`) {
+		t.Errorf("verify through node 3 returned %d: %s", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/hash/%d?wait=1s", urls[1], first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != hasher.Compute("angryMonkey") {
+		t.Errorf("GET through node 2 returned %d: %s", resp.StatusCode, body)
+	}
+
+	// Once it's gone, it's gone from every node
+	resp, err = http.Get(fmt.Sprintf("%s/hash/%d", urls[2], first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 || resp.Header.Get(hashStateHeader) != "gone" {
+		t.Errorf("second GET through node 3 returned %d, %s", resp.StatusCode, resp.Header.Get(hashStateHeader))
+	}
+
+	resp, err = http.Get(urls[2] + "/cluster/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats cluster.Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil || len(stats.Nodes) != 3 || stats.Down != 0 || stats.Total.Counters.Submitted != 2 ||
+		stats.Total.Counters.Retrieved != 1 || stats.Nodes[0].Stats.Counters.Submitted != 1 {
+		t.Errorf("cluster stats were %+v, %v", stats, err)
+	}
+}
+
+// TestActor verifies that forwarded requests are audited as coming from the
+// client they were forwarded for, as well as the node.
+func TestActor(t *testing.T) {
+	r := httptest.NewRequest("GET", "/hash/1", nil)
+	r.RemoteAddr = "10.0.0.2:5555"
+	if got := actor(r); got != "10.0.0.2" {
+		t.Errorf("actor() = %q", got)
+	}
+
+	r.Header.Set(cluster.ForwardedHeader, "2")
+	r.Header.Set("X-Forwarded-For", "192.0.2.9, 192.0.2.1")
+	if got := actor(r); got != "192.0.2.1 via 10.0.0.2" {
+		t.Errorf("actor() of a forwarded request = %q", got)
+	}
+}
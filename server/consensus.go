@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/raft"
+)
+
+// The nodes of a consensus log send each other elections, log entries and
+// snapshots, see raft.Handler.  Anyone who could send those could win an
+// election, or append entries handing out ids, hashes and results of their
+// own, so they're kept off the public port, on a consensus listener started
+// with WithConsensusAddr, and every request must carry the cluster token.
+// The nodes talk to each other many times a second too, which would drown out
+// everything else in the access log and metrics, so they're left out of
+// both.
+
+// ConsensusHandler returns the http.Handler that the other nodes of the
+// consensus log send their requests to, at /raft/vote, /raft/append and
+// /raft/snapshot.  Without WithConsensus, it answers every request with 404.
+func (s *Server) ConsensusHandler() http.Handler {
+	return s.consensusMux
+}
+
+// ConsensusAddr returns the address the consensus listener is listening on,
+// or "" if there isn't one.  Like Addr, this is the actual address once the
+// server is Ready.
+func (s *Server) ConsensusAddr() string {
+	if s.consensusSrv == nil {
+		return ""
+	}
+
+	select {
+	case <-s.ready:
+		return s.consensusListener.Addr().String()
+	default:
+		return s.consensusSrv.Addr
+	}
+}
+
+// newConsensusMux creates the routes of the consensus listener.
+func (s *Server) newConsensusMux() *http.ServeMux {
+	m := http.NewServeMux()
+	if s.consensus != nil {
+		m.Handle("/raft/", raft.Handler(s.consensus, s.consensusToken))
+	}
+	return m
+}
+
+// startConsensus opens the consensus listener, if there is one, and serves
+// it in the background.
+func (s *Server) startConsensus() error {
+	if s.consensusSrv == nil {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", s.consensusSrv.Addr)
+	if err != nil {
+		return err
+	}
+	s.consensusListener = l
+
+	go func() {
+		if err := s.consensusSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.log.Error("consensus serve failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// stopConsensus closes the consensus listener.  It is only called once the
+// hasher has drained, since finishing the last jobs can take the log, and
+// the other nodes are better off timing out than waiting on us.
+func (s *Server) stopConsensus() {
+	if s.consensusListener != nil {
+		s.consensusSrv.Close()
+	}
+}
+
+// toLeader sends the client to the leader of the consensus log if err says
+// this node isn't it.  The redirect is a 307, so the client repeats the same
+// request there, body and all.  If there's no leader right now, for instance
+// during an election, the client is told to try again shortly.  It returns
+// true if the request has been answered.
+func (s *Server) toLeader(w http.ResponseWriter, r *http.Request, err error) bool {
+	var notLeader *hasher.NotLeaderError
+	if !errors.As(err, &notLeader) {
+		return false
+	}
+
+	if notLeader.Leader == "" {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "No leader has been elected.", 503)
+		return true
+	}
+	http.Redirect(w, r, strings.TrimSuffix(notLeader.Leader, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// raftStatusHandler serves this node's view of the consensus log: its role,
+// term, the leader, the members, and how far the log has got.
+func (s *Server) raftStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.consensus == nil {
+		http.Error(w, "No consensus log.", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.consensus.Status())
+}
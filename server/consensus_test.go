@@ -0,0 +1,271 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/consensus"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+	"github.com/jaredcantwell/hash-server/raft"
+)
+
+const testClusterToken = "s3cret"
+
+// startConsensus runs the first started of n nodes sharing a consensus log
+// on localhost, with ids 1 to n, and returns all of their public URLs, and
+// the URLs of their consensus listeners.  The rest are listening, but never
+// answer.
+func startConsensus(t *testing.T, n, started int) (urls, raftURLs []string) {
+	var listeners, raftListeners []net.Listener
+	var members []raft.Member
+	clientURLs := make(map[int]string)
+	for i := 1; i <= n; i++ {
+		for _, ls := range []*[]net.Listener{&listeners, &raftListeners} {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			*ls = append(*ls, l)
+		}
+		urls = append(urls, "http://"+listeners[i-1].Addr().String())
+		raftURLs = append(raftURLs, "http://"+raftListeners[i-1].Addr().String())
+		members = append(members, raft.Member{ID: i, URL: raftURLs[i-1]})
+		clientURLs[i] = urls[i-1]
+	}
+
+	// A client can dial a connection it then has no request for, and
+	// shutting down waits 5s for those, so they're closed first
+	client := &http.Client{Transport: &http.Transport{}}
+	for i, l := range listeners[:started] {
+		cfg := hasher.DefaultConfig()
+		cfg.Delay = 0
+		h, err := consensus.New(cfg, consensus.Config{
+			Node:              i + 1,
+			Members:           members,
+			URLs:              clientURLs,
+			Token:             testClusterToken,
+			Transport:         &raft.HTTPTransport{Client: client, Token: testClusterToken},
+			ElectionTimeout:   150 * time.Millisecond,
+			HeartbeatInterval: 30 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(WithHasher(h), WithListener(l), WithConsensus(h.Node(), testClusterToken),
+			WithLogger(slog.New(logging.Redact(slog.DiscardHandler))))
+		go s.Run()
+		<-s.Ready()
+		t.Cleanup(s.Shutdown)
+
+		rs := &http.Server{Handler: s.ConsensusHandler()}
+		go rs.Serve(raftListeners[i])
+		t.Cleanup(func() { rs.Close() })
+	}
+	t.Cleanup(func() {
+		client.CloseIdleConnections()
+		http.DefaultClient.CloseIdleConnections()
+	})
+	return urls, raftURLs
+}
+
+// raftStatus fetches a node's /raft/status.
+func raftStatus(t *testing.T, u string) raft.Status {
+	t.Helper()
+	resp, err := http.Get(u + "/raft/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status raft.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// TestConsensus verifies that followers send clients to the leader, which
+// hands out ids and results from the log.
+func TestConsensus(t *testing.T) {
+	t.Parallel()
+	urls, raftURLs := startConsensus(t, 3, 3)
+
+	var leader int
+	deadline := time.Now().Add(5 * time.Second)
+	for leader = raftStatus(t, urls[0]).Leader; leader <= 0; leader = raftStatus(t, urls[0]).Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader was elected")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	follower := urls[leader%3]
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.PostForm(follower+"/hash", url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != urls[leader-1]+"/hash" {
+		t.Errorf("POST to a follower returned %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// A client that follows redirects ends up at the leader, password and all
+	resp, err = http.PostForm(follower+"/hash", url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if id, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64); err != nil || id != 1 {
+		t.Fatalf("POST through a follower returned %d: %s", resp.StatusCode, body)
+	}
+
+	resp, err = noRedirects.Get(follower + "/hash/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != urls[leader-1]+"/hash/1" {
+		t.Errorf("GET from a follower returned %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = http.Get(follower + "/hash/1?wait=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != hasher.Compute("angryMonkey") {
+		t.Errorf("GET through a follower returned %d: %s", resp.StatusCode, body)
+	}
+
+	if status := raftStatus(t, follower); status.Role != raft.Follower || status.Leader != leader || len(status.Members) != 3 {
+		t.Errorf("follower status %+v", status)
+	}
+
+	// The log is only for members, and not on the public port at all
+	resp, err = http.Post(follower+raft.VotePath, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("vote on the public port returned %d", resp.StatusCode)
+	}
+	resp, err = http.Post(raftURLs[leader%3]+raft.VotePath, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("vote without the cluster token returned %d", resp.StatusCode)
+	}
+}
+
+// TestConsensusListener verifies that the consensus listener is started
+// alongside the public one.
+func TestConsensusListener(t *testing.T) {
+	h, err := consensus.New(hasher.DefaultConfig(), consensus.Config{
+		Node:    1,
+		Members: []raft.Member{{ID: 1, URL: "http://127.0.0.1:1"}},
+		Token:   testClusterToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithHasher(h), WithAddr("127.0.0.1:0"), WithConsensus(h.Node(), testClusterToken),
+		WithConsensusAddr("127.0.0.1:0"), WithLogger(slog.New(slog.DiscardHandler)))
+	go s.Run()
+	<-s.Ready()
+	defer s.Shutdown()
+
+	req, _ := http.NewRequest("POST", "http://"+s.ConsensusAddr()+raft.VotePath, strings.NewReader(`{"term": 0}`))
+	req.Header.Set("Authorization", "Bearer "+testClusterToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	http.DefaultClient.CloseIdleConnections()
+	if resp.StatusCode != 200 {
+		t.Errorf("vote on the consensus listener returned %d", resp.StatusCode)
+	}
+	if s.ConsensusAddr() == s.Addr() {
+		t.Errorf("the consensus listener is the public one, %s", s.Addr())
+	}
+}
+
+// TestNoLeader verifies that clients are told to try again while there's
+// no leader.
+func TestNoLeader(t *testing.T) {
+	t.Parallel()
+	urls, _ := startConsensus(t, 3, 1)
+
+	resp, err := http.PostForm(urls[0]+"/hash", url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("POST without a leader returned %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if status := raftStatus(t, urls[0]); status.Leader > 0 {
+		t.Errorf("a lone node out of 3 thinks %d leads", status.Leader)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/hash/%d", urls[0], 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Errorf("GET without a leader returned %d", resp.StatusCode)
+	}
+}
+
+// TestConsensusChaos verifies that /admin/chaos reaches chaos inside the
+// consensus log, around the hasher that does the work.
+func TestConsensusChaos(t *testing.T) {
+	var ch *chaos.Hasher
+	h, err := consensus.New(hasher.DefaultConfig(), consensus.Config{
+		Node:    1,
+		Members: []raft.Member{{ID: 1, URL: "http://127.0.0.1:1"}},
+		Token:   testClusterToken,
+		New: func(cfg hasher.Config) (hasher.AsyncHasher, error) {
+			var err error
+			ch, err = chaos.New(cfg, chaos.Config{})
+			return ch, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithHasher(h), WithChaos(ch), WithConsensus(h.Node(), testClusterToken),
+		WithLogger(slog.New(slog.DiscardHandler)))
+	defer s.Shutdown()
+
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, httptest.NewRequest("POST", "/admin/chaos", strings.NewReader("fail=1")))
+	if w.Code != 200 || ch.Config().FailRate != 1 {
+		t.Errorf("POST /admin/chaos returned %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/chaos", nil))
+	if w.Code != 200 || w.Body.String() != "fail=1\n" {
+		t.Errorf("GET /admin/chaos returned %d: %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// probeTimeout is how long a health check waits for the hasher to respond
+// before declaring it wedged.  The hasher should answer in microseconds, so
+// this is very generous.
+const probeTimeout = time.Second
+
+// defaultMaxPending is the number of outstanding hashes at which the server
+// reports itself as saturated and asks to be taken out of rotation.
+const defaultMaxPending = 10000
+
+// selfTestPassword and selfTestHashes are known good input/output pairs for
+// the built-in algorithms, used to verify hashing works before we accept any
+// requests.
+const selfTestPassword = "angryMonkey"
+
+var selfTestHashes = map[string]string{
+	"sha512": "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==",
+	"sha384": "lCFLBLhEvl4+crczHY2Xptqbh0dMwImKAReZFOc/SsXJlmlbYCEtwsO8IwrzZNzk",
+	"sha256": "/iKaK4dQuFt0w2h6u20dpZQ7EPaM30pdx/sWN4BXIR8=",
+}
+
+var errSelfTestPending = errors.New("startup self-test has not run")
+
+// check is a single named readiness condition.  fn returns nil when the
+// condition is healthy, and an error describing the problem otherwise.
+type check struct {
+	name string
+	fn   func() error
+}
+
+// checkResult is the JSON form of a single check.
+type checkResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthReport is the JSON body returned by /healthz and /readyz.
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// AddReadinessCheck registers an additional condition that must hold for
+// GET /readyz to report the server as ready.  This lets components outside
+// of this package, such as a persistence store, take the server out of
+// rotation when they are unhealthy.  It must be called before Run.
+func (s *Server) AddReadinessCheck(name string, fn func() error) {
+	s.readyChecks = append(s.readyChecks, check{name, fn})
+}
+
+// selfTest verifies that the hasher's algorithm produces the expected output
+// and that the hasher is responsive.  Algorithms registered elsewhere have no
+// known output, so only their responsiveness is checked.  It runs once at
+// startup, and readiness reports its result for the life of the server.
+func (s *Server) selfTest() error {
+	name := s.hasher.Stats().Algorithm
+	if want, ok := selfTestHashes[name]; ok {
+		algorithm, err := hasher.LookupAlgorithm(name)
+		if err != nil {
+			return err
+		}
+		if hash := algorithm(selfTestPassword); hash != want {
+			return fmt.Errorf("self-test %s hash mismatch: got %s", name, hash)
+		}
+	}
+
+	_, err := s.hasher.Probe(probeTimeout)
+	return err
+}
+
+// runSelfTest runs the self-test the first time it's called, and keeps the
+// result for readiness.  A failure is not fatal since the server may still be
+// useful for collecting results, but it will never report itself ready.
+func (s *Server) runSelfTest() {
+	s.selfTestOnce.Do(func() {
+		if s.selfTestErr = s.selfTest(); s.selfTestErr != nil {
+			s.log.Error("startup self-test failed", "error", s.selfTestErr)
+		}
+	})
+}
+
+// livenessChecks are the conditions that, if failing, mean the process should
+// be restarted.  Only a wedged hasher qualifies; everything else is something
+// we expect to recover from on our own.
+func (s *Server) livenessChecks() []check {
+	return []check{
+		{"hasher", func() error {
+			_, err := s.hasher.Probe(probeTimeout)
+			return err
+		}},
+	}
+}
+
+// readinessChecks are the conditions that must hold for the server to be
+// given new work.
+func (s *Server) readinessChecks() []check {
+	checks := []check{
+		{"state", func() error {
+			if st := s.getState(); st != stateServing {
+				return errors.New(st.String())
+			}
+			return nil
+		}},
+		{"self-test", func() error {
+			return s.selfTestErr
+		}},
+		{"hasher", func() error {
+			health, err := s.hasher.Probe(probeTimeout)
+			if err != nil {
+				return err
+			}
+			if health.Capacity > 0 && health.Queued >= health.Capacity {
+				return fmt.Errorf("saturated: queue of %d is full", health.Capacity)
+			}
+			if health.Pending >= int64(s.maxPending) {
+				return fmt.Errorf("saturated: %d of %d hashes pending", health.Pending, s.maxPending)
+			}
+			return nil
+		}},
+	}
+
+	return append(checks, s.readyChecks...)
+}
+
+// healthzHandler serves GET /healthz, the liveness endpoint.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	serveChecks(w, r, s.livenessChecks())
+}
+
+// readyzHandler serves GET /readyz, the readiness endpoint.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	serveChecks(w, r, s.readinessChecks())
+}
+
+// serveChecks runs every check and writes the result.  The status code is 200
+// if they all pass and 503 otherwise, since that's all a load balancer looks
+// at.  By default the body is a short plain text summary; callers that want
+// the detail of every check can ask for JSON with ?format=json or an Accept
+// header.
+func serveChecks(w http.ResponseWriter, r *http.Request, checks []check) {
+	report := healthReport{Status: "ok"}
+	code := 200
+	var failures []string
+
+	for _, c := range checks {
+		result := checkResult{Name: c.name, OK: true}
+		if err := c.fn(); err != nil {
+			result.OK = false
+			result.Detail = err.Error()
+			failures = append(failures, c.name+": "+result.Detail)
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	if len(failures) > 0 {
+		report.Status = "unavailable"
+		code = 503
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if len(failures) == 0 {
+		fmt.Fprintln(w, report.Status)
+		return
+	}
+	fmt.Fprintln(w, strings.Join(failures, "; "))
+}
+
+// wantsJSON returns true if the request asked for a JSON response.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// getHealth invokes handler and returns the status code and decoded JSON report.
+func getHealth(t *testing.T, handler func(w *httptest.ResponseRecorder)) (int, healthReport) {
+	w := httptest.NewRecorder()
+	handler(w)
+
+	var report healthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report
+}
+
+// failing returns the names of the failed checks in report.
+func failing(report healthReport) []string {
+	var names []string
+	for _, c := range report.Checks {
+		if !c.OK {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// TestReadiness walks the readiness endpoint through each condition that
+// should take the server out of rotation.
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t)
+	defer shutdownTestServer(s, clock)
+
+	ready := func() (int, healthReport) {
+		return getHealth(t, func(w *httptest.ResponseRecorder) {
+			s.readyzHandler(w, httptest.NewRequest("GET", "/readyz?format=json", nil))
+		})
+	}
+
+	// The self-test hasn't run yet
+	if code, report := ready(); code != 503 || strings.Join(failing(report), ",") != "self-test" {
+		t.Errorf("before self-test: %d %v", code, failing(report))
+	}
+
+	s.selfTestErr = s.selfTest()
+	if code, report := ready(); code != 200 || report.Status != "ok" {
+		t.Errorf("after self-test: %d %+v", code, report)
+	}
+
+	// Saturation
+	s.maxPending = 0
+	if code, report := ready(); code != 503 || strings.Join(failing(report), ",") != "hasher" {
+		t.Errorf("saturated: %d %v", code, failing(report))
+	}
+	s.maxPending = defaultMaxPending
+
+	// Externally registered checks, e.g. a persistence store
+	s.AddReadinessCheck("store", func() error { return errors.New("disk full") })
+	if code, report := ready(); code != 503 || strings.Join(failing(report), ",") != "store" {
+		t.Errorf("store failure: %d %v", code, failing(report))
+	}
+	s.readyChecks = nil
+
+	s.StartDraining()
+	if code, report := ready(); code != 503 || strings.Join(failing(report), ",") != "state" {
+		t.Errorf("draining: %d %v", code, failing(report))
+	}
+}
+
+// TestSelfTestAlgorithms verifies that the self-test checks whichever
+// algorithm the hasher is configured with, and knows the output of every
+// built-in one.
+func TestSelfTestAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range hasher.Algorithms() {
+		if _, ok := selfTestHashes[name]; !ok {
+			t.Errorf("%s: no self-test hash", name)
+			continue
+		}
+
+		clock := hasher.NewFakeClock(time.Unix(0, 0))
+		cfg := hasher.DefaultConfig()
+		cfg.Clock = clock
+		cfg.Algorithm = name
+		h, err := hasher.New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(WithHasher(h))
+		if err := s.selfTest(); err != nil {
+			t.Errorf("%s: self-test failed: %v", name, err)
+		}
+		shutdownTestServer(s, clock)
+	}
+}
+
+// TestReadinessEmbedded verifies that a server used only through Handler,
+// and never Run, still becomes ready.
+func TestReadinessEmbedded(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t)
+	defer shutdownTestServer(s, clock)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/readyz?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report healthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || report.Status != "ok" {
+		t.Errorf("GET /readyz through Handler() = %d %v", resp.StatusCode, failing(report))
+	}
+}
+
+// TestLivenessPlain verifies the plain text form used by load balancers, and
+// that draining does not affect liveness.
+func TestLivenessPlain(t *testing.T) {
+	t.Parallel()
+
+	s, _ := newTestServer(t)
+	s.StartDraining()
+
+	w := httptest.NewRecorder()
+	s.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 || w.Body.String() != "ok\n" {
+		t.Errorf("healthz: %d %q", w.Code, w.Body.String())
+	}
+
+	// A drained hasher can no longer do any work, so we're not alive
+	s.hasher.Drain()
+	w = httptest.NewRecorder()
+	s.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 503 || !strings.HasPrefix(w.Body.String(), "hasher: ") {
+		t.Errorf("healthz after drain: %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/metrics"
+)
+
+// metricPrefix starts the name of every metric we export.
+const metricPrefix = "hash_server_"
+
+// httpMetrics counts the requests served by each route.
+type httpMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*metrics.Histogram // By route
+}
+
+// requestKey identifies the labels of a request count.
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+// instrument wraps a handler so that every request to route is counted and
+// timed.
+func (m *httpMetrics) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: 200}
+		h(sw, r)
+		m.observe(requestKey{route, r.Method, sw.code}, time.Since(start))
+	}
+}
+
+func (m *httpMetrics) observe(key requestKey, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requests == nil {
+		m.requests = make(map[requestKey]uint64)
+		m.durations = make(map[string]*metrics.Histogram)
+	}
+	m.requests[key]++
+
+	h, ok := m.durations[key.route]
+	if !ok {
+		histogram := metrics.NewHistogram(metrics.DefaultBuckets)
+		h = &histogram
+		m.durations[key.route] = h
+	}
+	h.ObserveDuration(d)
+}
+
+// write writes the HTTP metrics, in a stable order.
+func (m *httpMetrics) write(w *metrics.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+
+	w.Family(metricPrefix+"http_requests_total", "counter", "HTTP requests served, by route, method and status code.")
+	for _, key := range keys {
+		labels := metrics.Labels{"route": key.route, "method": key.method, "code": strconv.Itoa(key.code)}
+		w.Sample(metricPrefix+"http_requests_total", labels, float64(m.requests[key]))
+	}
+
+	routes := make([]string, 0, len(m.durations))
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	w.Family(metricPrefix+"http_request_duration_seconds", "histogram", "Time to serve HTTP requests, by route.")
+	for _, route := range routes {
+		w.Histogram(metricPrefix+"http_request_duration_seconds", metrics.Labels{"route": route}, *m.durations[route])
+	}
+}
+
+// statusWriter remembers the status code written by a handler, and how much
+// it wrote.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// writeHasherMetrics writes the hasher's counters, gauges and histograms.
+func writeHasherMetrics(w *metrics.Writer, stats hasher.Stats) {
+	labels := metrics.Labels{"algorithm": stats.Algorithm}
+
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"jobs_submitted_total", "Hashes accepted by POST /hash.", stats.Counters.Submitted},
+		{"jobs_rejected_total", "Hashes refused by POST /hash because the hasher was paused or full.", stats.Counters.Rejected},
+		{"jobs_completed_total", "Hashes computed successfully.", stats.Counters.Completed},
+		{"jobs_failed_total", "Hashes that failed.", stats.Counters.Failed},
+		{"jobs_retrieved_total", "Hashes and failures returned by GET /hash/{id}.", stats.Counters.Retrieved},
+		{"jobs_expired_total", "Hashes thrown away after the TTL without being retrieved.", stats.Counters.Expired},
+	}
+	for _, c := range counters {
+		w.Family(metricPrefix+c.name, "counter", c.help)
+		w.Sample(metricPrefix+c.name, labels, float64(c.value))
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"jobs_in_flight", "Hashes being computed.", float64(stats.InFlight)},
+		{"jobs_queued", "Hashes waiting for a worker.", float64(stats.Queued)},
+		{"jobs_stored", "Completed hashes waiting to be retrieved.", float64(stats.Stored)},
+	}
+	for _, g := range gauges {
+		w.Family(metricPrefix+g.name, "gauge", g.help)
+		w.Sample(metricPrefix+g.name, labels, g.value)
+	}
+
+	if stats.HashSeconds.Counts == nil {
+		// Nothing has been hashed yet, so the histograms have no buckets
+		stats.HashSeconds = metrics.NewHistogram(metrics.DefaultBuckets)
+		stats.QueueSeconds = metrics.NewHistogram(metrics.DefaultBuckets)
+	}
+	w.Family(metricPrefix+"hash_duration_seconds", "histogram", "Time computing each hash, not including simulated work.")
+	w.Histogram(metricPrefix+"hash_duration_seconds", labels, stats.HashSeconds)
+	w.Family(metricPrefix+"queue_wait_seconds", "histogram", "Time each hash waited for a worker.")
+	w.Histogram(metricPrefix+"queue_wait_seconds", labels, stats.QueueSeconds)
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format.  GET
+// /stats still serves the same information as JSON.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+
+	mw := metrics.NewWriter(w)
+	writeHasherMetrics(mw, s.hasher.Stats())
+	s.httpMetrics.write(mw)
+	if err := mw.Err(); err != nil {
+		s.log.Warn("writing metrics failed", "error", err)
+	}
+}
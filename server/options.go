@@ -0,0 +1,169 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/audit"
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/cluster"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/raft"
+	"github.com/jaredcantwell/hash-server/recording"
+)
+
+// defaultAddr is the address the server listens on if none is supplied.
+const defaultAddr = ":8080"
+
+// defaultShutdownTimeout is how long Run waits for in-flight requests to
+// finish when shutting down.
+const defaultShutdownTimeout = 300 * time.Second
+
+// Option configures a Server.  Options are passed to New.
+type Option func(*Server)
+
+// WithAddr sets the TCP address the server listens on, in the form accepted
+// by net.Listen, such as ":8080" or "127.0.0.1:0".  Use port 0 to have the
+// operating system pick a free port, then call Addr once the server is Ready
+// to find out which one was chosen.
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.srv.Addr = addr
+	}
+}
+
+// WithAdminAddr starts an admin listener on addr, separate from the public
+// port, serving expvar, pprof and a dump of the current jobs.  See
+// AdminHandler.  There is no admin listener by default.
+func WithAdminAddr(addr string) Option {
+	return func(s *Server) {
+		s.adminAddr = addr
+	}
+}
+
+// WithListener has the server accept connections on an already open listener
+// instead of opening its own.  This is used for systemd socket activation,
+// where the service manager owns the socket.  The Server takes ownership of
+// the listener and closes it on shutdown.
+func WithListener(l net.Listener) Option {
+	return func(s *Server) {
+		s.srv.Addr = l.Addr().String()
+		s.listener = l
+	}
+}
+
+// WithAudit records every job that is submitted or retrieved in an audit log.
+// The Server doesn't take ownership of the log, which the caller should close
+// once Run returns.
+func WithAudit(l *audit.Log) Option {
+	return func(s *Server) {
+		s.audit = l
+	}
+}
+
+// WithRecorder records the timing and shape of every request, but not the
+// passwords, so the load can be replayed later.  The Server doesn't take
+// ownership of the recorder, which the caller should close once Run returns.
+func WithRecorder(r *recording.Recorder) Option {
+	return func(s *Server) {
+		s.recorder = r
+	}
+}
+
+// WithWorkerToken requires remote workers to present token as a bearer token
+// on every request to the worker endpoints.  Without one, the worker endpoints
+// refuse everyone, since a lease hands over a password.
+func WithWorkerToken(token string) Option {
+	return func(s *Server) {
+		s.workerToken = token
+	}
+}
+
+// WithCluster makes the server one node of a cluster.  Requests for ids
+// issued by another node are sent there, and GET /cluster/stats gathers the
+// stats of every node.  The hasher's Config.Node must be the cluster's Self.
+// If the cluster replicates, the hasher's Config.OnComplete must be its
+// Completed, and the Server takes ownership of it, closing it once the
+// hasher has drained.
+func WithCluster(c *cluster.Cluster) Option {
+	return func(s *Server) {
+		s.cluster = c
+	}
+}
+
+// WithConsensus makes the server one node of a cluster that keeps its jobs in
+// a Raft log, see package consensus.  The hasher must be the consensus.Hasher
+// that n belongs to.  The other nodes reach n through ConsensusHandler,
+// presenting token, and clients that ask a node other than the leader for
+// something only the leader can do are redirected to it.
+func WithConsensus(n *raft.Node, token string) Option {
+	return func(s *Server) {
+		s.consensus = n
+		s.consensusToken = token
+	}
+}
+
+// WithConsensusAddr starts a consensus listener on addr, separate from the
+// public port, serving ConsensusHandler to the other nodes of the consensus
+// log.  There is no consensus listener by default.
+func WithConsensusAddr(addr string) Option {
+	return func(s *Server) {
+		s.consensusAddr = addr
+	}
+}
+
+// WithHasher sets the AsyncHasher implementation used to compute hashes.
+// The Server takes ownership of the hasher and drains it on shutdown.
+func WithHasher(h hasher.AsyncHasher) Option {
+	return func(s *Server) {
+		s.hasher = h
+	}
+}
+
+// WithChaos sets the chaos.Hasher that /admin/chaos controls.  It is only
+// needed when chaos is somewhere inside the hasher rather than the hasher
+// itself, as it is under a consensus.Hasher.  By default, /admin/chaos
+// controls the hasher if it is a chaos.Hasher, and is 404 otherwise.
+func WithChaos(h *chaos.Hasher) Option {
+	return func(s *Server) {
+		s.chaos = h
+	}
+}
+
+// WithTimeouts sets the read, write and idle timeouts of the underlying
+// http.Server.  Zero means no timeout, which is the default.
+func WithTimeouts(read, write, idle time.Duration) Option {
+	return func(s *Server) {
+		s.srv.ReadTimeout = read
+		s.srv.WriteTimeout = write
+		s.srv.IdleTimeout = idle
+	}
+}
+
+// WithShutdownTimeout sets how long Run waits for in-flight requests to
+// complete when shutting down before giving up and returning an error.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithLogger sets the logger used for the access log, errors and lifecycle
+// messages.  Whatever handler it has, records go through logging.Redact on
+// the way to it.  The default logs JSON to stderr at info level.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.log = logger
+	}
+}
+
+// WithConfigReport supplies the effective configuration of the program the
+// server is part of.  The value returned by report is encoded as JSON for
+// GET /admin/config.  It is a function so that configuration reloads are
+// reflected.
+func WithConfigReport(report func() interface{}) Option {
+	return func(s *Server) {
+		s.configReport = report
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/recording"
+)
+
+// passwordPrefix starts the body of every request that carries a password.
+const passwordPrefix = "password="
+
+// record wraps a handler to record the shape of every request to route, if
+// there is a recorder.  The body is read here to measure it, and handed on
+// to h untouched.  Only the length of a password is recorded, never the
+// password.
+func (s *Server) record(route string, h http.HandlerFunc) http.HandlerFunc {
+	if s.recorder == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		e := recording.Entry{
+			Time:     start,
+			Method:   r.Method,
+			Route:    route,
+			Path:     r.URL.Path,
+			Wait:     r.URL.Query().Get("wait"),
+			BodySize: len(body),
+		}
+		if r.Method == "POST" && bytes.HasPrefix(body, []byte(passwordPrefix)) {
+			e.PasswordLength = len(body) - len(passwordPrefix)
+		}
+		if id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, route), 10, 64); err == nil && strings.HasSuffix(route, "/") {
+			e.JobID = id
+		}
+
+		// The id of a new job is only in the response
+		rw := &recordWriter{statusWriter: statusWriter{ResponseWriter: w, code: 200}}
+		h(rw, r)
+		if route == "/hash" && rw.code == 200 {
+			e.JobID, _ = strconv.ParseInt(strings.TrimSpace(rw.head.String()), 10, 64)
+		}
+
+		e.Status = rw.code
+		e.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		s.recorder.Record(e)
+	}
+}
+
+// recordWriter is a statusWriter that also keeps the start of the response,
+// which is enough for the id returned by POST /hash.
+type recordWriter struct {
+	statusWriter
+	head bytes.Buffer
+}
+
+// maxRecordedResponse is how much of a response recordWriter keeps.
+const maxRecordedResponse = 32
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	if n := maxRecordedResponse - w.head.Len(); n > 0 {
+		w.head.Write(b[:min(n, len(b))])
+	}
+	return w.statusWriter.Write(b)
+}
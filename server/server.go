@@ -9,87 +9,290 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jaredcantwell/hash-server/audit"
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/cluster"
 	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+	"github.com/jaredcantwell/hash-server/raft"
+	"github.com/jaredcantwell/hash-server/recording"
 )
 
+// state describes where the Server is in its lifecycle.  It is read
+// atomically since handlers run concurrently, and changed under
+// Server.lifecycle along with pausing or resuming the hasher, so that the
+// two always agree.
+type state int32
+
+const (
+	stateServing      state = iota // Accepting all requests
+	stateDraining                  // Refusing new hashes, but serving results and stats
+	stateShuttingDown              // Shutdown requested, Run will exit soon
+)
+
+// String returns the name reported by the readiness endpoint.
+func (st state) String() string {
+	switch st {
+	case stateServing:
+		return "serving"
+	case stateDraining:
+		return "draining"
+	default:
+		return "shutting down"
+	}
+}
+
 // Server implements the functionality of this package.
 type Server struct {
-	shutdownChan chan interface{}
-	shutdownDone chan interface{}
-	hasher       hasher.AsyncHasher
-	srv          *http.Server
+	state             int32      // atomic, holds a state value
+	lifecycle         sync.Mutex // Held while changing state, see state
+	started           int32      // atomic, set once Run (or Shutdown without Run) has been called
+	shutdownChan      chan interface{}
+	shutdownDone      chan interface{}
+	ready             chan interface{}
+	hasher            hasher.AsyncHasher
+	srv               *http.Server
+	mux               *http.ServeMux
+	log               *slog.Logger
+	listener          net.Listener       // If nil, Run will listen on srv.Addr itself
+	shutdownTimeout   time.Duration      // How long to wait for in-flight requests on shutdown
+	maxPending        int                // Outstanding hashes at which we report as saturated
+	readyChecks       []check            // Extra readiness conditions registered by AddReadinessCheck
+	selfTestErr       error              // Result of the startup self-test
+	selfTestOnce      sync.Once          // Runs the self-test from Run, or Handler if it's used first
+	configReport      func() interface{} // Effective configuration served by GET /admin/config
+	httpMetrics       httpMetrics        // Requests served, by route, for GET /metrics
+	adminAddr         string             // Address for the admin listener, "" for none
+	adminSrv          *http.Server       // Serves the admin diagnostics, nil if there's no admin listener
+	adminMux          *http.ServeMux
+	adminListener     net.Listener
+	audit             *audit.Log          // Records who submitted and retrieved each job, nil for none
+	recorder          *recording.Recorder // Records the shape of every request, nil for none
+	workerToken       string              // Bearer token required by the worker endpoints, "" to refuse every worker
+	cluster           *cluster.Cluster    // The other nodes, nil if this server stands alone
+	consensus         *raft.Node          // This node of the consensus log, nil if there isn't one
+	consensusToken    string              // Token the other nodes of the consensus log present, "" refuses them all
+	consensusAddr     string              // Address for the consensus listener, "" for none
+	consensusSrv      *http.Server        // Serves the consensus log to the other nodes, nil if there's no consensus listener
+	consensusMux      *http.ServeMux
+	consensusListener net.Listener
+	chaos             *chaos.Hasher // Controlled by /admin/chaos, nil if chaos isn't installed
 }
 
-// New creates and initializes a new Server that will listen on the supplied
-// port and provide the http functionality of this package.  The server will
-// not begin listening though.  Call Run to startup the server for incoming
-// connections.
-func New(port int) *Server {
+// New creates and initializes a new Server that provides the http
+// functionality of this package.  By default it uses an AsyncHasherChannel
+// and will listen on port 8080, but this can be changed with the supplied
+// options.  The server will not begin listening though.  Call Run to startup
+// the server for incoming connections, or use Handler to serve the API from
+// an http.Server of your own.
+func New(options ...Option) *Server {
 	var server Server
-	server.srv = &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	server.srv = &http.Server{Addr: defaultAddr}
 	server.shutdownChan = make(chan interface{}, 1)
 	server.shutdownDone = make(chan interface{})
-	server.hasher = hasher.NewHasherChannel()
-	//server.hasher = hasher.NewHasherMutex()
+	server.ready = make(chan interface{})
+	server.log = logging.New(os.Stderr, slog.LevelInfo)
+	server.shutdownTimeout = defaultShutdownTimeout
+	server.maxPending = defaultMaxPending
+	server.selfTestErr = errSelfTestPending
+
+	for _, option := range options {
+		option(&server)
+	}
+	server.log = slog.New(logging.Redact(server.log.Handler()))
+
+	if server.hasher == nil {
+		// The default config is always valid
+		server.hasher, _ = hasher.New(hasher.DefaultConfig())
+	}
+	if server.chaos == nil {
+		server.chaos, _ = server.hasher.(*chaos.Hasher)
+	}
+
+	// Each Server gets its own ServeMux rather than using http.DefaultServeMux
+	// so that more than one can live in the same process.
+	server.mux = http.NewServeMux()
+	server.handle("/hash", nil, server.hashPOSTHandler)
+	server.handle("/hash/", server.hashGETHandler, nil)
+	server.handle("/verify/", nil, server.verifyHandler)
+	server.handle("/stats", server.statsHandler, nil)
+	server.handle("/stats/reset", nil, server.resetStatsHandler)
+	server.handle("/shutdown", nil, server.shutdownHandler)
+	server.handle("/drain", nil, server.drainHandler)
+	server.handle("/undrain", nil, server.undrainHandler)
+	server.handle("/healthz", server.healthzHandler, nil)
+	server.handle("/readyz", server.readyzHandler, nil)
+	server.handle("/metrics", server.metricsHandler, nil)
+	server.handle("/cluster", server.clusterHandler, nil)
+	server.handle("/cluster/stats", server.clusterStatsHandler, nil)
+	server.handle("/cluster/replicate", server.replicaLastIDHandler, server.replicateHandler)
+	server.handle("/worker/lease", nil, server.workerLeaseHandler)
+	server.handle("/worker/heartbeat", nil, server.workerHeartbeatHandler)
+	server.handle("/worker/complete", nil, server.workerCompleteHandler)
+	server.handle("/worker/fail", nil, server.workerFailHandler)
+	server.handle("/raft/status", server.raftStatusHandler, nil)
+	server.srv.Handler = server.mux
+	server.srv.ErrorLog = slog.NewLogLogger(server.log.Handler(), slog.LevelError)
+
+	server.adminMux = server.newAdminMux()
+	if server.adminAddr != "" {
+		server.adminSrv = &http.Server{Addr: server.adminAddr, Handler: server.adminMux, ErrorLog: server.srv.ErrorLog}
+	}
+	server.consensusMux = server.newConsensusMux()
+	if server.consensusAddr != "" {
+		server.consensusSrv = &http.Server{Addr: server.consensusAddr, Handler: server.consensusMux, ErrorLog: server.srv.ErrorLog}
+	}
+
 	return &server
 }
 
+// Handler returns the http.Handler that serves this package's API.  This
+// allows the API to be embedded in another server or tested with httptest.
+// Note that POST /shutdown only signals Run to exit, so a Server that is never
+// Run should be cleaned up with Shutdown.  The startup self-test is run
+// before the handler is returned, just as Run does before listening, so that
+// GET /readyz reports on it.
+func (s *Server) Handler() http.Handler {
+	s.runSelfTest()
+	return s.mux
+}
+
+// Addr returns the address the server is listening on.  Until the server is
+// Ready, this is the configured address, after which it is the actual address
+// of the listener.  This is how to find which port was chosen when listening
+// on port 0.
+func (s *Server) Addr() string {
+	select {
+	case <-s.ready:
+		return s.listener.Addr().String()
+	default:
+		return s.srv.Addr
+	}
+}
+
+// Ready returns a channel that is closed once the server is listening and
+// able to accept requests.  If the server fails to start, the channel is
+// never closed.
+func (s *Server) Ready() <-chan interface{} {
+	return s.ready
+}
+
 // Run starts up the underlying http server and begins listening for new connections.
 // Run is a blocking call and will not return until a POST /shutdown request is
-// made, at which point everything will be cleaned up and Run will return.
-func (s *Server) Run() {
-	http.HandleFunc("/hash", mux(nil, s.hashPOSTHandler))
-	http.HandleFunc("/hash/", mux(s.hashGETHandler, nil))
-	http.HandleFunc("/stats", mux(s.statsHandler, nil))
-	http.HandleFunc("/shutdown", mux(nil, s.shutdownHandler))
+// made, at which point everything will be cleaned up and Run will return.  An
+// error is returned if the server could not listen, or failed to shutdown
+// cleanly.
+func (s *Server) Run() error {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return errors.New("server has already been run")
+	}
+
+	// Readiness reports the self-test result, so it must be done before we
+	// start listening
+	s.runSelfTest()
+
+	// Open the port ourselves rather than using ListenAndServe so that we know
+	// exactly when the server is able to accept connections.  Errors binding
+	// the port are reported the same way as errors from Serve below.
+	listenErr := make(chan error, 1)
+	if s.listener == nil {
+		l, err := net.Listen("tcp", s.srv.Addr)
+		if err != nil {
+			s.log.Error("listen failed", "addr", s.srv.Addr, "error", err)
+			listenErr <- err
+		}
+		s.listener = l
+	}
+
+	// The admin and consensus listeners are optional, but if one was asked
+	// for and we can't have it, that's as fatal as not getting the public
+	// port.
+	if s.listener != nil {
+		if err := s.startAdmin(); err != nil {
+			s.log.Error("admin listen failed", "addr", s.adminAddr, "error", err)
+			s.listener.Close()
+			s.listener = nil
+			listenErr <- err
+		}
+	}
+	if s.listener != nil {
+		if err := s.startConsensus(); err != nil {
+			s.log.Error("consensus listen failed", "addr", s.consensusAddr, "error", err)
+			s.listener.Close()
+			s.listener = nil
+			listenErr <- err
+		}
+	}
 
 	// Startup the server in the background so that we can perform the shutdown
 	// in this routine asynchronously
-	listenErr := make(chan error)
-	go func() {
-		if err := s.srv.ListenAndServe(); err != nil {
-			if err != http.ErrServerClosed {
-				log.Printf("Httpserver: ListenAndServe() error: %s", err)
-				listenErr <- err
+	if s.listener != nil {
+		s.log.Info("server listening", "addr", s.listener.Addr().String())
+		close(s.ready)
+		go func() {
+			if err := s.srv.Serve(s.listener); err != nil {
+				if err != http.ErrServerClosed {
+					s.log.Error("serve failed", "error", err)
+					listenErr <- err
+				}
 			}
-		}
-	}()
+		}()
+	}
 
 	// Wait until the /shutdown handler signals that its been called (at least once)
 	// OR an error happened in the startup
+	var err error
 	select {
-	case <-listenErr:
+	case err = <-listenErr:
 		// Don't shutdown the server because it never started
 	case <-s.shutdownChan:
-		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
 		defer cancel()
-		if err := s.srv.Shutdown(ctx); err != nil {
-			panic(err) // failure/timeout shutting down the server gracefully
+		if err = s.srv.Shutdown(ctx); err != nil {
+			s.log.Error("shutdown failed", "error", err)
 		}
 	}
+	s.stopAdmin()
 
 	// Now that we can guarantee no new requests will go into the hasher,
 	// let outstanding requests drain so we get a clean shutdown
 	s.hasher.Drain()
+	s.stopConsensus()
+	s.closeCluster()
 
-	fmt.Println("Server shutdown.")
+	s.log.Info("server shutdown")
 
 	// Signal to any callers of Shutdown() that Run() is about to exit
 	close(s.shutdownDone)
+
+	return err
 }
 
 // Shutdown gracefully stops the server and waits until all cleanup is
-// completed before returning.
+// completed before returning.  If Run was never called, for instance because
+// the server was only used through Handler, Shutdown does the cleanup itself.
 func (s *Server) Shutdown() {
 	s.shutdownHandler(nil, nil)
 
+	if atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		s.hasher.Drain()
+		s.closeCluster()
+		close(s.shutdownDone)
+	}
+
 	// Wait until the shutdownDone channel is closed.  Doing this over waiting for an
 	// entry into the channel means that multiple callers could technically safely call
 	// shutdown.
@@ -98,11 +301,45 @@ func (s *Server) Shutdown() {
 	}
 }
 
+// StartDraining takes the server out of rotation without shutting it down.
+// While draining, POST /hash is refused with 503 so a load balancer can move
+// new work elsewhere, but results and stats can still be retrieved so clients
+// can collect the hashes they are waiting on.  Returns false if the server is
+// shutting down.
+func (s *Server) StartDraining() bool {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if !atomic.CompareAndSwapInt32(&s.state, int32(stateServing), int32(stateDraining)) {
+		return s.getState() == stateDraining
+	}
+
+	s.hasher.Pause()
+	return true
+}
+
+// StopDraining puts a draining server back into rotation.  Returns false if
+// the server is shutting down, which can't be undone.
+func (s *Server) StopDraining() bool {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if !atomic.CompareAndSwapInt32(&s.state, int32(stateDraining), int32(stateServing)) {
+		return s.getState() == stateServing
+	}
+
+	s.hasher.Resume()
+	return true
+}
+
+// getState returns the current lifecycle state of the server.
+func (s *Server) getState() state {
+	return state(atomic.LoadInt32(&s.state))
+}
+
 // parsePathParamInt attempts to parse out a trailing int64 from the provided
 // URL.  To handle error cases, the prefix must be provided in order to catch
 // "extra" parts in the path.
 //
-//   parsePathParamInt("/some/path/123", "/some/path/") -> 123
+//	parsePathParamInt("/some/path/123", "/some/path/") -> 123
 //
 // Ideally, we wouldn't have to parse the path parameters ourselves,
 // but the frameworks that handle this for you aren't in the standard libraries
@@ -113,6 +350,8 @@ func parsePathParamInt(path string, prefix string) (int64, error) {
 }
 
 // hashGETHandler is invoked on a GET request to retrieve the hash for an id provided in the URL.
+// With ?wait=30s, a hash that isn't complete yet is waited for, for up to that
+// long, rather than the client having to poll for it.
 func (s *Server) hashGETHandler(w http.ResponseWriter, r *http.Request) {
 	// First parse out the id being requested
 	id, err := parsePathParamInt(r.URL.Path, "/hash/")
@@ -120,18 +359,122 @@ func (s *Server) hashGETHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request path.  id is not an integer.", 400)
 		return
 	}
+	if s.route(w, r, id) {
+		return
+	}
 
-	hash, err := s.hasher.GetAndRemoveHash(id)
-	if err != nil {
+	// Tell clients they needn't poll
+	w.Header().Set(longPollHeader, maxLongPoll.String())
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait duration.", 400)
+			return
+		}
+		if d > maxLongPoll {
+			d = maxLongPoll
+		}
+
+		// Whether the hash completed or the time ran out, the answer is
+		// whatever there is now
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		s.results(id).Wait(ctx, id)
+		cancel()
+	}
+
+	res, err := s.results(id).Retrieve(r.Context(), id)
+	if res.RequestID != "" {
+		w.Header().Set(jobRequestIDHeader, res.RequestID)
+	}
+	var jobErr *hasher.JobError
+	if err == nil || errors.As(err, &jobErr) {
+		s.retrieved(id)
+
+		// Whichever it was, the outcome can't be handed to the client off
+		// the record
+		if !s.recordAudit(r, audit.Retrieved, id) {
+			http.Error(w, "Unable to audit the request.", 500)
+			return
+		}
+	}
+	if jobErr != nil {
+		// The job is gone either way, so this is the only time the client
+		// will hear about the failure.
+		http.Error(w, fmt.Sprintf("Hash failed: %s.", jobErr.Reason), 500)
+		return
+	} else if err != nil {
+		if !s.toLeader(w, r, err) && !s.failover(w, r, id) {
+			notFound(w, err)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, res.Hash)
+}
+
+// notFound reports that there is no hash for an id, and why, in the
+// X-Hash-State header: pending, gone or unknown.
+func notFound(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hasher.ErrPending):
+		w.Header().Set(hashStateHeader, "pending")
+		http.Error(w, "Hash not complete yet.", 404)
+	case errors.Is(err, hasher.ErrGone):
+		w.Header().Set(hashStateHeader, "gone")
+		http.Error(w, "Hash already retrieved or expired.", 404)
+	default:
+		w.Header().Set(hashStateHeader, "unknown")
 		http.Error(w, "Hash not found.", 404)
+	}
+}
+
+// verifyHandler is invoked on a POST request to check a password against the
+// hash for an id provided in the URL.  Unlike GET /hash/{id}, the hash is
+// left in place to be retrieved.
+func (s *Server) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parsePathParamInt(r.URL.Path, "/verify/")
+	if err != nil {
+		http.Error(w, "Invalid request path.  id is not an integer.", 400)
+		return
+	}
+	if s.route(w, r, id) {
+		return
+	}
+	password, ok := readPassword(w, r)
+	if !ok {
+		return
+	}
+
+	match, err := s.results(id).Verify(r.Context(), id, password)
+	var jobErr *hasher.JobError
+	if errors.As(err, &jobErr) {
+		http.Error(w, fmt.Sprintf("Hash failed: %s.", jobErr.Reason), 500)
+		return
+	} else if s.toLeader(w, r, err) {
+		return
+	} else if err != nil {
+		// The replicas need the password too
+		r.Body = io.NopCloser(strings.NewReader(passwordPrefix + password))
+		if !s.failover(w, r, id) {
+			notFound(w, err)
+		}
+		return
+	}
+
+	if !s.recordAudit(r, audit.Verified, id) {
+		http.Error(w, "Unable to audit the request.", 500)
 		return
 	}
 
-	fmt.Fprintln(w, hash)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Match bool `json:"match"`
+	}{match})
 }
 
-// hashPOSTHandler is invoked on a POST request to compute a new password hash
-func (s *Server) hashPOSTHandler(w http.ResponseWriter, r *http.Request) {
+// readPassword reads the password from the body of a POST request.  If there
+// isn't one, the error has been reported to the client and ok is false.
+func readPassword(w http.ResponseWriter, r *http.Request) (password string, ok bool) {
 	// NOTE: We have to parse the body of the request ourselves.  The instructions state that we should
 	// handle a body of "password=<the password to hash>".  Without being more strict about the encoding,
 	// r.FormValue has problems with special characters (like % and &), and doesn't do the right thing
@@ -144,24 +487,92 @@ func (s *Server) hashPOSTHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !strings.HasPrefix(body, "password=") {
 		http.Error(w, "Invalid password parameter.", 400)
-		return
+		return "", false
 	}
 
-	password := strings.TrimPrefix(body, "password=")
+	password = strings.TrimPrefix(body, "password=")
 
 	if password == "" {
 		http.Error(w, "No password supplied.", 400)
+		return "", false
+	}
+	return password, true
+}
+
+// hashPOSTHandler is invoked on a POST request to compute a new password hash
+func (s *Server) hashPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	password, ok := readPassword(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := s.hasher.ComputeContext(r.Context(), password)
+	if s.toLeader(w, r, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case hasher.ErrPaused:
+		http.Error(w, "Server is not accepting new hashes.", 503)
+		return
+	case hasher.ErrQueueFull:
+		// The queue drains at the rate of the workers, so it's worth
+		// trying again shortly.
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server is too busy.", 503)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// The hash is being computed either way, but the client isn't told the
+	// id unless the submission is on record
+	if !s.recordAudit(r, audit.Submitted, id) {
+		http.Error(w, "Unable to audit the request.", 500)
+		return
+	}
+	// Nor unless it would survive this node dying
+	if !s.replicate(r, id, password) {
+		http.Error(w, "Unable to replicate the request.", 500)
 		return
 	}
 
-	id := s.hasher.Compute(password)
 	fmt.Fprintln(w, id)
 }
 
-// statsHandler serves up the json stats requests
+// statsHandler serves up the json stats requests.  With ?window=5m, only that
+// window is returned.
 func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.hasher.Stats()
+
+	var result interface{} = stats
+	if name := r.URL.Query().Get("window"); name != "" {
+		result = nil
+		for _, window := range stats.Windows {
+			if window.Window == name {
+				result = window
+			}
+		}
+		if result == nil {
+			names := make([]string, len(hasher.Windows))
+			for i, d := range hasher.Windows {
+				names[i] = hasher.WindowName(d)
+			}
+			http.Error(w, "Unknown window.  Expected one of: "+strings.Join(names, ", "), 400)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.hasher.Stats())
+	json.NewEncoder(w).Encode(result)
+}
+
+// resetStatsHandler starts the cumulative stats over when a POST /stats/reset
+// request is made.
+func (s *Server) resetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	s.hasher.ResetStats()
+	s.log.Info("stats reset")
 }
 
 // shutdownHandler signals for the server to be shutdown when a POST /shutdown request is made.
@@ -172,6 +583,10 @@ func (s *Server) shutdownHandler(w http.ResponseWriter, r *http.Request) {
 	// it will be hard to respond after we've shutdown the server, so we simply
 	// begin the shutdown process with the /shutdown call, but do not wait.
 	// With a lot more coordination this could be improved.
+	s.lifecycle.Lock()
+	atomic.StoreInt32(&s.state, int32(stateShuttingDown))
+	s.hasher.Pause()
+	s.lifecycle.Unlock()
 
 	// This select allows multiple calls to shutdown that will all simply
 	// just return.  The first called will add to the channel (of size 1),
@@ -184,6 +599,81 @@ func (s *Server) shutdownHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// configHandler serves GET /admin/config, reporting the effective configuration
+// supplied with WithConfigReport.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	if s.configReport == nil {
+		http.Error(w, "No configuration available.", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.configReport())
+}
+
+// chaosGETHandler serves GET /admin/chaos, reporting the faults currently
+// being injected into the hasher.
+func (s *Server) chaosGETHandler(w http.ResponseWriter, r *http.Request) {
+	h := s.chaos
+	if h == nil {
+		http.Error(w, "Chaos is not installed.", 404)
+		return
+	}
+
+	fmt.Fprintln(w, h.Config())
+}
+
+// chaosPOSTHandler serves POST /admin/chaos, replacing the faults being
+// injected with the spec in the body.  A body of "off" turns them all off.
+func (s *Server) chaosPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	h := s.chaos
+	if h == nil {
+		http.Error(w, "Chaos is not installed.", 404)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(r.Body)
+	c, err := chaos.Parse(buf.String())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	h.SetConfig(c)
+	s.log.Info("chaos set", "chaos", c.String())
+	fmt.Fprintln(w, c)
+}
+
+// drainHandler takes the server out of rotation when a POST /drain request is made.
+func (s *Server) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.StartDraining() {
+		http.Error(w, "Server is shutting down.", 409)
+		return
+	}
+
+	fmt.Fprintln(w, s.getState())
+}
+
+// undrainHandler puts the server back into rotation when a POST /undrain request is made.
+func (s *Server) undrainHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.StopDraining() {
+		http.Error(w, "Server is shutting down.", 409)
+		return
+	}
+
+	fmt.Fprintln(w, s.getState())
+}
+
+// handle registers the GET and POST handlers for a route, counting every
+// request to it in the HTTP metrics and the access log, and recording it if
+// there is a recorder.
+func (s *Server) handle(pattern string, get func(http.ResponseWriter, *http.Request),
+	post func(http.ResponseWriter, *http.Request)) {
+
+	s.mux.HandleFunc(pattern, withRequest(s.record(pattern, s.accessLog(pattern, s.httpMetrics.instrument(pattern, mux(get, post))))))
+}
+
 // mux is a simple helper demux out GET and POST functions from the single handler that
 // you must register with the http code.  It reduces code duplication and hides annoying
 // boiler plate code around checking if a request is a GET/POST/etc. and returning an
@@ -2,17 +2,33 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/jaredcantwell/hash-server/audit"
+	"github.com/jaredcantwell/hash-server/chaos"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+	"github.com/jaredcantwell/hash-server/metrics"
+	"github.com/jaredcantwell/hash-server/recording"
 )
 
 // Missing Tests
 // -------------
 // These tests should be added in order to have complete test coverage:
-// - Verify that bad port input correctly errors out gracefully
 // - Verify that many simulataneous shutdown requests are properly handled and the
 //   server still shuts down correctly.
 // - Verify correct behavior if there are incoming requests while trying to shutdown.
@@ -25,47 +41,651 @@ import (
 //   - Requests for results that have already been retrieved
 //   - Verify different password param permutations
 
+// newTestServer creates a Server whose hasher runs on a FakeClock, so tests
+// decide exactly when hashes complete instead of sleeping.
+func newTestServer(t *testing.T, options ...Option) (*Server, *hasher.FakeClock) {
+	clock := hasher.NewFakeClock(time.Unix(0, 0))
+	cfg := hasher.DefaultConfig()
+	cfg.Clock = clock
+
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(append([]Option{WithHasher(h)}, options...)...), clock
+}
+
+// shutdownTestServer shuts down a test server, advancing its clock until any
+// outstanding hashes have completed.
+func shutdownTestServer(s *Server, clock *hasher.FakeClock) {
+	done := make(chan interface{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+			clock.Advance(time.Second)
+		}
+	}
+}
+
+// postHash submits a password to a running server.
+func postHash(t *testing.T, base string) {
+	resp, err := http.PostForm(base+"/hash", url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("POST /hash returned %d", resp.StatusCode)
+	}
+}
+
 func TestStress(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t, WithAddr("127.0.0.1:0"))
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		New(8080).Run()
+		if err := s.Run(); err != nil {
+			t.Error(err)
+		}
 		wg.Done()
 	}()
 
-	// Sleep 2 seconds to let the server startup.. this obviously needs fixed/improved
-	time.Sleep(2 * time.Second)
-
-	responses := make(chan string, 100)
+	<-s.Ready()
+	base := "http://" + s.Addr()
 
 	// note: this can scale much higher, but requires changing ulimit and
 	// I didn't want to require that to run the tests
-	for i := 0; i < 100; i++ {
+	var posts sync.WaitGroup
+	submit := func(n int) {
+		posts.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				postHash(t, base)
+				posts.Done()
+			}()
+		}
+		posts.Wait()
+	}
+
+	// Let the first batch complete, and leave the second outstanding when
+	// shutdown is requested so that shutdown has to wait for them.
+	submit(50)
+	clock.BlockUntil(50)
+	clock.Advance(5 * time.Second)
+	submit(50)
+	clock.BlockUntil(50)
+
+	resp, err := http.Post(base+"/shutdown", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	stopped := make(chan interface{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("server stopped with hashes outstanding")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(5 * time.Second)
+	<-stopped
+}
+
+// TestDrain verifies that a draining server refuses new hashes and reports
+// itself as not ready, and that it can be put back into rotation.
+func TestDrain(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t)
+	s.selfTestErr = s.selfTest()
+	defer shutdownTestServer(s, clock)
+
+	post := func() int {
+		w := httptest.NewRecorder()
+		s.hashPOSTHandler(w, httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey")))
+		return w.Code
+	}
+	ready := func() int {
+		w := httptest.NewRecorder()
+		s.readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	if !s.StartDraining() {
+		t.Fatal("StartDraining failed")
+	}
+	if code := post(); code != 503 {
+		t.Errorf("POST /hash while draining returned %d, want 503", code)
+	}
+	if code := ready(); code != 503 {
+		t.Errorf("GET /readyz while draining returned %d, want 503", code)
+	}
+
+	if !s.StopDraining() {
+		t.Fatal("StopDraining failed")
+	}
+	if code := ready(); code != 200 {
+		t.Errorf("GET /readyz after draining returned %d, want 200", code)
+	}
+	if code := post(); code != 200 {
+		t.Errorf("POST /hash after draining returned %d, want 200", code)
+	}
+
+	// Once shutdown is requested, there's no going back into rotation
+	s.shutdownHandler(nil, nil)
+	if s.StartDraining() || s.StopDraining() {
+		t.Error("drain state changed during shutdown")
+	}
+	if code := post(); code != 503 {
+		t.Errorf("POST /hash during shutdown returned %d, want 503", code)
+	}
+}
+
+// TestUndrainDuringShutdown verifies that putting a server back into rotation
+// just as it's told to shut down can't leave it accepting new hashes.
+func TestUndrainDuringShutdown(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 50; i++ {
+		s, clock := newTestServer(t)
+		s.StartDraining()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.StopDraining()
+		}()
 		go func() {
-			resp, err := http.PostForm("http://localhost:8080/hash",
-				url.Values{"password": {"angryMonkey"}})
+			defer wg.Done()
+			s.shutdownHandler(nil, nil)
+		}()
+		wg.Wait()
+
+		w := httptest.NewRecorder()
+		s.hashPOSTHandler(w, httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey")))
+		if w.Code != 503 {
+			t.Fatalf("POST /hash after undrain and shutdown raced returned %d, want 503", w.Code)
+		}
+		shutdownTestServer(s, clock)
+	}
+}
+
+// TestHandler verifies that two servers can be served from the same process
+// through httptest without their routes colliding.
+func TestHandler(t *testing.T) {
+	t.Parallel()
 
-			if err != nil {
-				t.Fail()
-				return
+	for i := 0; i < 2; i++ {
+		s, clock := newTestServer(t)
+		ts := httptest.NewServer(s.Handler())
+
+		postHash(t, ts.URL)
+
+		ts.Close()
+		shutdownTestServer(s, clock)
+	}
+}
+
+// TestRunBadAddr verifies that Run reports an error instead of hanging when
+// it can't listen.
+func TestRunBadAddr(t *testing.T) {
+	t.Parallel()
+
+	if err := New(WithAddr("not an address")).Run(); err == nil {
+		t.Error("Run succeeded with an invalid address")
+	}
+}
+
+// TestConfigReport verifies GET /admin/config serves the supplied report.
+func TestConfigReport(t *testing.T) {
+	t.Parallel()
+
+	s := New(WithConfigReport(func() interface{} {
+		return map[string]string{"workers": "4"}
+	}))
+	defer s.Shutdown()
+
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if w.Code != 200 || w.Body.String() != "{\"workers\":\"4\"}\n" {
+		t.Errorf("GET /admin/config: %d %q", w.Code, w.Body.String())
+	}
+
+	// It's only for the admin listener
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if w.Code != 404 {
+		t.Errorf("GET /admin/config on the public port returned %d", w.Code)
+	}
+}
+
+// TestChaos verifies that /admin/chaos controls the faults injected into the
+// hasher, and that GET /hash/{id} reports a failed job.
+func TestChaos(t *testing.T) {
+	t.Parallel()
+
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	h, err := chaos.New(cfg, chaos.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithHasher(h))
+	defer s.Shutdown()
+
+	// The chaos controls are only on the admin listener
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler := s.Handler()
+		if strings.HasPrefix(path, "/admin/") {
+			handler = s.AdminHandler()
+		}
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := serve("GET", "/admin/chaos", ""); w.Body.String() != "off\n" {
+		t.Errorf("GET /admin/chaos: %d %q", w.Code, w.Body.String())
+	}
+	if w := serve("POST", "/admin/chaos", "fail=2"); w.Code != 400 {
+		t.Errorf("POST /admin/chaos with an invalid spec returned %d", w.Code)
+	}
+	if w := serve("POST", "/admin/chaos", "fail=1"); w.Code != 200 || h.Config().FailRate != 1 {
+		t.Errorf("POST /admin/chaos: %d %q", w.Code, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/admin/chaos", strings.NewReader("off")))
+	if w.Code != 404 || h.Config().FailRate != 1 {
+		t.Errorf("POST /admin/chaos on the public port returned %d", w.Code)
+	}
+
+	if w := serve("POST", "/hash", "password=angryMonkey"); w.Code != 200 {
+		t.Fatalf("POST /hash returned %d", w.Code)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		w := serve("GET", "/hash/1", "")
+		if w.Code == 500 {
+			break
+		}
+		if w.Code != 404 || time.Since(start) > 5*time.Second {
+			t.Fatalf("GET /hash/1: %d %q", w.Code, w.Body.String())
+		}
+	}
+	if w := serve("GET", "/hash/1", ""); w.Code != 404 {
+		t.Errorf("failure was reported twice: %d", w.Code)
+	}
+}
+
+// TestStatsWindow verifies GET /stats?window= picks out a single window, and
+// that POST /stats/reset starts the cumulative stats over.
+func TestStatsWindow(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t)
+	defer shutdownTestServer(s, clock)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader("password=angryMonkey")))
+		return w
+	}
+
+	serve("POST", "/hash")
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	for start := time.Now(); s.hasher.Stats().Total != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for hash")
+		}
+	}
+
+	var window hasher.Window
+	w := serve("GET", "/stats?window=5m")
+	if err := json.NewDecoder(w.Body).Decode(&window); err != nil || window.Window != "5m" || window.Completed != 1 {
+		t.Errorf("GET /stats?window=5m: %v %+v", err, window)
+	}
+	if w := serve("GET", "/stats?window=2m"); w.Code != 400 {
+		t.Errorf("GET /stats?window=2m returned %d", w.Code)
+	}
+
+	if w := serve("POST", "/stats/reset"); w.Code != 200 {
+		t.Errorf("POST /stats/reset returned %d", w.Code)
+	}
+	if stats := s.hasher.Stats(); stats.Total != 0 {
+		t.Errorf("stats not reset: %+v", stats)
+	}
+}
+
+// TestMetrics verifies GET /metrics reports the hasher and HTTP metrics.
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t)
+	defer shutdownTestServer(s, clock)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	postHash(t, ts.URL)
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := new(strings.Builder)
+	io.Copy(body, resp.Body)
+
+	if resp.Header.Get("Content-Type") != metrics.ContentType {
+		t.Errorf("Content-Type is %q", resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`hash_server_jobs_submitted_total{algorithm="sha512"} 1`,
+		`hash_server_jobs_in_flight{algorithm="sha512"} 1`,
+		`hash_server_hash_duration_seconds_count{algorithm="sha512"} 0`,
+		`hash_server_http_requests_total{code="200",method="POST",route="/hash"} 1`,
+		`hash_server_http_request_duration_seconds_count{route="/hash"} 1`,
+	} {
+		if !strings.Contains(body.String(), want+"\n") {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+}
+
+// TestAdmin verifies the admin listener serves diagnostics on its own port,
+// without any passwords in the job dump.
+func TestAdmin(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t, WithAddr("127.0.0.1:0"), WithAdminAddr("127.0.0.1:0"))
+	go s.Run()
+	defer shutdownTestServer(s, clock)
+
+	<-s.Ready()
+	if s.AdminAddr() == s.Addr() {
+		t.Fatal("admin listener is on the public port")
+	}
+	postHash(t, "http://"+s.Addr())
+
+	get := func(path string) string {
+		resp, err := http.Get("http://" + s.AdminAddr() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := new(strings.Builder)
+		io.Copy(body, resp.Body)
+		if resp.StatusCode != 200 {
+			t.Errorf("GET %s returned %d", path, resp.StatusCode)
+		}
+		return body.String()
+	}
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(get("/debug/vars")), &vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"memstats", "hasher", "queueDepth", "goroutines"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("/debug/vars is missing %s", name)
+		}
+	}
+
+	jobs := get("/debug/jobs")
+	if !strings.Contains(jobs, `"state":"running"`) || strings.Contains(jobs, "angryMonkey") {
+		t.Errorf("GET /debug/jobs: %s", jobs)
+	}
+
+	get("/debug/pprof/")
+
+	// None of this is on the public port
+	resp, err := http.Get("http://" + s.Addr() + "/debug/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("public GET /debug/jobs returned %d", resp.StatusCode)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that the server and hasher can log to at the
+// same time.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestLogRedaction verifies that a password never reaches the logs, even when
+// a hash fails with an error that quotes it.
+func TestLogRedaction(t *testing.T) {
+	t.Parallel()
+
+	const password = "hunter2 & password=hunter2"
+
+	var buf syncBuffer
+	log := logging.New(&buf, slog.LevelDebug)
+
+	cfg := hasher.DefaultConfig()
+	cfg.Delay = 0
+	cfg.Logger = log
+	cfg.Work = func(password string) (string, error) {
+		return "", fmt.Errorf("rejected password=%s", password)
+	}
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithHasher(h), WithLogger(log))
+	defer s.Shutdown()
+
+	post := httptest.NewRecorder()
+	form := url.Values{"password": {password}}
+	req := httptest.NewRequest("POST", "/hash", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.Handler().ServeHTTP(post, req)
+	if post.Code != 200 {
+		t.Fatalf("POST /hash returned %d", post.Code)
+	}
+
+	// Wait for the hash to fail
+	id := strings.TrimSpace(post.Body.String())
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		get := httptest.NewRecorder()
+		s.Handler().ServeHTTP(get, httptest.NewRequest("GET", "/hash/"+id, nil))
+		if get.Code == 500 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /hash/%s returned %d", id, get.Code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	out := buf.String()
+	for _, msg := range []string{`"msg":"request"`, `"msg":"job submitted"`, `"msg":"job failed"`, `"msg":"job retrieved"`} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("log is missing %s:\n%s", msg, out)
+		}
+	}
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("password was logged:\n%s", out)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	s, clock := newTestServer(t)
+	defer shutdownTestServer(s, clock)
+
+	post := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey"))
+	req.Header.Set("X-Request-ID", "submit-1")
+	s.Handler().ServeHTTP(post, req)
+	if post.Code != 200 || post.Header().Get("X-Request-ID") != "submit-1" {
+		t.Fatalf("POST /hash returned %d with headers %v", post.Code, post.Header())
+	}
+	id := strings.TrimSpace(post.Body.String())
+
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+
+	// The GET gets its own request ID, and names the one that submitted the job
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		get := httptest.NewRecorder()
+		s.Handler().ServeHTTP(get, httptest.NewRequest("GET", "/hash/"+id, nil))
+		if get.Code == 200 {
+			if got := get.Header().Get("X-Job-Request-ID"); got != "submit-1" {
+				t.Errorf("X-Job-Request-ID is %q", got)
+			}
+			if got := get.Header().Get("X-Request-ID"); got == "" || got == "submit-1" {
+				t.Errorf("X-Request-ID is %q", got)
 			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /hash/%s returned %d", id, get.Code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
 
-			buf := new(bytes.Buffer)
-			buf.ReadFrom(resp.Body)
-			responses <- buf.String()
-		}()
+func TestAudit(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, clock := newTestServer(t, WithAudit(l))
+	defer shutdownTestServer(s, clock)
+
+	post := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey"))
+	req.Header.Set("X-Request-ID", "submit-1")
+	s.Handler().ServeHTTP(post, req)
+	id := strings.TrimSpace(post.Body.String())
+
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		get := httptest.NewRecorder()
+		s.Handler().ServeHTTP(get, httptest.NewRequest("GET", "/hash/"+id, nil))
+		if get.Code == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /hash/%s returned %d", id, get.Code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
 	}
+	log := string(b)
+	if !strings.Contains(log, `"action":"submitted","jobId":`+id+`,"actor":"192.0.2.1","requestId":"submit-1"`) ||
+		!strings.Contains(log, `"action":"retrieved","jobId":`+id) {
+		t.Errorf("unexpected audit log:\n%s", log)
+	}
+	if strings.Contains(log, "angryMonkey") || strings.Contains(log, hasher.Compute("angryMonkey")) {
+		t.Errorf("audit log holds a secret:\n%s", log)
+	}
+	if sum, err := audit.Verify(strings.NewReader(log)); err != nil || sum.Records != 2 {
+		t.Errorf("got %+v, %v", sum, err)
+	}
+}
 
-	// Sleep enough so that some hashes complete and others are still queued.
-	// NOTE: sleep in unittests is generally bad.  I would much prefer that we
-	// could test with a more controlled hash function with hooks into the UT,
-	// but I didn't have time to implement that.
-	time.Sleep(10 * time.Second)
+func TestRecord(t *testing.T) {
+	t.Parallel()
 
-	_, err := http.Post("http://localhost:8080/shutdown", "", nil)
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := recording.Open(path)
 	if err != nil {
-		t.Fail()
+		t.Fatal(err)
 	}
 
-	wg.Wait()
+	s, clock := newTestServer(t, WithRecorder(rec))
+	defer shutdownTestServer(s, clock)
+
+	post := httptest.NewRecorder()
+	s.Handler().ServeHTTP(post, httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey")))
+	id := strings.TrimSpace(post.Body.String())
+
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	get := httptest.NewRecorder()
+	s.Handler().ServeHTTP(get, httptest.NewRequest("GET", "/hash/"+id+"?wait=1s", nil))
+	if get.Code != 200 {
+		t.Fatalf("GET /hash/%s returned %d", id, get.Code)
+	}
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", strings.NewReader("nonsense")))
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "angryMonkey") || strings.Contains(string(b), hasher.Compute("angryMonkey")) {
+		t.Errorf("recording holds a secret:\n%s", b)
+	}
+
+	var entries []recording.Entry
+	r := recording.NewReader(bytes.NewReader(b))
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		e.Time, e.Duration = time.Time{}, 0
+		entries = append(entries, e)
+	}
+
+	jobID, _ := strconv.ParseInt(id, 10, 64)
+	want := []recording.Entry{
+		{Method: "POST", Route: "/hash", Path: "/hash", BodySize: 20, PasswordLength: 11, JobID: jobID, Status: 200},
+		{Method: "GET", Route: "/hash/", Path: "/hash/" + id, Wait: "1s", JobID: jobID, Status: 200},
+		{Method: "POST", Route: "/hash", Path: "/hash", BodySize: 8, Status: 400},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("recorded %+v\nexpected %+v", entries, want)
+	}
 }
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+// The worker endpoints let remote workers do the hashing for a hasher
+// configured with Remote, see hasher.Leaser.  A worker leases a job with
+// POST /worker/lease, keeps it with POST /worker/heartbeat while it works, and
+// reports the outcome with POST /worker/complete or POST /worker/fail.  Every
+// request and response body is JSON.
+//
+// The lease ID is sent in the body rather than the path, so that it stays out
+// of the access log.  Only the worker holding a lease should be able to report
+// on it.  A lease hands over the password, so workers must present the token
+// set with WithWorkerToken as a bearer token, and without one, no worker is
+// let in.
+
+// workerLeaseRequest is the body of POST /worker/lease.
+type workerLeaseRequest struct {
+	Worker string `json:"worker"` // Names the worker in the logs
+}
+
+// workerRequest is the body of POST /worker/heartbeat, /worker/complete and
+// /worker/fail.  Outcome is only used by complete, and Reason only by fail.
+type workerRequest struct {
+	Lease   string         `json:"lease"`
+	Outcome hasher.Outcome `json:"outcome"`
+	Reason  string         `json:"reason"`
+}
+
+// workerHeartbeatResponse is the response to POST /worker/heartbeat.
+type workerHeartbeatResponse struct {
+	Expires time.Time `json:"expires"`
+}
+
+// workerAuthorized checks the worker token, and reports the error to the
+// client if it isn't right.
+func (s *Server) workerAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.workerToken == "" {
+		http.Error(w, "Remote workers need a worker token.", 403)
+		return false
+	}
+
+	want := "Bearer " + s.workerToken
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid worker token.", 401)
+		return false
+	}
+	return true
+}
+
+// leaser returns the hasher as a hasher.Leaser.  If it can't lease jobs, that
+// has been reported to the client and ok is false.
+func (s *Server) leaser(w http.ResponseWriter) (l hasher.Leaser, ok bool) {
+	if l, ok = s.hasher.(hasher.Leaser); !ok {
+		http.Error(w, "Remote workers are not enabled.", 501)
+	}
+	return l, ok
+}
+
+// readWorkerRequest decodes the body of a worker request into v.  If it can't,
+// the error has been reported to the client and ok is false.
+func readWorkerRequest(w http.ResponseWriter, r *http.Request, v interface{}) (ok bool) {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), 400)
+		return false
+	}
+	return true
+}
+
+// workerError reports the failure of a worker request.
+func workerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hasher.ErrNotRemote):
+		http.Error(w, "Remote workers are not enabled.", 501)
+	case errors.Is(err, hasher.ErrLeaseExpired):
+		http.Error(w, "Lease has expired.", 410)
+	case errors.Is(err, hasher.ErrDrained):
+		http.Error(w, "Server is shutting down.", 503)
+	default:
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+// workerLeaseHandler leases a job to a worker.  With ?wait=30s, the request is
+// held open until a job is queued, for up to that long.  If there's no job,
+// the response is 204 and the worker should ask again.
+func (s *Server) workerLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	leaser, ok := s.leaser(w)
+	if !ok {
+		return
+	}
+	var req workerLeaseRequest
+	if !readWorkerRequest(w, r, &req) {
+		return
+	}
+
+	var d time.Duration
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		var err error
+		d, err = time.ParseDuration(wait)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait duration.", 400)
+			return
+		}
+		if d > maxLongPoll {
+			d = maxLongPoll
+		}
+	}
+	w.Header().Set(longPollHeader, maxLongPoll.String())
+
+	// A job that's already queued is leased even with no wait at all
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	l, err := leaser.Lease(ctx, req.Worker)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		w.WriteHeader(204)
+		return
+	} else if err != nil {
+		workerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// workerHeartbeatHandler renews a worker's lease.
+func (s *Server) workerHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	leaser, ok := s.leaser(w)
+	if !ok {
+		return
+	}
+	var req workerRequest
+	if !readWorkerRequest(w, r, &req) {
+		return
+	}
+
+	expires, err := leaser.Heartbeat(req.Lease)
+	if err != nil {
+		workerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workerHeartbeatResponse{expires})
+}
+
+// workerCompleteHandler records the hash a worker computed.
+func (s *Server) workerCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	leaser, ok := s.leaser(w)
+	if !ok {
+		return
+	}
+	var req workerRequest
+	if !readWorkerRequest(w, r, &req) {
+		return
+	}
+
+	if err := leaser.Complete(req.Lease, req.Outcome); err != nil {
+		workerError(w, err)
+	}
+}
+
+// workerFailHandler records that a worker couldn't hash a job.
+func (s *Server) workerFailHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	leaser, ok := s.leaser(w)
+	if !ok {
+		return
+	}
+	var req workerRequest
+	if !readWorkerRequest(w, r, &req) {
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "No reason supplied.", 400)
+		return
+	}
+
+	if err := leaser.Fail(req.Lease, req.Reason); err != nil {
+		workerError(w, err)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/hasher"
+)
+
+func TestWorker(t *testing.T) {
+	t.Parallel()
+
+	clock := hasher.NewFakeClock(time.Unix(0, 0))
+	cfg := hasher.DefaultConfig()
+	cfg.Clock = clock
+	cfg.Remote, cfg.QueueDepth = true, 4
+	h, err := hasher.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithHasher(h), WithWorkerToken("sesame"))
+	defer shutdownTestServer(s, clock)
+
+	worker := func(path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := worker("/worker/lease", "", `{"worker": "w1"}`); w.Code != 401 {
+		t.Errorf("lease without a token returned %d", w.Code)
+	}
+	if w := worker("/worker/lease", "open", `{"worker": "w1"}`); w.Code != 401 {
+		t.Errorf("lease with the wrong token returned %d", w.Code)
+	}
+	if w := worker("/worker/lease", "sesame", `{"worker": "w1"}`); w.Code != 204 {
+		t.Errorf("lease with nothing queued returned %d", w.Code)
+	}
+
+	post := httptest.NewRecorder()
+	s.Handler().ServeHTTP(post, httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey")))
+	id := strings.TrimSpace(post.Body.String())
+
+	w := worker("/worker/lease?wait=1s", "sesame", `{"worker": "w1"}`)
+	var l hasher.Lease
+	if err := json.Unmarshal(w.Body.Bytes(), &l); w.Code != 200 || err != nil || l.Password != "angryMonkey" {
+		t.Fatalf("lease returned %d: %s", w.Code, w.Body)
+	}
+
+	if w := worker("/worker/heartbeat", "sesame", `{"lease": "`+l.ID+`"}`); w.Code != 200 || !strings.Contains(w.Body.String(), "expires") {
+		t.Errorf("heartbeat returned %d: %s", w.Code, w.Body)
+	}
+	complete := `{"lease": "` + l.ID + `", "outcome": {"hash": "` + hasher.Compute("angryMonkey") + `"}}`
+	if w := worker("/worker/complete", "sesame", complete); w.Code != 200 {
+		t.Errorf("complete returned %d: %s", w.Code, w.Body)
+	}
+	if w := worker("/worker/complete", "sesame", complete); w.Code != 410 {
+		t.Errorf("completing twice returned %d: %s", w.Code, w.Body)
+	}
+	if w := worker("/worker/fail", "sesame", `{"lease": "`+l.ID+`"}`); w.Code != 400 {
+		t.Errorf("fail without a reason returned %d: %s", w.Code, w.Body)
+	}
+
+	get := httptest.NewRecorder()
+	s.Handler().ServeHTTP(get, httptest.NewRequest("GET", "/hash/"+id+"?wait=1s", nil))
+	if got := strings.TrimSpace(get.Body.String()); get.Code != 200 || got != hasher.Compute("angryMonkey") {
+		t.Errorf("GET /hash/%s returned %d: %s", id, get.Code, got)
+	}
+
+	// A hasher that runs its own hashes has no use for workers
+	local, localClock := newTestServer(t, WithWorkerToken("sesame"))
+	defer shutdownTestServer(local, localClock)
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/worker/lease", strings.NewReader(`{"worker": "w1"}`))
+	req.Header.Set("Authorization", "Bearer sesame")
+	local.Handler().ServeHTTP(w, req)
+	if w.Code != 501 {
+		t.Errorf("lease from a local hasher returned %d", w.Code)
+	}
+
+	// Nor does one that can't lease at all
+	plain := New(WithHasher(struct{ hasher.AsyncHasher }{h}), WithWorkerToken("sesame"))
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/worker/heartbeat", strings.NewReader(`{"lease": "x"}`))
+	req.Header.Set("Authorization", "Bearer sesame")
+	plain.Handler().ServeHTTP(w, req)
+	if w.Code != 501 {
+		t.Errorf("heartbeat to a hasher that isn't a Leaser returned %d", w.Code)
+	}
+
+	// And without a token, no worker gets a password
+	open := New(WithHasher(h))
+	w = httptest.NewRecorder()
+	open.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/worker/lease", strings.NewReader(`{"worker": "w1"}`)))
+	if w.Code != 403 {
+		t.Errorf("lease without a worker token configured returned %d", w.Code)
+	}
+}
@@ -0,0 +1,70 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor systemd passes to an activated
+// service.  0, 1 and 2 are stdin, stdout and stderr.
+const listenFdsStart = 3
+
+// Listeners returns the sockets passed to this process by systemd socket
+// activation, in the order they are listed in the socket unit.  If the process
+// was not socket activated, Listeners returns an empty slice and no error.
+//
+// The LISTEN_* environment variables are cleared so that child processes don't
+// mistakenly believe the sockets were meant for them.
+func Listeners() ([]net.Listener, error) {
+	return listeners(listenFdsStart)
+}
+
+// listeners does the work of Listeners, but allows the first file descriptor
+// to be overridden.  Tests can't control which descriptors they get, so this
+// lets them hand us a listener that lives somewhere other than fd 3.
+func listeners(start int) ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var ls []net.Listener
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", start+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// net.FileListener dups the descriptor, so the original can be
+		// closed once we have the listener.
+		f := os.NewFile(uintptr(start+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd: fd %d (%s) is not a listening socket: %v", start+i, name, err)
+		}
+
+		ls = append(ls, l)
+	}
+
+	return ls, nil
+}
@@ -0,0 +1,49 @@
+// Package systemd implements the small subset of the systemd service
+// protocols that the hash server needs: readiness notification (sd_notify)
+// and socket activation (LISTEN_FDS).
+//
+// Both protocols are simple enough that it isn't worth pulling in a library
+// for them.  Everything here is a no-op when the process was not started by
+// systemd, so callers can use it unconditionally.
+package systemd
+
+import (
+	"net"
+	"os"
+)
+
+// Notification states understood by systemd.  See sd_notify(3).
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Stopping  = "STOPPING=1"
+)
+
+// Notify sends the supplied state string to the service manager over the
+// socket named by $NOTIFY_SOCKET.  If the variable isn't set (we weren't
+// started by systemd, or the unit isn't Type=notify), Notify does nothing and
+// returns false.  A true return means the notification was sent.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	// A leading '@' means the socket lives in the abstract namespace,
+	// which Go spells with a leading NUL byte.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
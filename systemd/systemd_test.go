@@ -0,0 +1,121 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestNotifyUnset verifies that Notify is a harmless no-op outside of systemd.
+func TestNotifyUnset(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Fatalf("Notify() = %v, %v; want false, nil", sent, err)
+	}
+}
+
+// TestNotify stands up a fake notify socket in place of systemd and verifies
+// that the state string arrives intact.
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	for _, state := range []string{Ready, Reloading, Stopping} {
+		sent, err := Notify(state)
+		if !sent || err != nil {
+			t.Fatalf("Notify(%q) = %v, %v", state, sent, err)
+		}
+
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf[:n]) != state {
+			t.Errorf("got %q, want %q", buf[:n], state)
+		}
+	}
+}
+
+// TestListeners passes a real listening socket through the LISTEN_FDS
+// protocol and verifies it comes back out as a usable net.Listener.
+func TestListeners(t *testing.T) {
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+
+	f, err := orig.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listeners takes ownership of the descriptors it is handed and closes
+	// them, so give it a copy rather than the one f will close.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+
+	ls, err := listeners(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("got %d listeners, want 1", len(ls))
+	}
+	defer ls[0].Close()
+
+	if ls[0].Addr().String() != orig.Addr().String() {
+		t.Errorf("listener address %s, want %s", ls[0].Addr(), orig.Addr())
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS was not cleared")
+	}
+
+	// Make sure the descriptor really is the same socket
+	go func() {
+		c, err := net.Dial("tcp", orig.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ls[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+// TestListenersOtherPid verifies that sockets meant for another process
+// (e.g. our parent) are ignored.
+func TestListenersOtherPid(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	ls, err := Listeners()
+	if err != nil || len(ls) != 0 {
+		t.Fatalf("Listeners() = %v, %v; want none", ls, err)
+	}
+}
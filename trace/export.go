@@ -0,0 +1,427 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServiceName is the service.name resource attribute of every exported span.
+const ServiceName = "hash-server"
+
+// Spans are exported in batches of up to maxBatch, at least every
+// flushInterval.  Spans recorded faster than they can be exported are
+// buffered up to bufferSize, after which they are dropped rather than holding
+// up the jobs they describe.
+const (
+	maxBatch      = 100
+	flushInterval = time.Second
+	bufferSize    = 1000
+)
+
+// Exporter sends a batch of spans somewhere.
+type Exporter interface {
+	Export(spans []Span) error
+}
+
+// Tracer collects spans and exports them in the background.  A nil *Tracer
+// is valid and records nothing, so tracing costs nothing when it is off.
+type Tracer struct {
+	exporter Exporter
+	dropped  uint64 // atomic count of spans dropped because the buffer was full
+
+	mu     sync.Mutex // Protects closed, so Record never sends on a closed channel
+	closed bool
+	spans  chan Span
+	done   chan interface{} // Closed once the last batch is exported
+	err    error            // The first export error, returned by Close
+}
+
+// New creates a Tracer that exports to e.  Call Close to export whatever is
+// left and stop it.
+func New(e Exporter) *Tracer {
+	t := &Tracer{
+		exporter: e,
+		spans:    make(chan Span, bufferSize),
+		done:     make(chan interface{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Open creates a Tracer for a destination: "off" or "" for none, an
+// http:// or https:// URL of an OTLP/HTTP collector such as
+// http://localhost:4318/v1/traces, or the path of a file to append to.
+func Open(dest string) (*Tracer, error) {
+	switch {
+	case dest == "" || dest == "off":
+		return nil, nil
+	case strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://"):
+		return New(&HTTPExporter{URL: dest}), nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return New(NewWriterExporter(f)), nil
+}
+
+// Record queues a span to be exported.  It never blocks: if the exporter
+// has fallen too far behind, the span is dropped.
+func (t *Tracer) Record(s Span) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Dropped returns the number of spans that were dropped because they were
+// recorded faster than they could be exported.
+func (t *Tracer) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Close exports any spans that are still buffered and stops the Tracer.
+// Spans recorded afterwards are ignored.  It returns the first error the
+// exporter reported, if any.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+
+	<-t.done
+	if c, ok := t.exporter.(io.Closer); ok {
+		if err := c.Close(); err != nil && t.err == nil {
+			t.err = err
+		}
+	}
+	return t.err
+}
+
+// loop exports the spans in batches until the Tracer is closed.
+func (t *Tracer) loop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			// Traces are diagnostics, so losing some isn't worth more
+			// than a warning.
+			slog.Warn("exporting spans failed", "spans", len(batch), "error", err)
+			if t.err == nil {
+				t.err = err
+			}
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= maxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// writerExporter writes each batch as a single line of OTLP JSON.
+type writerExporter struct {
+	w io.Writer
+}
+
+// NewWriterExporter creates an Exporter that writes each batch to w as an
+// OTLP JSON ExportTraceServiceRequest on a line of its own.  If w is an
+// io.Closer, it is closed along with the Tracer.
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w}
+}
+
+func (e *writerExporter) Export(spans []Span) error {
+	b, err := json.Marshal(encode(spans))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *writerExporter) Close() error {
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// HTTPExporter POSTs each batch as OTLP JSON to a collector, such as an
+// OpenTelemetry collector's OTLP/HTTP receiver or a Collector.
+type HTTPExporter struct {
+	URL    string
+	Client *http.Client // nil uses a client with a 10 second timeout
+}
+
+func (e *HTTPExporter) Export(spans []Span) error {
+	b, err := json.Marshal(encode(spans))
+	if err != nil {
+		return err
+	}
+
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(e.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Collector is a stand-in for an OpenTelemetry collector, for tests and for
+// looking at traces locally without running one.  It accepts the OTLP JSON
+// that HTTPExporter POSTs and keeps the spans in memory.
+type Collector struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	spans, err := Decode(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, spans...)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, "{}")
+}
+
+// Spans returns every span collected so far.
+func (c *Collector) Spans() []Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Span(nil), c.spans...)
+}
+
+// Decode reads spans from OTLP JSON, either a single request body or a file
+// of them one per line as written by NewWriterExporter.
+func Decode(r io.Reader) ([]Span, error) {
+	var spans []Span
+	d := json.NewDecoder(r)
+	for {
+		var req otlpRequest
+		if err := d.Decode(&req); err == io.EOF {
+			return spans, nil
+		} else if err != nil {
+			return spans, err
+		}
+
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, o := range ss.Spans {
+					s, err := o.span()
+					if err != nil {
+						return spans, err
+					}
+					spans = append(spans, s)
+				}
+			}
+		}
+	}
+}
+
+// The subset of the OTLP JSON encoding that is used here.  See
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        otlpNanos       `json:"startTimeUnixNano"`
+	End          otlpNanos       `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+// otlpNanos is a time in nanoseconds since the epoch.  It is written as a
+// string, since it doesn't fit in the float64 most JSON readers use, but can
+// be read from either a string or a number.
+type otlpNanos int64
+
+func (n otlpNanos) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatInt(int64(n), 10) + `"`), nil
+}
+
+func (n *otlpNanos) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*n = otlpNanos(v)
+	return err
+}
+
+// encode converts spans to an OTLP request.
+func encode(spans []Span) otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID: s.Trace.String(),
+			SpanID:  s.ID.String(),
+			Name:    s.Name,
+			Kind:    otlpKindInternal,
+			Start:   otlpNanos(s.Start.UnixNano()),
+			End:     otlpNanos(s.End.UnixNano()),
+		}
+		if !s.Parent.IsZero() {
+			o.ParentSpanID = s.Parent.String()
+		}
+
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			o.Attributes = append(o.Attributes, otlpAttribute{k, otlpValue{s.Attributes[k]}})
+		}
+
+		if s.Error != "" {
+			o.Status = &otlpStatus{otlpStatusError, s.Error}
+		}
+		out[i] = o
+	}
+
+	return otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpAttribute{{"service.name", otlpValue{ServiceName}}}},
+		ScopeSpans: []otlpScopeSpans{{otlpScope{ServiceName}, out}},
+	}}}
+}
+
+// span converts an OTLP span back to a Span.
+func (o otlpSpan) span() (Span, error) {
+	s := Span{
+		Name:  o.Name,
+		Start: time.Unix(0, int64(o.Start)),
+		End:   time.Unix(0, int64(o.End)),
+	}
+	if err := parseID(s.Trace[:], o.TraceID); err != nil {
+		return s, err
+	}
+	if err := parseID(s.ID[:], o.SpanID); err != nil {
+		return s, err
+	}
+	if o.ParentSpanID != "" {
+		if err := parseID(s.Parent[:], o.ParentSpanID); err != nil {
+			return s, err
+		}
+	}
+	if len(o.Attributes) > 0 {
+		s.Attributes = make(map[string]string, len(o.Attributes))
+		for _, a := range o.Attributes {
+			s.Attributes[a.Key] = a.Value.StringValue
+		}
+	}
+	if o.Status != nil && o.Status.Code == otlpStatusError {
+		s.Error = o.Status.Message
+	}
+	return s, nil
+}
@@ -0,0 +1,173 @@
+// Package trace follows each hash job from the request that submitted it to
+// its retrieval.
+//
+// Every request to the server is given a Request, which carries a request ID
+// and the trace it belongs to.  The hasher stores the Request with the job it
+// submits, logs the ID with each job event, and records a Span for each phase
+// of the job's life.  A Tracer exports the spans in the OTLP JSON format, so
+// they can be loaded into any OpenTelemetry collector or read from a file.
+//
+// Only what the hash server needs is implemented, with the standard library,
+// rather than pulling in the OpenTelemetry SDK.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The headers a Request is taken from.
+const (
+	RequestIDHeader   = "X-Request-ID"
+	TraceparentHeader = "traceparent"
+)
+
+// maxRequestIDLength is the longest X-Request-ID that is accepted.  Anything
+// longer is ignored and an ID generated instead, so a client can't bloat every
+// log line about its job.
+const maxRequestIDLength = 128
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// NewTraceID generates a random TraceID.
+func NewTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+// NewSpanID generates a random SpanID.
+func NewSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+// String returns the id in lowercase hex, as used by traceparent and OTLP.
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsZero returns true for the all-zero id, which is never valid.
+func (id TraceID) IsZero() bool { return id == TraceID{} }
+
+// String returns the id in lowercase hex, as used by traceparent and OTLP.
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsZero returns true for the all-zero id, which means no span.
+func (id SpanID) IsZero() bool { return id == SpanID{} }
+
+// parseID decodes a hex id of exactly len(dst) bytes.
+func parseID(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid id %q", s)
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// ParseTraceparent parses a W3C traceparent header, returning the caller's
+// trace and span.
+func ParseTraceparent(header string) (TraceID, SpanID, error) {
+	var trace TraceID
+	var span SpanID
+
+	// version-traceid-parentid-flags.  Later versions may append fields,
+	// but must keep these.
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return trace, span, fmt.Errorf("invalid traceparent %q", header)
+	}
+	if parseID(trace[:], fields[1]) != nil || parseID(span[:], fields[2]) != nil || trace.IsZero() || span.IsZero() {
+		return trace, span, fmt.Errorf("invalid traceparent %q", header)
+	}
+	return trace, span, nil
+}
+
+// Request identifies the request that submitted a job, and the trace its
+// spans belong to.
+type Request struct {
+	ID     string  // From X-Request-ID, or the trace ID if there wasn't one
+	Trace  TraceID // From traceparent, or generated
+	Parent SpanID  // The caller's span from traceparent, zero if there wasn't one
+}
+
+// NewRequest generates a Request for work that didn't arrive with one.
+func NewRequest() Request {
+	trace := NewTraceID()
+	return Request{ID: trace.String(), Trace: trace}
+}
+
+// FromHTTP takes a Request from the X-Request-ID and traceparent headers of
+// r.  Headers that are missing or invalid are ignored, and whatever they would
+// have supplied is generated.
+func FromHTTP(r *http.Request) Request {
+	var req Request
+	if trace, parent, err := ParseTraceparent(r.Header.Get(TraceparentHeader)); err == nil {
+		req.Trace, req.Parent = trace, parent
+	} else {
+		req.Trace = NewTraceID()
+	}
+
+	req.ID = req.Trace.String()
+	if id := r.Header.Get(RequestIDHeader); validRequestID(id) {
+		req.ID = id
+	}
+	return req
+}
+
+// validRequestID returns true if id is short, printable ASCII, which is all
+// that is safe to copy into headers and logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent returns the traceparent header naming span as the parent, for
+// passing the trace on to another service.
+func (r Request) Traceparent(span SpanID) string {
+	return fmt.Sprintf("00-%s-%s-01", r.Trace, span)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries req.
+func NewContext(ctx context.Context, req Request) context.Context {
+	return context.WithValue(ctx, contextKey{}, req)
+}
+
+// FromContext returns the Request carried by ctx, if there is one.
+func FromContext(ctx context.Context) (Request, bool) {
+	req, ok := ctx.Value(contextKey{}).(Request)
+	return req, ok
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	Trace      TraceID
+	ID         SpanID
+	Parent     SpanID // Zero for the root span of a trace
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string // Why the operation failed, "" if it didn't
+}
+
+// ErrClosed is returned by Tracer.Close if it was already closed.
+var ErrClosed = errors.New("tracer is closed")
@@ -0,0 +1,148 @@
+package trace
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	trace, span, err := ParseTraceparent(testTraceparent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.String() != "00f067aa0ba902b7" {
+		t.Errorf("got %s %s", trace, span)
+	}
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		if _, _, err := ParseTraceparent(header); err == nil {
+			t.Errorf("ParseTraceparent(%q) succeeded", header)
+		}
+	}
+}
+
+func TestFromHTTP(t *testing.T) {
+	r := httptest.NewRequest("POST", "/hash", nil)
+	r.Header.Set(TraceparentHeader, testTraceparent)
+	req := FromHTTP(r)
+	if req.ID != "4bf92f3577b34da6a3ce929d0e0e4736" || req.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("traceparent: got %+v", req)
+	}
+
+	r.Header.Set(RequestIDHeader, "abc-123")
+	if req := FromHTTP(r); req.ID != "abc-123" || req.Trace.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("X-Request-ID: got %+v", req)
+	}
+
+	// Nothing usable, so everything is generated
+	r = httptest.NewRequest("POST", "/hash", nil)
+	r.Header.Set(RequestIDHeader, strings.Repeat("x", maxRequestIDLength+1))
+	r.Header.Set(TraceparentHeader, "garbage")
+	req = FromHTTP(r)
+	if req.ID != req.Trace.String() || req.Trace.IsZero() || !req.Parent.IsZero() {
+		t.Errorf("generated: got %+v", req)
+	}
+	if FromHTTP(r).Trace == req.Trace {
+		t.Error("generated the same trace twice")
+	}
+}
+
+// testSpans returns a root span and a failed child.
+func testSpans() []Span {
+	root := Span{
+		Trace: NewTraceID(),
+		ID:    NewSpanID(),
+		Name:  "hash job",
+		Start: time.Unix(1, 5),
+		End:   time.Unix(6, 0),
+		Attributes: map[string]string{
+			"hash.job_id":     "1",
+			"hash.request_id": "abc-123",
+		},
+	}
+	child := Span{
+		Trace:  root.Trace,
+		ID:     NewSpanID(),
+		Parent: root.ID,
+		Name:   "hash",
+		// A time that a float64 can't hold exactly
+		Start: time.Unix(1700000000, 123456789),
+		End:   time.Unix(1700000001, 987654321),
+		Error: "panic: oops",
+	}
+	return []Span{root, child}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := New(NewWriterExporter(&buf))
+	spans := testSpans()
+	for _, s := range spans {
+		tracer.Record(s)
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tracer.Record(spans[0]) // Ignored
+	if err := tracer.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v", err)
+	}
+
+	if !strings.Contains(buf.String(), `"startTimeUnixNano":"1700000000123456789"`) {
+		t.Errorf("unexpected OTLP: %s", buf.String())
+	}
+	got, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, spans) {
+		t.Errorf("got %+v, expected %+v", got, spans)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	var collector Collector
+	ts := httptest.NewServer(&collector)
+	defer ts.Close()
+
+	tracer := New(&HTTPExporter{URL: ts.URL + "/v1/traces"})
+	spans := testSpans()
+	for _, s := range spans {
+		tracer.Record(s)
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := collector.Spans(); !reflect.DeepEqual(got, spans) {
+		t.Errorf("got %+v, expected %+v", got, spans)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	tracer.Record(Span{})
+	if err := tracer.Close(); err != nil {
+		t.Error(err)
+	}
+
+	tracer, err := Open("off")
+	if tracer != nil || err != nil {
+		t.Errorf("Open(off) = %v, %v", tracer, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/client"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/logging"
+)
+
+// workerRetry is how long a worker waits before asking for another job after
+// the server couldn't be reached.
+const workerRetry = time.Second
+
+// worker hashes jobs for a server started with --remote-workers, so the
+// hashing can be spread over more processes, or machines, than the one
+// taking the requests.
+//
+//	hash-server worker [flags]
+//
+// Each of -concurrency goroutines leases a job, performs the simulated work
+// the server asks for, hashes the password with the server's algorithm and
+// reports the hash, keeping the lease alive with heartbeats as it goes.  On
+// SIGINT or SIGTERM, the worker stops leasing jobs and exits once the ones it
+// holds are reported.
+func worker(args []string) error {
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	target := fs.String("server", "http://localhost:8080", "URL of the server to hash for")
+	concurrency := fs.Int("concurrency", runtime.NumCPU(), "jobs to hash at once")
+	token := fs.String("token", os.Getenv("HASH_SERVER_WORKER_TOKEN"), "the server's --worker-token, default $HASH_SERVER_WORKER_TOKEN")
+	name := fs.String("name", defaultWorkerName(), "name of this worker in the server's logs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hash-server worker [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("worker takes no arguments")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be positive: %d", *concurrency)
+	}
+
+	// Every goroutine holds a long poll open, so each needs a connection
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	c := client.New(*target, client.WithHTTPClient(&http.Client{Transport: transport}), client.WithToken(*token))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := &remoteWorker{client: c, name: *name, log: logging.New(os.Stderr, slog.LevelInfo)}
+	w.log.Info("worker started", "server", *target, "name", *name, "concurrency", *concurrency)
+	err := w.run(ctx, *concurrency)
+	w.log.Info("worker stopped", "completed", atomic.LoadUint64(&w.completed), "failed", atomic.LoadUint64(&w.failed),
+		"lost", atomic.LoadUint64(&w.lost))
+	return err
+}
+
+// defaultWorkerName names a worker after its host and process, which is
+// enough to find it.
+func defaultWorkerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// remoteWorker leases jobs from a server and hashes them.
+type remoteWorker struct {
+	client *client.Client
+	name   string
+	log    *slog.Logger
+
+	completed uint64 // atomic count of hashes reported
+	failed    uint64 // atomic count of jobs reported as failed
+	lost      uint64 // atomic count of jobs whose lease expired before they were reported
+}
+
+// run hashes jobs on concurrency goroutines until ctx is done, and then
+// until the jobs already leased are reported.  It returns an error if the
+// server refuses to hand out jobs at all.
+func (w *remoteWorker) run(ctx context.Context, concurrency int) error {
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loop leases and hashes jobs, one at a time, until ctx is done.
+func (w *remoteWorker) loop(ctx context.Context) error {
+	for ctx.Err() == nil {
+		l, ok, err := w.client.Lease(ctx, w.name)
+		var status *client.StatusError
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.As(err, &status) && (status.Code == 401 || status.Code == 403 || status.Code == 501):
+			// Asking again won't help
+			return fmt.Errorf("server refused to lease a job: %w", err)
+		case err != nil:
+			// The server may be restarting, so keep trying
+			w.log.Warn("lease failed", "error", err)
+			select {
+			case <-time.After(workerRetry):
+			case <-ctx.Done():
+			}
+			continue
+		case !ok:
+			continue
+		}
+
+		// The job is finished even if ctx is done in the meantime, since
+		// otherwise it would sit out the rest of its lease before anyone
+		// else could have it
+		w.hash(l)
+	}
+	return nil
+}
+
+// hash performs a leased job and reports the outcome.
+func (w *remoteWorker) hash(l hasher.Lease) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.heartbeat(ctx, l)
+
+	algorithm, err := hasher.LookupAlgorithm(l.Algorithm)
+	if err != nil {
+		// This worker is older than the server, but another may not be
+		w.report(l, w.client.Fail(ctx, l.ID, err.Error()), &w.failed)
+		return
+	}
+
+	// The simulated work is done here rather than on the server, so that
+	// adding workers speeds up the whole job and not just the hash
+	start := time.Now()
+	time.Sleep(l.Delay)
+	o := hasher.Outcome{Simulated: time.Since(start)}
+
+	start = time.Now()
+	o.Hash = algorithm(l.Password)
+	o.Elapsed = time.Since(start)
+	w.report(l, w.client.Complete(ctx, l.ID, o), &w.completed)
+}
+
+// heartbeat keeps a lease alive, renewing it a few times per TTL, until ctx
+// is done.
+func (w *remoteWorker) heartbeat(ctx context.Context, l hasher.Lease) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		_, err := w.client.Heartbeat(ctx, l.ID)
+		if errors.Is(err, client.ErrLeaseExpired) {
+			// The job has gone to someone else.  It's finished here
+			// anyway, since it can't be interrupted, and the report is
+			// turned away.
+			return
+		} else if err != nil && ctx.Err() == nil {
+			w.log.Warn("heartbeat failed", "job", l.JobID, "error", err)
+		}
+	}
+}
+
+// report counts the outcome of reporting on a job in counter, unless the
+// report failed.
+func (w *remoteWorker) report(l hasher.Lease, err error, counter *uint64) {
+	switch {
+	case errors.Is(err, client.ErrLeaseExpired):
+		atomic.AddUint64(&w.lost, 1)
+		w.log.Warn("lease expired before the job was reported", "job", l.JobID)
+	case err != nil:
+		atomic.AddUint64(&w.lost, 1)
+		w.log.Warn("reporting job failed", "job", l.JobID, "error", err)
+	default:
+		atomic.AddUint64(counter, 1)
+	}
+}
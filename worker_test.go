@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaredcantwell/hash-server/client"
+	"github.com/jaredcantwell/hash-server/hasher"
+	"github.com/jaredcantwell/hash-server/server"
+)
+
+func TestWorker(t *testing.T) {
+	cfg := hasher.DefaultConfig()
+	cfg.Remote, cfg.QueueDepth = true, 20
+	cfg.Delay = 10 * time.Millisecond
+	cfg.LeaseTTL = 100 * time.Millisecond
+	s, err := startLocalServer(cfg, server.WithWorkerToken("sesame"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	c := client.New("http://"+s.Addr(), client.WithLongPoll(50*time.Millisecond), client.WithToken("sesame"))
+	ctx := context.Background()
+
+	// A worker that dies holding a job
+	dead, _ := c.Submit(ctx, "deadMonkey")
+	l, ok, err := c.Lease(ctx, "dead")
+	if !ok || err != nil || l.JobID != dead {
+		t.Fatalf("Lease returned %+v, %v, %v", l, ok, err)
+	}
+
+	w := &remoteWorker{client: c, name: "test", log: slog.New(slog.DiscardHandler)}
+	workerCtx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- w.run(workerCtx, 3)
+	}()
+
+	passwords := map[int64]string{dead: "deadMonkey"}
+	for _, password := range []string{"a", "b", "c", "d", "e", "f"} {
+		id, err := c.Submit(ctx, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passwords[id] = password
+	}
+	for id, password := range passwords {
+		if hash, err := c.Wait(ctx, id); err != nil || hash != hasher.Compute(password) {
+			t.Errorf("hash %d was %q, %v", id, hash, err)
+		}
+	}
+
+	// The dead worker's job went to the live one, and it's too late to
+	// report on it now
+	if err := c.Complete(ctx, l.ID, hasher.Outcome{Hash: "stale"}); err != client.ErrLeaseExpired {
+		t.Errorf("completing an expired lease returned %v", err)
+	}
+
+	stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&w.completed); n != 7 {
+		t.Errorf("worker completed %d hashes", n)
+	}
+}
+
+func TestWorkerRefused(t *testing.T) {
+	s, err := startLocalServer(hasher.DefaultConfig(), server.WithWorkerToken("sesame"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	// The server hashes for itself, so there's no point carrying on
+	w := &remoteWorker{client: client.New("http://"+s.Addr(), client.WithToken("sesame")), name: "test", log: slog.New(slog.DiscardHandler)}
+	if err := w.run(context.Background(), 1); err == nil {
+		t.Error("worker ran against a server without remote workers")
+	}
+
+	// Nor is there without the token
+	w = &remoteWorker{client: client.New("http://" + s.Addr()), name: "test", log: slog.New(slog.DiscardHandler)}
+	if err := w.run(context.Background(), 1); err == nil {
+		t.Error("worker ran without the worker token")
+	}
+}